@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	"github.com/aws/aws-sdk-go/service/elbv2/elbv2iface"
+	"github.com/stretchr/testify/assert"
+)
+
+type mockELBV2ClientTargetHealth struct {
+	elbv2iface.ELBV2API
+	states []string
+	calls  *int
+	// attempts records the limit of the waiter attempts
+	attempts *int
+}
+
+func (m mockELBV2ClientTargetHealth) WaitUntilTargetInServiceWithContext(ctx aws.Context, input *elbv2.DescribeTargetHealthInput, opts ...request.WaiterOption) error {
+	if m.attempts != nil {
+		waiter := request.Waiter{}
+		waiter.ApplyOptions(opts...)
+		*m.attempts = waiter.MaxAttempts
+	}
+
+	return ctx.Err()
+}
+
+func (m mockELBV2ClientTargetHealth) DescribeTargetHealth(input *elbv2.DescribeTargetHealthInput) (*elbv2.DescribeTargetHealthOutput, error) {
+	state := m.states[*m.calls]
+	if *m.calls < len(m.states)-1 {
+		*m.calls++
+	}
+
+	return &elbv2.DescribeTargetHealthOutput{
+		TargetHealthDescriptions: []*elbv2.TargetHealthDescription{
+			{Target: input.Targets[0], TargetHealth: &elbv2.TargetHealth{State: aws.String(state)}},
+		},
+	}, nil
+}
+
+type staticMetrics struct {
+	count float64
+}
+
+func (m staticMetrics) ErrorCount(string, time.Time, time.Time) (float64, error) {
+	return m.count, nil
+}
+
+func canaryPipelineInfo() *PipelineInfo {
+	return &PipelineInfo{
+		NewInstancesIds:  []*string{aws.String("i-new")},
+		TargetGroupsArns: []*string{aws.String("arn:aws:elasticloadbalancing:us-east-1:1:targetgroup/web/73e2")},
+	}
+}
+
+func TestCanaryBakeAction(t *testing.T) {
+	sleep = func(ctx context.Context, d time.Duration) error { return ctx.Err() }
+	defer func() { sleep = sleepContext }()
+
+	dataTable := []struct {
+		states        []string
+		errors        float64
+		expectedError bool
+	}{
+		{[]string{"healthy"}, 0, false},
+		{[]string{"healthy"}, 2, false},
+		{[]string{"healthy"}, 3, true},
+		{[]string{"healthy", "healthy", "unhealthy"}, 0, true},
+	}
+
+	for _, item := range dataTable {
+		calls := 0
+		action := CanaryBakeAction{
+			Svc:       mockELBV2ClientTargetHealth{states: item.states, calls: &calls},
+			Metrics:   staticMetrics{item.errors},
+			BakeTime:  5 * time.Minute,
+			Interval:  time.Minute,
+			MaxErrors: 2,
+		}
+
+		err := action.Commit(context.Background(), canaryPipelineInfo())
+
+		if item.expectedError && err == nil {
+			t.Errorf("CanaryBakeAction.Commit() executed correctly for %v. Expected error.", item)
+		}
+
+		if !item.expectedError && err != nil {
+			t.Errorf("Unexpected error from CanaryBakeAction.Commit() for %v: %s", item, err.Error())
+		}
+	}
+}
+
+func TestCanaryBakeActionWaitsWithTimeout(t *testing.T) {
+	calls, attempts := 0, 0
+	action := CanaryBakeAction{
+		Svc:      mockELBV2ClientTargetHealth{states: []string{"healthy"}, calls: &calls, attempts: &attempts},
+		Metrics:  staticMetrics{0},
+		BakeTime: time.Minute,
+		Interval: time.Minute,
+		Timeout:  10 * time.Minute,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	assert.Equal(t, context.Canceled, action.Commit(ctx, canaryPipelineInfo()))
+	assert.Equal(t, int(10*time.Minute/waiterDelay), attempts)
+}
+
+func TestArnResource(t *testing.T) {
+	assert.Equal(t, "targetgroup/web/73e2", arnResource("arn:aws:elasticloadbalancing:us-east-1:1:targetgroup/web/73e2"))
+	assert.Equal(t, "loadbalancer/app/lb/50dc", arnResource("arn:aws:elasticloadbalancing:us-east-1:1:loadbalancer/app/lb/50dc"))
+	assert.Equal(t, "invalid", arnResource("invalid"))
+}
+
+func TestRollingDeploymentActionCanaryBatch(t *testing.T) {
+	log := []string{}
+	info := &PipelineInfo{OldInstances: instancesDesc("i-1", "i-2", "i-3")}
+
+	action := &RollingDeploymentAction{
+		Actions:       []InfrastructureAction{launchingAction{&log}},
+		CanaryActions: []InfrastructureAction{launchingAction{&log}, failingAction{"i-1"}},
+	}
+
+	if err := action.Commit(context.Background(), info); err == nil {
+		t.Fatal("Expected error from RollingDeploymentAction.Commit() for failed canary")
+	}
+
+	assert.Equal(t, []string{"launch i-1", "terminate new-i-1"}, log)
+
+	log = []string{}
+	info = &PipelineInfo{OldInstances: instancesDesc("i-1", "i-2", "i-3")}
+	action.CanaryActions = []InfrastructureAction{launchingAction{&log}}
+
+	if err := action.Commit(context.Background(), info); err != nil {
+		t.Fatalf("Unexpected error from RollingDeploymentAction.Commit(): %s", err.Error())
+	}
+
+	assert.Equal(t, 2, info.CompletedBatches)
+	assert.Equal(t, []string{"launch i-1", "launch i-2", "launch i-3"}, log)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/stretchr/testify/assert"
+)
+
+type mockEC2ClientPublicIps struct {
+	ec2iface.EC2API
+	pages []*ec2.DescribeInstancesOutput
+}
+
+func (m *mockEC2ClientPublicIps) DescribeInstances(input *ec2.DescribeInstancesInput) (*ec2.DescribeInstancesOutput, error) {
+	if input.NextToken == nil {
+		return m.pages[0], nil
+	}
+
+	return m.pages[1], nil
+}
+
+func TestCollectPublicIpsAction(t *testing.T) {
+	svc := &mockEC2ClientPublicIps{pages: []*ec2.DescribeInstancesOutput{
+		{
+			Reservations: []*ec2.Reservation{{Instances: []*ec2.Instance{
+				{InstanceId: aws.String("i-1"), PublicIpAddress: aws.String("192.0.2.1")},
+				{InstanceId: aws.String("i-2"), PublicIpAddress: aws.String("192.0.2.2")},
+			}}},
+			NextToken: aws.String("page-2"),
+		},
+		{
+			Reservations: []*ec2.Reservation{{Instances: []*ec2.Instance{
+				{InstanceId: aws.String("i-3"), PublicIpAddress: aws.String("192.0.2.3")},
+			}}},
+		},
+	}}
+	info := &PipelineInfo{NewInstancesIds: aws.StringSlice([]string{"i-1", "i-2", "i-3"})}
+
+	if err := (CollectPublicIpsAction{svc, false}).Commit(context.Background(), info); err != nil {
+		t.Fatalf("Unexpected error from CollectPublicIpsAction.Commit(): %s", err.Error())
+	}
+
+	assert.Equal(t, []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"}, info.NewInstancesIps)
+}
+
+func TestCollectPublicIpsActionWithoutPublicIP(t *testing.T) {
+	svc := &mockEC2ClientPublicIps{pages: []*ec2.DescribeInstancesOutput{
+		{Reservations: []*ec2.Reservation{{Instances: []*ec2.Instance{{InstanceId: aws.String("i-1")}}}}},
+	}}
+
+	if err := (CollectPublicIpsAction{svc, false}).Commit(context.Background(), &PipelineInfo{}); err == nil {
+		t.Error("Expected error from CollectPublicIpsAction.Commit() for instance without public IP")
+	}
+}
+
+func TestCollectPublicIpsActionPrivateIP(t *testing.T) {
+	svc := &mockEC2ClientPublicIps{pages: []*ec2.DescribeInstancesOutput{
+		{Reservations: []*ec2.Reservation{{Instances: []*ec2.Instance{
+			{InstanceId: aws.String("i-1"), PrivateIpAddress: aws.String("10.0.0.1")},
+		}}}},
+	}}
+	info := &PipelineInfo{}
+
+	if err := (CollectPublicIpsAction{svc, true}).Commit(context.Background(), info); err != nil {
+		t.Fatalf("Unexpected error from CollectPublicIpsAction.Commit(): %s", err.Error())
+	}
+
+	assert.Equal(t, []string{"10.0.0.1"}, info.NewInstancesIps)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	"github.com/aws/aws-sdk-go/service/elbv2/elbv2iface"
+	"github.com/stretchr/testify/assert"
+)
+
+type mockELBV2ClientTargetGroupPages struct {
+	elbv2iface.ELBV2API
+	pages   int
+	markers []string
+	used    map[string]bool
+}
+
+func (m *mockELBV2ClientTargetGroupPages) DescribeTargetGroups(input *elbv2.DescribeTargetGroupsInput) (*elbv2.DescribeTargetGroupsOutput, error) {
+	page := len(m.markers)
+	m.markers = append(m.markers, aws.StringValue(input.Marker))
+
+	res := &elbv2.DescribeTargetGroupsOutput{}
+	for idx := 0; idx < 2; idx++ {
+		res.TargetGroups = append(res.TargetGroups, &elbv2.TargetGroup{
+			TargetGroupArn: aws.String(fmt.Sprintf("arn:tg-%d-%d", page, idx)),
+		})
+	}
+
+	if page+1 < m.pages {
+		res.NextMarker = aws.String(fmt.Sprintf("marker-%d", page+1))
+	}
+
+	return res, nil
+}
+
+func (m *mockELBV2ClientTargetGroupPages) DescribeTargetHealth(input *elbv2.DescribeTargetHealthInput) (*elbv2.DescribeTargetHealthOutput, error) {
+	state := elbv2.TargetHealthStateEnumUnused
+	if m.used[*input.TargetGroupArn] {
+		state = elbv2.TargetHealthStateEnumHealthy
+	}
+
+	return &elbv2.DescribeTargetHealthOutput{
+		TargetHealthDescriptions: []*elbv2.TargetHealthDescription{
+			{Target: input.Targets[0], TargetHealth: &elbv2.TargetHealth{State: aws.String(state)}},
+		},
+	}, nil
+}
+
+func TestFindLoadBalancerActionPagination(t *testing.T) {
+	svc := &mockELBV2ClientTargetGroupPages{
+		pages: 3,
+		used:  map[string]bool{"arn:tg-0-1": true, "arn:tg-2-0": true},
+	}
+	info := &PipelineInfo{OldInstancesIds: []*string{aws.String("i-1")}}
+
+	if err := (FindLoadBalancerAction{svc}).Commit(context.Background(), info); err != nil {
+		t.Fatalf("Unexpected error from FindLoadBalancerAction.Commit(): %s", err.Error())
+	}
+
+	assert.Equal(t, []string{"", "marker-1", "marker-2"}, svc.markers)
+	assert.Equal(t, []string{"arn:tg-0-1", "arn:tg-2-0"}, aws.StringValueSlice(info.TargetGroupsArns))
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"testing"
 )
 
@@ -15,13 +16,14 @@ func TestInitializePipelineAction(t *testing.T) {
 		{"ami-1ds1ha9822123", "ami-7dsa7fg7r7b7q1", false},
 		{"ami-123", "ami-123", true},
 		{"ami-123", "", true},
-		{"", "ami-123", true},
+		{"", "ami-123", false},
+		{"123", "ami-123", true},
 	}
 
 	for _, item := range dataTable {
 		pipelineInfo := &PipelineInfo{}
 		action := InitializePipelineAction{item.OldAMI, item.NewAMI}
-		err := action.Commit(pipelineInfo)
+		err := action.Commit(context.Background(), pipelineInfo)
 
 		if item.expectedError == true {
 			if  err == nil {
@@ -44,7 +46,7 @@ func TestInitializePipelineAction(t *testing.T) {
 			t.Errorf("New AMI ID is valid in pipeline. Expected %s. Got %s.", item.NewAMI, pipelineInfo.Input.NewAMI)
 		}
 
-		if action.Rollback(pipelineInfo) != nil {
+		if action.Rollback(context.Background(), pipelineInfo) != nil {
 			t.Errorf("Rollback failed for InitializePipelineAction.")
 		}
 	}
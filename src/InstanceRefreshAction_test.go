@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/autoscaling/autoscalingiface"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/stretchr/testify/assert"
+)
+
+type mockAutoScalingClient struct {
+	autoscalingiface.AutoScalingAPI
+	versions  map[string]string
+	statuses  []string
+	refreshes int
+	cancels   int
+}
+
+func (m *mockAutoScalingClient) DescribeAutoScalingGroups(input *autoscaling.DescribeAutoScalingGroupsInput) (*autoscaling.DescribeAutoScalingGroupsOutput, error) {
+	return &autoscaling.DescribeAutoScalingGroupsOutput{
+		AutoScalingGroups: []*autoscaling.Group{
+			{
+				AutoScalingGroupName: input.AutoScalingGroupNames[0],
+				LaunchTemplate:       &autoscaling.LaunchTemplateSpecification{LaunchTemplateId: aws.String("lt-1"), Version: aws.String("3")},
+			},
+		},
+	}, nil
+}
+
+func (m *mockAutoScalingClient) UpdateAutoScalingGroup(input *autoscaling.UpdateAutoScalingGroupInput) (*autoscaling.UpdateAutoScalingGroupOutput, error) {
+	m.versions[*input.AutoScalingGroupName] = *input.LaunchTemplate.Version
+	return &autoscaling.UpdateAutoScalingGroupOutput{}, nil
+}
+
+func (m *mockAutoScalingClient) StartInstanceRefresh(*autoscaling.StartInstanceRefreshInput) (*autoscaling.StartInstanceRefreshOutput, error) {
+	m.refreshes++
+	return &autoscaling.StartInstanceRefreshOutput{InstanceRefreshId: aws.String("refresh-1")}, nil
+}
+
+func (m *mockAutoScalingClient) CancelInstanceRefresh(*autoscaling.CancelInstanceRefreshInput) (*autoscaling.CancelInstanceRefreshOutput, error) {
+	m.cancels++
+	return &autoscaling.CancelInstanceRefreshOutput{}, nil
+}
+
+func (m *mockAutoScalingClient) DescribeInstanceRefreshes(input *autoscaling.DescribeInstanceRefreshesInput) (*autoscaling.DescribeInstanceRefreshesOutput, error) {
+	status := m.statuses[0]
+	if len(m.statuses) > 1 {
+		m.statuses = m.statuses[1:]
+	}
+
+	return &autoscaling.DescribeInstanceRefreshesOutput{
+		InstanceRefreshes: []*autoscaling.InstanceRefresh{
+			{InstanceRefreshId: input.InstanceRefreshIds[0], Status: aws.String(status)},
+		},
+	}, nil
+}
+
+type mockEC2ClientLaunchTemplates struct {
+	ec2iface.EC2API
+	created *ec2.CreateLaunchTemplateVersionInput
+	deleted []*string
+}
+
+func (m *mockEC2ClientLaunchTemplates) DescribeLaunchTemplateVersions(*ec2.DescribeLaunchTemplateVersionsInput) (*ec2.DescribeLaunchTemplateVersionsOutput, error) {
+	return &ec2.DescribeLaunchTemplateVersionsOutput{
+		LaunchTemplateVersions: []*ec2.LaunchTemplateVersion{{VersionNumber: aws.Int64(3)}},
+	}, nil
+}
+
+func (m *mockEC2ClientLaunchTemplates) CreateLaunchTemplateVersion(input *ec2.CreateLaunchTemplateVersionInput) (*ec2.CreateLaunchTemplateVersionOutput, error) {
+	m.created = input
+	return &ec2.CreateLaunchTemplateVersionOutput{
+		LaunchTemplateVersion: &ec2.LaunchTemplateVersion{VersionNumber: aws.Int64(4)},
+	}, nil
+}
+
+func (m *mockEC2ClientLaunchTemplates) DeleteLaunchTemplateVersions(input *ec2.DeleteLaunchTemplateVersionsInput) (*ec2.DeleteLaunchTemplateVersionsOutput, error) {
+	m.deleted = input.Versions
+	return &ec2.DeleteLaunchTemplateVersionsOutput{}, nil
+}
+
+func TestFindAutoScalingGroupsAction(t *testing.T) {
+	info := &PipelineInfo{
+		OldInstances: []ShortInstanceDesc{
+			{ID: "i-1", Tags: map[string]string{autoScalingGroupTag: "web"}},
+			{ID: "i-2", Tags: map[string]string{autoScalingGroupTag: "web"}},
+		},
+	}
+
+	if err := (FindAutoScalingGroupsAction{&mockAutoScalingClient{}}).Commit(context.Background(), info); err != nil {
+		t.Fatalf("Unexpected error from FindAutoScalingGroupsAction.Commit(): %s", err.Error())
+	}
+
+	assert.Equal(t, []AutoScalingGroupState{{Name: "web", LaunchTemplateID: "lt-1", PreviousVersion: "3"}}, info.AutoScalingGroups)
+
+	info.OldInstances = append(info.OldInstances, ShortInstanceDesc{ID: "i-3", Tags: map[string]string{}})
+	if err := (FindAutoScalingGroupsAction{&mockAutoScalingClient{}}).Commit(context.Background(), info); err == nil {
+		t.Error("Expected error from FindAutoScalingGroupsAction.Commit() for instance outside of Auto Scaling Group")
+	}
+}
+
+func TestCreateLaunchTemplateVersionsAction(t *testing.T) {
+	svc := &mockEC2ClientLaunchTemplates{}
+	info := &PipelineInfo{
+		Input: InputArgs{NewAMI: "ami-456"},
+		AutoScalingGroups: []AutoScalingGroupState{
+			{Name: "web", LaunchTemplateID: "lt-1", PreviousVersion: "$Latest"},
+			{Name: "web-2", LaunchTemplateID: "lt-1", PreviousVersion: "$Latest"},
+		},
+	}
+
+	if err := (CreateLaunchTemplateVersionsAction{svc}).Commit(context.Background(), info); err != nil {
+		t.Fatalf("Unexpected error from CreateLaunchTemplateVersionsAction.Commit(): %s", err.Error())
+	}
+
+	assert.Equal(t, "3", *svc.created.SourceVersion)
+	assert.Equal(t, "ami-456", *svc.created.LaunchTemplateData.ImageId)
+	assert.Equal(t, "4", info.AutoScalingGroups[0].NewVersion)
+	assert.Equal(t, "4", info.AutoScalingGroups[1].NewVersion)
+
+	if err := (CreateLaunchTemplateVersionsAction{svc}).Rollback(context.Background(), info); err != nil {
+		t.Fatalf("Unexpected error from CreateLaunchTemplateVersionsAction.Rollback(): %s", err.Error())
+	}
+
+	assert.Equal(t, []*string{aws.String("4")}, svc.deleted)
+}
+
+func TestInstanceRefreshAction(t *testing.T) {
+	sleep = func(ctx context.Context, d time.Duration) error { return ctx.Err() }
+	defer func() { sleep = sleepContext }()
+
+	group := AutoScalingGroupState{Name: "web", LaunchTemplateID: "lt-1", PreviousVersion: "3", NewVersion: "4"}
+
+	svc := &mockAutoScalingClient{versions: map[string]string{}, statuses: []string{"Pending", "InProgress", "Successful"}}
+	info := &PipelineInfo{AutoScalingGroups: []AutoScalingGroupState{group}}
+	action := InstanceRefreshAction{svc, 90, time.Second, nil}
+
+	if err := action.Commit(context.Background(), info); err != nil {
+		t.Fatalf("Unexpected error from InstanceRefreshAction.Commit(): %s", err.Error())
+	}
+
+	assert.Equal(t, "refresh-1", info.AutoScalingGroups[0].InstanceRefreshID)
+
+	svc = &mockAutoScalingClient{versions: map[string]string{}, statuses: []string{"InProgress", "Failed"}}
+	info = &PipelineInfo{AutoScalingGroups: []AutoScalingGroupState{group}}
+	action = InstanceRefreshAction{svc, 90, time.Second, nil}
+
+	if err := action.Commit(context.Background(), info); err == nil {
+		t.Fatal("Expected error from InstanceRefreshAction.Commit() for failed refresh")
+	}
+
+	svc.statuses = []string{"Successful"}
+	if err := action.Rollback(context.Background(), info); err != nil {
+		t.Fatalf("Unexpected error from InstanceRefreshAction.Rollback(): %s", err.Error())
+	}
+
+	// Previous launch template version is restored and instances are refreshed again
+	assert.Equal(t, "3", svc.versions["web"])
+	assert.Equal(t, 2, svc.refreshes)
+}
+
+func TestInstanceRefreshActionRollbackWaitsForRefreshOfInterruptedRollback(t *testing.T) {
+	sleep = func(ctx context.Context, d time.Duration) error { return ctx.Err() }
+	defer func() { sleep = sleepContext }()
+
+	svc := &mockAutoScalingClient{versions: map[string]string{}, statuses: []string{"Cancelled", "InProgress"}}
+	info := &PipelineInfo{AutoScalingGroups: []AutoScalingGroupState{
+		{Name: "web", LaunchTemplateID: "lt-1", PreviousVersion: "3", NewVersion: "4", InstanceRefreshID: "refresh-0"},
+	}}
+
+	// The process stops right after the refresh of the rollback is saved
+	ctx, cancel := context.WithCancel(context.Background())
+	saved := ""
+	action := InstanceRefreshAction{svc, 90, time.Second, func() {
+		saved = info.AutoScalingGroups[0].RollbackRefreshID
+		cancel()
+	}}
+
+	assert.Error(t, action.Rollback(ctx, info))
+	assert.Equal(t, "refresh-1", saved)
+
+	svc.statuses = []string{"Successful"}
+	assert.NoError(t, action.Rollback(context.Background(), info))
+
+	// The started refresh is finished instead of being cancelled and started again
+	assert.Equal(t, 1, svc.cancels)
+	assert.Equal(t, 1, svc.refreshes)
+	assert.Empty(t, info.AutoScalingGroups[0].InstanceRefreshID)
+	assert.Empty(t, info.AutoScalingGroups[0].RollbackRefreshID)
+}
+
+func TestUpdateAutoScalingGroupsActionRollsBackUpdatedGroupsOnly(t *testing.T) {
+	svc := &mockAutoScalingClient{versions: map[string]string{}}
+	info := &PipelineInfo{AutoScalingGroups: []AutoScalingGroupState{
+		{Name: "web", LaunchTemplateID: "lt-1", PreviousVersion: "3", NewVersion: "4", Updated: true},
+		{Name: "api", LaunchTemplateID: "lt-1", PreviousVersion: "3", NewVersion: "4"},
+	}}
+	action := UpdateAutoScalingGroupsAction{svc}
+
+	if err := action.Rollback(context.Background(), info); err != nil {
+		t.Fatalf("Unexpected error from UpdateAutoScalingGroupsAction.Rollback(): %s", err.Error())
+	}
+
+	assert.Equal(t, map[string]string{"web": "3"}, svc.versions)
+	assert.False(t, info.AutoScalingGroups[0].Updated)
+	assert.Empty(t, action.Leftovers(info))
+}
+
+func TestAutoScalingRollbackRestoresLatestAfterDeletingNewVersion(t *testing.T) {
+	sleep = func(ctx context.Context, d time.Duration) error { return ctx.Err() }
+	defer func() { sleep = sleepContext }()
+
+	ec2Svc := &mockEC2ClientLaunchTemplates{}
+	svc := &mockAutoScalingClient{versions: map[string]string{}, statuses: []string{"Failed"}}
+	info := &PipelineInfo{
+		Input:             InputArgs{NewAMI: "ami-456"},
+		AutoScalingGroups: []AutoScalingGroupState{{Name: "web", LaunchTemplateID: "lt-1", PreviousVersion: "$Latest"}},
+	}
+	actions := []InfrastructureAction{
+		FindAutoScalingGroupsAction{svc},
+		CreateLaunchTemplateVersionsAction{ec2Svc},
+		UpdateAutoScalingGroupsAction{svc},
+		InstanceRefreshAction{svc, 90, time.Second, nil},
+	}
+
+	for _, action := range actions[1:3] {
+		assert.NoError(t, action.Commit(context.Background(), info))
+	}
+	assert.Equal(t, "3", info.AutoScalingGroups[0].PreviousVersionNumber)
+	assert.Error(t, actions[3].Commit(context.Background(), info))
+
+	// The refresh of the rollback uses the previous version while $Latest still points to the new one
+	svc.statuses = []string{"Successful"}
+	assert.NoError(t, actions[3].Rollback(context.Background(), info))
+	assert.Equal(t, "3", svc.versions["web"])
+	assert.True(t, info.AutoScalingGroups[0].Pinned)
+
+	assert.NoError(t, actions[2].Rollback(context.Background(), info))
+	assert.NoError(t, actions[1].Rollback(context.Background(), info))
+	assert.Equal(t, []*string{aws.String("4")}, ec2Svc.deleted)
+
+	assert.NoError(t, actions[0].Rollback(context.Background(), info))
+	assert.Equal(t, "$Latest", svc.versions["web"])
+	assert.False(t, info.AutoScalingGroups[0].Pinned)
+}
+
+func TestFindAutoScalingGroupsActionKeepsNumberOfUndeletedVersion(t *testing.T) {
+	svc := &mockAutoScalingClient{versions: map[string]string{}}
+	info := &PipelineInfo{AutoScalingGroups: []AutoScalingGroupState{
+		{Name: "web", LaunchTemplateID: "lt-1", PreviousVersion: "$Latest", PreviousVersionNumber: "3", NewVersion: "4", Pinned: true},
+	}}
+	action := FindAutoScalingGroupsAction{svc}
+
+	assert.Error(t, action.Rollback(context.Background(), info))
+	assert.Empty(t, svc.versions)
+	assert.Equal(t, []string{"Auto Scaling Group web uses version 3 of launch template lt-1 instead of $Latest"}, action.Leftovers(info))
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
     "testing"
 
     "github.com/aws/aws-sdk-go/aws"
@@ -8,6 +9,7 @@ import (
     "github.com/aws/aws-sdk-go/service/ec2/ec2iface"
     "github.com/stretchr/testify/assert"
     "errors"
+    "fmt"
 )
 
 type mockEC2ClientError struct {
@@ -63,6 +65,39 @@ func (t mockEC2ClientCorrectResult) DescribeInstances(*ec2.DescribeInstancesInpu
     return res, nil
 }
 
+func (t mockEC2ClientCorrectResult) DescribeInstanceTypes(input *ec2.DescribeInstanceTypesInput) (*ec2.DescribeInstanceTypesOutput, error) {
+    res := &ec2.DescribeInstanceTypesOutput{}
+
+    for _, instanceType := range input.InstanceTypes {
+        res.InstanceTypes = append(res.InstanceTypes, &ec2.InstanceTypeInfo{
+            InstanceType: instanceType,
+            BurstablePerformanceSupported: aws.Bool(true),
+        })
+    }
+
+    return res, nil
+}
+
+func (t mockEC2ClientCorrectResult) DescribeInstanceCreditSpecifications(input *ec2.DescribeInstanceCreditSpecificationsInput) (*ec2.DescribeInstanceCreditSpecificationsOutput, error) {
+    res := &ec2.DescribeInstanceCreditSpecificationsOutput{}
+
+    for _, instanceID := range input.InstanceIds {
+        res.InstanceCreditSpecifications = append(res.InstanceCreditSpecifications, &ec2.InstanceCreditSpecification{
+            InstanceId: instanceID,
+            CpuCredits: aws.String("unlimited"),
+        })
+    }
+
+    return res, nil
+}
+
+func (t mockEC2ClientCorrectResult) DescribeInstanceAttribute(input *ec2.DescribeInstanceAttributeInput) (*ec2.DescribeInstanceAttributeOutput, error) {
+    return &ec2.DescribeInstanceAttributeOutput{
+        InstanceId: input.InstanceId,
+        UserData: &ec2.AttributeValue{Value: aws.String("IyEvYmluL3No")},
+    }, nil
+}
+
 type mockEC2ClientNoResult struct {
     ec2iface.EC2API
 }
@@ -79,7 +114,7 @@ func TestInitializePipelineActionErrorFromClient(t *testing.T) {
     pipelineInfo := &PipelineInfo{}
     svcMock := &mockEC2ClientError{}
 
-    err := ListInstancesAction{svcMock}.Commit(pipelineInfo)
+    err := ListInstancesAction{Svc: svcMock}.Commit(context.Background(), pipelineInfo)
 
     if err == nil || err.Error() != "Error_From_Ec2Client" {
         t.Error("Expected error from ListInstancesAction.Commit()")
@@ -90,7 +125,7 @@ func TestInitializePipelineActionDescribeInstances(t *testing.T) {
     pipelineInfo := &PipelineInfo{}
     svcMock := &mockEC2ClientCorrectResult{}
 
-    ListInstancesAction{svcMock}.Commit(pipelineInfo)
+    ListInstancesAction{Svc: svcMock}.Commit(context.Background(), pipelineInfo)
 
     expectedPipelineInfo := PipelineInfo{
         OldInstancesIds: []*string{},
@@ -128,6 +163,10 @@ func TestInitializePipelineActionDescribeInstances(t *testing.T) {
         assert.Equal(t, instance.VpcID, expectedPipelineInfo.OldInstances[idx].VpcID)
         assert.Equal(t, instance.SecurityGroupsIds, expectedPipelineInfo.OldInstances[idx].SecurityGroupsIds)
         assert.Equal(t, instance.Tags, expectedPipelineInfo.OldInstances[idx].Tags)
+
+        // Settings not returned by DescribeInstances are described separately
+        assert.Equal(t, "unlimited", instance.CreditSpecification)
+        assert.Equal(t, "IyEvYmluL3No", instance.UserData)
     }
 }
 
@@ -135,9 +174,97 @@ func TestInitializePipelineActionNoInstances(t *testing.T) {
     pipelineInfo := &PipelineInfo{}
     svcMock := &mockEC2ClientNoResult{}
 
-    err :=ListInstancesAction{svcMock}.Commit(pipelineInfo)
+    err :=ListInstancesAction{Svc: svcMock}.Commit(context.Background(), pipelineInfo)
     if err == nil {
         t.Error("Expected error from ListInstancesAction.Commit()")
     }
     assert.Equal(t, "Not found any running instance", err.Error())
 }
+
+type mockEC2ClientFilters struct {
+    mockEC2ClientCorrectResult
+    input *ec2.DescribeInstancesInput
+}
+
+func (t *mockEC2ClientFilters) DescribeInstances(input *ec2.DescribeInstancesInput) (*ec2.DescribeInstancesOutput, error) {
+    t.input = input
+    return mockEC2ClientCorrectResult{}.DescribeInstances(input)
+}
+
+func filterValues(input *ec2.DescribeInstancesInput) map[string][]string {
+    values := map[string][]string{}
+
+    for _, filter := range input.Filters {
+        values[*filter.Name] = aws.StringValueSlice(filter.Values)
+    }
+
+    return values
+}
+
+func TestListInstancesActionSelector(t *testing.T) {
+    svcMock := &mockEC2ClientFilters{}
+    selector := SelectorConfig{
+        Tags: map[string]string{"App": "web", "Env": "prod"},
+        VpcID: "vpc-prod",
+        SubnetIDs: []string{"subnet-123a", "subnet-123b"},
+        InstanceIDs: []string{"i-1", "i-2"},
+    }
+
+    err := ListInstancesAction{svcMock, selector}.Commit(context.Background(), &PipelineInfo{})
+    if err != nil {
+        t.Fatalf("Unexpected error from ListInstancesAction.Commit(): %s", err.Error())
+    }
+
+    assert.Equal(t, map[string][]string{
+        "instance-state-name": {"running"},
+        "tag:App": {"web"},
+        "tag:Env": {"prod"},
+        "vpc-id": {"vpc-prod"},
+        "subnet-id": {"subnet-123a", "subnet-123b"},
+    }, filterValues(svcMock.input))
+    assert.Equal(t, []string{"i-1", "i-2"}, aws.StringValueSlice(svcMock.input.InstanceIds))
+
+    // Selector is combined with the AMI filter when old AMI is given
+    pipelineInfo := &PipelineInfo{Input: InputArgs{OldAMI: "ami-123"}}
+    selector.AMI = "ami-123"
+    ListInstancesAction{svcMock, selector}.Commit(context.Background(), pipelineInfo)
+
+    assert.Equal(t, []string{"ami-123"}, filterValues(svcMock.input)["image-id"])
+}
+
+type mockEC2ClientPages struct {
+    mockEC2ClientCorrectResult
+    tokens []string
+}
+
+func (t *mockEC2ClientPages) DescribeInstances(input *ec2.DescribeInstancesInput) (*ec2.DescribeInstancesOutput, error) {
+    t.tokens = append(t.tokens, aws.StringValue(input.NextToken))
+    res, _ := mockEC2ClientCorrectResult{}.DescribeInstances(input)
+
+    if input.NextToken == nil {
+        // Instances launched together share the reservation
+        res.Reservations[0].Instances = append(res.Reservations[0].Instances, res.Reservations[1].Instances[0])
+        res.Reservations = res.Reservations[:1]
+        res.NextToken = aws.String("page-2")
+        return res, nil
+    }
+
+    for idx, reservation := range res.Reservations {
+        reservation.Instances[0].InstanceId = aws.String(fmt.Sprintf("i-%d", idx+3))
+    }
+
+    return res, nil
+}
+
+func TestListInstancesActionPagination(t *testing.T) {
+    pipelineInfo := &PipelineInfo{}
+    svcMock := &mockEC2ClientPages{}
+
+    if err := (ListInstancesAction{Svc: svcMock}).Commit(context.Background(), pipelineInfo); err != nil {
+        t.Fatalf("Unexpected error from ListInstancesAction.Commit(): %s", err.Error())
+    }
+
+    assert.Equal(t, []string{"", "page-2"}, svcMock.tokens)
+    assert.Equal(t, []string{"i-1", "i-2", "i-3", "i-4"}, aws.StringValueSlice(pipelineInfo.OldInstancesIds))
+    assert.Equal(t, 4, len(pipelineInfo.OldInstances))
+}
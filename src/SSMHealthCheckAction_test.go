@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
+	"github.com/stretchr/testify/assert"
+)
+
+type mockSSMClient struct {
+	ssmiface.SSMAPI
+	sent     [][]string
+	commands []string
+	// codes are printed by curl on the instances in the following attempts
+	codes       map[string][]string
+	invocations int
+	// unregistered is the number of commands rejected before instances are registered in SSM
+	unregistered int
+}
+
+func (m *mockSSMClient) SendCommand(input *ssm.SendCommandInput) (*ssm.SendCommandOutput, error) {
+	m.sent = append(m.sent, aws.StringValueSlice(input.InstanceIds))
+	if len(m.sent) <= m.unregistered {
+		return nil, awserr.New(ssm.ErrCodeInvalidInstanceId, "Instances not in a valid state for account", nil)
+	}
+
+	m.commands = append(m.commands, *input.Parameters["commands"][0])
+
+	return &ssm.SendCommandOutput{Command: &ssm.Command{CommandId: aws.String("command-1")}}, nil
+}
+
+func (m *mockSSMClient) GetCommandInvocation(input *ssm.GetCommandInvocationInput) (*ssm.GetCommandInvocationOutput, error) {
+	m.invocations++
+
+	// The first call comes before the invocation is registered
+	if m.invocations == 1 {
+		return nil, awserr.New(ssm.ErrCodeInvocationDoesNotExist, "Invocation does not exist", nil)
+	}
+
+	codes := m.codes[*input.InstanceId]
+	code := codes[0]
+	if len(codes) > 1 {
+		m.codes[*input.InstanceId] = codes[1:]
+	}
+
+	return &ssm.GetCommandInvocationOutput{
+		Status:                aws.String(ssm.CommandInvocationStatusSuccess),
+		StandardOutputContent: aws.String(code),
+	}, nil
+}
+
+func TestSSMHealthCheckAction(t *testing.T) {
+	sleep = func(ctx context.Context, d time.Duration) error { return ctx.Err() }
+	defer func() { sleep = sleepContext }()
+
+	check := DefaultConfig().HealthCheck
+	check.Port = 8080
+	check.Path = "/health"
+	check.Retries = 3
+
+	svc := &mockSSMClient{codes: map[string][]string{"i-1": {"200"}, "i-2": {"503", "200"}}}
+	info := &PipelineInfo{NewInstancesIds: aws.StringSlice([]string{"i-1", "i-2"})}
+
+	if err := (SSMHealthCheckAction{svc, check}).Commit(context.Background(), info); err != nil {
+		t.Fatalf("Unexpected error from SSMHealthCheckAction.Commit(): %s", err.Error())
+	}
+
+	assert.Equal(t, "curl -s -o /dev/null -w '%{http_code}' --max-time 10 'http://127.0.0.1:8080/health'", svc.commands[0])
+
+	// Healthy instances are not checked again
+	assert.Equal(t, [][]string{{"i-1", "i-2"}, {"i-2"}}, svc.sent)
+
+	// Certificate is not verified on the loopback address
+	check.Scheme = "https"
+	check.Port = 443
+	assert.Equal(t, "curl -s -k -o /dev/null -w '%{http_code}' --max-time 10 'https://127.0.0.1:443/health'", SSMHealthCheckAction{svc, check}.command())
+}
+
+func TestSSMHealthCheckActionApplicationDown(t *testing.T) {
+	sleep = func(ctx context.Context, d time.Duration) error { return ctx.Err() }
+	defer func() { sleep = sleepContext }()
+
+	check := DefaultConfig().HealthCheck
+	check.Retries = 2
+
+	svc := &mockSSMClient{codes: map[string][]string{"i-1": {"000"}}}
+	info := &PipelineInfo{NewInstancesIds: aws.StringSlice([]string{"i-1"})}
+
+	err := (SSMHealthCheckAction{svc, check}).Commit(context.Background(), info)
+	if err == nil {
+		t.Fatal("Expected error from SSMHealthCheckAction.Commit() for application which is down")
+	}
+
+	assert.Equal(t, "Application is down on i-1. Response code 0", err.Error())
+	assert.Equal(t, 2, len(svc.sent))
+}
+
+func TestSSMHealthCheckActionWaitsForRegistration(t *testing.T) {
+	sleep = func(ctx context.Context, d time.Duration) error { return ctx.Err() }
+	defer func() { sleep = sleepContext }()
+
+	check := DefaultConfig().HealthCheck
+	check.Retries = 3
+
+	svc := &mockSSMClient{codes: map[string][]string{"i-1": {"200"}}, unregistered: 1}
+	info := &PipelineInfo{NewInstancesIds: aws.StringSlice([]string{"i-1"})}
+
+	if err := (SSMHealthCheckAction{svc, check}).Commit(context.Background(), info); err != nil {
+		t.Fatalf("Unexpected error from SSMHealthCheckAction.Commit(): %s", err.Error())
+	}
+	assert.Equal(t, [][]string{{"i-1"}, {"i-1"}}, svc.sent)
+
+	// Instances never registered fail once the retries are used
+	svc = &mockSSMClient{unregistered: 3}
+	err := (SSMHealthCheckAction{svc, check}).Commit(context.Background(), info)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "New instances are not registered in SSM")
+	}
+	assert.Equal(t, 3, len(svc.sent))
+}
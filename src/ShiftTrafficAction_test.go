@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	"github.com/aws/aws-sdk-go/service/elbv2/elbv2iface"
+	"github.com/stretchr/testify/assert"
+)
+
+type mockELBV2ClientListeners struct {
+	elbv2iface.ELBV2API
+	defaultActions map[string][]*elbv2.Action
+	ruleActions    map[string][]*elbv2.Action
+	unhealthy      bool
+}
+
+func (m *mockELBV2ClientListeners) DescribeTargetGroups(input *elbv2.DescribeTargetGroupsInput) (*elbv2.DescribeTargetGroupsOutput, error) {
+	return &elbv2.DescribeTargetGroupsOutput{
+		TargetGroups: []*elbv2.TargetGroup{
+			{TargetGroupArn: input.TargetGroupArns[0], LoadBalancerArns: []*string{aws.String("arn:lb")}},
+		},
+	}, nil
+}
+
+func (m *mockELBV2ClientListeners) DescribeListeners(*elbv2.DescribeListenersInput) (*elbv2.DescribeListenersOutput, error) {
+	return &elbv2.DescribeListenersOutput{
+		Listeners: []*elbv2.Listener{{ListenerArn: aws.String("arn:listener")}},
+	}, nil
+}
+
+func (m *mockELBV2ClientListeners) DescribeRules(*elbv2.DescribeRulesInput) (*elbv2.DescribeRulesOutput, error) {
+	return &elbv2.DescribeRulesOutput{
+		Rules: []*elbv2.Rule{
+			{RuleArn: aws.String("arn:rule-default"), IsDefault: aws.Bool(true), Actions: m.defaultActions["arn:listener"]},
+			{RuleArn: aws.String("arn:rule-1"), IsDefault: aws.Bool(false), Actions: m.ruleActions["arn:rule-1"]},
+		},
+	}, nil
+}
+
+func (m *mockELBV2ClientListeners) ModifyListener(input *elbv2.ModifyListenerInput) (*elbv2.ModifyListenerOutput, error) {
+	m.defaultActions[*input.ListenerArn] = input.DefaultActions
+	return &elbv2.ModifyListenerOutput{}, nil
+}
+
+func (m *mockELBV2ClientListeners) ModifyRule(input *elbv2.ModifyRuleInput) (*elbv2.ModifyRuleOutput, error) {
+	m.ruleActions[*input.RuleArn] = input.Actions
+	return &elbv2.ModifyRuleOutput{}, nil
+}
+
+func (m *mockELBV2ClientListeners) DescribeTargetHealth(input *elbv2.DescribeTargetHealthInput) (*elbv2.DescribeTargetHealthOutput, error) {
+	state := elbv2.TargetHealthStateEnumHealthy
+	if m.unhealthy {
+		state = elbv2.TargetHealthStateEnumUnhealthy
+	}
+
+	return &elbv2.DescribeTargetHealthOutput{
+		TargetHealthDescriptions: []*elbv2.TargetHealthDescription{
+			{Target: input.Targets[0], TargetHealth: &elbv2.TargetHealth{State: aws.String(state)}},
+		},
+	}, nil
+}
+
+func newMockELBV2ClientListeners() *mockELBV2ClientListeners {
+	return &mockELBV2ClientListeners{
+		defaultActions: map[string][]*elbv2.Action{
+			"arn:listener": {{Type: aws.String("forward"), TargetGroupArn: aws.String("arn:blue")}},
+		},
+		ruleActions: map[string][]*elbv2.Action{
+			"arn:rule-1": {{Type: aws.String("fixed-response")}},
+		},
+	}
+}
+
+func blueGreenPipelineInfo() *PipelineInfo {
+	return &PipelineInfo{
+		NewInstancesIds:   []*string{aws.String("i-new")},
+		GreenTargetGroups: []TargetGroupPair{{BlueArn: "arn:blue", GreenArn: "arn:green"}},
+	}
+}
+
+func TestShiftTrafficAction(t *testing.T) {
+	sleep = func(ctx context.Context, d time.Duration) error { return ctx.Err() }
+	defer func() { sleep = sleepContext }()
+
+	svc := newMockELBV2ClientListeners()
+	info := blueGreenPipelineInfo()
+	action := ShiftTrafficAction{svc, []int64{10, 100}, time.Minute}
+
+	if err := action.Commit(context.Background(), info); err != nil {
+		t.Fatalf("Unexpected error from ShiftTrafficAction.Commit(): %s", err.Error())
+	}
+
+	tgs := svc.defaultActions["arn:listener"][0].ForwardConfig.TargetGroups
+	assert.Equal(t, "arn:blue", *tgs[0].TargetGroupArn)
+	assert.Equal(t, int64(0), *tgs[0].Weight)
+	assert.Equal(t, "arn:green", *tgs[1].TargetGroupArn)
+	assert.Equal(t, int64(100), *tgs[1].Weight)
+	assert.Equal(t, 1, len(info.ShiftedListenerRules))
+	assert.Equal(t, "fixed-response", *svc.ruleActions["arn:rule-1"][0].Type)
+
+	if err := action.Rollback(context.Background(), info); err != nil {
+		t.Fatalf("Unexpected error from ShiftTrafficAction.Rollback(): %s", err.Error())
+	}
+
+	assert.Equal(t, "arn:blue", *svc.defaultActions["arn:listener"][0].TargetGroupArn)
+	assert.Nil(t, svc.defaultActions["arn:listener"][0].ForwardConfig)
+}
+
+func TestShiftTrafficActionUnhealthyGreen(t *testing.T) {
+	sleep = func(ctx context.Context, d time.Duration) error { return ctx.Err() }
+	defer func() { sleep = sleepContext }()
+
+	svc := newMockELBV2ClientListeners()
+	svc.unhealthy = true
+	info := blueGreenPipelineInfo()
+	action := ShiftTrafficAction{svc, []int64{10, 100}, time.Minute}
+
+	if err := action.Commit(context.Background(), info); err == nil {
+		t.Fatal("Expected error from ShiftTrafficAction.Commit() for unhealthy instances")
+	}
+
+	// Traffic stays at the first step until the rollback sends it back to the blue target group
+	assert.Equal(t, int64(10), *svc.defaultActions["arn:listener"][0].ForwardConfig.TargetGroups[1].Weight)
+	action.Rollback(context.Background(), info)
+	assert.Equal(t, "arn:blue", *svc.defaultActions["arn:listener"][0].TargetGroupArn)
+}
+
+func TestForwardsOnlyTo(t *testing.T) {
+	weighted := []*elbv2.Action{{
+		Type: aws.String("forward"),
+		ForwardConfig: &elbv2.ForwardActionConfig{TargetGroups: []*elbv2.TargetGroupTuple{
+			{TargetGroupArn: aws.String("arn:blue")}, {TargetGroupArn: aws.String("arn:other")},
+		}},
+	}}
+
+	forwards, err := forwardsOnlyTo(weighted, "arn:blue")
+	assert.False(t, forwards)
+	assert.NotNil(t, err)
+
+	forwards, err = forwardsOnlyTo(weighted, "arn:green")
+	assert.False(t, forwards)
+	assert.Nil(t, err)
+}
+
+func TestGreenTargetGroupName(t *testing.T) {
+	assert.Equal(t, "web-g20190101120000", greenTargetGroupName("web", "20190101_120000"))
+	assert.Equal(t, "very-long-target-g20190101120000", greenTargetGroupName("very-long-target-group-name", "20190101_120000"))
+}
+
+func TestFinalizeBlueGreenActionRollbackKeepsTrafficServed(t *testing.T) {
+	fake := newFakeAWS()
+	fake.addInstance("i-old-1", "ami-old", "sg-1", "arn:tg-web")
+	fake.addInstance("i-new-1", "ami-new", "sg-1", "arn:tg-green")
+	fake.failures["TerminateInstances"] = errors.New("UnauthorizedOperation: not allowed")
+
+	elbSvc := fake.clients().ELBV2
+	actions := []InfrastructureAction{
+		DeregisterOldInstancesAction{elbSvc},
+		WaitForDeregisterAction{elbSvc, time.Minute},
+		FinalizeBlueGreenAction{elbSvc, time.Minute, time.Minute},
+		TerminateOldInstancesAction{fake.clients().EC2},
+	}
+	info := &PipelineInfo{
+		OldInstancesIds:  aws.StringSlice([]string{"i-old-1"}),
+		NewInstancesIds:  aws.StringSlice([]string{"i-new-1"}),
+		TargetGroupsArns: aws.StringSlice([]string{"arn:tg-web"}),
+	}
+
+	step, err := runActions(context.Background(), 0, info, actions, func(int) {})
+	assert.Error(t, err)
+	assert.Equal(t, []string{"i-new-1"}, fake.targets("arn:tg-web"))
+
+	calls := len(fake.calls)
+	assert.NoError(t, rollbackActions(context.Background(), step, info, actions, func(int) {}))
+
+	// Old instances are healthy again before new ones are drained
+	assert.Equal(t, []string{"RegisterTargets", "WaitUntilTargetInService", "DeregisterTargets", "WaitUntilTargetDeregistered"}, fake.calls[calls:])
+	assert.Equal(t, []string{"i-old-1"}, fake.targets("arn:tg-web"))
+}
@@ -6,8 +6,13 @@ import(
     "github.com/aws/aws-sdk-go/service/ec2"
     "github.com/aws/aws-sdk-go/service/ec2/ec2iface"
     "github.com/aws/aws-sdk-go/service/elbv2"
+    "github.com/aws/aws-sdk-go/service/elbv2/elbv2iface"
 
+    "context"
     "errors"
+    "fmt"
+    "sort"
+    "time"
 )
 
 // InputArgs is struct to keep input arguments
@@ -18,8 +23,8 @@ type InputArgs struct {
 
 // InfrastructureAction is an interface for all deployment steps
 type InfrastructureAction interface {
-    Commit(info *PipelineInfo) error
-    Rollback(info *PipelineInfo) error
+    Commit(ctx context.Context, info *PipelineInfo) error
+    Rollback(ctx context.Context, info *PipelineInfo) error
 }
 
 // ShortInstanceDesc keeps information about instance required for the deployment
@@ -31,19 +36,58 @@ type ShortInstanceDesc struct {
     VpcID string
     SecurityGroupsIds []*string
     Tags map[string]string
+    // Launch configuration copied to the new instance, so it differs only by the AMI
+    IamInstanceProfile string `json:",omitempty"`
+    UserData string `json:",omitempty"`
+    PlacementGroup string `json:",omitempty"`
+    Tenancy string `json:",omitempty"`
+    Monitoring bool `json:",omitempty"`
+    EbsOptimized bool `json:",omitempty"`
+    // CreditSpecification is standard or unlimited for burstable instance types
+    CreditSpecification string `json:",omitempty"`
+    MetadataOptions *InstanceMetadataDesc `json:",omitempty"`
+    BlockDevices []BlockDeviceDesc `json:",omitempty"`
+}
+
+// SecurityGroupRule is the ingress rule of the health check port authorized by the deployment
+type SecurityGroupRule struct {
+    GroupID string
+    Port int64
 }
 
 // PipelineInfo keep information about deployment progress
 type PipelineInfo struct {
     Version string
     Input InputArgs
+    Config Config
     ClientIP string
     OldInstancesIds []*string
     OldInstances []ShortInstanceDesc
     NewInstancesIds []*string
     NewInstancesIps []string
-    ModifiedSecurityGroups []*string
+    ModifiedSecurityGroups []SecurityGroupRule
     TargetGroupsArns []*string
+    // RegisteredTargetGroups and DeregisteredTargetGroups record target groups already changed by the steps
+    RegisteredTargetGroups []*string
+    DeregisteredTargetGroups []*string
+    CompletedBatches int
+    CurrentBatch *BatchInfo
+    // Batch is the number of the rolling deployment batch the info belongs to. Zero for the whole deployment.
+    Batch int `json:",omitempty"`
+    GreenTargetGroups []TargetGroupPair
+    ShiftedListenerRules []ListenerRuleState
+    AutoScalingGroups []AutoScalingGroupState
+    // Region is the region of the multi-region deployment the info belongs to. Empty for the whole deployment.
+    Region string `json:",omitempty"`
+    Regions []RegionDeployment `json:",omitempty"`
+    // CopiedImageID is the copy of the new AMI made in the region. Snapshots of the copy are recorded by its rollback.
+    CopiedImageID string `json:",omitempty"`
+    CopiedSnapshotIds []*string `json:",omitempty"`
+    // SharedImage records permissions on the new AMI granted to the account of the deployment
+    SharedImage *SharedImageState `json:",omitempty"`
+    // PartialStep is set when the last executed step failed partway.
+    // Its rollback undoes only the changes recorded before the failure.
+    PartialStep bool `json:",omitempty"`
 }
 
 // InitializePipelineAction is a pipeline step struct
@@ -55,68 +99,80 @@ type InitializePipelineAction struct {
 // ListInstancesAction is a pipeline step struct
 type ListInstancesAction struct {
     Svc   ec2iface.EC2API
+    Selector SelectorConfig
 }
 
 // RunInstancesAction is a pipeline step struct
 type RunInstancesAction struct {
-    Svc   *ec2.EC2
+    Svc   ec2iface.EC2API
+    // PrivateNetwork leaves the public IP assignment to the subnet settings
+    PrivateNetwork bool
 }
 
 // WaitUntilStatusOkAction is a pipeline step struct
 type WaitUntilStatusOkAction struct {
-    Svc   *ec2.EC2
+    Svc   ec2iface.EC2API
+    Timeout time.Duration
 }
 
 // AuthorizeSecurityGroupsAction is a pipeline step struct
 type AuthorizeSecurityGroupsAction struct {
-    Svc   *ec2.EC2
+    Svc   ec2iface.EC2API
+    Port int64
 }
 
 // TestInstancesAction is a pipeline step struct
 type TestInstancesAction struct {
-    Svc   *ec2.EC2
+    Svc   ec2iface.EC2API
+    HealthCheck HealthCheckConfig
+    // SmokeTests are run once on every instance after it passes the health check
+    SmokeTests SmokeTestsConfig
 }
 
 // CollectPublicIpsAction is a pipeline step struct
 type CollectPublicIpsAction struct {
-    Svc   *ec2.EC2
+    Svc   ec2iface.EC2API
+    // PrivateIP collects private IPs for the health check run inside the VPC
+    PrivateIP bool
 }
 
 // FindLoadBalancerAction is a pipeline step struct
 type FindLoadBalancerAction struct {
-    Svc   *elbv2.ELBV2
+    Svc   elbv2iface.ELBV2API
 }
 
 // RegisterNewInstancesAction is a pipeline step struct
 type RegisterNewInstancesAction struct {
-    Svc   *elbv2.ELBV2
+    Svc   elbv2iface.ELBV2API
 }
 
 // WaitForDeregisterAction is a pipeline step struct
 type WaitForDeregisterAction struct {
-    Svc   *elbv2.ELBV2
+    Svc   elbv2iface.ELBV2API
+    Timeout time.Duration
 }
 
 // DeregisterOldInstancesAction is a pipeline step struct
 type DeregisterOldInstancesAction struct {
-    Svc   *elbv2.ELBV2
+    Svc   elbv2iface.ELBV2API
 }
 
 // TerminateOldInstancesAction is a pipeline step struct
 type TerminateOldInstancesAction struct {
-    Svc   *ec2.EC2
+    Svc   ec2iface.EC2API
 }
 
 // Commit is an action to apply changes in the InitializePipelineAction step
-func (act InitializePipelineAction) Commit(pipelineInfo *PipelineInfo) error {
+func (act InitializePipelineAction) Commit(ctx context.Context, pipelineInfo *PipelineInfo) error {
     OldAMI := act.OldAMI
     NewAMI := act.NewAMI
 
-    if len(OldAMI) < 4|| len(NewAMI) < 4 {
+    // Old AMI is not required when instances are selected by tags, network or IDs
+    if (OldAMI != "" && len(OldAMI) < 4) || len(NewAMI) < 4 {
         return errors.New("Invalid AMI ID")
     }
 
-    if OldAMI[:4] != "ami-" || NewAMI[:4] != "ami-" {
+    if (OldAMI != "" && OldAMI[:4] != "ami-") || NewAMI[:4] != "ami-" {
         return errors.New("Invalid AMI ID")
     }
 
@@ -124,32 +180,46 @@ func (act InitializePipelineAction) Commit(pipelineInfo *PipelineInfo) error {
         return errors.New("Both new and old AMI ID are the same")
     }
 
-    pipelineInfo.Input = InputArgs{OldAMI, NewAMI}
-    clientIP, err := getClientIP()
-
-    if err != nil {
-        return err
-    }
-
-    pipelineInfo.ClientIP = clientIP
+    pipelineInfo.Input.OldAMI = OldAMI
+    pipelineInfo.Input.NewAMI = NewAMI
     return nil
 }
 
 // Rollback is an action to apply changes in the InitializePipelineAction step
-func (act InitializePipelineAction) Rollback(pipelineInfo *PipelineInfo) error {
+func (act InitializePipelineAction) Rollback(ctx context.Context, pipelineInfo *PipelineInfo) error {
     return nil
 }
 
+func appendOldInstance(pipelineInfo *PipelineInfo, instance *ec2.Instance) {
+    sgIDs := []*string{}
+
+    for _, sg := range instance.SecurityGroups {
+        sgIDs = append(sgIDs, sg.GroupId)
+    }
+
+    tags := map[string]string{}
+
+    for _, tag := range instance.Tags {
+        tags[*tag.Key] = *tag.Value
+    }
+
+    desc := launchConfig(instance)
+    desc.ID = *instance.InstanceId
+    desc.InstanceType = *instance.InstanceType
+    desc.KeyName = aws.StringValue(instance.KeyName)
+    desc.SubnetID = *instance.SubnetId
+    desc.VpcID = *instance.VpcId
+    desc.SecurityGroupsIds = sgIDs
+    desc.Tags = tags
+
+    pipelineInfo.OldInstancesIds = append(pipelineInfo.OldInstancesIds, instance.InstanceId)
+    pipelineInfo.OldInstances = append(pipelineInfo.OldInstances, desc)
+}
+
 // Commit is an action to apply changes in the ListInstancesAction step
-func (act ListInstancesAction) Commit(pipelineInfo *PipelineInfo) error {
+func (act ListInstancesAction) Commit(ctx context.Context, pipelineInfo *PipelineInfo) error {
     input := &ec2.DescribeInstancesInput{
         Filters: []*ec2.Filter{
-            &ec2.Filter{
-                Name: aws.String("image-id"),
-                Values: []*string{
-                    aws.String(pipelineInfo.Input.OldAMI),
-                },
-            },
             &ec2.Filter{
                 Name: aws.String("instance-state-name"),
                 Values: []*string{
@@ -159,52 +229,86 @@ func (act ListInstancesAction) Commit(pipelineInfo *PipelineInfo) error {
         },
     }
 
-    result, err := act.Svc.DescribeInstances(input)
-    if err != nil {
-        return err
+    // The old AMI is optional when instances are selected otherwise
+    if pipelineInfo.Input.OldAMI != "" || act.Selector.isEmpty() {
+        input.Filters = append(input.Filters, &ec2.Filter{
+            Name: aws.String("image-id"),
+            Values: []*string{aws.String(pipelineInfo.Input.OldAMI)},
+        })
     }
 
-    for _, item := range result.Reservations {
-        instance := item.Instances[0]
+    tagKeys := []string{}
+    for key := range act.Selector.Tags {
+        tagKeys = append(tagKeys, key)
+    }
+    sort.Strings(tagKeys)
+
+    for _, key := range tagKeys {
+        input.Filters = append(input.Filters, &ec2.Filter{
+            Name: aws.String("tag:" + key),
+            Values: []*string{aws.String(act.Selector.Tags[key])},
+        })
+    }
+
+    if act.Selector.VpcID != "" {
+        input.Filters = append(input.Filters, &ec2.Filter{
+            Name: aws.String("vpc-id"),
+            Values: []*string{aws.String(act.Selector.VpcID)},
+        })
+    }
+
+    if len(act.Selector.SubnetIDs) > 0 {
+        input.Filters = append(input.Filters, &ec2.Filter{
+            Name: aws.String("subnet-id"),
+            Values: aws.StringSlice(act.Selector.SubnetIDs),
+        })
+    }
 
-        sgIDs := []*string{}
+    if len(act.Selector.InstanceIDs) > 0 {
+        input.InstanceIds = aws.StringSlice(act.Selector.InstanceIDs)
+    }
 
-        for _, sg := range instance.SecurityGroups {
-            sgIDs = append(sgIDs, sg.GroupId)
+    // Every reservation may keep several instances and results may be split into pages
+    for {
+        result, err := act.Svc.DescribeInstances(input)
+        if err != nil {
+            return err
         }
 
-        tags := map[string]string{}
+        for _, item := range result.Reservations {
+            for _, instance := range item.Instances {
+                appendOldInstance(pipelineInfo, instance)
+            }
+        }
 
-        for _, tag := range instance.Tags {
-            tags[*tag.Key] = *tag.Value
+        if aws.StringValue(result.NextToken) == "" {
+            break
         }
 
-        pipelineInfo.OldInstancesIds = append(pipelineInfo.OldInstancesIds, instance.InstanceId)
-        pipelineInfo.OldInstances = append(pipelineInfo.OldInstances, ShortInstanceDesc{
-            ID: *instance.InstanceId,
-            InstanceType: *instance.InstanceType,
-            KeyName: *instance.KeyName,
-            SubnetID: *instance.SubnetId,
-            VpcID: *instance.VpcId,
-            SecurityGroupsIds: sgIDs,
-            Tags: tags,
-        })
+        input.NextToken = result.NextToken
     }
 
     if len(pipelineInfo.OldInstances) < 1 {
         return errors.New("Not found any running instance")
     }
 
-    return nil
+    return describeLaunchConfig(act.Svc, pipelineInfo.OldInstances)
 }
 
 // Rollback is an action to apply changes in the ListInstancesAction step
-func (act ListInstancesAction) Rollback(pipelineInfo *PipelineInfo) error {
+func (act ListInstancesAction) Rollback(ctx context.Context, pipelineInfo *PipelineInfo) error {
     return nil
 }
 
 // Commit is an action to apply changes in the RunInstancesAction step
-func (act RunInstancesAction) Commit(pipelineInfo *PipelineInfo) error {
+func (act RunInstancesAction) Commit(ctx context.Context, pipelineInfo *PipelineInfo) error {
+    for _, item := range pipelineInfo.OldInstances {
+        // Auto Scaling Group would replace terminated old instances with the old AMI again
+        if groupName, ok := item.Tags[autoScalingGroupTag]; ok {
+            return fmt.Errorf("Instance %s belongs to Auto Scaling Group %s. Use the Auto Scaling Group mode", item.ID, groupName)
+        }
+    }
+
     for _, item := range pipelineInfo.OldInstances {
         oldTags := item.Tags
         newTags := []*ec2.Tag{}
@@ -217,7 +321,6 @@ func (act RunInstancesAction) Commit(pipelineInfo *PipelineInfo) error {
         input := &ec2.RunInstancesInput{
             ImageId:      aws.String(pipelineInfo.Input.NewAMI),
             InstanceType: aws.String(item.InstanceType),
-            KeyName:      aws.String(item.KeyName),
             MaxCount:     aws.Int64(1),
             MinCount:     aws.Int64(1),
             NetworkInterfaces: []*ec2.InstanceNetworkInterfaceSpecification{
@@ -236,6 +339,12 @@ func (act RunInstancesAction) Commit(pipelineInfo *PipelineInfo) error {
             },
         }
 
+        if act.PrivateNetwork {
+            input.NetworkInterfaces[0].AssociatePublicIpAddress = nil
+        }
+
+        applyLaunchConfig(input, item)
+
         result, err := act.Svc.RunInstances(input)
         if err != nil {
             return err
@@ -248,7 +357,12 @@ func (act RunInstancesAction) Commit(pipelineInfo *PipelineInfo) error {
 }
 
 // Rollback is an action to apply changes in the RunInstancesAction step
-func (act RunInstancesAction) Rollback(pipelineInfo *PipelineInfo) error {
+func (act RunInstancesAction) Rollback(ctx context.Context, pipelineInfo *PipelineInfo) error {
+    // Only instances recorded after successful launches are terminated
+    if len(pipelineInfo.NewInstancesIds) < 1 {
+        return nil
+    }
+
     input := &ec2.TerminateInstancesInput{
         InstanceIds: pipelineInfo.NewInstancesIds,
     }
@@ -261,14 +375,25 @@ func (act RunInstancesAction) Rollback(pipelineInfo *PipelineInfo) error {
     return nil
 }
 
+// Leftovers describes instances launched by the deployment
+func (act RunInstancesAction) Leftovers(pipelineInfo *PipelineInfo) []string {
+    leftovers := []string{}
+
+    for _, instanceID := range pipelineInfo.NewInstancesIds {
+        leftovers = append(leftovers, "EC2 instance "+*instanceID+" launched by the deployment")
+    }
+
+    return leftovers
+}
+
 // Commit is an action to apply changes in the WaitUntilStatusOkAction step
-func (act WaitUntilStatusOkAction) Commit(pipelineInfo *PipelineInfo) error {
+func (act WaitUntilStatusOkAction) Commit(ctx context.Context, pipelineInfo *PipelineInfo) error {
 
     input := &ec2.DescribeInstancesInput{
         InstanceIds: pipelineInfo.NewInstancesIds,
 	}
 
-    err := act.Svc.WaitUntilInstanceRunning(input)
+    err := act.Svc.WaitUntilInstanceRunningWithContext(ctx, input, waiterTimeout(act.Timeout))
 
     if err != nil {
         return err
@@ -278,47 +403,87 @@ func (act WaitUntilStatusOkAction) Commit(pipelineInfo *PipelineInfo) error {
 }
 
 // Rollback is an action to apply changes in the WaitUntilStatusOkAction step
-func (act WaitUntilStatusOkAction) Rollback(pipelineInfo *PipelineInfo) error {
+func (act WaitUntilStatusOkAction) Rollback(ctx context.Context, pipelineInfo *PipelineInfo) error {
     return nil
 }
 
 // Commit is an action to apply changes in the AuthorizeSecurityGroupsAction step
-func (act AuthorizeSecurityGroupsAction) Commit(pipelineInfo *PipelineInfo) error {
+func (act AuthorizeSecurityGroupsAction) Commit(ctx context.Context, pipelineInfo *PipelineInfo) error {
+    // Only the public IP health check needs the address of this machine
+    if pipelineInfo.ClientIP == "" {
+        clientIP, err := getClientIP()
+
+        if err != nil {
+            return err
+        }
+
+        pipelineInfo.ClientIP = clientIP
+    }
 
     for _, instance := range pipelineInfo.OldInstances {
         if len(instance.SecurityGroupsIds) < 1 {
             return errors.New("Instance must have Security Group")
         }
 
-        isIPAuthorizedStatus, err := isIPAuthorized(act.Svc, *instance.SecurityGroupsIds[0], 80, pipelineInfo.ClientIP)
+        sgID := *instance.SecurityGroupsIds[0]
+        isIPAuthorizedStatus, err := isIPAuthorized(act.Svc, sgID, act.Port, pipelineInfo.ClientIP)
         if err != nil {
-            return errors.New("Cannot describe security group")
+            return fmt.Errorf("Cannot describe security group %s: %s", sgID, err.Error())
         }
 
         if !isIPAuthorizedStatus {
-            authorizeIP(act.Svc, *instance.SecurityGroupsIds[0], 80, pipelineInfo.ClientIP)
-            pipelineInfo.ModifiedSecurityGroups = append(pipelineInfo.ModifiedSecurityGroups, instance.SecurityGroupsIds[0])
+            if err := authorizeIP(act.Svc, sgID, act.Port, pipelineInfo.ClientIP); err != nil {
+                return fmt.Errorf("Cannot authorize access to security group %s: %s", sgID, err.Error())
+            }
+
+            pipelineInfo.ModifiedSecurityGroups = append(pipelineInfo.ModifiedSecurityGroups, SecurityGroupRule{sgID, act.Port})
         }
     }
 
     return nil
 }
 
-// Rollback is an action to apply changes in the AuthorizeSecurityGroupsAction step
-func (act AuthorizeSecurityGroupsAction) Rollback(pipelineInfo *PipelineInfo) error {
-    for _, sgID := range pipelineInfo.ModifiedSecurityGroups {
-        err := revokeIP(act.Svc, *sgID, 80, pipelineInfo.ClientIP)
+// Rollback is an action to apply changes in the AuthorizeSecurityGroupsAction step.
+// Only rules of the port of the step are revoked. Revoked rules are removed from the pipeline info,
+// so only the remaining rules are reported as leftovers.
+func (act AuthorizeSecurityGroupsAction) Rollback(ctx context.Context, pipelineInfo *PipelineInfo) error {
+    remaining := []SecurityGroupRule{}
+    var lastErr error
+
+    for _, rule := range pipelineInfo.ModifiedSecurityGroups {
+        if rule.Port != act.Port {
+            remaining = append(remaining, rule)
+            continue
+        }
+
+        err := revokeIP(act.Svc, rule.GroupID, rule.Port, pipelineInfo.ClientIP)
 
         if err != nil {
-            return errors.New("Cannot describe security group")
+            remaining = append(remaining, rule)
+            lastErr = fmt.Errorf("Cannot revoke access to security group %s: %s", rule.GroupID, err.Error())
         }
     }
 
-    return nil
+    pipelineInfo.ModifiedSecurityGroups = remaining
+
+    return lastErr
+}
+
+// Leftovers describes security group rules which were not revoked
+func (act AuthorizeSecurityGroupsAction) Leftovers(pipelineInfo *PipelineInfo) []string {
+    leftovers := []string{}
+
+    for _, rule := range pipelineInfo.ModifiedSecurityGroups {
+        if rule.Port == act.Port {
+            leftovers = append(leftovers, fmt.Sprintf("Security group %s rule tcp/%d from %s/32", rule.GroupID, rule.Port, pipelineInfo.ClientIP))
+        }
+    }
+
+    return leftovers
 }
 
 // Commit is an action to apply changes in the CollectPublicIpsAction step
-func (act CollectPublicIpsAction) Commit(pipelineInfo *PipelineInfo) error {
+func (act CollectPublicIpsAction) Commit(ctx context.Context, pipelineInfo *PipelineInfo) error {
 
     input := &ec2.DescribeInstancesInput{
         InstanceIds: pipelineInfo.NewInstancesIds,
@@ -332,89 +497,120 @@ func (act CollectPublicIpsAction) Commit(pipelineInfo *PipelineInfo) error {
         },
     }
 
-    result, err := act.Svc.DescribeInstances(input)
-    if err != nil {
-        return err
-    }
+    for {
+        result, err := act.Svc.DescribeInstances(input)
+        if err != nil {
+            return err
+        }
+
+        for _, item := range result.Reservations {
+            for _, instance := range item.Instances {
+                ip := instance.PublicIpAddress
+                if act.PrivateIP {
+                    ip = instance.PrivateIpAddress
+                }
+
+                if aws.StringValue(ip) == "" && act.PrivateIP {
+                    return errors.New("To perform deployment instance must have private IP")
+                }
 
-    for _, item := range result.Reservations {
-        instance := item.Instances[0]
+                if aws.StringValue(ip) == "" {
+                    return errors.New("To perform deployment instance must have public IP")
+                }
 
-        if *instance.PublicIpAddress == "" {
-            return errors.New("To perform deployment instance must have public IP")
+                pipelineInfo.NewInstancesIps = append(pipelineInfo.NewInstancesIps, *ip)
+            }
         }
 
-        pipelineInfo.NewInstancesIps = append(pipelineInfo.NewInstancesIps, *instance.PublicIpAddress)
-	}
+        if aws.StringValue(result.NextToken) == "" {
+            break
+        }
 
-	return nil
+        input.NextToken = result.NextToken
+    }
+
+    return nil
 }
 
 // Rollback is an action to apply changes in the CollectPublicIpsAction step
-func (act CollectPublicIpsAction) Rollback(pipelineInfo *PipelineInfo) error {
+func (act CollectPublicIpsAction) Rollback(ctx context.Context, pipelineInfo *PipelineInfo) error {
 	return nil
 }
 
 // Commit is an action to apply changes in the TestInstancesAction step
-func (act TestInstancesAction) Commit(pipelineInfo *PipelineInfo) error {
-    for _, ip := range pipelineInfo.NewInstancesIps {
-        isValid, err := isValidRequest("http://"+ip, 10)
+func (act TestInstancesAction) Commit(ctx context.Context, pipelineInfo *PipelineInfo) error {
+    err := checkInstances(ctx, act.HealthCheck.healthChecks(), pipelineInfo.NewInstancesIps, act.HealthCheck)
+    if err != nil {
+        return errors.New("Application is down. " + err.Error())
+    }
 
-        if err != nil {
-            return errors.New("Application is down")
-        }
+    if act.SmokeTests.File == "" {
+        return nil
+    }
+
+    suite, err := loadSmokeSuite(act.SmokeTests.File)
+    if err != nil {
+        return err
+    }
+
+    results := suite.run(ctx, pipelineInfo.NewInstancesIps, act.HealthCheck)
 
-        if !isValid {
-            return errors.New("Application is down")
+    if act.SmokeTests.Report != "" {
+        if err := writeJUnitReport(act.SmokeTests.Report, pipelineInfo.Version, results); err != nil {
+            return err
         }
-	}
+    }
 
-	return nil
+    return smokeFailure(results)
 }
 
 // Rollback is an action to apply changes in the TestInstancesAction step
-func (act TestInstancesAction) Rollback(pipelineInfo *PipelineInfo) error {
+func (act TestInstancesAction) Rollback(ctx context.Context, pipelineInfo *PipelineInfo) error {
 	return nil
 }
 
 // Commit is an action to apply changes in the FindLoadBalancerAction step
-func (act FindLoadBalancerAction) Commit(pipelineInfo *PipelineInfo) error {
+func (act FindLoadBalancerAction) Commit(ctx context.Context, pipelineInfo *PipelineInfo) error {
     input := &elbv2.DescribeTargetGroupsInput{
         PageSize: aws.Int64(400),
     }
 
-    res, err := act.Svc.DescribeTargetGroups(input)
-
-    if err != nil {
-        return err
-    }
-
-    for _, tg := range res.TargetGroups {
-        status, err := findInstancesInTargetGroup(act.Svc, *tg.TargetGroupArn, pipelineInfo.OldInstancesIds)
+    for {
+        res, err := act.Svc.DescribeTargetGroups(input)
 
         if err != nil {
             return err
         }
-        if status == true {
-            pipelineInfo.TargetGroupsArns = append(pipelineInfo.TargetGroupsArns, tg.TargetGroupArn)
+
+        for _, tg := range res.TargetGroups {
+            status, err := findInstancesInTargetGroup(act.Svc, *tg.TargetGroupArn, pipelineInfo.OldInstancesIds)
+
+            if err != nil {
+                return err
+            }
+            if status == true {
+                pipelineInfo.TargetGroupsArns = append(pipelineInfo.TargetGroupsArns, tg.TargetGroupArn)
+            }
         }
-	}
 
-	return nil
+        if aws.StringValue(res.NextMarker) == "" {
+            break
+        }
+
+        input.Marker = res.NextMarker
+    }
+
+    return nil
 }
 
 // Rollback is an action to apply changes in the FindLoadBalancerAction step
-func (act FindLoadBalancerAction) Rollback(pipelineInfo *PipelineInfo) error {
+func (act FindLoadBalancerAction) Rollback(ctx context.Context, pipelineInfo *PipelineInfo) error {
 	return nil
 }
 
 // Commit is an action to apply changes in the RegisterNewInstancesAction step
-func (act RegisterNewInstancesAction) Commit(pipelineInfo *PipelineInfo) error {
-    targets := []*elbv2.TargetDescription{}
-
-    for _, instanceID := range pipelineInfo.NewInstancesIds {
-        targets = append(targets, &elbv2.TargetDescription{Id: instanceID})
-    }
+func (act RegisterNewInstancesAction) Commit(ctx context.Context, pipelineInfo *PipelineInfo) error {
+    targets := newTargetDescriptions(pipelineInfo.NewInstancesIds)
 
     for _, tgArn := range pipelineInfo.TargetGroupsArns {
         input := &elbv2.RegisterTargetsInput{
@@ -427,22 +623,21 @@ func (act RegisterNewInstancesAction) Commit(pipelineInfo *PipelineInfo) error {
         if err != nil {
             return err
         }
+
+        pipelineInfo.RegisteredTargetGroups = append(pipelineInfo.RegisteredTargetGroups, tgArn)
 	}
 
 	return nil
 }
 
-// Rollback is an action to apply changes in the RegisterNewInstancesAction step
-func (act RegisterNewInstancesAction) Rollback(pipelineInfo *PipelineInfo) error {
-    targets := []*elbv2.TargetDescription{}
+// Rollback is an action to apply changes in the RegisterNewInstancesAction step.
+// New instances are deregistered only from target groups recorded by the Commit.
+func (act RegisterNewInstancesAction) Rollback(ctx context.Context, pipelineInfo *PipelineInfo) error {
+    targets := newTargetDescriptions(pipelineInfo.NewInstancesIds)
 
-    for _, instanceID := range pipelineInfo.NewInstancesIds {
-        targets = append(targets, &elbv2.TargetDescription{Id: instanceID})
-    }
-
-    for _, tgArn := range pipelineInfo.TargetGroupsArns {
+    for len(pipelineInfo.RegisteredTargetGroups) > 0 {
         input := &elbv2.DeregisterTargetsInput{
-            TargetGroupArn: tgArn,
+            TargetGroupArn: pipelineInfo.RegisteredTargetGroups[0],
             Targets: targets,
         }
 
@@ -451,18 +646,21 @@ func (act RegisterNewInstancesAction) Rollback(pipelineInfo *PipelineInfo) error
         if err != nil {
             return err
         }
+
+        pipelineInfo.RegisteredTargetGroups = pipelineInfo.RegisteredTargetGroups[1:]
 	}
 
 	return nil
 }
 
-// Commit is an action to apply changes in the DeregisterOldInstancesAction step
-func (act DeregisterOldInstancesAction) Commit(pipelineInfo *PipelineInfo) error {
-    targets := []*elbv2.TargetDescription{}
+// Leftovers describes new instances registered in target groups
+func (act RegisterNewInstancesAction) Leftovers(pipelineInfo *PipelineInfo) []string {
+    return targetLeftovers("registered in", pipelineInfo.NewInstancesIds, pipelineInfo.RegisteredTargetGroups)
+}
 
-    for _, instanceID := range pipelineInfo.OldInstancesIds {
-        targets = append(targets, &elbv2.TargetDescription{Id: instanceID})
-    }
+// Commit is an action to apply changes in the DeregisterOldInstancesAction step
+func (act DeregisterOldInstancesAction) Commit(ctx context.Context, pipelineInfo *PipelineInfo) error {
+    targets := newTargetDescriptions(pipelineInfo.OldInstancesIds)
 
     for _, tgArn := range pipelineInfo.TargetGroupsArns {
         input := &elbv2.DeregisterTargetsInput{
@@ -475,22 +673,21 @@ func (act DeregisterOldInstancesAction) Commit(pipelineInfo *PipelineInfo) error
         if err != nil {
             return err
         }
+
+        pipelineInfo.DeregisteredTargetGroups = append(pipelineInfo.DeregisteredTargetGroups, tgArn)
 	}
 
 	return nil
 }
 
-// Rollback is an action to apply changes in the DeregisterOldInstancesAction step
-func (act DeregisterOldInstancesAction) Rollback(pipelineInfo *PipelineInfo) error {
-    targets := []*elbv2.TargetDescription{}
+// Rollback is an action to apply changes in the DeregisterOldInstancesAction step.
+// Old instances are registered back only in target groups recorded by the Commit.
+func (act DeregisterOldInstancesAction) Rollback(ctx context.Context, pipelineInfo *PipelineInfo) error {
+    targets := newTargetDescriptions(pipelineInfo.OldInstancesIds)
 
-    for _, instanceID := range pipelineInfo.OldInstancesIds {
-        targets = append(targets, &elbv2.TargetDescription{Id: instanceID})
-    }
-
-    for _, tgArn := range pipelineInfo.TargetGroupsArns {
+    for len(pipelineInfo.DeregisteredTargetGroups) > 0 {
         input := &elbv2.RegisterTargetsInput{
-            TargetGroupArn: tgArn,
+            TargetGroupArn: pipelineInfo.DeregisteredTargetGroups[0],
             Targets: targets,
         }
 
@@ -499,26 +696,45 @@ func (act DeregisterOldInstancesAction) Rollback(pipelineInfo *PipelineInfo) err
         if err != nil {
             return err
         }
+
+        pipelineInfo.DeregisteredTargetGroups = pipelineInfo.DeregisteredTargetGroups[1:]
 	}
 
 	return nil
 }
 
-// Commit is an action to apply changes in the WaitForDeregisterAction step
-func (act WaitForDeregisterAction) Commit(pipelineInfo *PipelineInfo) error {
-    targets := []*elbv2.TargetDescription{}
+// Leftovers describes old instances missing in target groups
+func (act DeregisterOldInstancesAction) Leftovers(pipelineInfo *PipelineInfo) []string {
+    return targetLeftovers("deregistered from", pipelineInfo.OldInstancesIds, pipelineInfo.DeregisteredTargetGroups)
+}
 
-    for _, instanceID := range pipelineInfo.OldInstancesIds {
-        targets = append(targets, &elbv2.TargetDescription{Id: instanceID})
+// targetLeftovers describes targets of every target group
+func targetLeftovers(change string, instancesIds []*string, tgArns []*string) []string {
+    leftovers := []string{}
+
+    for _, tgArn := range tgArns {
+        for _, instanceID := range instancesIds {
+            leftovers = append(leftovers, fmt.Sprintf("Target %s %s target group %s", *instanceID, change, *tgArn))
+        }
     }
 
-    for _, tgArn := range pipelineInfo.TargetGroupsArns {
+    return leftovers
+}
+
+// Commit is an action to apply changes in the WaitForDeregisterAction step
+func (act WaitForDeregisterAction) Commit(ctx context.Context, pipelineInfo *PipelineInfo) error {
+    return act.waitDeregistered(ctx, pipelineInfo.TargetGroupsArns, pipelineInfo.OldInstancesIds)
+}
+
+// waitDeregistered waits until the instances are drained and deregistered from the target groups
+func (act WaitForDeregisterAction) waitDeregistered(ctx context.Context, tgArns []*string, instancesIds []*string) error {
+    for _, tgArn := range tgArns {
         input := &elbv2.DescribeTargetHealthInput{
             TargetGroupArn: tgArn,
-            Targets: targets,
+            Targets: newTargetDescriptions(instancesIds),
         }
 
-        err := act.Svc.WaitUntilTargetDeregistered(input)
+        err := act.Svc.WaitUntilTargetDeregisteredWithContext(ctx, input, waiterTimeout(act.Timeout))
 
         if err != nil {
             return err
@@ -529,12 +745,12 @@ func (act WaitForDeregisterAction) Commit(pipelineInfo *PipelineInfo) error {
 }
 
 // Rollback is an action to apply changes in the WaitForDeregisterAction step
-func (act WaitForDeregisterAction) Rollback(pipelineInfo *PipelineInfo) error {
+func (act WaitForDeregisterAction) Rollback(ctx context.Context, pipelineInfo *PipelineInfo) error {
     return nil
 }
 
 // Commit is an action to apply changes in the TerminateOldInstancesAction step
-func (act TerminateOldInstancesAction) Commit(pipelineInfo *PipelineInfo) error {
+func (act TerminateOldInstancesAction) Commit(ctx context.Context, pipelineInfo *PipelineInfo) error {
     input := &ec2.TerminateInstancesInput{InstanceIds: pipelineInfo.OldInstancesIds}
 
     _, err := act.Svc.TerminateInstances(input)
@@ -547,7 +763,7 @@ func (act TerminateOldInstancesAction) Commit(pipelineInfo *PipelineInfo) error
 }
 
 // Rollback is an action to apply changes in the TerminateOldInstancesAction step
-func (act TerminateOldInstancesAction) Rollback(pipelineInfo *PipelineInfo) error {
+func (act TerminateOldInstancesAction) Rollback(ctx context.Context, pipelineInfo *PipelineInfo) error {
     return nil
 }
 
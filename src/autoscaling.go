@@ -0,0 +1,480 @@
+package main
+
+import (
+    "github.com/aws/aws-sdk-go/aws"
+    "github.com/aws/aws-sdk-go/aws/awserr"
+    "github.com/aws/aws-sdk-go/service/autoscaling"
+    "github.com/aws/aws-sdk-go/service/autoscaling/autoscalingiface"
+    "github.com/aws/aws-sdk-go/service/ec2"
+    "github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+
+    "context"
+    "errors"
+    "fmt"
+    "sort"
+    "strconv"
+    "time"
+)
+
+// autoScalingGroupTag is added by AWS to every instance launched by the Auto Scaling Group
+const autoScalingGroupTag = "aws:autoscaling:groupName"
+
+// AutoScalingGroupState keeps the launch template versions of the Auto Scaling Group updated by the deployment
+type AutoScalingGroupState struct {
+    Name string
+    LaunchTemplateID string
+    PreviousVersion string
+    // PreviousVersionNumber is the number of the previous version. $Latest points to the new version until
+    // it is deleted, so the rollback restores the number first and the symbolic version after the deletion.
+    PreviousVersionNumber string `json:",omitempty"`
+    NewVersion string
+    InstanceRefreshID string
+    // RollbackRefreshID is the instance refresh started by the rollback. Interrupted rollback waits for it
+    // instead of cancelling it and starting another one.
+    RollbackRefreshID string `json:",omitempty"`
+    // Updated is set when the group uses the new launch template version
+    Updated bool `json:",omitempty"`
+    // Pinned is set when the group uses the number of the previous version instead of the symbolic one
+    Pinned bool `json:",omitempty"`
+}
+
+// rollbackVersion is the launch template version set by rollbacks while the new version exists
+func (g AutoScalingGroupState) rollbackVersion() string {
+    if g.PreviousVersionNumber != "" {
+        return g.PreviousVersionNumber
+    }
+
+    return g.PreviousVersion
+}
+
+// restorePrevious sets the previous launch template version of the group by its number
+func restorePrevious(svc autoscalingiface.AutoScalingAPI, pipelineInfo *PipelineInfo, idx int) error {
+    group := pipelineInfo.AutoScalingGroups[idx]
+    if err := setLaunchTemplateVersion(svc, group, group.rollbackVersion()); err != nil {
+        return err
+    }
+
+    pipelineInfo.AutoScalingGroups[idx].Updated = false
+    pipelineInfo.AutoScalingGroups[idx].Pinned = group.rollbackVersion() != group.PreviousVersion
+
+    return nil
+}
+
+// FindAutoScalingGroupsAction is a pipeline step struct
+type FindAutoScalingGroupsAction struct {
+    Svc autoscalingiface.AutoScalingAPI
+}
+
+// CreateLaunchTemplateVersionsAction is a pipeline step struct
+type CreateLaunchTemplateVersionsAction struct {
+    Svc ec2iface.EC2API
+}
+
+// UpdateAutoScalingGroupsAction is a pipeline step struct
+type UpdateAutoScalingGroupsAction struct {
+    Svc autoscalingiface.AutoScalingAPI
+}
+
+// InstanceRefreshAction is a pipeline step struct. It replaces instances of the Auto Scaling Groups
+// with the instance refresh and waits until it is finished.
+type InstanceRefreshAction struct {
+    Svc autoscalingiface.AutoScalingAPI
+    MinHealthyPercentage int64
+    Interval time.Duration
+    Checkpoint func()
+}
+
+// Commit is an action to apply changes in the FindAutoScalingGroupsAction step
+func (act FindAutoScalingGroupsAction) Commit(ctx context.Context, pipelineInfo *PipelineInfo) error {
+    names := map[string]bool{}
+
+    for _, instance := range pipelineInfo.OldInstances {
+        name, ok := instance.Tags[autoScalingGroupTag]
+        if !ok {
+            return fmt.Errorf("Instance %s does not belong to any Auto Scaling Group", instance.ID)
+        }
+
+        names[name] = true
+    }
+
+    input := &autoscaling.DescribeAutoScalingGroupsInput{}
+    for name := range names {
+        input.AutoScalingGroupNames = append(input.AutoScalingGroupNames, aws.String(name))
+    }
+
+    res, err := act.Svc.DescribeAutoScalingGroups(input)
+    if err != nil {
+        return err
+    }
+
+    for _, group := range res.AutoScalingGroups {
+        if group.LaunchTemplate == nil || group.LaunchTemplate.LaunchTemplateId == nil {
+            return fmt.Errorf("Auto Scaling Group %s does not use a launch template", *group.AutoScalingGroupName)
+        }
+
+        // Group without the version uses the default version of the launch template
+        version := aws.StringValue(group.LaunchTemplate.Version)
+        if version == "" {
+            version = "$Default"
+        }
+
+        pipelineInfo.AutoScalingGroups = append(pipelineInfo.AutoScalingGroups, AutoScalingGroupState{
+            Name: *group.AutoScalingGroupName,
+            LaunchTemplateID: *group.LaunchTemplate.LaunchTemplateId,
+            PreviousVersion: version,
+        })
+    }
+
+    if len(pipelineInfo.AutoScalingGroups) != len(names) {
+        return errors.New("Not found all Auto Scaling Groups of old instances")
+    }
+
+    sort.Slice(pipelineInfo.AutoScalingGroups, func(i, j int) bool {
+        return pipelineInfo.AutoScalingGroups[i].Name < pipelineInfo.AutoScalingGroups[j].Name
+    })
+
+    return nil
+}
+
+// Rollback is an action to apply changes in the FindAutoScalingGroupsAction step.
+// Groups pinned to the number of the previous version get the symbolic version back once the new version is deleted.
+func (act FindAutoScalingGroupsAction) Rollback(ctx context.Context, pipelineInfo *PipelineInfo) error {
+    var lastErr error
+
+    for idx, group := range pipelineInfo.AutoScalingGroups {
+        if !group.Pinned {
+            continue
+        }
+
+        if group.NewVersion != "" {
+            lastErr = fmt.Errorf("Cannot restore version %s of Auto Scaling Group %s: version %s of launch template %s is not deleted",
+                group.PreviousVersion, group.Name, group.NewVersion, group.LaunchTemplateID)
+            continue
+        }
+
+        if err := setLaunchTemplateVersion(act.Svc, group, group.PreviousVersion); err != nil {
+            lastErr = err
+            continue
+        }
+
+        pipelineInfo.AutoScalingGroups[idx].Pinned = false
+    }
+
+    return lastErr
+}
+
+// Leftovers describes Auto Scaling Groups which use the number of the previous version instead of the symbolic one
+func (act FindAutoScalingGroupsAction) Leftovers(pipelineInfo *PipelineInfo) []string {
+    leftovers := []string{}
+
+    for _, group := range pipelineInfo.AutoScalingGroups {
+        if group.Pinned {
+            leftovers = append(leftovers, fmt.Sprintf("Auto Scaling Group %s uses version %s of launch template %s instead of %s",
+                group.Name, group.PreviousVersionNumber, group.LaunchTemplateID, group.PreviousVersion))
+        }
+    }
+
+    return leftovers
+}
+
+// Commit is an action to apply changes in the CreateLaunchTemplateVersionsAction step
+func (act CreateLaunchTemplateVersionsAction) Commit(ctx context.Context, pipelineInfo *PipelineInfo) error {
+    // Groups sharing the launch template get the same new version
+    newVersions := map[string]string{}
+
+    for idx, group := range pipelineInfo.AutoScalingGroups {
+        versions, err := act.Svc.DescribeLaunchTemplateVersions(&ec2.DescribeLaunchTemplateVersionsInput{
+            LaunchTemplateId: aws.String(group.LaunchTemplateID),
+            Versions: []*string{aws.String(group.PreviousVersion)},
+        })
+        if err != nil {
+            return err
+        }
+
+        if len(versions.LaunchTemplateVersions) < 1 {
+            return fmt.Errorf("Not found version %s of launch template %s", group.PreviousVersion, group.LaunchTemplateID)
+        }
+
+        previous := strconv.FormatInt(*versions.LaunchTemplateVersions[0].VersionNumber, 10)
+        pipelineInfo.AutoScalingGroups[idx].PreviousVersionNumber = previous
+
+        if version, ok := newVersions[group.LaunchTemplateID]; ok {
+            pipelineInfo.AutoScalingGroups[idx].NewVersion = version
+            continue
+        }
+
+        res, err := act.Svc.CreateLaunchTemplateVersion(&ec2.CreateLaunchTemplateVersionInput{
+            LaunchTemplateId: aws.String(group.LaunchTemplateID),
+            SourceVersion: aws.String(previous),
+            VersionDescription: aws.String("deploy-hat " + pipelineInfo.Version),
+            LaunchTemplateData: &ec2.RequestLaunchTemplateData{
+                ImageId: aws.String(pipelineInfo.Input.NewAMI),
+            },
+        })
+        if err != nil {
+            return err
+        }
+
+        version := strconv.FormatInt(*res.LaunchTemplateVersion.VersionNumber, 10)
+        newVersions[group.LaunchTemplateID] = version
+        pipelineInfo.AutoScalingGroups[idx].NewVersion = version
+    }
+
+    return nil
+}
+
+// Rollback is an action to apply changes in the CreateLaunchTemplateVersionsAction step
+func (act CreateLaunchTemplateVersionsAction) Rollback(ctx context.Context, pipelineInfo *PipelineInfo) error {
+    deleted := map[string]bool{}
+
+    for idx, group := range pipelineInfo.AutoScalingGroups {
+        if group.NewVersion == "" {
+            continue
+        }
+
+        if !deleted[group.LaunchTemplateID] {
+            _, err := act.Svc.DeleteLaunchTemplateVersions(&ec2.DeleteLaunchTemplateVersionsInput{
+                LaunchTemplateId: aws.String(group.LaunchTemplateID),
+                Versions: []*string{aws.String(group.NewVersion)},
+            })
+
+            if err != nil {
+                return err
+            }
+
+            deleted[group.LaunchTemplateID] = true
+        }
+
+        pipelineInfo.AutoScalingGroups[idx].NewVersion = ""
+    }
+
+    return nil
+}
+
+// Leftovers describes launch template versions created by the deployment
+func (act CreateLaunchTemplateVersionsAction) Leftovers(pipelineInfo *PipelineInfo) []string {
+    leftovers := []string{}
+    seen := map[string]bool{}
+
+    for _, group := range pipelineInfo.AutoScalingGroups {
+        if group.NewVersion == "" || seen[group.LaunchTemplateID] {
+            continue
+        }
+
+        seen[group.LaunchTemplateID] = true
+        leftovers = append(leftovers, fmt.Sprintf("Launch template %s version %s", group.LaunchTemplateID, group.NewVersion))
+    }
+
+    return leftovers
+}
+
+func setLaunchTemplateVersion(svc autoscalingiface.AutoScalingAPI, group AutoScalingGroupState, version string) error {
+    _, err := svc.UpdateAutoScalingGroup(&autoscaling.UpdateAutoScalingGroupInput{
+        AutoScalingGroupName: aws.String(group.Name),
+        LaunchTemplate: &autoscaling.LaunchTemplateSpecification{
+            LaunchTemplateId: aws.String(group.LaunchTemplateID),
+            Version: aws.String(version),
+        },
+    })
+
+    return err
+}
+
+// Commit is an action to apply changes in the UpdateAutoScalingGroupsAction step
+func (act UpdateAutoScalingGroupsAction) Commit(ctx context.Context, pipelineInfo *PipelineInfo) error {
+    for idx, group := range pipelineInfo.AutoScalingGroups {
+        if err := setLaunchTemplateVersion(act.Svc, group, group.NewVersion); err != nil {
+            return err
+        }
+
+        pipelineInfo.AutoScalingGroups[idx].Updated = true
+    }
+
+    return nil
+}
+
+// Rollback is an action to apply changes in the UpdateAutoScalingGroupsAction step.
+// Only groups recorded as updated get the previous version back.
+func (act UpdateAutoScalingGroupsAction) Rollback(ctx context.Context, pipelineInfo *PipelineInfo) error {
+    for idx, group := range pipelineInfo.AutoScalingGroups {
+        if !group.Updated {
+            continue
+        }
+
+        if err := restorePrevious(act.Svc, pipelineInfo, idx); err != nil {
+            return err
+        }
+    }
+
+    return nil
+}
+
+// Leftovers describes Auto Scaling Groups which still use the new launch template version
+func (act UpdateAutoScalingGroupsAction) Leftovers(pipelineInfo *PipelineInfo) []string {
+    leftovers := []string{}
+
+    for _, group := range pipelineInfo.AutoScalingGroups {
+        if !group.Updated {
+            continue
+        }
+
+        leftovers = append(leftovers, fmt.Sprintf("Auto Scaling Group %s uses version %s of launch template %s instead of %s",
+            group.Name, group.NewVersion, group.LaunchTemplateID, group.rollbackVersion()))
+    }
+
+    return leftovers
+}
+
+func (act InstanceRefreshAction) start(group AutoScalingGroupState) (string, error) {
+    res, err := act.Svc.StartInstanceRefresh(&autoscaling.StartInstanceRefreshInput{
+        AutoScalingGroupName: aws.String(group.Name),
+        Preferences: &autoscaling.RefreshPreferences{
+            MinHealthyPercentage: aws.Int64(act.MinHealthyPercentage),
+        },
+    })
+    if err != nil {
+        return "", err
+    }
+
+    return *res.InstanceRefreshId, nil
+}
+
+// wait polls the instance refresh until it reaches one of the final statuses
+func (act InstanceRefreshAction) wait(ctx context.Context, group AutoScalingGroupState, refreshID string) (*autoscaling.InstanceRefresh, error) {
+    for {
+        res, err := act.Svc.DescribeInstanceRefreshes(&autoscaling.DescribeInstanceRefreshesInput{
+            AutoScalingGroupName: aws.String(group.Name),
+            InstanceRefreshIds: []*string{aws.String(refreshID)},
+        })
+        if err != nil {
+            return nil, err
+        }
+
+        if len(res.InstanceRefreshes) < 1 {
+            return nil, fmt.Errorf("Not found instance refresh %s of %s", refreshID, group.Name)
+        }
+
+        refresh := res.InstanceRefreshes[0]
+        switch *refresh.Status {
+        case autoscaling.InstanceRefreshStatusSuccessful, autoscaling.InstanceRefreshStatusFailed, autoscaling.InstanceRefreshStatusCancelled:
+            return refresh, nil
+        }
+
+        logger.Info("Instance refresh in progress", Fields{
+            "action": actionName(act),
+            "group": group.Name,
+            "percent_complete": aws.Int64Value(refresh.PercentageComplete),
+        })
+        if err := sleep(ctx, act.Interval); err != nil {
+            return nil, err
+        }
+    }
+}
+
+func (act InstanceRefreshAction) refresh(ctx context.Context, group AutoScalingGroupState, refreshID string) error {
+    refresh, err := act.wait(ctx, group, refreshID)
+    if err != nil {
+        return err
+    }
+
+    if *refresh.Status != autoscaling.InstanceRefreshStatusSuccessful {
+        return fmt.Errorf("Instance refresh of %s is %s: %s", group.Name, *refresh.Status, aws.StringValue(refresh.StatusReason))
+    }
+
+    return nil
+}
+
+// Commit is an action to apply changes in the InstanceRefreshAction step
+func (act InstanceRefreshAction) Commit(ctx context.Context, pipelineInfo *PipelineInfo) error {
+    for idx, group := range pipelineInfo.AutoScalingGroups {
+        refreshID, err := act.start(group)
+        if err != nil {
+            return err
+        }
+
+        pipelineInfo.AutoScalingGroups[idx].InstanceRefreshID = refreshID
+        act.checkpoint()
+
+        if err := act.refresh(ctx, group, refreshID); err != nil {
+            return err
+        }
+    }
+
+    return nil
+}
+
+// checkpoint saves IDs of started instance refreshes, which outlive the process
+func (act InstanceRefreshAction) checkpoint() {
+    if act.Checkpoint != nil {
+        act.Checkpoint()
+    }
+}
+
+// Rollback is an action to apply changes in the InstanceRefreshAction step.
+// Instances already replaced are refreshed again with the previous launch template version.
+func (act InstanceRefreshAction) Rollback(ctx context.Context, pipelineInfo *PipelineInfo) error {
+    for idx, group := range pipelineInfo.AutoScalingGroups {
+        if group.InstanceRefreshID == "" {
+            continue
+        }
+
+        if group.RollbackRefreshID == "" {
+            _, err := act.Svc.CancelInstanceRefresh(&autoscaling.CancelInstanceRefreshInput{
+                AutoScalingGroupName: aws.String(group.Name),
+            })
+
+            if aerr, ok := err.(awserr.Error); err != nil && !(ok && aerr.Code() == autoscaling.ErrCodeActiveInstanceRefreshNotFoundFault) {
+                return err
+            }
+
+            // Cancelled refresh has to finish before the next one is started
+            if _, err := act.wait(ctx, group, group.InstanceRefreshID); err != nil {
+                return err
+            }
+
+            // The symbolic previous version could still point to the new version
+            if err := restorePrevious(act.Svc, pipelineInfo, idx); err != nil {
+                return err
+            }
+
+            refreshID, err := act.start(group)
+            if err != nil {
+                return err
+            }
+
+            pipelineInfo.AutoScalingGroups[idx].RollbackRefreshID = refreshID
+            act.checkpoint()
+        }
+
+        refresh, err := act.wait(ctx, group, pipelineInfo.AutoScalingGroups[idx].RollbackRefreshID)
+        if err != nil {
+            return err
+        }
+
+        // Finished refresh cannot be waited on again, the next rollback starts a new one
+        pipelineInfo.AutoScalingGroups[idx].RollbackRefreshID = ""
+        if *refresh.Status != autoscaling.InstanceRefreshStatusSuccessful {
+            return fmt.Errorf("Instance refresh of %s is %s: %s", group.Name, *refresh.Status, aws.StringValue(refresh.StatusReason))
+        }
+
+        pipelineInfo.AutoScalingGroups[idx].InstanceRefreshID = ""
+    }
+
+    return nil
+}
+
+// Leftovers describes Auto Scaling Groups with instances launched from the new launch template version
+func (act InstanceRefreshAction) Leftovers(pipelineInfo *PipelineInfo) []string {
+    leftovers := []string{}
+
+    for _, group := range pipelineInfo.AutoScalingGroups {
+        if group.InstanceRefreshID == "" {
+            continue
+        }
+
+        leftovers = append(leftovers, fmt.Sprintf("Auto Scaling Group %s has instances of version %s of launch template %s. Refresh them with version %s",
+            group.Name, group.NewVersion, group.LaunchTemplateID, group.rollbackVersion()))
+    }
+
+    return leftovers
+}
@@ -3,13 +3,34 @@ package main
 
 import(
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
 	"github.com/aws/aws-sdk-go/service/elbv2"
+	"github.com/aws/aws-sdk-go/service/elbv2/elbv2iface"
 
 	"errors"
+	"fmt"
+	"time"
 )
 
-func isIPAuthorized(svc *ec2.EC2, sgID string, port int64, ip string) (bool, error) {
+// waiterDelay is the delay between checks of the EC2 and ELBv2 waiters used by the deployment
+const waiterDelay = 15 * time.Second
+
+// waiterTimeout limits the number of waiter attempts to fit into the timeout
+func waiterTimeout(timeout time.Duration) request.WaiterOption {
+	attempts := int(timeout / waiterDelay)
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	return func(w *request.Waiter) {
+		w.MaxAttempts = attempts
+		w.Delay = request.ConstantWaiterDelay(waiterDelay)
+	}
+}
+
+func isIPAuthorized(svc ec2iface.EC2API, sgID string, port int64, ip string) (bool, error) {
 	input := &ec2.DescribeSecurityGroupsInput{
 		GroupIds: []*string{
 			aws.String(sgID),
@@ -18,8 +39,8 @@ func isIPAuthorized(svc *ec2.EC2, sgID string, port int64, ip string) (bool, err
 
 	result, err := svc.DescribeSecurityGroups(input)
 	if err != nil {
-        panic(err)
-    }
+		return false, err
+	}
 
 	if len(result.SecurityGroups) < 1 {
         return false, errors.New("Security group does not exists")
@@ -43,7 +64,7 @@ func isIPAuthorized(svc *ec2.EC2, sgID string, port int64, ip string) (bool, err
     return false, nil
 }
 
-func authorizeIP(svc *ec2.EC2, sgID string, port int64, ip string) error {
+func authorizeIP(svc ec2iface.EC2API, sgID string, port int64, ip string) error {
 	input := &ec2.AuthorizeSecurityGroupIngressInput{
 		GroupId: aws.String(sgID),
 		IpPermissions: []*ec2.IpPermission{
@@ -69,7 +90,7 @@ func authorizeIP(svc *ec2.EC2, sgID string, port int64, ip string) error {
 	return nil
 }
 
-func revokeIP(svc *ec2.EC2, sgID string, port int64, ip string) error {
+func revokeIP(svc ec2iface.EC2API, sgID string, port int64, ip string) error {
 
 	input := &ec2.RevokeSecurityGroupIngressInput{
 		GroupId: aws.String(sgID),
@@ -96,7 +117,7 @@ func revokeIP(svc *ec2.EC2, sgID string, port int64, ip string) error {
 	return nil
 }
 
-func findInstancesInTargetGroup(svc *elbv2.ELBV2, tgArn string, instancesID []*string) (bool, error) {
+func findInstancesInTargetGroup(svc elbv2iface.ELBV2API, tgArn string, instancesID []*string) (bool, error) {
 	targets := []*elbv2.TargetDescription{}
 
 	for _, instanceID := range instancesID {
@@ -122,3 +143,34 @@ func findInstancesInTargetGroup(svc *elbv2.ELBV2, tgArn string, instancesID []*s
 
 	return false, nil
 }
+
+func newTargetDescriptions(instancesIds []*string) []*elbv2.TargetDescription {
+	targets := []*elbv2.TargetDescription{}
+
+	for _, instanceID := range instancesIds {
+		targets = append(targets, &elbv2.TargetDescription{Id: instanceID})
+	}
+
+	return targets
+}
+
+func checkTargetsHealthy(svc elbv2iface.ELBV2API, tgArn *string, instancesIds []*string) error {
+	input := &elbv2.DescribeTargetHealthInput{
+		TargetGroupArn: tgArn,
+		Targets: newTargetDescriptions(instancesIds),
+	}
+
+	res, err := svc.DescribeTargetHealth(input)
+
+	if err != nil {
+		return err
+	}
+
+	for _, tgHealth := range res.TargetHealthDescriptions {
+		if *tgHealth.TargetHealth.State != elbv2.TargetHealthStateEnumHealthy {
+			return fmt.Errorf("Instance %s is %s in target group %s", *tgHealth.Target.Id, *tgHealth.TargetHealth.State, *tgArn)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,477 @@
+package main
+
+import (
+    "github.com/aws/aws-sdk-go/aws"
+    "github.com/aws/aws-sdk-go/service/elbv2"
+    "github.com/aws/aws-sdk-go/service/elbv2/elbv2iface"
+
+    "context"
+    "errors"
+    "fmt"
+    "strings"
+    "time"
+)
+
+// TargetGroupPair keeps the target group of the old version and its temporary sibling for the new version
+type TargetGroupPair struct {
+    BlueArn string
+    GreenArn string
+    // Registered is set when new instances are registered in the green target group
+    Registered bool `json:",omitempty"`
+}
+
+// ListenerRuleState keeps the original actions of the listener rule forwarding to the blue target group
+type ListenerRuleState struct {
+    ListenerArn string
+    RuleArn string
+    IsDefault bool
+    OriginalActions []*elbv2.Action
+    Pair TargetGroupPair
+}
+
+// CreateGreenTargetGroupsAction is a pipeline step struct
+type CreateGreenTargetGroupsAction struct {
+    Svc elbv2iface.ELBV2API
+}
+
+// RegisterGreenInstancesAction is a pipeline step struct
+type RegisterGreenInstancesAction struct {
+    Svc elbv2iface.ELBV2API
+    Timeout time.Duration
+}
+
+// ShiftTrafficAction is a pipeline step struct. It moves traffic to the green target groups
+// with the weighted forward actions, checking health of new instances after each step.
+type ShiftTrafficAction struct {
+    Svc elbv2iface.ELBV2API
+    Steps []int64
+    Interval time.Duration
+}
+
+// FinalizeBlueGreenAction is a pipeline step struct. It moves new instances to the blue target groups,
+// restores the original listener actions and deletes the green target groups.
+type FinalizeBlueGreenAction struct {
+    Svc elbv2iface.ELBV2API
+    Timeout time.Duration
+    DeregistrationTimeout time.Duration
+}
+
+func greenTargetGroupName(blueName string, version string) string {
+    suffix := "-g" + strings.Replace(version, "_", "", -1)
+
+    // Target group name cannot be longer than 32 characters
+    if len(blueName)+len(suffix) > 32 {
+        blueName = strings.TrimRight(blueName[:32-len(suffix)], "-")
+    }
+
+    return blueName + suffix
+}
+
+// Commit is an action to apply changes in the CreateGreenTargetGroupsAction step
+func (act CreateGreenTargetGroupsAction) Commit(ctx context.Context, pipelineInfo *PipelineInfo) error {
+    if len(pipelineInfo.TargetGroupsArns) < 1 {
+        return errors.New("Instances are not registered in any target group")
+    }
+
+    res, err := act.Svc.DescribeTargetGroups(&elbv2.DescribeTargetGroupsInput{
+        TargetGroupArns: pipelineInfo.TargetGroupsArns,
+    })
+    if err != nil {
+        return err
+    }
+
+    for _, blue := range res.TargetGroups {
+        input := &elbv2.CreateTargetGroupInput{
+            Name: aws.String(greenTargetGroupName(*blue.TargetGroupName, pipelineInfo.Version)),
+            Protocol: blue.Protocol,
+            ProtocolVersion: blue.ProtocolVersion,
+            Port: blue.Port,
+            VpcId: blue.VpcId,
+            TargetType: blue.TargetType,
+            HealthCheckEnabled: blue.HealthCheckEnabled,
+            HealthCheckIntervalSeconds: blue.HealthCheckIntervalSeconds,
+            HealthCheckPath: blue.HealthCheckPath,
+            HealthCheckPort: blue.HealthCheckPort,
+            HealthCheckProtocol: blue.HealthCheckProtocol,
+            HealthCheckTimeoutSeconds: blue.HealthCheckTimeoutSeconds,
+            HealthyThresholdCount: blue.HealthyThresholdCount,
+            UnhealthyThresholdCount: blue.UnhealthyThresholdCount,
+            Matcher: blue.Matcher,
+            Tags: []*elbv2.Tag{{Key: aws.String("Version"), Value: aws.String(pipelineInfo.Version)}},
+        }
+
+        green, err := act.Svc.CreateTargetGroup(input)
+        if err != nil {
+            return err
+        }
+
+        pipelineInfo.GreenTargetGroups = append(pipelineInfo.GreenTargetGroups, TargetGroupPair{
+            BlueArn: *blue.TargetGroupArn,
+            GreenArn: *green.TargetGroups[0].TargetGroupArn,
+        })
+    }
+
+    return nil
+}
+
+// Rollback is an action to apply changes in the CreateGreenTargetGroupsAction step
+func (act CreateGreenTargetGroupsAction) Rollback(ctx context.Context, pipelineInfo *PipelineInfo) error {
+    // Deleted target groups are removed from the pipeline info one by one, so only the remaining ones are reported
+    for len(pipelineInfo.GreenTargetGroups) > 0 {
+        pair := pipelineInfo.GreenTargetGroups[0]
+        _, err := act.Svc.DeleteTargetGroup(&elbv2.DeleteTargetGroupInput{TargetGroupArn: aws.String(pair.GreenArn)})
+
+        if err != nil {
+            return err
+        }
+
+        pipelineInfo.GreenTargetGroups = pipelineInfo.GreenTargetGroups[1:]
+    }
+
+    pipelineInfo.GreenTargetGroups = nil
+    return nil
+}
+
+// Leftovers describes green target groups created by the deployment
+func (act CreateGreenTargetGroupsAction) Leftovers(pipelineInfo *PipelineInfo) []string {
+    leftovers := []string{}
+
+    for _, pair := range pipelineInfo.GreenTargetGroups {
+        leftovers = append(leftovers, "Target group "+pair.GreenArn+" created for target group "+pair.BlueArn)
+    }
+
+    return leftovers
+}
+
+// Commit is an action to apply changes in the RegisterGreenInstancesAction step
+func (act RegisterGreenInstancesAction) Commit(ctx context.Context, pipelineInfo *PipelineInfo) error {
+    for idx, pair := range pipelineInfo.GreenTargetGroups {
+        _, err := act.Svc.RegisterTargets(&elbv2.RegisterTargetsInput{
+            TargetGroupArn: aws.String(pair.GreenArn),
+            Targets: newTargetDescriptions(pipelineInfo.NewInstancesIds),
+        })
+
+        if err != nil {
+            return err
+        }
+
+        pipelineInfo.GreenTargetGroups[idx].Registered = true
+    }
+
+    for _, pair := range pipelineInfo.GreenTargetGroups {
+        err := act.Svc.WaitUntilTargetInServiceWithContext(ctx, &elbv2.DescribeTargetHealthInput{
+            TargetGroupArn: aws.String(pair.GreenArn),
+            Targets: newTargetDescriptions(pipelineInfo.NewInstancesIds),
+        }, waiterTimeout(act.Timeout))
+
+        if err != nil {
+            return err
+        }
+    }
+
+    return nil
+}
+
+// Rollback is an action to apply changes in the RegisterGreenInstancesAction step
+func (act RegisterGreenInstancesAction) Rollback(ctx context.Context, pipelineInfo *PipelineInfo) error {
+    for idx, pair := range pipelineInfo.GreenTargetGroups {
+        if !pair.Registered {
+            continue
+        }
+
+        _, err := act.Svc.DeregisterTargets(&elbv2.DeregisterTargetsInput{
+            TargetGroupArn: aws.String(pair.GreenArn),
+            Targets: newTargetDescriptions(pipelineInfo.NewInstancesIds),
+        })
+
+        if err != nil {
+            return err
+        }
+
+        pipelineInfo.GreenTargetGroups[idx].Registered = false
+    }
+
+    return nil
+}
+
+// Leftovers describes new instances registered in green target groups
+func (act RegisterGreenInstancesAction) Leftovers(pipelineInfo *PipelineInfo) []string {
+    tgArns := []*string{}
+    for _, pair := range pipelineInfo.GreenTargetGroups {
+        if pair.Registered {
+            tgArns = append(tgArns, aws.String(pair.GreenArn))
+        }
+    }
+
+    return targetLeftovers("registered in", pipelineInfo.NewInstancesIds, tgArns)
+}
+
+// forwardsOnlyTo checks whether the rule sends all the traffic to the given target group
+func forwardsOnlyTo(actions []*elbv2.Action, tgArn string) (bool, error) {
+    for _, action := range actions {
+        if *action.Type != elbv2.ActionTypeEnumForward {
+            continue
+        }
+
+        if action.ForwardConfig == nil {
+            return aws.StringValue(action.TargetGroupArn) == tgArn, nil
+        }
+
+        for _, tg := range action.ForwardConfig.TargetGroups {
+            if *tg.TargetGroupArn != tgArn {
+                continue
+            }
+
+            if len(action.ForwardConfig.TargetGroups) > 1 {
+                return false, fmt.Errorf("Target group %s is already used in the weighted forward action", tgArn)
+            }
+
+            return true, nil
+        }
+    }
+
+    return false, nil
+}
+
+// weightedActions returns copy of the rule actions with the forward action split between blue and green target groups
+func weightedActions(actions []*elbv2.Action, pair TargetGroupPair, greenWeight int64) []*elbv2.Action {
+    weighted := []*elbv2.Action{}
+
+    for _, action := range actions {
+        if *action.Type != elbv2.ActionTypeEnumForward {
+            weighted = append(weighted, action)
+            continue
+        }
+
+        forwardConfig := &elbv2.ForwardActionConfig{
+            TargetGroups: []*elbv2.TargetGroupTuple{
+                {TargetGroupArn: aws.String(pair.BlueArn), Weight: aws.Int64(100 - greenWeight)},
+                {TargetGroupArn: aws.String(pair.GreenArn), Weight: aws.Int64(greenWeight)},
+            },
+        }
+
+        if action.ForwardConfig != nil {
+            forwardConfig.TargetGroupStickinessConfig = action.ForwardConfig.TargetGroupStickinessConfig
+        }
+
+        weighted = append(weighted, &elbv2.Action{
+            Type: action.Type,
+            Order: action.Order,
+            ForwardConfig: forwardConfig,
+        })
+    }
+
+    return weighted
+}
+
+func (act ShiftTrafficAction) findRules(pair TargetGroupPair) ([]ListenerRuleState, error) {
+    rules := []ListenerRuleState{}
+
+    tgs, err := act.Svc.DescribeTargetGroups(&elbv2.DescribeTargetGroupsInput{
+        TargetGroupArns: []*string{aws.String(pair.BlueArn)},
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    for _, tg := range tgs.TargetGroups {
+        for _, lbArn := range tg.LoadBalancerArns {
+            listeners, err := act.Svc.DescribeListeners(&elbv2.DescribeListenersInput{LoadBalancerArn: lbArn})
+            if err != nil {
+                return nil, err
+            }
+
+            for _, listener := range listeners.Listeners {
+                res, err := act.Svc.DescribeRules(&elbv2.DescribeRulesInput{ListenerArn: listener.ListenerArn})
+                if err != nil {
+                    return nil, err
+                }
+
+                for _, rule := range res.Rules {
+                    forwards, err := forwardsOnlyTo(rule.Actions, pair.BlueArn)
+                    if err != nil {
+                        return nil, err
+                    }
+
+                    if forwards {
+                        rules = append(rules, ListenerRuleState{
+                            ListenerArn: *listener.ListenerArn,
+                            RuleArn: *rule.RuleArn,
+                            IsDefault: aws.BoolValue(rule.IsDefault),
+                            OriginalActions: rule.Actions,
+                            Pair: pair,
+                        })
+                    }
+                }
+            }
+        }
+    }
+
+    if len(rules) < 1 {
+        return nil, fmt.Errorf("Not found any listener rule forwarding to %s", pair.BlueArn)
+    }
+
+    return rules, nil
+}
+
+func (act ShiftTrafficAction) setActions(rule ListenerRuleState, actions []*elbv2.Action) error {
+    // The default rule cannot be modified directly, it is changed with the listener default actions
+    if rule.IsDefault {
+        _, err := act.Svc.ModifyListener(&elbv2.ModifyListenerInput{
+            ListenerArn: aws.String(rule.ListenerArn),
+            DefaultActions: actions,
+        })
+
+        return err
+    }
+
+    _, err := act.Svc.ModifyRule(&elbv2.ModifyRuleInput{
+        RuleArn: aws.String(rule.RuleArn),
+        Actions: actions,
+    })
+
+    return err
+}
+
+// Commit is an action to apply changes in the ShiftTrafficAction step
+func (act ShiftTrafficAction) Commit(ctx context.Context, pipelineInfo *PipelineInfo) error {
+    rules := []ListenerRuleState{}
+
+    for _, pair := range pipelineInfo.GreenTargetGroups {
+        pairRules, err := act.findRules(pair)
+        if err != nil {
+            return err
+        }
+
+        rules = append(rules, pairRules...)
+    }
+
+    for idx, weight := range act.Steps {
+        if idx > 0 {
+            if err := sleep(ctx, act.Interval); err != nil {
+                return err
+            }
+        }
+
+        logger.Info("Sending traffic to new instances", Fields{"action": actionName(act), "weight_percent": weight})
+
+        for _, rule := range rules {
+            if err := act.setActions(rule, weightedActions(rule.OriginalActions, rule.Pair, weight)); err != nil {
+                return err
+            }
+
+            if idx == 0 {
+                pipelineInfo.ShiftedListenerRules = append(pipelineInfo.ShiftedListenerRules, rule)
+            }
+        }
+
+        for _, pair := range pipelineInfo.GreenTargetGroups {
+            if err := checkTargetsHealthy(act.Svc, aws.String(pair.GreenArn), pipelineInfo.NewInstancesIds); err != nil {
+                return err
+            }
+        }
+    }
+
+    return nil
+}
+
+// Rollback is an action to apply changes in the ShiftTrafficAction step
+func (act ShiftTrafficAction) Rollback(ctx context.Context, pipelineInfo *PipelineInfo) error {
+    for _, rule := range pipelineInfo.ShiftedListenerRules {
+        if err := act.setActions(rule, rule.OriginalActions); err != nil {
+            return err
+        }
+    }
+
+    pipelineInfo.ShiftedListenerRules = nil
+    return nil
+}
+
+// Leftovers describes listener rules which still send the traffic to green target groups
+func (act ShiftTrafficAction) Leftovers(pipelineInfo *PipelineInfo) []string {
+    leftovers := []string{}
+
+    for _, rule := range pipelineInfo.ShiftedListenerRules {
+        name := "Listener rule " + rule.RuleArn
+        if rule.IsDefault {
+            name = "Default action of listener " + rule.ListenerArn
+        }
+
+        leftovers = append(leftovers, name+" forwards traffic to target group "+rule.Pair.GreenArn)
+    }
+
+    return leftovers
+}
+
+// Commit is an action to apply changes in the FinalizeBlueGreenAction step
+func (act FinalizeBlueGreenAction) Commit(ctx context.Context, pipelineInfo *PipelineInfo) error {
+    shift := ShiftTrafficAction{Svc: act.Svc}
+
+    // Blue target groups do not receive traffic at this point, so new instances can be moved there safely
+    err := RegisterNewInstancesAction{act.Svc}.Commit(ctx, pipelineInfo)
+    if err != nil {
+        return err
+    }
+
+    for _, tgArn := range pipelineInfo.TargetGroupsArns {
+        err := act.Svc.WaitUntilTargetInServiceWithContext(ctx, &elbv2.DescribeTargetHealthInput{
+            TargetGroupArn: tgArn,
+            Targets: newTargetDescriptions(pipelineInfo.NewInstancesIds),
+        }, waiterTimeout(act.Timeout))
+
+        if err != nil {
+            return err
+        }
+    }
+
+    if err := shift.Rollback(ctx, pipelineInfo); err != nil {
+        return err
+    }
+
+    if err := (RegisterGreenInstancesAction{act.Svc, act.Timeout}).Rollback(ctx, pipelineInfo); err != nil {
+        return err
+    }
+
+    return CreateGreenTargetGroupsAction{act.Svc}.Rollback(ctx, pipelineInfo)
+}
+
+// Rollback is an action to apply changes in the FinalizeBlueGreenAction step
+func (act FinalizeBlueGreenAction) Rollback(ctx context.Context, pipelineInfo *PipelineInfo) error {
+    if len(pipelineInfo.RegisteredTargetGroups) < 1 {
+        return nil
+    }
+
+    // Blue target groups do not receive traffic while listener actions forward it to the green ones
+    if len(pipelineInfo.ShiftedListenerRules) > 0 {
+        return RegisterNewInstancesAction{act.Svc}.Rollback(ctx, pipelineInfo)
+    }
+
+    // New instances serve the traffic alone, so old instances are registered back and have to be healthy
+    // before new instances are deregistered and drained
+    if err := (DeregisterOldInstancesAction{act.Svc}).Rollback(ctx, pipelineInfo); err != nil {
+        return err
+    }
+
+    for _, tgArn := range pipelineInfo.TargetGroupsArns {
+        err := act.Svc.WaitUntilTargetInServiceWithContext(ctx, &elbv2.DescribeTargetHealthInput{
+            TargetGroupArn: tgArn,
+            Targets: newTargetDescriptions(pipelineInfo.OldInstancesIds),
+        }, waiterTimeout(act.Timeout))
+
+        if err != nil {
+            return fmt.Errorf("Old instances are not healthy in target group %s: %s", *tgArn, err.Error())
+        }
+    }
+
+    tgArns := append([]*string{}, pipelineInfo.RegisteredTargetGroups...)
+    if err := (RegisterNewInstancesAction{act.Svc}).Rollback(ctx, pipelineInfo); err != nil {
+        return err
+    }
+
+    return WaitForDeregisterAction{act.Svc, act.DeregistrationTimeout}.waitDeregistered(ctx, tgArns, pipelineInfo.NewInstancesIds)
+}
+
+// Leftovers describes new instances registered in blue target groups
+func (act FinalizeBlueGreenAction) Leftovers(pipelineInfo *PipelineInfo) []string {
+    return RegisterNewInstancesAction{act.Svc}.Leftovers(pipelineInfo)
+}
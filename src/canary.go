@@ -0,0 +1,145 @@
+package main
+
+import (
+    "github.com/aws/aws-sdk-go/aws"
+    "github.com/aws/aws-sdk-go/service/cloudwatch"
+    "github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
+    "github.com/aws/aws-sdk-go/service/elbv2"
+    "github.com/aws/aws-sdk-go/service/elbv2/elbv2iface"
+
+    "context"
+    "fmt"
+    "strings"
+    "time"
+)
+
+// MetricsSource provides number of errors returned by the target group in the given period
+type MetricsSource interface {
+    ErrorCount(targetGroupArn string, start time.Time, end time.Time) (float64, error)
+}
+
+// CloudWatchMetrics reads the HTTPCode_Target_5XX_Count metric of the Application Load Balancer
+type CloudWatchMetrics struct {
+    Svc cloudwatchiface.CloudWatchAPI
+    ElbSvc elbv2iface.ELBV2API
+}
+
+// CanaryBakeAction is a pipeline step struct. It observes the registered canary instances for the BakeTime.
+type CanaryBakeAction struct {
+    Svc elbv2iface.ELBV2API
+    Metrics MetricsSource
+    BakeTime time.Duration
+    Interval time.Duration
+    MaxErrors float64
+    // Timeout limits waiting until the canary instances are healthy
+    Timeout time.Duration
+}
+
+// arnResource returns the resource part of the ARN, e.g. targetgroup/web/73e2d6bc24d8a067
+func arnResource(arn string) string {
+    parts := strings.SplitN(arn, ":", 6)
+
+    if len(parts) < 6 {
+        return arn
+    }
+
+    return parts[5]
+}
+
+// ErrorCount is an action to sum 5XX responses returned by targets of the target group
+func (m CloudWatchMetrics) ErrorCount(targetGroupArn string, start time.Time, end time.Time) (float64, error) {
+    tgs, err := m.ElbSvc.DescribeTargetGroups(&elbv2.DescribeTargetGroupsInput{
+        TargetGroupArns: []*string{aws.String(targetGroupArn)},
+    })
+    if err != nil {
+        return 0, err
+    }
+
+    count := float64(0)
+    for _, tg := range tgs.TargetGroups {
+        for _, lbArn := range tg.LoadBalancerArns {
+            res, err := m.Svc.GetMetricStatistics(&cloudwatch.GetMetricStatisticsInput{
+                Namespace: aws.String("AWS/ApplicationELB"),
+                MetricName: aws.String("HTTPCode_Target_5XX_Count"),
+                Dimensions: []*cloudwatch.Dimension{
+                    {Name: aws.String("TargetGroup"), Value: aws.String(arnResource(targetGroupArn))},
+                    {Name: aws.String("LoadBalancer"), Value: aws.String(strings.TrimPrefix(arnResource(*lbArn), "loadbalancer/"))},
+                },
+                StartTime: aws.Time(start),
+                EndTime: aws.Time(end),
+                Period: aws.Int64(60),
+                Statistics: []*string{aws.String(cloudwatch.StatisticSum)},
+            })
+            if err != nil {
+                return 0, err
+            }
+
+            for _, datapoint := range res.Datapoints {
+                count += aws.Float64Value(datapoint.Sum)
+            }
+        }
+    }
+
+    return count, nil
+}
+
+func (act CanaryBakeAction) checkErrors(pipelineInfo *PipelineInfo, start time.Time) error {
+    count := float64(0)
+
+    for _, tgArn := range pipelineInfo.TargetGroupsArns {
+        tgCount, err := act.Metrics.ErrorCount(*tgArn, start, time.Now())
+        if err != nil {
+            return err
+        }
+
+        count += tgCount
+    }
+
+    if count > act.MaxErrors {
+        return fmt.Errorf("Target groups returned %.0f errors during the canary stage. Allowed %.0f", count, act.MaxErrors)
+    }
+
+    return nil
+}
+
+// Commit is an action to apply changes in the CanaryBakeAction step
+func (act CanaryBakeAction) Commit(ctx context.Context, pipelineInfo *PipelineInfo) error {
+    for _, tgArn := range pipelineInfo.TargetGroupsArns {
+        err := act.Svc.WaitUntilTargetInServiceWithContext(ctx, &elbv2.DescribeTargetHealthInput{
+            TargetGroupArn: tgArn,
+            Targets: newTargetDescriptions(pipelineInfo.NewInstancesIds),
+        }, waiterTimeout(act.Timeout))
+
+        if err != nil {
+            return err
+        }
+    }
+
+    start := time.Now()
+    checks := int(act.BakeTime / act.Interval)
+
+    for check := 0; check <= checks; check++ {
+        if check > 0 {
+            if err := sleep(ctx, act.Interval); err != nil {
+                return err
+            }
+        }
+
+        for _, tgArn := range pipelineInfo.TargetGroupsArns {
+            if err := checkTargetsHealthy(act.Svc, tgArn, pipelineInfo.NewInstancesIds); err != nil {
+                return err
+            }
+        }
+
+        if err := act.checkErrors(pipelineInfo, start); err != nil {
+            return err
+        }
+    }
+
+    return nil
+}
+
+// Rollback is an action to apply changes in the CanaryBakeAction step
+func (act CanaryBakeAction) Rollback(ctx context.Context, pipelineInfo *PipelineInfo) error {
+    return nil
+}
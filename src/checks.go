@@ -0,0 +1,547 @@
+package main
+
+import (
+    "google.golang.org/grpc"
+    "google.golang.org/grpc/credentials"
+    "google.golang.org/grpc/credentials/insecure"
+    healthpb "google.golang.org/grpc/health/grpc_health_v1"
+
+    "context"
+    "crypto/tls"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "math/rand"
+    "net"
+    "net/http"
+    "regexp"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// Types of the application checks
+const (
+    CheckHTTP = "http"
+    CheckTCP = "tcp"
+    CheckGRPC = "grpc"
+)
+
+// defaultCheckTimeout limits a single check, when the timeout is not configured
+const defaultCheckTimeout = 10 * time.Second
+
+// maxCheckBodySize limits the response body read by the HTTP check
+const maxCheckBodySize = 1 << 20
+
+// CheckConfig is a single declarative check of the application. Port, scheme, path and expected codes
+// missing in the check are taken from the health check config.
+type CheckConfig struct {
+    Name string `yaml:"name" json:"name"`
+    Type string `yaml:"type" json:"type"`
+    Port int64 `yaml:"port" json:"port"`
+    Timeout Duration `yaml:"timeout" json:"timeout"`
+
+    // HTTP check
+    Scheme string `yaml:"scheme" json:"scheme"`
+    Method string `yaml:"method" json:"method"`
+    Path string `yaml:"path" json:"path"`
+    RequestHeaders map[string]string `yaml:"request_headers" json:"request_headers"`
+    Body string `yaml:"body" json:"body"`
+    ExpectedCodes []int `yaml:"expected_codes" json:"expected_codes"`
+    BodyRegex string `yaml:"body_regex" json:"body_regex"`
+    JSONPath string `yaml:"json_path" json:"json_path"`
+    JSONValue string `yaml:"json_value" json:"json_value"`
+    // Headers are required in the response. Empty value requires only the presence of the header.
+    Headers map[string]string `yaml:"headers" json:"headers"`
+
+    // TLS of HTTP and gRPC checks. ServerName is sent in SNI and the Host header.
+    ServerName string `yaml:"server_name" json:"server_name"`
+    InsecureSkipVerify bool `yaml:"insecure_skip_verify" json:"insecure_skip_verify"`
+
+    // Service checked with the gRPC health protocol. Empty service checks the whole server.
+    Service string `yaml:"service" json:"service"`
+}
+
+// HealthCheck checks the application on a single instance
+type HealthCheck interface {
+    Name() string
+    Check(ctx context.Context, host string) error
+}
+
+// HTTPCheck requests the application and checks the status, headers and body of the response
+type HTTPCheck struct {
+    Config CheckConfig
+}
+
+// TCPCheck connects to the port of the application
+type TCPCheck struct {
+    Config CheckConfig
+}
+
+// GRPCCheck calls the gRPC health service of the application
+type GRPCCheck struct {
+    Config CheckConfig
+}
+
+// runHealthCheck runs the check on the host. It is replaced in the plan mode.
+var runHealthCheck = func(ctx context.Context, check HealthCheck, host string) error {
+    return check.Check(ctx, host)
+}
+
+func (c CheckConfig) validate() error {
+    switch c.Type {
+    case CheckHTTP, CheckTCP, CheckGRPC:
+    default:
+        return fmt.Errorf("Unknown check type %s", c.Type)
+    }
+
+    if c.Port < 0 || c.Port > 65535 {
+        return fmt.Errorf("Invalid port %d of check %s", c.Port, c.Name)
+    }
+
+    if c.Timeout < 0 {
+        return fmt.Errorf("Invalid timeout of check %s", c.Name)
+    }
+
+    if c.Scheme != "" && c.Scheme != "http" && c.Scheme != "https" {
+        return fmt.Errorf("Invalid scheme %s of check %s. Expected http or https", c.Scheme, c.Name)
+    }
+
+    if c.Path != "" && !strings.HasPrefix(c.Path, "/") {
+        return fmt.Errorf("Invalid path %s of check %s. Expected path starting with /", c.Path, c.Name)
+    }
+
+    for _, code := range c.ExpectedCodes {
+        if code < 100 || code > 599 {
+            return fmt.Errorf("Invalid expected status code %d of check %s", code, c.Name)
+        }
+    }
+
+    if _, err := regexp.Compile(c.BodyRegex); err != nil {
+        return fmt.Errorf("Invalid body regex of check %s: %s", c.Name, err.Error())
+    }
+
+    if c.JSONValue != "" && c.JSONPath == "" {
+        return fmt.Errorf("JSON value of check %s requires JSON path", c.Name)
+    }
+
+    return nil
+}
+
+// withDefaults fills the check with values of the health check config
+func (c CheckConfig) withDefaults(hc HealthCheckConfig) CheckConfig {
+    if c.Port == 0 {
+        c.Port = hc.Port
+    }
+
+    if c.Scheme == "" {
+        c.Scheme = hc.Scheme
+    }
+
+    if c.Path == "" {
+        c.Path = hc.Path
+    }
+
+    if c.Method == "" {
+        c.Method = http.MethodGet
+    }
+
+    if c.Type == CheckHTTP && len(c.ExpectedCodes) == 0 {
+        c.ExpectedCodes = hc.ExpectedCodes
+    }
+
+    if c.Timeout == 0 {
+        c.Timeout = Duration(defaultCheckTimeout)
+    }
+
+    if c.Name == "" {
+        c.Name = fmt.Sprintf("%s:%d", c.Type, c.Port)
+    }
+
+    return c
+}
+
+func (c CheckConfig) address(host string) string {
+    return net.JoinHostPort(host, strconv.FormatInt(c.Port, 10))
+}
+
+func (c CheckConfig) tlsConfig() *tls.Config {
+    return &tls.Config{ServerName: c.ServerName, InsecureSkipVerify: c.InsecureSkipVerify}
+}
+
+// healthChecks returns the configured checks. Without them the application is checked with a single HTTP request.
+func (c HealthCheckConfig) healthChecks() []HealthCheck {
+    checks := []HealthCheck{}
+    for _, config := range c.checkConfigs() {
+        switch config.Type {
+        case CheckTCP:
+            checks = append(checks, TCPCheck{config})
+        case CheckGRPC:
+            checks = append(checks, GRPCCheck{config})
+        default:
+            checks = append(checks, HTTPCheck{config})
+        }
+    }
+
+    return checks
+}
+
+// checkConfigs returns the configured checks filled with defaults
+func (c HealthCheckConfig) checkConfigs() []CheckConfig {
+    configs := []CheckConfig{}
+    for _, config := range c.Checks {
+        configs = append(configs, config.withDefaults(c))
+    }
+
+    if len(configs) == 0 {
+        configs = append(configs, CheckConfig{Name: CheckHTTP, Type: CheckHTTP}.withDefaults(c))
+    }
+
+    return configs
+}
+
+// ports returns distinct ports used by the checks
+func (c HealthCheckConfig) ports() []int64 {
+    ports := []int64{}
+    seen := map[int64]bool{}
+
+    for _, config := range c.checkConfigs() {
+        if !seen[config.Port] {
+            seen[config.Port] = true
+            ports = append(ports, config.Port)
+        }
+    }
+
+    return ports
+}
+
+// checkInstances checks the hosts in parallel. Checks of the remaining hosts are cancelled after the first failure
+// or when the deadline of the health check is exceeded.
+func checkInstances(ctx context.Context, checks []HealthCheck, hosts []string, hc HealthCheckConfig) error {
+    if hc.Deadline > 0 {
+        var cancelDeadline context.CancelFunc
+        ctx, cancelDeadline = context.WithTimeout(ctx, time.Duration(hc.Deadline))
+        defer cancelDeadline()
+    }
+
+    ctx, cancel := context.WithCancel(ctx)
+    defer cancel()
+
+    parallelism := hc.Parallelism
+    if parallelism < 1 {
+        parallelism = 1
+    }
+
+    slots := make(chan struct{}, parallelism)
+    errs := make([]error, len(hosts))
+    var wg sync.WaitGroup
+
+    for idx, host := range hosts {
+        select {
+        case slots <- struct{}{}:
+        case <-ctx.Done():
+            errs[idx] = ctx.Err()
+            continue
+        }
+
+        if err := ctx.Err(); err != nil {
+            errs[idx] = err
+            <-slots
+            continue
+        }
+
+        wg.Add(1)
+        go func(idx int, host string) {
+            defer wg.Done()
+            defer func() { <-slots }()
+
+            errs[idx] = checkInstance(ctx, checks, host, hc)
+            if errs[idx] != nil {
+                cancel()
+            }
+        }(idx, host)
+    }
+
+    wg.Wait()
+
+    // Instances cancelled because of the failure of another instance are not reported
+    var cancelled error
+    for _, err := range errs {
+        if err == context.Canceled {
+            cancelled = err
+            continue
+        }
+
+        if err != nil {
+            return err
+        }
+    }
+
+    return cancelled
+}
+
+// checkInstance runs all checks on the instance until they pass, the retries are exhausted or the context is done
+func checkInstance(ctx context.Context, checks []HealthCheck, host string, hc HealthCheckConfig) error {
+    var failure error
+
+    for attempt := uint(1); attempt <= hc.Retries; attempt++ {
+        failure = nil
+
+        for _, check := range checks {
+            if err := runHealthCheck(ctx, check, host); err != nil {
+                failure = fmt.Errorf("Health check %s failed on %s: %s", check.Name(), host, err.Error())
+                break
+            }
+        }
+
+        if failure == nil {
+            logger.Info("Instance passed health checks", Fields{"host": host, "attempt": attempt})
+            return nil
+        }
+
+        if ctx.Err() == context.Canceled {
+            return ctx.Err()
+        }
+
+        if ctx.Err() == context.DeadlineExceeded {
+            return fmt.Errorf("%s. Health check deadline %s exceeded", failure.Error(), time.Duration(hc.Deadline))
+        }
+
+        if attempt < hc.Retries {
+            delay := backoff(attempt, time.Duration(hc.Interval), time.Duration(hc.MaxInterval))
+            logger.Warning("Health check attempt failed. "+failure.Error(), Fields{
+                "host": host,
+                "attempt": attempt,
+                "retries": hc.Retries,
+                "retry_in": delay.String(),
+            })
+
+            if err := sleep(ctx, delay); err == context.Canceled {
+                return err
+            }
+        }
+    }
+
+    return failure
+}
+
+// backoff returns the exponential delay before the next attempt. Half of the delay is random,
+// so instances checked in parallel do not retry at the same time.
+func backoff(attempt uint, interval time.Duration, maxInterval time.Duration) time.Duration {
+    delay := interval
+    for i := uint(1); i < attempt && (maxInterval <= 0 || delay < maxInterval); i++ {
+        delay *= 2
+    }
+
+    if maxInterval > 0 && delay > maxInterval {
+        delay = maxInterval
+    }
+
+    if delay <= 0 {
+        return 0
+    }
+
+    return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// Name returns the name of the check used in errors
+func (c HTTPCheck) Name() string {
+    return c.Config.Name
+}
+
+func (c HTTPCheck) transport() http.RoundTripper {
+    if c.Config.Scheme != "https" || (c.Config.ServerName == "" && !c.Config.InsecureSkipVerify) {
+        return httpTransport
+    }
+
+    // Transports replaced in the plan mode and tests are used as they are
+    base, ok := httpTransport.(*http.Transport)
+    if !ok {
+        return httpTransport
+    }
+
+    transport := base.Clone()
+    transport.TLSClientConfig = c.Config.tlsConfig()
+
+    return transport
+}
+
+// Check requests the application on the host
+func (c HTTPCheck) Check(ctx context.Context, host string) error {
+    client := &http.Client{
+        Transport: c.transport(),
+        Timeout: time.Duration(c.Config.Timeout),
+        CheckRedirect: func(req *http.Request, via []*http.Request) error {
+            return http.ErrUseLastResponse
+        },
+    }
+
+    req, err := http.NewRequestWithContext(ctx, c.Config.Method, c.Config.Scheme+"://"+c.Config.address(host)+c.Config.Path, strings.NewReader(c.Config.Body))
+    if err != nil {
+        return err
+    }
+
+    for name, value := range c.Config.RequestHeaders {
+        req.Header.Set(name, value)
+    }
+
+    if c.Config.ServerName != "" {
+        req.Host = c.Config.ServerName
+    }
+
+    resp, err := client.Do(req)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+
+    if !isExpectedStatus(c.Config.ExpectedCodes, resp.StatusCode) {
+        return fmt.Errorf("Response code %d. Expected %s", resp.StatusCode, expectedStatusText(c.Config.ExpectedCodes))
+    }
+
+    for name, expected := range c.Config.Headers {
+        value := resp.Header.Get(name)
+
+        if value == "" {
+            return fmt.Errorf("Missing response header %s", name)
+        }
+
+        if expected != "" && value != expected {
+            return fmt.Errorf("Response header %s is %q. Expected %q", name, value, expected)
+        }
+    }
+
+    if c.Config.BodyRegex == "" && c.Config.JSONPath == "" {
+        return nil
+    }
+
+    body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxCheckBodySize))
+    if err != nil {
+        return err
+    }
+
+    if c.Config.BodyRegex != "" {
+        if !regexp.MustCompile(c.Config.BodyRegex).Match(body) {
+            return fmt.Errorf("Response body does not match %s", c.Config.BodyRegex)
+        }
+    }
+
+    if c.Config.JSONPath != "" {
+        value, err := jsonPathValue(body, c.Config.JSONPath)
+        if err != nil {
+            return err
+        }
+
+        if c.Config.JSONValue != "" && fmt.Sprint(value) != c.Config.JSONValue {
+            return fmt.Errorf("Value of %s is %v. Expected %s", c.Config.JSONPath, value, c.Config.JSONValue)
+        }
+    }
+
+    return nil
+}
+
+// jsonPathValue returns the value of the dotted path, e.g. status or checks.0.status, in the JSON document
+func jsonPathValue(body []byte, path string) (interface{}, error) {
+    var value interface{}
+    if err := json.Unmarshal(body, &value); err != nil {
+        return nil, fmt.Errorf("Response body is not JSON: %s", err.Error())
+    }
+
+    for _, key := range strings.Split(path, ".") {
+        switch node := value.(type) {
+        case map[string]interface{}:
+            item, ok := node[key]
+            if !ok {
+                return nil, fmt.Errorf("Not found %s in the response body", path)
+            }
+
+            value = item
+        case []interface{}:
+            idx, err := strconv.Atoi(key)
+            if err != nil || idx < 0 || idx >= len(node) {
+                return nil, fmt.Errorf("Not found %s in the response body", path)
+            }
+
+            value = node[idx]
+        default:
+            return nil, fmt.Errorf("Not found %s in the response body", path)
+        }
+    }
+
+    return value, nil
+}
+
+// isExpectedStatus checks the status code against the expected codes. Without them any 2XX or 3XX code is valid.
+func isExpectedStatus(codes []int, code int) bool {
+    if len(codes) == 0 {
+        return code >= 200 && code <= 399
+    }
+
+    for _, expected := range codes {
+        if code == expected {
+            return true
+        }
+    }
+
+    return false
+}
+
+func expectedStatusText(codes []int) string {
+    if len(codes) == 0 {
+        return "in <200; 399>"
+    }
+
+    return fmt.Sprintf("one of %v", codes)
+}
+
+// Name returns the name of the check used in errors
+func (c TCPCheck) Name() string {
+    return c.Config.Name
+}
+
+// Check connects to the port of the application on the host
+func (c TCPCheck) Check(ctx context.Context, host string) error {
+    dialer := net.Dialer{Timeout: time.Duration(c.Config.Timeout)}
+    conn, err := dialer.DialContext(ctx, "tcp", c.Config.address(host))
+    if err != nil {
+        return err
+    }
+
+    return conn.Close()
+}
+
+// Name returns the name of the check used in errors
+func (c GRPCCheck) Name() string {
+    return c.Config.Name
+}
+
+// Check calls the gRPC health service on the host
+func (c GRPCCheck) Check(ctx context.Context, host string) error {
+    ctx, cancel := context.WithTimeout(ctx, time.Duration(c.Config.Timeout))
+    defer cancel()
+
+    creds := insecure.NewCredentials()
+    if c.Config.Scheme == "https" {
+        creds = credentials.NewTLS(c.Config.tlsConfig())
+    }
+
+    conn, err := grpc.DialContext(ctx, c.Config.address(host), grpc.WithTransportCredentials(creds), grpc.WithBlock())
+    if err != nil {
+        return err
+    }
+    defer conn.Close()
+
+    res, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{Service: c.Config.Service})
+    if err != nil {
+        return err
+    }
+
+    if res.Status != healthpb.HealthCheckResponse_SERVING {
+        return errors.New("gRPC health status is " + res.Status.String())
+    }
+
+    return nil
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+func splitTestAddr(t *testing.T, addr string) (string, int64) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value, err := strconv.ParseInt(port, 10, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return host, value
+}
+
+func TestHTTPCheck(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-App-Version", "1.2.3")
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+		w.Write([]byte(`{"status": "ok", "checks": [{"name": "db", "up": true}], "version": "1.2.3"}`))
+	}))
+	defer server.Close()
+
+	host, port := splitTestAddr(t, server.Listener.Addr().String())
+
+	cases := []struct {
+		check CheckConfig
+		err   string
+	}{
+		{CheckConfig{}, ""},
+		{CheckConfig{Path: "/missing"}, "Response code 404. Expected in <200; 399>"},
+		{CheckConfig{Path: "/missing", ExpectedCodes: []int{404}}, ""},
+		{CheckConfig{ExpectedCodes: []int{204}}, "Response code 200. Expected one of [204]"},
+		{CheckConfig{Headers: map[string]string{"X-App-Version": ""}}, ""},
+		{CheckConfig{Headers: map[string]string{"X-App-Version": "1.2.3"}}, ""},
+		{CheckConfig{Headers: map[string]string{"X-App-Version": "2.0.0"}}, `Response header X-App-Version is "1.2.3". Expected "2.0.0"`},
+		{CheckConfig{Headers: map[string]string{"X-Request-Id": ""}}, "Missing response header X-Request-Id"},
+		{CheckConfig{BodyRegex: `"status":\s*"ok"`}, ""},
+		{CheckConfig{BodyRegex: `"status":\s*"down"`}, `Response body does not match "status":\s*"down"`},
+		{CheckConfig{JSONPath: "status", JSONValue: "ok"}, ""},
+		{CheckConfig{JSONPath: "checks.0.up", JSONValue: "true"}, ""},
+		{CheckConfig{JSONPath: "checks.0.up", JSONValue: "false"}, "Value of checks.0.up is true. Expected false"},
+		{CheckConfig{JSONPath: "checks.1.up"}, "Not found checks.1.up in the response body"},
+	}
+
+	hc := DefaultConfig().HealthCheck
+	hc.Port = port
+
+	for _, c := range cases {
+		c.check.Type = CheckHTTP
+		err := HTTPCheck{c.check.withDefaults(hc)}.Check(context.Background(), host)
+
+		if c.err == "" {
+			assert.NoError(t, err, "%+v", c.check)
+		} else if assert.Error(t, err, "%+v", c.check) {
+			assert.Equal(t, c.err, err.Error())
+		}
+	}
+}
+
+func TestHTTPCheckTLSServerName(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Host != "app.example.com" || r.TLS.ServerName != "app.example.com" {
+			w.WriteHeader(http.StatusMisdirectedRequest)
+		}
+	}))
+	defer server.Close()
+
+	host, port := splitTestAddr(t, server.Listener.Addr().String())
+	check := CheckConfig{
+		Type:               CheckHTTP,
+		Scheme:             "https",
+		Port:               port,
+		ServerName:         "app.example.com",
+		InsecureSkipVerify: true,
+	}
+
+	assert.NoError(t, HTTPCheck{check.withDefaults(DefaultConfig().HealthCheck)}.Check(context.Background(), host))
+
+	check.ServerName = ""
+	assert.Error(t, HTTPCheck{check.withDefaults(DefaultConfig().HealthCheck)}.Check(context.Background(), host))
+}
+
+func TestTCPCheck(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	host, port := splitTestAddr(t, listener.Addr().String())
+	check := CheckConfig{Type: CheckTCP, Port: port}.withDefaults(DefaultConfig().HealthCheck)
+
+	assert.NoError(t, TCPCheck{check}.Check(context.Background(), host))
+
+	listener.Close()
+	assert.Error(t, TCPCheck{check}.Check(context.Background(), host))
+}
+
+func TestGRPCCheck(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	healthServer := health.NewServer()
+	healthServer.SetServingStatus("app.Orders", healthpb.HealthCheckResponse_NOT_SERVING)
+
+	server := grpc.NewServer()
+	healthpb.RegisterHealthServer(server, healthServer)
+	go server.Serve(listener)
+	defer server.Stop()
+
+	host, port := splitTestAddr(t, listener.Addr().String())
+	check := CheckConfig{Type: CheckGRPC, Port: port, Timeout: Duration(5 * time.Second)}.withDefaults(DefaultConfig().HealthCheck)
+
+	assert.NoError(t, GRPCCheck{check}.Check(context.Background(), host))
+
+	check.Service = "app.Orders"
+	if err := (GRPCCheck{check}).Check(context.Background(), host); assert.Error(t, err) {
+		assert.Equal(t, "gRPC health status is NOT_SERVING", err.Error())
+	}
+}
+
+type stubCheck struct {
+	name   string
+	failOn map[string]bool
+	calls  int
+}
+
+func (c *stubCheck) Name() string {
+	return c.name
+}
+
+func (c *stubCheck) Check(ctx context.Context, host string) error {
+	c.calls++
+	if c.failOn[host] {
+		return assert.AnError
+	}
+
+	return nil
+}
+
+func TestCheckInstanceReportsFailedCheck(t *testing.T) {
+	sleep = func(ctx context.Context, d time.Duration) error { return ctx.Err() }
+	defer func() { sleep = sleepContext }()
+
+	port := &stubCheck{name: "tcp:9000"}
+	ready := &stubCheck{name: "ready", failOn: map[string]bool{"10.0.0.2": true}}
+	checks := []HealthCheck{port, ready}
+
+	hc := DefaultConfig().HealthCheck
+	hc.Retries = 3
+
+	assert.NoError(t, checkInstance(context.Background(), checks, "10.0.0.1", hc))
+
+	err := checkInstance(context.Background(), checks, "10.0.0.2", hc)
+	if assert.Error(t, err) {
+		assert.True(t, strings.HasPrefix(err.Error(), "Health check ready failed on 10.0.0.2: "), err.Error())
+	}
+
+	// Every retry runs all checks until the first failure
+	assert.Equal(t, 4, port.calls)
+	assert.Equal(t, 4, ready.calls)
+}
+
+// slowCheck passes after the delay and records the highest number of concurrent checks
+type slowCheck struct {
+	delay   time.Duration
+	failOn  string
+	mu      sync.Mutex
+	running int
+	peak    int
+	hosts   []string
+}
+
+func (c *slowCheck) Name() string {
+	return "slow"
+}
+
+func (c *slowCheck) Check(ctx context.Context, host string) error {
+	c.mu.Lock()
+	c.running++
+	if c.running > c.peak {
+		c.peak = c.running
+	}
+	c.hosts = append(c.hosts, host)
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		c.running--
+		c.mu.Unlock()
+	}()
+
+	select {
+	case <-time.After(c.delay):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	if host == c.failOn {
+		return assert.AnError
+	}
+
+	return nil
+}
+
+func TestCheckInstancesParallelism(t *testing.T) {
+	check := &slowCheck{delay: 20 * time.Millisecond}
+	hosts := []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4", "10.0.0.5"}
+
+	hc := DefaultConfig().HealthCheck
+	hc.Parallelism = 2
+
+	assert.NoError(t, checkInstances(context.Background(), []HealthCheck{check}, hosts, hc))
+	assert.Equal(t, 2, check.peak)
+	assert.ElementsMatch(t, hosts, check.hosts)
+}
+
+func TestCheckInstancesStopsAfterFailure(t *testing.T) {
+	check := &slowCheck{delay: 20 * time.Millisecond, failOn: "10.0.0.1"}
+	hosts := []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}
+
+	hc := DefaultConfig().HealthCheck
+	hc.Parallelism = 1
+	hc.Retries = 1
+
+	err := checkInstances(context.Background(), []HealthCheck{check}, hosts, hc)
+	if assert.Error(t, err) {
+		assert.True(t, strings.HasPrefix(err.Error(), "Health check slow failed on 10.0.0.1"), err.Error())
+	}
+
+	// Waiting instances are not checked after the failure
+	assert.Equal(t, []string{"10.0.0.1"}, check.hosts)
+}
+
+func TestCheckInstancesDeadline(t *testing.T) {
+	check := &slowCheck{delay: time.Minute}
+
+	hc := DefaultConfig().HealthCheck
+	hc.Deadline = Duration(50 * time.Millisecond)
+
+	started := time.Now()
+	err := checkInstances(context.Background(), []HealthCheck{check}, []string{"10.0.0.1", "10.0.0.2"}, hc)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "Health check deadline 50ms exceeded")
+	}
+
+	assert.True(t, time.Since(started) < 5*time.Second)
+}
+
+func TestBackoff(t *testing.T) {
+	for attempt, max := range map[uint]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 10: 5 * time.Second} {
+		delay := backoff(attempt, time.Second, 5*time.Second)
+		assert.True(t, delay >= max/2 && delay <= max, "attempt %d: %s", attempt, delay)
+	}
+
+	assert.Equal(t, time.Duration(0), backoff(3, 0, time.Minute))
+}
+
+func TestHealthCheckConfigChecks(t *testing.T) {
+	hc := DefaultConfig().HealthCheck
+	hc.Port = 8080
+	hc.Checks = []CheckConfig{
+		{Type: CheckHTTP, Path: "/ready"},
+		{Type: CheckTCP, Port: 9000},
+		{Name: "orders", Type: CheckGRPC, Port: 8080, Service: "app.Orders"},
+	}
+
+	checks := hc.healthChecks()
+	if assert.Len(t, checks, 3) {
+		assert.Equal(t, "http:8080", checks[0].Name())
+		assert.Equal(t, "/ready", checks[0].(HTTPCheck).Config.Path)
+		assert.Equal(t, "tcp:9000", checks[1].Name())
+		assert.Equal(t, "orders", checks[2].Name())
+	}
+
+	assert.Equal(t, []int64{8080, 9000}, hc.ports())
+
+	hc.Checks = nil
+	assert.Equal(t, []int64{8080}, hc.ports())
+}
+
+func TestValidateChecks(t *testing.T) {
+	for _, check := range []CheckConfig{
+		{Type: "udp"},
+		{Type: CheckTCP, Port: 70000},
+		{Type: CheckHTTP, Scheme: "ftp"},
+		{Type: CheckHTTP, Path: "ready"},
+		{Type: CheckHTTP, ExpectedCodes: []int{42}},
+		{Type: CheckHTTP, BodyRegex: "("},
+		{Type: CheckHTTP, JSONValue: "ok"},
+	} {
+		config := DefaultConfig()
+		config.NewAMI = "ami-456"
+		config.Selector.AMI = "ami-123"
+		config.HealthCheck.Checks = []CheckConfig{check}
+
+		assert.Error(t, config.Validate(), "%+v", check)
+	}
+
+	config := DefaultConfig()
+	config.NewAMI = "ami-456"
+	config.Selector.AMI = "ami-123"
+	config.HealthCheck.Checks = []CheckConfig{{Type: CheckTCP}}
+	assert.NoError(t, config.Validate())
+
+	config.HealthCheck.Mode = HealthCheckSSM
+	assert.Error(t, config.Validate())
+}
+
+func TestPipelineAuthorizesCheckPorts(t *testing.T) {
+	fake, config := newFakeDeployment()
+	config.HealthCheck.Checks = []CheckConfig{
+		{Type: CheckHTTP},
+		{Type: CheckHTTP, Port: 8080, Path: "/ready"},
+	}
+
+	authorized := []int64{}
+	for _, action := range newActions(config, fake.clients()) {
+		if authorize, ok := action.(AuthorizeSecurityGroupsAction); ok {
+			authorized = append(authorized, authorize.Port)
+		}
+	}
+
+	assert.Equal(t, []int64{80, 8080}, authorized)
+
+	if _, err := runFakeDeployment(fake, config); err != nil {
+		t.Fatalf("Unexpected error from deployment with checks: %s", err.Error())
+	}
+}
+
+func TestAuthorizeSecurityGroupsActionRollsBackEveryPort(t *testing.T) {
+	fake, _ := newFakeDeployment()
+	ports := []AuthorizeSecurityGroupsAction{{fake.clients().EC2, 8080}, {fake.clients().EC2, 9000}}
+	info := &PipelineInfo{
+		ClientIP:     "203.0.113.10",
+		OldInstances: []ShortInstanceDesc{{ID: "i-old-1", SecurityGroupsIds: []*string{aws.String("sg-1")}}},
+	}
+
+	for _, act := range ports {
+		assert.NoError(t, act.Commit(context.Background(), info))
+	}
+	assert.Len(t, fake.rules("sg-1"), 2)
+
+	// Steps are rolled back in the reverse order, each one revokes only its own port
+	fake.failures["RevokeSecurityGroupIngress"] = errors.New("InternalError: try again")
+	assert.Error(t, ports[1].Rollback(context.Background(), info))
+	assert.Equal(t, []string{"Security group sg-1 rule tcp/9000 from 203.0.113.10/32"}, ports[1].Leftovers(info))
+	assert.Equal(t, []string{"Security group sg-1 rule tcp/8080 from 203.0.113.10/32"}, ports[0].Leftovers(info))
+
+	delete(fake.failures, "RevokeSecurityGroupIngress")
+	assert.NoError(t, ports[1].Rollback(context.Background(), info))
+	assert.NoError(t, ports[0].Rollback(context.Background(), info))
+	assert.Empty(t, fake.rules("sg-1"))
+	assert.Empty(t, info.ModifiedSecurityGroups)
+}
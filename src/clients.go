@@ -0,0 +1,78 @@
+package main
+
+import (
+    "github.com/aws/aws-sdk-go/aws/request"
+    "github.com/aws/aws-sdk-go/aws/session"
+    "github.com/aws/aws-sdk-go/service/autoscaling"
+    "github.com/aws/aws-sdk-go/service/autoscaling/autoscalingiface"
+    "github.com/aws/aws-sdk-go/service/cloudwatch"
+    "github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
+    "github.com/aws/aws-sdk-go/service/ec2"
+    "github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+    "github.com/aws/aws-sdk-go/service/elbv2"
+    "github.com/aws/aws-sdk-go/service/elbv2/elbv2iface"
+    "github.com/aws/aws-sdk-go/service/kms"
+    "github.com/aws/aws-sdk-go/service/kms/kmsiface"
+    "github.com/aws/aws-sdk-go/service/ssm"
+    "github.com/aws/aws-sdk-go/service/ssm/ssmiface"
+    "github.com/aws/aws-sdk-go/service/sts"
+    "github.com/aws/aws-sdk-go/service/sts/stsiface"
+)
+
+// awsClients keeps AWS service clients used by the pipeline. Tests replace them with fakes.
+type awsClients struct {
+    EC2 ec2iface.EC2API
+    ELBV2 elbv2iface.ELBV2API
+    CloudWatch cloudwatchiface.CloudWatchAPI
+    AutoScaling autoscalingiface.AutoScalingAPI
+    SSM ssmiface.SSMAPI
+    KMS kmsiface.KMSAPI
+    STS stsiface.STSAPI
+}
+
+func newClients(sess *session.Session) awsClients {
+    return awsClients{
+        EC2: ec2.New(sess),
+        ELBV2: elbv2.New(sess),
+        CloudWatch: cloudwatch.New(sess),
+        AutoScaling: autoscaling.New(sess),
+        SSM: ssm.New(sess),
+        KMS: kms.New(sess),
+        STS: sts.New(sess),
+    }
+}
+
+// handlers returns request handlers of clients created from the session. Fake clients have no handlers.
+func (c awsClients) handlers() []*request.Handlers {
+    handlers := []*request.Handlers{}
+
+    if svc, ok := c.EC2.(*ec2.EC2); ok {
+        handlers = append(handlers, &svc.Handlers)
+    }
+
+    if svc, ok := c.ELBV2.(*elbv2.ELBV2); ok {
+        handlers = append(handlers, &svc.Handlers)
+    }
+
+    if svc, ok := c.CloudWatch.(*cloudwatch.CloudWatch); ok {
+        handlers = append(handlers, &svc.Handlers)
+    }
+
+    if svc, ok := c.AutoScaling.(*autoscaling.AutoScaling); ok {
+        handlers = append(handlers, &svc.Handlers)
+    }
+
+    if svc, ok := c.SSM.(*ssm.SSM); ok {
+        handlers = append(handlers, &svc.Handlers)
+    }
+
+    if svc, ok := c.KMS.(*kms.KMS); ok {
+        handlers = append(handlers, &svc.Handlers)
+    }
+
+    if svc, ok := c.STS.(*sts.STS); ok {
+        handlers = append(handlers, &svc.Handlers)
+    }
+
+    return handlers
+}
@@ -0,0 +1,839 @@
+package main
+
+import (
+    "gopkg.in/yaml.v2"
+
+    "encoding/json"
+    "errors"
+    "flag"
+    "fmt"
+    "io/ioutil"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// Deployment strategies
+const (
+    StrategyAllAtOnce = "all-at-once"
+    StrategyRolling = "rolling"
+    StrategyCanary = "canary"
+    StrategyBlueGreen = "blue-green"
+    StrategyAutoScaling = "asg"
+)
+
+// Health check modes
+const (
+    // HealthCheckPublicIP requests public IPs of new instances. Security groups are opened for this machine.
+    HealthCheckPublicIP = "public-ip"
+    // HealthCheckPrivateIP requests private IPs of new instances, when the deployment runs inside the VPC
+    HealthCheckPrivateIP = "private-ip"
+    // HealthCheckTargetHealth relies on the health check of the load balancer
+    HealthCheckTargetHealth = "target-health"
+    // HealthCheckSSM requests the application with curl executed on new instances by the SSM Run Command
+    HealthCheckSSM = "ssm"
+)
+
+// Region modes of the multi-region deployment
+const (
+    RegionModeSequential = "sequential"
+    RegionModeParallel = "parallel"
+)
+
+// Duration is a time.Duration written as "90s" or "5m" in the deployment spec
+type Duration time.Duration
+
+// UnmarshalYAML parses the duration string
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+    var value string
+    if err := unmarshal(&value); err != nil {
+        return err
+    }
+
+    duration, err := time.ParseDuration(value)
+    if err != nil {
+        return err
+    }
+
+    *d = Duration(duration)
+    return nil
+}
+
+// MarshalJSON writes the duration as a string, so the state file stays readable
+func (d Duration) MarshalJSON() ([]byte, error) {
+    return json.Marshal(time.Duration(d).String())
+}
+
+// UnmarshalJSON parses the duration string
+func (d *Duration) UnmarshalJSON(data []byte) error {
+    var value string
+    if err := json.Unmarshal(data, &value); err != nil {
+        return err
+    }
+
+    duration, err := time.ParseDuration(value)
+    if err != nil {
+        return err
+    }
+
+    *d = Duration(duration)
+    return nil
+}
+
+// SelectorConfig describes instances replaced by the deployment. All given criteria have to match.
+type SelectorConfig struct {
+    AMI string `yaml:"ami" json:"ami"`
+    Tags map[string]string `yaml:"tags" json:"tags"`
+    VpcID string `yaml:"vpc_id" json:"vpc_id"`
+    SubnetIDs []string `yaml:"subnet_ids" json:"subnet_ids"`
+    InstanceIDs []string `yaml:"instance_ids" json:"instance_ids"`
+}
+
+// isEmpty is true when the selector would match all instances of the region
+func (s SelectorConfig) isEmpty() bool {
+    return s.AMI == "" && len(s.Tags) == 0 && s.VpcID == "" && len(s.SubnetIDs) == 0 && len(s.InstanceIDs) == 0
+}
+
+// String describes the selector in the plan and logs
+func (s SelectorConfig) String() string {
+    parts := []string{}
+
+    if s.AMI != "" {
+        parts = append(parts, s.AMI)
+    }
+
+    keys := make([]string, 0, len(s.Tags))
+    for key := range s.Tags {
+        keys = append(keys, key)
+    }
+    sort.Strings(keys)
+
+    for _, key := range keys {
+        parts = append(parts, key+"="+s.Tags[key])
+    }
+
+    if s.VpcID != "" {
+        parts = append(parts, s.VpcID)
+    }
+
+    parts = append(parts, s.SubnetIDs...)
+    parts = append(parts, s.InstanceIDs...)
+
+    return strings.Join(parts, ", ")
+}
+
+// parseTags parses comma separated list of Key=Value pairs
+func parseTags(tags string) (map[string]string, error) {
+    result := map[string]string{}
+
+    for _, tag := range strings.Split(tags, ",") {
+        pair := strings.SplitN(strings.TrimSpace(tag), "=", 2)
+        if len(pair) != 2 || pair[0] == "" {
+            return nil, fmt.Errorf("Invalid tag %s. Expected Key=Value", tag)
+        }
+
+        result[pair[0]] = pair[1]
+    }
+
+    return result, nil
+}
+
+// splitList parses comma separated list of IDs
+func splitList(list string) []string {
+    result := []string{}
+
+    for _, item := range strings.Split(list, ",") {
+        if item = strings.TrimSpace(item); item != "" {
+            result = append(result, item)
+        }
+    }
+
+    return result
+}
+
+// HealthCheckConfig describes the application check of new instances
+type HealthCheckConfig struct {
+    Mode string `yaml:"mode" json:"mode"`
+    Scheme string `yaml:"scheme" json:"scheme"`
+    Port int64 `yaml:"port" json:"port"`
+    Path string `yaml:"path" json:"path"`
+    ExpectedCodes []int `yaml:"expected_codes" json:"expected_codes"`
+    Retries uint `yaml:"retries" json:"retries"`
+    // Interval is the delay after the first failed attempt. It doubles up to MaxInterval with every next attempt.
+    Interval Duration `yaml:"interval" json:"interval"`
+    MaxInterval Duration `yaml:"max_interval" json:"max_interval"`
+    // Parallelism limits the number of instances checked at the same time
+    Parallelism int `yaml:"parallelism" json:"parallelism"`
+    // Deadline limits the check of all new instances. Zero disables the limit.
+    Deadline Duration `yaml:"deadline" json:"deadline"`
+    // Checks replace the single HTTP check described by the fields above. All of them must pass.
+    Checks []CheckConfig `yaml:"checks" json:"checks"`
+}
+
+// TimeoutsConfig limits waiting for AWS resources
+type TimeoutsConfig struct {
+    InstanceRunning Duration `yaml:"instance_running" json:"instance_running"`
+    TargetDeregistration Duration `yaml:"target_deregistration" json:"target_deregistration"`
+    TargetHealthy Duration `yaml:"target_healthy" json:"target_healthy"`
+    ImageAvailable Duration `yaml:"image_available" json:"image_available"`
+}
+
+// StrategyConfig describes how instances are replaced
+type StrategyConfig struct {
+    Type string `yaml:"type" json:"type"`
+    BatchSize int `yaml:"batch_size" json:"batch_size"`
+    BatchPercent int `yaml:"batch_percent" json:"batch_percent"`
+    CanaryBakeTime Duration `yaml:"canary_bake_time" json:"canary_bake_time"`
+    CanaryMaxErrors float64 `yaml:"canary_max_errors" json:"canary_max_errors"`
+    TrafficSteps []int64 `yaml:"traffic_steps" json:"traffic_steps"`
+    TrafficStepInterval Duration `yaml:"traffic_step_interval" json:"traffic_step_interval"`
+    MinHealthyPercentage int64 `yaml:"min_healthy_percentage" json:"min_healthy_percentage"`
+}
+
+// SecurityGroupsConfig describes changes of security groups made for the health check
+type SecurityGroupsConfig struct {
+    // Authorize opens the health check port for the deploying machine. It applies only to the public IP health check.
+    Authorize bool `yaml:"authorize" json:"authorize"`
+}
+
+// SmokeTestsConfig describes the suite of requests run against every new instance after the health check
+type SmokeTestsConfig struct {
+    File string `yaml:"file" json:"file"`
+    // Report is the path of the JUnit XML report with results of the suite
+    Report string `yaml:"report" json:"report"`
+}
+
+// RegionConfig is a single target of the multi-region deployment
+type RegionConfig struct {
+    // Name tells apart targets in the same region, e.g. staging and production accounts. It is the region by default.
+    Name string `yaml:"name" json:"name"`
+    Region string `yaml:"region" json:"region"`
+    // Credentials replace the credentials of the deployment in the target
+    Credentials CredentialsConfig `yaml:"credentials" json:"credentials"`
+    // NewAMI is the AMI deployed in the region. The new AMI of the deployment is used in its own region
+    // and copied to other regions with copy_ami.
+    NewAMI string `yaml:"new_ami" json:"new_ami"`
+    // OldAMI selects instances in the region, when they are selected by the AMI
+    OldAMI string `yaml:"old_ami" json:"old_ami"`
+}
+
+func (r RegionConfig) name() string {
+    if r.Name != "" {
+        return r.Name
+    }
+
+    return r.Region
+}
+
+// MultiRegionConfig describes regions of the deployment. The deployment runs only in the region of the config,
+// when the list is empty.
+type MultiRegionConfig struct {
+    Regions []RegionConfig `yaml:"regions" json:"regions"`
+    // Mode is sequential or parallel
+    Mode string `yaml:"mode" json:"mode"`
+    // CopyAMI copies the new AMI from the region of the config to regions without their own AMI
+    CopyAMI bool `yaml:"copy_ami" json:"copy_ami"`
+}
+
+// LoggingConfig describes the deployment output
+type LoggingConfig struct {
+    // Format is text or json
+    Format string `yaml:"format" json:"format"`
+    // Level is the lowest level of logged entries: debug, info, warning or error
+    Level string `yaml:"level" json:"level"`
+    // Report is the path of the JSON report. It is deploy_<VERSION>.report.json by default.
+    Report string `yaml:"report" json:"report"`
+}
+
+// Config is the deployment spec. It is loaded from the file, overridden by the command line flags
+// and recorded in the state file, so resumed deployment runs with the same settings.
+type Config struct {
+    Region string `yaml:"region" json:"region"`
+    Credentials CredentialsConfig `yaml:"credentials" json:"credentials"`
+    NewAMI string `yaml:"new_ami" json:"new_ami"`
+    Selector SelectorConfig `yaml:"selector" json:"selector"`
+    HealthCheck HealthCheckConfig `yaml:"health_check" json:"health_check"`
+    Timeouts TimeoutsConfig `yaml:"timeouts" json:"timeouts"`
+    Strategy StrategyConfig `yaml:"strategy" json:"strategy"`
+    SecurityGroups SecurityGroupsConfig `yaml:"security_groups" json:"security_groups"`
+    SmokeTests SmokeTestsConfig `yaml:"smoke_tests" json:"smoke_tests"`
+    Logging LoggingConfig `yaml:"logging" json:"logging"`
+    Notifications []NotificationConfig `yaml:"notifications" json:"notifications"`
+    Hooks []HookConfig `yaml:"hooks" json:"hooks"`
+    MultiRegion MultiRegionConfig `yaml:"multi_region" json:"multi_region"`
+    ImageSharing ImageSharingConfig `yaml:"image_sharing" json:"image_sharing"`
+    ImageValidation ImageValidationConfig `yaml:"image_validation" json:"image_validation"`
+}
+
+// DefaultConfig returns the config used for values missing in the file and flags
+func DefaultConfig() Config {
+    return Config{
+        Region: "us-east-1",
+        HealthCheck: HealthCheckConfig{
+            Mode: HealthCheckPublicIP,
+            Scheme: "http",
+            Port: 80,
+            Path: "/",
+            Retries: 10,
+            Interval: Duration(15 * time.Second),
+            MaxInterval: Duration(time.Minute),
+            Parallelism: 10,
+            Deadline: Duration(15 * time.Minute),
+        },
+        Timeouts: TimeoutsConfig{
+            InstanceRunning: Duration(10 * time.Minute),
+            TargetDeregistration: Duration(10 * time.Minute),
+            TargetHealthy: Duration(10 * time.Minute),
+            ImageAvailable: Duration(30 * time.Minute),
+        },
+        Strategy: StrategyConfig{
+            Type: StrategyAllAtOnce,
+            CanaryBakeTime: Duration(10 * time.Minute),
+            TrafficSteps: []int64{10, 50, 100},
+            TrafficStepInterval: Duration(5 * time.Minute),
+            MinHealthyPercentage: 90,
+        },
+        SecurityGroups: SecurityGroupsConfig{Authorize: true},
+        MultiRegion: MultiRegionConfig{Mode: RegionModeSequential},
+        Logging: LoggingConfig{Format: LogFormatText, Level: LevelInfo},
+    }
+}
+
+// loadConfig reads the YAML or JSON spec on top of the default config. Unknown keys are rejected.
+func loadConfig(path string) (Config, error) {
+    config := DefaultConfig()
+
+    data, err := ioutil.ReadFile(path)
+    if err != nil {
+        return config, err
+    }
+
+    // JSON document is valid YAML, so both formats are read by the same parser
+    if err := yaml.UnmarshalStrict(data, &config); err != nil {
+        return config, fmt.Errorf("Invalid config file %s: %s", path, err.Error())
+    }
+
+    return config, nil
+}
+
+// validateTrafficSteps checks the blue/green steps are increasing percents ending with 100
+func validateTrafficSteps(steps []int64) error {
+    previous := int64(0)
+
+    for _, weight := range steps {
+        if weight <= previous || weight > 100 {
+            return errors.New("Invalid traffic steps. Expected increasing percents ending with 100")
+        }
+
+        previous = weight
+    }
+
+    if previous != 100 {
+        return errors.New("Invalid traffic steps. Expected increasing percents ending with 100")
+    }
+
+    return nil
+}
+
+// healthCheckURL returns the address of the application health check on the given host
+func (c HealthCheckConfig) healthCheckURL(host string) string {
+    return fmt.Sprintf("%s://%s:%d%s", c.Scheme, host, c.Port, c.Path)
+}
+
+// isExpectedCode checks the status code against the expected codes. Without them any 2XX or 3XX code is valid.
+func (c HealthCheckConfig) isExpectedCode(code int) bool {
+    return isExpectedStatus(c.ExpectedCodes, code)
+}
+
+// parseStatusCodes parses comma separated list of HTTP status codes
+func parseStatusCodes(codes string) ([]int, error) {
+    result := []int{}
+
+    for _, code := range strings.Split(codes, ",") {
+        value, err := strconv.Atoi(strings.TrimSpace(code))
+        if err != nil {
+            return nil, fmt.Errorf("Invalid status code %s", code)
+        }
+
+        result = append(result, value)
+    }
+
+    return result, nil
+}
+
+// Validate checks the config before any change is made
+func (c Config) Validate() error {
+    if c.Region == "" {
+        return errors.New("Region is required")
+    }
+
+    if c.NewAMI == "" {
+        return errors.New("New AMI is required")
+    }
+
+    if c.Selector.isEmpty() {
+        return errors.New("Instance selector is required. Use old AMI, tags, VPC, subnets or instance IDs")
+    }
+
+    hc := c.HealthCheck
+    switch hc.Mode {
+    case HealthCheckPublicIP, HealthCheckPrivateIP, HealthCheckTargetHealth, HealthCheckSSM:
+    default:
+        return fmt.Errorf("Unknown health check mode %s", hc.Mode)
+    }
+
+    if hc.Scheme != "http" && hc.Scheme != "https" {
+        return fmt.Errorf("Invalid health check scheme %s. Expected http or https", hc.Scheme)
+    }
+
+    if hc.Port < 1 || hc.Port > 65535 {
+        return fmt.Errorf("Invalid health check port %d", hc.Port)
+    }
+
+    if !strings.HasPrefix(hc.Path, "/") {
+        return fmt.Errorf("Invalid health check path %s. Expected path starting with /", hc.Path)
+    }
+
+    for _, code := range hc.ExpectedCodes {
+        if code < 100 || code > 599 {
+            return fmt.Errorf("Invalid expected status code %d", code)
+        }
+    }
+
+    if hc.Retries < 1 || hc.Interval < 0 {
+        return errors.New("Health check requires at least one retry and non-negative interval")
+    }
+
+    if hc.MaxInterval < 0 || hc.Parallelism < 1 || hc.Deadline < 0 {
+        return errors.New("Health check requires non-negative max interval and deadline and parallelism of at least 1")
+    }
+
+    if len(hc.Checks) > 0 && hc.Mode != HealthCheckPublicIP && hc.Mode != HealthCheckPrivateIP {
+        return fmt.Errorf("Checks are not supported in health check mode %s", hc.Mode)
+    }
+
+    for _, check := range hc.Checks {
+        if err := check.validate(); err != nil {
+            return err
+        }
+    }
+
+    if c.SmokeTests.File != "" && hc.Mode != HealthCheckPublicIP && hc.Mode != HealthCheckPrivateIP {
+        return fmt.Errorf("Smoke tests are not supported in health check mode %s", hc.Mode)
+    }
+
+    if c.SmokeTests.Report != "" && c.SmokeTests.File == "" {
+        return errors.New("Smoke test report requires the smoke test suite")
+    }
+
+    if c.Logging.Format != LogFormatText && c.Logging.Format != LogFormatJSON {
+        return fmt.Errorf("Invalid log format %s. Expected text or json", c.Logging.Format)
+    }
+
+    if _, ok := logLevels[c.Logging.Level]; !ok {
+        return fmt.Errorf("Invalid log level %s. Expected debug, info, warning or error", c.Logging.Level)
+    }
+
+    for _, notification := range c.Notifications {
+        if err := notification.validate(); err != nil {
+            return err
+        }
+    }
+
+    for _, hook := range c.Hooks {
+        if err := hook.validate(); err != nil {
+            return err
+        }
+    }
+
+    if err := c.validateRegions(); err != nil {
+        return err
+    }
+
+    if err := c.ImageSharing.Credentials.validate(); err != nil {
+        return fmt.Errorf("Image sharing: %s", err.Error())
+    }
+
+    t := c.Timeouts
+    if t.InstanceRunning <= 0 || t.TargetDeregistration <= 0 || t.TargetHealthy <= 0 || t.ImageAvailable <= 0 {
+        return errors.New("Timeouts must be positive")
+    }
+
+    s := c.Strategy
+    if s.BatchSize < 0 || s.BatchPercent < 0 || s.BatchPercent > 100 || (s.BatchSize > 0 && s.BatchPercent > 0) {
+        return errors.New("Use either batch size or batch percent with value in range <1; 100>")
+    }
+
+    batches := s.BatchSize > 0 || s.BatchPercent > 0
+
+    switch s.Type {
+    case StrategyAllAtOnce:
+        if batches {
+            return fmt.Errorf("Batches require %s or %s strategy", StrategyRolling, StrategyCanary)
+        }
+    case StrategyRolling:
+        if !batches {
+            return errors.New("Rolling strategy requires batch size or batch percent")
+        }
+    case StrategyCanary:
+        if s.CanaryBakeTime <= 0 || s.CanaryMaxErrors < 0 {
+            return errors.New("Canary requires positive bake time and non-negative max errors")
+        }
+    case StrategyBlueGreen, StrategyAutoScaling:
+        if batches {
+            return fmt.Errorf("Strategy %s cannot be combined with batches", s.Type)
+        }
+
+        if s.Type == StrategyBlueGreen {
+            if err := validateTrafficSteps(s.TrafficSteps); err != nil {
+                return err
+            }
+        } else if s.MinHealthyPercentage < 0 || s.MinHealthyPercentage > 100 {
+            return errors.New("Minimum healthy percentage must be in range <0; 100>")
+        }
+    default:
+        return fmt.Errorf("Unknown strategy %s", s.Type)
+    }
+
+    // Steps are only built here, clients are not called
+    return validateHookSteps(newPipeline(c, func(config Config) awsClients { return awsClients{} }), c.Hooks)
+}
+
+// validateRegions checks every region gets the new AMI and its instances can be selected
+func (c Config) validateRegions() error {
+    m := c.MultiRegion
+    if m.Mode != RegionModeSequential && m.Mode != RegionModeParallel {
+        return fmt.Errorf("Invalid region mode %s. Expected sequential or parallel", m.Mode)
+    }
+
+    if err := c.Credentials.validate(); err != nil {
+        return err
+    }
+
+    names := map[string]bool{}
+
+    for _, region := range m.Regions {
+        if region.Region == "" {
+            return errors.New("Region name is required")
+        }
+
+        if names[region.name()] {
+            return fmt.Errorf("Region %s is listed more than once. Targets in the same region need different names", region.name())
+        }
+        names[region.name()] = true
+
+        if err := region.Credentials.validate(); err != nil {
+            return fmt.Errorf("Region %s: %s", region.name(), err.Error())
+        }
+
+        if region.Region == c.Region {
+            continue
+        }
+
+        if region.NewAMI == "" && !m.CopyAMI {
+            return fmt.Errorf("Region %s requires new AMI or copy AMI", region.Region)
+        }
+
+        // AMI, VPC, subnet and instance IDs differ between regions. Only tags match instances everywhere.
+        if c.Selector.AMI != "" && region.OldAMI == "" {
+            return fmt.Errorf("Region %s requires old AMI, because instances are selected by the AMI", region.Region)
+        }
+
+        if c.Selector.VpcID != "" || len(c.Selector.SubnetIDs) > 0 || len(c.Selector.InstanceIDs) > 0 {
+            return errors.New("Instances in multiple regions can be selected only by AMI or tags")
+        }
+    }
+
+    return nil
+}
+
+// regionConfig returns the config of the deployment in the region
+func (c Config) regionConfig(region RegionConfig) Config {
+    config := c
+    config.Region = region.Region
+    config.MultiRegion = MultiRegionConfig{Mode: c.MultiRegion.Mode}
+
+    if !region.Credentials.isEmpty() {
+        config.Credentials = region.Credentials
+    }
+
+    if region.NewAMI != "" {
+        config.NewAMI = region.NewAMI
+    }
+
+    if region.OldAMI != "" {
+        config.Selector.AMI = region.OldAMI
+    }
+
+    return config
+}
+
+// copiesImage is true when the new AMI is copied to the region
+func (c Config) copiesImage(region RegionConfig) bool {
+    return c.MultiRegion.CopyAMI && region.NewAMI == "" && region.Region != c.Region
+}
+
+// sharesImage is true when the new AMI of the config is shared with the account of the region
+func (c Config) sharesImage(region RegionConfig) bool {
+    return c.ImageSharing.Enabled && region.NewAMI == ""
+}
+
+// ownerConfig returns the config of the account owning the new AMI in the region of the config
+func (c Config) ownerConfig() Config {
+    config := c
+    config.Credentials = c.ImageSharing.Credentials
+    config.MultiRegion = MultiRegionConfig{Mode: c.MultiRegion.Mode}
+
+    return config
+}
+
+// parseRegions parses comma separated list of regions with optional AMIs, e.g. us-east-1,eu-west-1=ami-123
+func parseRegions(regions string) ([]RegionConfig, error) {
+    result := []RegionConfig{}
+
+    for _, item := range splitList(regions) {
+        pair := strings.SplitN(item, "=", 2)
+        region := RegionConfig{Region: pair[0]}
+
+        if len(pair) == 2 {
+            if pair[1] == "" {
+                return nil, fmt.Errorf("Invalid region %s. Expected REGION or REGION=NEW_AMI", item)
+            }
+
+            region.NewAMI = pair[1]
+        }
+
+        result = append(result, region)
+    }
+
+    return result, nil
+}
+
+// configFlags are the command line flags overriding the deployment spec
+type configFlags struct {
+    region *string
+    tags *string
+    vpcID *string
+    subnetIDs *string
+    instanceIDs *string
+    strategy *string
+    batchSize *int
+    batchPercent *int
+    canary *bool
+    canaryBakeTime *time.Duration
+    canaryMaxErrors *float64
+    blueGreen *bool
+    trafficSteps *string
+    trafficStepInterval *time.Duration
+    autoScaling *bool
+    healthCheckMode *string
+    healthCheckPort *int64
+    healthCheckPath *string
+    healthCheckCodes *string
+    healthCheckRetries *uint
+    healthCheckInterval *time.Duration
+    healthCheckParallelism *int
+    healthCheckDeadline *time.Duration
+    authorizeSecurityGroups *bool
+    smokeTests *string
+    junitReport *string
+    logFormat *string
+    logLevel *string
+    report *string
+    slackWebhook *string
+    notifyCommand *string
+    regions *string
+    regionMode *string
+    copyAMI *bool
+    shareAMI *bool
+    requiredAMITags *string
+    profile *string
+    roleARN *string
+    externalID *string
+    mfaSerial *string
+}
+
+func newConfigFlags(fs *flag.FlagSet) *configFlags {
+    defaults := DefaultConfig()
+
+    return &configFlags{
+        region: fs.String("region", defaults.Region, "AWS region of the deployment"),
+        tags: fs.String("tags", "", "Select old instances by comma separated Key=Value tags, e.g. App=web,Env=prod"),
+        vpcID: fs.String("vpc", "", "Select old instances in the VPC"),
+        subnetIDs: fs.String("subnets", "", "Select old instances in one of comma separated subnets"),
+        instanceIDs: fs.String("instance-ids", "", "Select comma separated old instances"),
+        strategy: fs.String("strategy", defaults.Strategy.Type, "Deployment strategy: all-at-once, rolling, canary, blue-green or asg"),
+        batchSize: fs.Int("batch-size", 0, "Replace instances in batches of the given size"),
+        batchPercent: fs.Int("batch-percent", 0, "Replace instances in batches of the given percent of the fleet"),
+        canary: fs.Bool("canary", false, "Replace a single instance first and observe it before replacing the rest. Same as --strategy canary"),
+        canaryBakeTime: fs.Duration("canary-bake-time", time.Duration(defaults.Strategy.CanaryBakeTime), "How long the canary instance is observed"),
+        canaryMaxErrors: fs.Float64("canary-max-errors", 0, "Maximum number of 5XX responses of target groups during the canary stage"),
+        blueGreen: fs.Bool("blue-green", false, "Shift traffic to new instances with weighted target groups. Same as --strategy blue-green"),
+        trafficSteps: fs.String("traffic-steps", "10,50,100", "Percents of traffic sent to new instances in the following blue/green steps"),
+        trafficStepInterval: fs.Duration("traffic-step-interval", time.Duration(defaults.Strategy.TrafficStepInterval), "Time between blue/green traffic steps"),
+        autoScaling: fs.Bool("asg", false, "Replace instances of Auto Scaling Groups with a new launch template version and instance refresh. Same as --strategy asg"),
+        healthCheckMode: fs.String("health-check-mode", defaults.HealthCheck.Mode, "How new instances are checked: public-ip, private-ip, target-health or ssm"),
+        healthCheckPort: fs.Int64("health-check-port", defaults.HealthCheck.Port, "Port of the application health check"),
+        healthCheckPath: fs.String("health-check-path", defaults.HealthCheck.Path, "Path of the application health check"),
+        healthCheckCodes: fs.String("health-check-codes", "", "Comma separated list of expected health check status codes. Any 2XX or 3XX code by default"),
+        healthCheckRetries: fs.Uint("health-check-retries", defaults.HealthCheck.Retries, "Number of health check attempts"),
+        healthCheckInterval: fs.Duration("health-check-interval", time.Duration(defaults.HealthCheck.Interval), "Delay after the first failed health check attempt. It doubles with every next attempt"),
+        healthCheckParallelism: fs.Int("health-check-parallelism", defaults.HealthCheck.Parallelism, "Number of instances checked at the same time"),
+        healthCheckDeadline: fs.Duration("health-check-deadline", time.Duration(defaults.HealthCheck.Deadline), "Time limit of the health check of all new instances. Zero disables the limit"),
+        authorizeSecurityGroups: fs.Bool("authorize-sg", defaults.SecurityGroups.Authorize, "Open the health check port for this machine in security groups of instances"),
+        smokeTests: fs.String("smoke-tests", "", "YAML or JSON suite of requests run against every new instance before registration"),
+        junitReport: fs.String("junit-report", "", "Write results of the smoke tests to the JUnit XML file"),
+        logFormat: fs.String("log-format", defaults.Logging.Format, "Format of the output: text or json"),
+        logLevel: fs.String("log-level", defaults.Logging.Level, "Lowest level of logged entries: debug, info, warning or error"),
+        report: fs.String("report", "", "Path of the JSON deployment report. deploy_<VERSION>.report.json by default"),
+        slackWebhook: fs.String("slack-webhook", "", "Send deployment events to the Slack incoming webhook URL"),
+        notifyCommand: fs.String("notify-command", "", "Run the shell command for every deployment event"),
+        regions: fs.String("regions", "", "Deploy to comma separated regions with optional AMIs, e.g. us-east-1,eu-west-1=ami-123"),
+        regionMode: fs.String("region-mode", defaults.MultiRegion.Mode, "How regions are deployed: sequential or parallel"),
+        copyAMI: fs.Bool("copy-ami", false, "Copy the new AMI to regions without their own AMI"),
+        requiredAMITags: fs.String("required-ami-tags", "", "Comma separated Key=Value tags the new AMI must have, e.g. BuildStatus=passed"),
+        shareAMI: fs.Bool("share-ami", false, "Share the new AMI owned by the default credentials with accounts of the deployment"),
+        profile: fs.String("profile", "", "Profile of the shared AWS config and credentials files"),
+        roleARN: fs.String("role-arn", "", "Assume the IAM role for the deployment"),
+        externalID: fs.String("external-id", "", "External ID required by the assumed role"),
+        mfaSerial: fs.String("mfa-serial", "", "MFA device required by the assumed role"),
+    }
+}
+
+// apply overrides the config with the flags set explicitly in the command line
+func (f *configFlags) apply(fs *flag.FlagSet, config *Config) error {
+    var err error
+    strategies := map[string]bool{}
+
+    fs.Visit(func(fl *flag.Flag) {
+        switch fl.Name {
+        case "region":
+            config.Region = *f.region
+        case "tags":
+            tags, tagsErr := parseTags(*f.tags)
+            if tagsErr != nil {
+                err = tagsErr
+            }
+            config.Selector.Tags = tags
+        case "vpc":
+            config.Selector.VpcID = *f.vpcID
+        case "subnets":
+            config.Selector.SubnetIDs = splitList(*f.subnetIDs)
+        case "instance-ids":
+            config.Selector.InstanceIDs = splitList(*f.instanceIDs)
+        case "strategy":
+            strategies[*f.strategy] = true
+        case "canary":
+            if *f.canary {
+                strategies[StrategyCanary] = true
+            }
+        case "blue-green":
+            if *f.blueGreen {
+                strategies[StrategyBlueGreen] = true
+            }
+        case "asg":
+            if *f.autoScaling {
+                strategies[StrategyAutoScaling] = true
+            }
+        case "batch-size":
+            config.Strategy.BatchSize = *f.batchSize
+        case "batch-percent":
+            config.Strategy.BatchPercent = *f.batchPercent
+        case "canary-bake-time":
+            config.Strategy.CanaryBakeTime = Duration(*f.canaryBakeTime)
+        case "canary-max-errors":
+            config.Strategy.CanaryMaxErrors = *f.canaryMaxErrors
+        case "traffic-steps":
+            steps, stepsErr := parseTrafficSteps(*f.trafficSteps)
+            if stepsErr != nil {
+                err = stepsErr
+            }
+            config.Strategy.TrafficSteps = steps
+        case "traffic-step-interval":
+            config.Strategy.TrafficStepInterval = Duration(*f.trafficStepInterval)
+        case "health-check-mode":
+            config.HealthCheck.Mode = *f.healthCheckMode
+        case "health-check-port":
+            config.HealthCheck.Port = *f.healthCheckPort
+        case "health-check-path":
+            config.HealthCheck.Path = *f.healthCheckPath
+        case "health-check-codes":
+            codes, codesErr := parseStatusCodes(*f.healthCheckCodes)
+            if codesErr != nil {
+                err = codesErr
+            }
+            config.HealthCheck.ExpectedCodes = codes
+        case "health-check-retries":
+            config.HealthCheck.Retries = *f.healthCheckRetries
+        case "health-check-interval":
+            config.HealthCheck.Interval = Duration(*f.healthCheckInterval)
+        case "health-check-parallelism":
+            config.HealthCheck.Parallelism = *f.healthCheckParallelism
+        case "health-check-deadline":
+            config.HealthCheck.Deadline = Duration(*f.healthCheckDeadline)
+        case "authorize-sg":
+            config.SecurityGroups.Authorize = *f.authorizeSecurityGroups
+        case "smoke-tests":
+            config.SmokeTests.File = *f.smokeTests
+        case "junit-report":
+            config.SmokeTests.Report = *f.junitReport
+        case "log-format":
+            config.Logging.Format = *f.logFormat
+        case "log-level":
+            config.Logging.Level = *f.logLevel
+        case "report":
+            config.Logging.Report = *f.report
+        case "slack-webhook":
+            config.Notifications = append(config.Notifications, NotificationConfig{Type: NotificationWebhook, URL: *f.slackWebhook, Format: WebhookSlack})
+        case "notify-command":
+            config.Notifications = append(config.Notifications, NotificationConfig{Type: NotificationCommand, Command: *f.notifyCommand})
+        case "regions":
+            regions, regionsErr := parseRegions(*f.regions)
+            if regionsErr != nil {
+                err = regionsErr
+            }
+            config.MultiRegion.Regions = regions
+        case "region-mode":
+            config.MultiRegion.Mode = *f.regionMode
+        case "copy-ami":
+            config.MultiRegion.CopyAMI = *f.copyAMI
+        case "required-ami-tags":
+            tags, tagsErr := parseTags(*f.requiredAMITags)
+            if tagsErr != nil {
+                err = tagsErr
+            }
+            config.ImageValidation.RequiredTags = tags
+        case "share-ami":
+            config.ImageSharing.Enabled = *f.shareAMI
+        case "profile":
+            config.Credentials.Profile = *f.profile
+        case "role-arn":
+            config.Credentials.RoleARN = *f.roleARN
+        case "external-id":
+            config.Credentials.ExternalID = *f.externalID
+        case "mfa-serial":
+            config.Credentials.MFASerial = *f.mfaSerial
+        }
+    })
+
+    if err != nil {
+        return err
+    }
+
+    if len(strategies) > 1 {
+        return errors.New("--strategy, --canary, --blue-green and --asg select different strategies")
+    }
+
+    for strategy := range strategies {
+        config.Strategy.Type = strategy
+    }
+
+    // Batch flags alone turn the default strategy into the rolling deployment
+    batches := config.Strategy.BatchSize > 0 || config.Strategy.BatchPercent > 0
+    if len(strategies) == 0 && batches && config.Strategy.Type == StrategyAllAtOnce {
+        config.Strategy.Type = StrategyRolling
+    }
+
+    return nil
+}
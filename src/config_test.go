@@ -0,0 +1,221 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeConfig(t *testing.T, name string, content string) string {
+	dir, err := ioutil.TempDir("", "deploy-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestLoadConfigYAML(t *testing.T) {
+	path := writeConfig(t, "deploy.yaml", `
+region: eu-west-1
+new_ami: ami-456
+selector:
+  ami: ami-123
+health_check:
+  port: 8080
+  path: /health
+  expected_codes: [200, 204]
+  interval: 5s
+strategy:
+  type: canary
+  batch_percent: 25
+  canary_bake_time: 2m
+security_groups:
+  authorize: false
+`)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	config, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("Unexpected error from loadConfig(): %s", err.Error())
+	}
+
+	assert.Equal(t, "eu-west-1", config.Region)
+	assert.Equal(t, "ami-123", config.Selector.AMI)
+	assert.Equal(t, int64(8080), config.HealthCheck.Port)
+	assert.Equal(t, []int{200, 204}, config.HealthCheck.ExpectedCodes)
+	assert.Equal(t, Duration(5*time.Second), config.HealthCheck.Interval)
+	assert.Equal(t, Duration(2*time.Minute), config.Strategy.CanaryBakeTime)
+	assert.False(t, config.SecurityGroups.Authorize)
+
+	// Values missing in the file keep defaults
+	assert.Equal(t, uint(10), config.HealthCheck.Retries)
+	assert.Equal(t, "http", config.HealthCheck.Scheme)
+	assert.Nil(t, config.Validate())
+}
+
+func TestLoadConfigJSON(t *testing.T) {
+	path := writeConfig(t, "deploy.json", `{"region": "eu-west-1", "new_ami": "ami-456", "selector": {"ami": "ami-123"}, "strategy": {"type": "blue-green", "traffic_steps": [50, 100]}}`)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	config, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("Unexpected error from loadConfig(): %s", err.Error())
+	}
+
+	assert.Equal(t, StrategyBlueGreen, config.Strategy.Type)
+	assert.Equal(t, []int64{50, 100}, config.Strategy.TrafficSteps)
+	assert.Nil(t, config.Validate())
+}
+
+func TestLoadConfigUnknownKey(t *testing.T) {
+	path := writeConfig(t, "deploy.yaml", "regoin: eu-west-1\n")
+	defer os.RemoveAll(filepath.Dir(path))
+
+	if _, err := loadConfig(path); err == nil {
+		t.Error("Expected error from loadConfig() for unknown key")
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	valid := DefaultConfig()
+	valid.Selector.AMI = "ami-123"
+	valid.NewAMI = "ami-456"
+	assert.Nil(t, valid.Validate())
+
+	invalid := []func(c *Config){
+		func(c *Config) { c.Region = "" },
+		func(c *Config) { c.NewAMI = "" },
+		func(c *Config) { c.Selector = SelectorConfig{} },
+		func(c *Config) { c.HealthCheck.Port = 0 },
+		func(c *Config) { c.HealthCheck.Path = "health" },
+		func(c *Config) { c.HealthCheck.ExpectedCodes = []int{999} },
+		func(c *Config) { c.HealthCheck.Retries = 0 },
+		func(c *Config) { c.Strategy.Type = "unknown" },
+		func(c *Config) { c.Strategy.BatchSize = 2 },
+		func(c *Config) { c.Strategy.Type = StrategyRolling },
+		func(c *Config) {
+			c.Strategy.Type = StrategyRolling
+			c.Strategy.BatchSize = 2
+			c.Strategy.BatchPercent = 10
+		},
+		func(c *Config) { c.Strategy.Type = StrategyBlueGreen; c.Strategy.TrafficSteps = []int64{50, 10} },
+		func(c *Config) { c.Strategy.Type = StrategyAutoScaling; c.Strategy.BatchPercent = 10 },
+		func(c *Config) { c.SmokeTests.Report = "report.xml" },
+		func(c *Config) { c.SmokeTests.File = "smoke.yaml"; c.HealthCheck.Mode = HealthCheckSSM },
+		func(c *Config) { c.Logging.Format = "xml" },
+		func(c *Config) { c.Logging.Level = "trace" },
+		func(c *Config) { c.Notifications = []NotificationConfig{{Type: NotificationWebhook, URL: "hooks.slack.com"}} },
+		func(c *Config) { c.Hooks = []HookConfig{{Name: "warm", After: "WarmCacheAction", Command: "./warm.sh"}} },
+		func(c *Config) { c.Hooks = []HookConfig{{Name: "bake", After: "CanaryBakeAction", Command: "./bake.sh"}} },
+		func(c *Config) { c.MultiRegion.Mode = "random" },
+		func(c *Config) { c.MultiRegion.Regions = []RegionConfig{{Region: "eu-west-1", OldAMI: "ami-eu-old"}} },
+		func(c *Config) { c.MultiRegion.Regions = []RegionConfig{{Region: "eu-west-1", NewAMI: "ami-eu-new"}} },
+		func(c *Config) {
+			c.Selector = SelectorConfig{VpcID: "vpc-1"}
+			c.MultiRegion.Regions = []RegionConfig{{Region: "eu-west-1", NewAMI: "ami-eu-new"}}
+		},
+		func(c *Config) { c.MultiRegion.Regions = []RegionConfig{{Region: "us-east-1"}, {Region: "us-east-1"}} },
+	}
+
+	for idx, modify := range invalid {
+		config := valid
+		modify(&config)
+
+		if err := config.Validate(); err == nil {
+			t.Errorf("Expected error from Config.Validate() for invalid config %d", idx)
+		}
+	}
+}
+
+func TestConfigFlagsOverride(t *testing.T) {
+	fs := flag.NewFlagSet("deploy", flag.ContinueOnError)
+	flags := newConfigFlags(fs)
+
+	if err := fs.Parse([]string{"--region", "eu-central-1", "--batch-size", "2", "--health-check-codes", "200,301"}); err != nil {
+		t.Fatal(err)
+	}
+
+	config := DefaultConfig()
+	config.Region = "eu-west-1"
+	config.HealthCheck.Port = 8080
+
+	if err := flags.apply(fs, &config); err != nil {
+		t.Fatalf("Unexpected error from configFlags.apply(): %s", err.Error())
+	}
+
+	assert.Equal(t, "eu-central-1", config.Region)
+	assert.Equal(t, StrategyRolling, config.Strategy.Type)
+	assert.Equal(t, 2, config.Strategy.BatchSize)
+	assert.Equal(t, []int{200, 301}, config.HealthCheck.ExpectedCodes)
+
+	// Flags not given in the command line keep file values
+	assert.Equal(t, int64(8080), config.HealthCheck.Port)
+}
+
+func TestConfigFlagsConflictingStrategies(t *testing.T) {
+	fs := flag.NewFlagSet("deploy", flag.ContinueOnError)
+	flags := newConfigFlags(fs)
+
+	if err := fs.Parse([]string{"--canary", "--strategy", "blue-green"}); err != nil {
+		t.Fatal(err)
+	}
+
+	config := DefaultConfig()
+	if err := flags.apply(fs, &config); err == nil {
+		t.Error("Expected error from configFlags.apply() for conflicting strategies")
+	}
+}
+
+func TestSelectorFlags(t *testing.T) {
+	fs := flag.NewFlagSet("deploy", flag.ContinueOnError)
+	flags := newConfigFlags(fs)
+
+	if err := fs.Parse([]string{"--tags", "App=web, Env=prod", "--subnets", "subnet-1,subnet-2", "--instance-ids", "i-1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	config := DefaultConfig()
+	config.NewAMI = "ami-456"
+	if err := flags.apply(fs, &config); err != nil {
+		t.Fatalf("Unexpected error from configFlags.apply(): %s", err.Error())
+	}
+
+	assert.Equal(t, map[string]string{"App": "web", "Env": "prod"}, config.Selector.Tags)
+	assert.Equal(t, []string{"subnet-1", "subnet-2"}, config.Selector.SubnetIDs)
+	assert.Equal(t, []string{"i-1"}, config.Selector.InstanceIDs)
+	assert.Equal(t, "App=web, Env=prod, subnet-1, subnet-2, i-1", config.Selector.String())
+
+	// Old AMI is optional with other selectors
+	assert.Nil(t, config.Validate())
+
+	_, err := parseTags("App")
+	assert.NotNil(t, err)
+}
+
+func TestImageFlags(t *testing.T) {
+	fs := flag.NewFlagSet("deploy", flag.ContinueOnError)
+	flags := newConfigFlags(fs)
+
+	if err := fs.Parse([]string{"--required-ami-tags", "BuildStatus=passed,Commit=", "--share-ami"}); err != nil {
+		t.Fatal(err)
+	}
+
+	config := DefaultConfig()
+	if err := flags.apply(fs, &config); err != nil {
+		t.Fatalf("Unexpected error from configFlags.apply(): %s", err.Error())
+	}
+
+	assert.Equal(t, map[string]string{"BuildStatus": "passed", "Commit": ""}, config.ImageValidation.RequiredTags)
+	assert.True(t, config.ImageSharing.Enabled)
+}
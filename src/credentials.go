@@ -0,0 +1,158 @@
+package main
+
+import (
+    "github.com/aws/aws-sdk-go/aws"
+    "github.com/aws/aws-sdk-go/aws/credentials"
+    "github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+    "github.com/aws/aws-sdk-go/aws/session"
+    "github.com/aws/aws-sdk-go/service/sts"
+
+    "errors"
+    "fmt"
+    "regexp"
+    "strings"
+    "sync"
+    "time"
+)
+
+var roleSessionName = regexp.MustCompile(`^[\w+=,.@-]{2,64}$`)
+
+// askToken reads the MFA token from stdin
+var askToken = stscreds.StdinTokenProvider
+
+// CredentialsConfig describes the AWS identity used in the target. The default credential chain is used when it is empty.
+type CredentialsConfig struct {
+    // Profile is the profile of the shared AWS config and credentials files
+    Profile string `yaml:"profile" json:"profile"`
+    // RoleARN is the role assumed with the credentials of the profile
+    RoleARN string `yaml:"role_arn" json:"role_arn"`
+    ExternalID string `yaml:"external_id" json:"external_id"`
+    // SessionName identifies the deployment in CloudTrail. It is deploy-<VERSION> by default.
+    SessionName string `yaml:"session_name" json:"session_name"`
+    // MFASerial is the MFA device required by the role. The token is read from --mfa-token or asked on stdin.
+    MFASerial string `yaml:"mfa_serial" json:"mfa_serial"`
+    Duration Duration `yaml:"duration" json:"duration"`
+}
+
+func (c CredentialsConfig) isEmpty() bool {
+    return c == CredentialsConfig{}
+}
+
+func (c CredentialsConfig) validate() error {
+    if c.RoleARN == "" {
+        if c.ExternalID != "" || c.SessionName != "" || c.MFASerial != "" || c.Duration != 0 {
+            return errors.New("External ID, session name, MFA serial and duration require the role ARN")
+        }
+
+        return nil
+    }
+
+    if !strings.HasPrefix(c.RoleARN, "arn:") || !strings.Contains(c.RoleARN, ":role/") {
+        return fmt.Errorf("Invalid role ARN %s", c.RoleARN)
+    }
+
+    if c.SessionName != "" && !roleSessionName.MatchString(c.SessionName) {
+        return fmt.Errorf("Invalid role session name %s", c.SessionName)
+    }
+
+    if c.Duration != 0 && (c.Duration < Duration(15*time.Minute) || c.Duration > Duration(12*time.Hour)) {
+        return errors.New("Role session duration must be in range <15m; 12h>")
+    }
+
+    return nil
+}
+
+// String describes the identity in logs
+func (c CredentialsConfig) String() string {
+    parts := []string{}
+
+    if c.Profile != "" {
+        parts = append(parts, "profile "+c.Profile)
+    }
+
+    if c.RoleARN != "" {
+        parts = append(parts, "role "+c.RoleARN)
+    }
+
+    if len(parts) == 0 {
+        return "default credentials"
+    }
+
+    return strings.Join(parts, ", ")
+}
+
+// sessionFactory creates sessions of the targets. Targets with the same credentials share them,
+// so every role is assumed and every MFA token is asked only once.
+type sessionFactory struct {
+    version string
+    // mfaToken is the token passed in the command line. MFA tokens are valid for a single use,
+    // so it is handed out once and the next tokens are asked on stdin.
+    mfaToken string
+
+    mu sync.Mutex
+    credentials map[CredentialsConfig]*credentials.Credentials
+}
+
+func newSessionFactory(version string, mfaToken string) *sessionFactory {
+    return &sessionFactory{version: version, mfaToken: mfaToken, credentials: map[CredentialsConfig]*credentials.Credentials{}}
+}
+
+func (f *sessionFactory) tokenProvider() (string, error) {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+
+    if token := f.mfaToken; token != "" {
+        f.mfaToken = ""
+        return token, nil
+    }
+
+    return askToken()
+}
+
+// session returns the session of the region with the credentials of the config
+func (f *sessionFactory) session(region string, config CredentialsConfig) (*session.Session, error) {
+    base, err := session.NewSessionWithOptions(session.Options{
+        Config: aws.Config{Region: aws.String(region)},
+        Profile: config.Profile,
+        SharedConfigState: session.SharedConfigEnable,
+        AssumeRoleTokenProvider: f.tokenProvider,
+    })
+
+    if err != nil || config.RoleARN == "" {
+        return base, err
+    }
+
+    f.mu.Lock()
+    defer f.mu.Unlock()
+
+    creds, ok := f.credentials[config]
+    if !ok {
+        creds = stscreds.NewCredentials(base, config.RoleARN, func(p *stscreds.AssumeRoleProvider) {
+            p.RoleSessionName = config.SessionName
+            if p.RoleSessionName == "" {
+                p.RoleSessionName = "deploy-" + f.version
+            }
+
+            if config.ExternalID != "" {
+                p.ExternalID = aws.String(config.ExternalID)
+            }
+
+            if config.MFASerial != "" {
+                p.SerialNumber = aws.String(config.MFASerial)
+                p.TokenProvider = f.tokenProvider
+            }
+
+            if config.Duration != 0 {
+                p.Duration = time.Duration(config.Duration)
+            }
+        })
+        f.credentials[config] = creds
+    }
+
+    return base.Copy(&aws.Config{Credentials: creds}), nil
+}
+
+// callerIdentity returns the account and ARN of the session. STS calls are never intercepted by the plan mode.
+func callerIdentity(sess *session.Session) (*sts.GetCallerIdentityOutput, error) {
+    return sts.New(sess).GetCallerIdentity(&sts.GetCallerIdentityInput{})
+}
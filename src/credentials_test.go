@@ -0,0 +1,67 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCredentialsConfigValidate(t *testing.T) {
+	valid := []CredentialsConfig{
+		{},
+		{Profile: "staging"},
+		{
+			RoleARN:     "arn:aws:iam::111111111111:role/deploy",
+			ExternalID:  "deploy-hat",
+			SessionName: "ci@example.com",
+			MFASerial:   "arn:aws:iam::000000000000:mfa/ci",
+			Duration:    Duration(time.Hour),
+		},
+	}
+	for _, config := range valid {
+		assert.NoError(t, config.validate())
+	}
+
+	invalid := []CredentialsConfig{
+		{ExternalID: "deploy-hat"},
+		{RoleARN: "deploy"},
+		{RoleARN: "arn:aws:iam::111111111111:user/deploy"},
+		{RoleARN: "arn:aws:iam::111111111111:role/deploy", SessionName: "deploy hat"},
+		{RoleARN: "arn:aws:iam::111111111111:role/deploy", Duration: Duration(time.Minute)},
+	}
+	for idx, config := range invalid {
+		assert.Error(t, config.validate(), "credentials %d", idx)
+	}
+}
+
+func TestSessionFactorySharesAssumedRoles(t *testing.T) {
+	staging := CredentialsConfig{RoleARN: "arn:aws:iam::111111111111:role/deploy"}
+	production := CredentialsConfig{RoleARN: "arn:aws:iam::222222222222:role/deploy"}
+	sessions := newSessionFactory("1", "123456")
+
+	east, err := sessions.session("us-east-1", staging)
+	assert.NoError(t, err)
+	west, err := sessions.session("eu-west-1", staging)
+	assert.NoError(t, err)
+	other, err := sessions.session("us-east-1", production)
+	assert.NoError(t, err)
+
+	// The role is assumed once for all regions of the target
+	assert.Same(t, east.Config.Credentials, west.Config.Credentials)
+	assert.NotSame(t, east.Config.Credentials, other.Config.Credentials)
+	assert.Equal(t, "eu-west-1", *west.Config.Region)
+
+	askToken = func() (string, error) { return "654321", nil }
+	defer func() { askToken = stscreds.StdinTokenProvider }()
+
+	token, err := sessions.tokenProvider()
+	assert.NoError(t, err)
+	assert.Equal(t, "123456", token)
+
+	// The token of the command line is used once, the role of the next target asks for another one
+	token, err = sessions.tokenProvider()
+	assert.NoError(t, err)
+	assert.Equal(t, "654321", token)
+}
@@ -0,0 +1,933 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	"github.com/aws/aws-sdk-go/service/elbv2/elbv2iface"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/aws/aws-sdk-go/service/sts/stsiface"
+)
+
+// fakeClientIP is returned to the deployment by the fake public IP services
+const fakeClientIP = "203.0.113.10"
+
+// fakeAccount is the account of the fake AWS credentials
+const fakeAccount = "123456789012"
+
+type fakeInstance struct {
+	ID             string
+	AMI            string
+	State          string
+	PublicIP       string
+	PrivateIP      string
+	InstanceType   string
+	KeyName        string
+	SubnetID       string
+	VpcID          string
+	SecurityGroups []*string
+	Tags           map[string]string
+	Profile        string
+	UserData       string
+	CPUCredits     string
+	HTTPTokens     string
+	Volumes        []fakeVolume
+}
+
+type fakeVolume struct {
+	ID     string
+	Device string
+	Size   int64
+	Type   string
+}
+
+// fakeAWS is an in-memory model of instances, security groups and target groups used by the deployment
+type fakeAWS struct {
+	instances      map[string]*fakeInstance
+	securityGroups map[string]map[string]bool
+	targetGroups   map[string]map[string]bool
+	unhealthyAMIs  map[string]bool
+	images         map[string]*ec2.Image
+	snapshots      map[string]bool
+	snapshotKeys   map[string]string
+	permissions    map[string]map[string]bool
+	grants         map[string]string
+	account        string
+	failures       map[string]error
+	failOnCall     map[string]int
+	calls          []string
+	launched       int
+}
+
+func newFakeAWS() *fakeAWS {
+	return &fakeAWS{
+		instances:      map[string]*fakeInstance{},
+		securityGroups: map[string]map[string]bool{},
+		targetGroups:   map[string]map[string]bool{},
+		unhealthyAMIs:  map[string]bool{},
+		images:         map[string]*ec2.Image{},
+		snapshots:      map[string]bool{},
+		snapshotKeys:   map[string]string{},
+		permissions:    map[string]map[string]bool{},
+		grants:         map[string]string{},
+		account:        fakeAccount,
+		failures:       map[string]error{},
+		failOnCall:     map[string]int{},
+	}
+}
+
+// addInstance adds the running instance registered in the target group
+func (f *fakeAWS) addInstance(id string, ami string, sgID string, tgArn string) {
+	f.instances[id] = &fakeInstance{
+		ID:             id,
+		AMI:            ami,
+		State:          ec2.InstanceStateNameRunning,
+		InstanceType:   "t2.micro",
+		KeyName:        "deploy-key",
+		SubnetID:       "subnet-1",
+		VpcID:          "vpc-1",
+		SecurityGroups: []*string{aws.String(sgID)},
+		Tags:           map[string]string{"App": "web"},
+		Profile:        "arn:aws:iam::123456789012:instance-profile/web",
+		UserData:       "IyEvYmluL3NoCmVjaG8gd2Vi",
+		CPUCredits:     "unlimited",
+		HTTPTokens:     "required",
+		Volumes:        []fakeVolume{{ID: "vol-" + id, Device: "/dev/xvda", Size: 20, Type: ec2.VolumeTypeGp3}},
+	}
+
+	if f.securityGroups[sgID] == nil {
+		f.securityGroups[sgID] = map[string]bool{}
+	}
+
+	if f.targetGroups[tgArn] == nil {
+		f.targetGroups[tgArn] = map[string]bool{}
+	}
+	f.targetGroups[tgArn][id] = true
+}
+
+// addImage adds the available AMI of the account with a single EBS snapshot, encrypted when the KMS key is given
+func (f *fakeAWS) addImage(id string, owner string, snapshotID string, kmsKeyID string) {
+	f.images[id] = &ec2.Image{
+		ImageId:            aws.String(id),
+		OwnerId:            aws.String(owner),
+		State:              aws.String(ec2.ImageStateAvailable),
+		Architecture:       aws.String(ec2.ArchitectureValuesX8664),
+		VirtualizationType: aws.String(ec2.VirtualizationTypeHvm),
+		RootDeviceType:     aws.String(ec2.RootDeviceTypeEbs),
+		BlockDeviceMappings: []*ec2.BlockDeviceMapping{{
+			DeviceName: aws.String("/dev/xvda"),
+			Ebs:        &ec2.EbsBlockDevice{SnapshotId: aws.String(snapshotID)},
+		}},
+	}
+	f.snapshots[snapshotID] = true
+
+	if kmsKeyID != "" {
+		f.snapshotKeys[snapshotID] = kmsKeyID
+	}
+}
+
+// fail records the call and returns the error injected for the operation once, so the rollback of the step
+// can succeed. The error is returned by the call number set in failOnCall, by the first call by default.
+func (f *fakeAWS) fail(operation string) error {
+	f.calls = append(f.calls, operation)
+	if call, ok := f.failOnCall[operation]; ok && call != f.count(operation) {
+		return nil
+	}
+
+	err := f.failures[operation]
+	delete(f.failures, operation)
+
+	return err
+}
+
+// count returns the number of calls of the operation
+func (f *fakeAWS) count(operation string) int {
+	count := 0
+
+	for _, call := range f.calls {
+		if call == operation {
+			count++
+		}
+	}
+
+	return count
+}
+
+func (f *fakeAWS) clients() awsClients {
+	return awsClients{EC2: &fakeEC2{aws: f}, ELBV2: &fakeELBV2{aws: f}, KMS: &fakeKMS{aws: f}, STS: &fakeSTS{aws: f}}
+}
+
+// instancesByState returns sorted IDs of instances in the state running the AMI
+func (f *fakeAWS) instancesByState(ami string, state string) []string {
+	ids := []string{}
+
+	for id, instance := range f.instances {
+		if instance.AMI == ami && instance.State == state {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+
+	return ids
+}
+
+// targets returns sorted IDs of instances registered in the target group
+func (f *fakeAWS) targets(tgArn string) []string {
+	ids := []string{}
+
+	for id := range f.targetGroups[tgArn] {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	return ids
+}
+
+// rules returns sorted ingress rules of the security group
+func (f *fakeAWS) rules(sgID string) []string {
+	rules := []string{}
+
+	for rule := range f.securityGroups[sgID] {
+		rules = append(rules, rule)
+	}
+	sort.Strings(rules)
+
+	return rules
+}
+
+// RoundTrip answers health checks of instances and requests of the public IP services
+func (f *fakeAWS) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := req.URL.Hostname()
+
+	for _, instance := range f.instances {
+		if host == "" || (instance.PublicIP != host && instance.PrivateIP != host) {
+			continue
+		}
+
+		status := http.StatusOK
+		if f.unhealthyAMIs[instance.AMI] || instance.State != ec2.InstanceStateNameRunning {
+			status = http.StatusServiceUnavailable
+		}
+
+		return &http.Response{StatusCode: status, Body: ioutil.NopCloser(strings.NewReader("")), Request: req}, nil
+	}
+
+	if strings.Contains(host, ".") && !strings.HasPrefix(host, "198.51.100.") && !strings.HasPrefix(host, "10.") {
+		return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader(fakeClientIP)), Request: req}, nil
+	}
+
+	return nil, fmt.Errorf("Connection refused by %s", host)
+}
+
+type fakeEC2 struct {
+	ec2iface.EC2API
+	aws *fakeAWS
+}
+
+func matchesFilter(instance *fakeInstance, filter *ec2.Filter) bool {
+	value := ""
+
+	switch name := *filter.Name; {
+	case name == "image-id":
+		value = instance.AMI
+	case name == "instance-state-name":
+		value = instance.State
+	case name == "vpc-id":
+		value = instance.VpcID
+	case name == "subnet-id":
+		value = instance.SubnetID
+	case strings.HasPrefix(name, "tag:"):
+		value = instance.Tags[strings.TrimPrefix(name, "tag:")]
+	default:
+		return false
+	}
+
+	for _, expected := range filter.Values {
+		if *expected == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (f *fakeEC2) DescribeInstances(input *ec2.DescribeInstancesInput) (*ec2.DescribeInstancesOutput, error) {
+	if err := f.aws.fail("DescribeInstances"); err != nil {
+		return nil, err
+	}
+
+	ids := aws.StringValueSlice(input.InstanceIds)
+	if len(ids) == 0 {
+		for id := range f.aws.instances {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+
+	res := &ec2.DescribeInstancesOutput{}
+
+	for _, id := range ids {
+		instance, ok := f.aws.instances[id]
+		if !ok {
+			return nil, fmt.Errorf("InvalidInstanceID.NotFound: %s", id)
+		}
+
+		matches := true
+		for _, filter := range input.Filters {
+			matches = matches && matchesFilter(instance, filter)
+		}
+
+		if !matches {
+			continue
+		}
+
+		sgs := []*ec2.GroupIdentifier{}
+		for _, sgID := range instance.SecurityGroups {
+			sgs = append(sgs, &ec2.GroupIdentifier{GroupId: sgID})
+		}
+
+		tags := []*ec2.Tag{}
+		for key, value := range instance.Tags {
+			tags = append(tags, &ec2.Tag{Key: aws.String(key), Value: aws.String(value)})
+		}
+
+		mappings := []*ec2.InstanceBlockDeviceMapping{}
+		for _, volume := range instance.Volumes {
+			mappings = append(mappings, &ec2.InstanceBlockDeviceMapping{
+				DeviceName: aws.String(volume.Device),
+				Ebs:        &ec2.EbsInstanceBlockDevice{VolumeId: aws.String(volume.ID), DeleteOnTermination: aws.Bool(true)},
+			})
+		}
+
+		res.Reservations = append(res.Reservations, &ec2.Reservation{Instances: []*ec2.Instance{{
+			InstanceId:         aws.String(instance.ID),
+			ImageId:            aws.String(instance.AMI),
+			InstanceType:       aws.String(instance.InstanceType),
+			KeyName:            aws.String(instance.KeyName),
+			SubnetId:           aws.String(instance.SubnetID),
+			VpcId:              aws.String(instance.VpcID),
+			PublicIpAddress:    aws.String(instance.PublicIP),
+			PrivateIpAddress:   aws.String(instance.PrivateIP),
+			State:              &ec2.InstanceState{Name: aws.String(instance.State)},
+			SecurityGroups:     sgs,
+			Tags:               tags,
+			IamInstanceProfile: &ec2.IamInstanceProfile{Arn: aws.String(instance.Profile)},
+			MetadataOptions: &ec2.InstanceMetadataOptionsResponse{
+				HttpEndpoint:            aws.String(ec2.InstanceMetadataEndpointStateEnabled),
+				HttpTokens:              aws.String(instance.HTTPTokens),
+				HttpPutResponseHopLimit: aws.Int64(1),
+			},
+			BlockDeviceMappings: mappings,
+		}}})
+	}
+
+	return res, nil
+}
+
+func (f *fakeEC2) RunInstances(input *ec2.RunInstancesInput) (*ec2.Reservation, error) {
+	if err := f.aws.fail("RunInstances"); err != nil {
+		return nil, err
+	}
+
+	f.aws.launched++
+	network := input.NetworkInterfaces[0]
+	instance := &fakeInstance{
+		ID:             fmt.Sprintf("i-new-%d", f.aws.launched),
+		AMI:            *input.ImageId,
+		State:          ec2.InstanceStateNameRunning,
+		PrivateIP:      fmt.Sprintf("10.0.0.%d", f.aws.launched),
+		InstanceType:   *input.InstanceType,
+		KeyName:        aws.StringValue(input.KeyName),
+		SubnetID:       *network.SubnetId,
+		VpcID:          "vpc-1",
+		SecurityGroups: network.Groups,
+		Tags:           map[string]string{},
+		UserData:       aws.StringValue(input.UserData),
+	}
+
+	if input.IamInstanceProfile != nil {
+		instance.Profile = *input.IamInstanceProfile.Arn
+	}
+
+	if input.CreditSpecification != nil {
+		instance.CPUCredits = *input.CreditSpecification.CpuCredits
+	}
+
+	if input.MetadataOptions != nil {
+		instance.HTTPTokens = *input.MetadataOptions.HttpTokens
+	}
+
+	for idx, mapping := range input.BlockDeviceMappings {
+		instance.Volumes = append(instance.Volumes, fakeVolume{
+			ID:     fmt.Sprintf("vol-%s-%d", instance.ID, idx),
+			Device: *mapping.DeviceName,
+			Size:   *mapping.Ebs.VolumeSize,
+			Type:   *mapping.Ebs.VolumeType,
+		})
+	}
+
+	if aws.BoolValue(network.AssociatePublicIpAddress) {
+		instance.PublicIP = fmt.Sprintf("198.51.100.%d", f.aws.launched)
+	}
+
+	for _, tag := range input.TagSpecifications[0].Tags {
+		instance.Tags[*tag.Key] = *tag.Value
+	}
+
+	f.aws.instances[instance.ID] = instance
+
+	return &ec2.Reservation{Instances: []*ec2.Instance{{
+		InstanceId:      aws.String(instance.ID),
+		PublicIpAddress: aws.String(instance.PublicIP),
+	}}}, nil
+}
+
+func (f *fakeEC2) TerminateInstances(input *ec2.TerminateInstancesInput) (*ec2.TerminateInstancesOutput, error) {
+	if err := f.aws.fail("TerminateInstances"); err != nil {
+		return nil, err
+	}
+
+	if len(input.InstanceIds) == 0 {
+		return nil, errors.New("MissingParameter: The request must contain the parameter InstanceIds")
+	}
+
+	for _, id := range input.InstanceIds {
+		instance, ok := f.aws.instances[*id]
+		if !ok {
+			return nil, fmt.Errorf("InvalidInstanceID.NotFound: %s", *id)
+		}
+
+		instance.State = ec2.InstanceStateNameTerminated
+		for _, targets := range f.aws.targetGroups {
+			delete(targets, *id)
+		}
+	}
+
+	return &ec2.TerminateInstancesOutput{}, nil
+}
+
+func (f *fakeEC2) WaitUntilInstanceRunningWithContext(ctx aws.Context, input *ec2.DescribeInstancesInput, opts ...request.WaiterOption) error {
+	if err := f.aws.fail("WaitUntilInstanceRunning"); err != nil {
+		return err
+	}
+
+	for _, id := range input.InstanceIds {
+		if instance, ok := f.aws.instances[*id]; !ok || instance.State != ec2.InstanceStateNameRunning {
+			return fmt.Errorf("ResourceNotReady: instance %s is not running", *id)
+		}
+	}
+
+	return nil
+}
+
+func sgRule(permission *ec2.IpPermission) string {
+	return fmt.Sprintf("%d/%s", *permission.FromPort, *permission.IpRanges[0].CidrIp)
+}
+
+func (f *fakeEC2) DescribeSecurityGroups(input *ec2.DescribeSecurityGroupsInput) (*ec2.DescribeSecurityGroupsOutput, error) {
+	if err := f.aws.fail("DescribeSecurityGroups"); err != nil {
+		return nil, err
+	}
+
+	res := &ec2.DescribeSecurityGroupsOutput{}
+
+	for _, sgID := range input.GroupIds {
+		rules, ok := f.aws.securityGroups[*sgID]
+		if !ok {
+			return nil, fmt.Errorf("InvalidGroup.NotFound: %s", *sgID)
+		}
+
+		group := &ec2.SecurityGroup{GroupId: sgID}
+		for rule := range rules {
+			var port int64
+			var cidr string
+			fmt.Sscanf(strings.Replace(rule, "/", " ", 1), "%d %s", &port, &cidr)
+
+			group.IpPermissions = append(group.IpPermissions, &ec2.IpPermission{
+				FromPort: aws.Int64(port),
+				ToPort:   aws.Int64(port),
+				IpRanges: []*ec2.IpRange{{CidrIp: aws.String(cidr)}},
+			})
+		}
+
+		res.SecurityGroups = append(res.SecurityGroups, group)
+	}
+
+	return res, nil
+}
+
+func (f *fakeEC2) AuthorizeSecurityGroupIngress(input *ec2.AuthorizeSecurityGroupIngressInput) (*ec2.AuthorizeSecurityGroupIngressOutput, error) {
+	if err := f.aws.fail("AuthorizeSecurityGroupIngress"); err != nil {
+		return nil, err
+	}
+
+	f.aws.securityGroups[*input.GroupId][sgRule(input.IpPermissions[0])] = true
+
+	return &ec2.AuthorizeSecurityGroupIngressOutput{}, nil
+}
+
+func (f *fakeEC2) RevokeSecurityGroupIngress(input *ec2.RevokeSecurityGroupIngressInput) (*ec2.RevokeSecurityGroupIngressOutput, error) {
+	if err := f.aws.fail("RevokeSecurityGroupIngress"); err != nil {
+		return nil, err
+	}
+
+	delete(f.aws.securityGroups[*input.GroupId], sgRule(input.IpPermissions[0]))
+
+	return &ec2.RevokeSecurityGroupIngressOutput{}, nil
+}
+
+type fakeELBV2 struct {
+	elbv2iface.ELBV2API
+	aws *fakeAWS
+}
+
+func (f *fakeELBV2) DescribeTargetGroups(input *elbv2.DescribeTargetGroupsInput) (*elbv2.DescribeTargetGroupsOutput, error) {
+	if err := f.aws.fail("DescribeTargetGroups"); err != nil {
+		return nil, err
+	}
+
+	arns := aws.StringValueSlice(input.TargetGroupArns)
+	if len(arns) == 0 {
+		for arn := range f.aws.targetGroups {
+			arns = append(arns, arn)
+		}
+	}
+	sort.Strings(arns)
+
+	res := &elbv2.DescribeTargetGroupsOutput{}
+	for _, arn := range arns {
+		res.TargetGroups = append(res.TargetGroups, &elbv2.TargetGroup{TargetGroupArn: aws.String(arn)})
+	}
+
+	return res, nil
+}
+
+func (f *fakeELBV2) targetState(tgArn string, id string) string {
+	if !f.aws.targetGroups[tgArn][id] {
+		return elbv2.TargetHealthStateEnumUnused
+	}
+
+	instance := f.aws.instances[id]
+	if f.aws.unhealthyAMIs[instance.AMI] {
+		return elbv2.TargetHealthStateEnumUnhealthy
+	}
+
+	return elbv2.TargetHealthStateEnumHealthy
+}
+
+func (f *fakeELBV2) DescribeTargetHealth(input *elbv2.DescribeTargetHealthInput) (*elbv2.DescribeTargetHealthOutput, error) {
+	if err := f.aws.fail("DescribeTargetHealth"); err != nil {
+		return nil, err
+	}
+
+	if _, ok := f.aws.targetGroups[*input.TargetGroupArn]; !ok {
+		return nil, fmt.Errorf("TargetGroupNotFound: %s", *input.TargetGroupArn)
+	}
+
+	ids := []string{}
+	for _, target := range input.Targets {
+		ids = append(ids, *target.Id)
+	}
+
+	if len(input.Targets) == 0 {
+		ids = f.aws.targets(*input.TargetGroupArn)
+	}
+
+	res := &elbv2.DescribeTargetHealthOutput{}
+	for _, id := range ids {
+		res.TargetHealthDescriptions = append(res.TargetHealthDescriptions, &elbv2.TargetHealthDescription{
+			Target:       &elbv2.TargetDescription{Id: aws.String(id)},
+			TargetHealth: &elbv2.TargetHealth{State: aws.String(f.targetState(*input.TargetGroupArn, id))},
+		})
+	}
+
+	return res, nil
+}
+
+func (f *fakeELBV2) RegisterTargets(input *elbv2.RegisterTargetsInput) (*elbv2.RegisterTargetsOutput, error) {
+	if err := f.aws.fail("RegisterTargets"); err != nil {
+		return nil, err
+	}
+
+	for _, target := range input.Targets {
+		instance, ok := f.aws.instances[*target.Id]
+		if !ok || instance.State != ec2.InstanceStateNameRunning {
+			return nil, fmt.Errorf("InvalidTarget: %s", *target.Id)
+		}
+
+		f.aws.targetGroups[*input.TargetGroupArn][*target.Id] = true
+	}
+
+	return &elbv2.RegisterTargetsOutput{}, nil
+}
+
+func (f *fakeELBV2) DeregisterTargets(input *elbv2.DeregisterTargetsInput) (*elbv2.DeregisterTargetsOutput, error) {
+	if err := f.aws.fail("DeregisterTargets"); err != nil {
+		return nil, err
+	}
+
+	for _, target := range input.Targets {
+		delete(f.aws.targetGroups[*input.TargetGroupArn], *target.Id)
+	}
+
+	return &elbv2.DeregisterTargetsOutput{}, nil
+}
+
+func (f *fakeELBV2) WaitUntilTargetInServiceWithContext(ctx aws.Context, input *elbv2.DescribeTargetHealthInput, opts ...request.WaiterOption) error {
+	if err := f.aws.fail("WaitUntilTargetInService"); err != nil {
+		return err
+	}
+
+	for _, target := range input.Targets {
+		if state := f.targetState(*input.TargetGroupArn, *target.Id); state != elbv2.TargetHealthStateEnumHealthy {
+			return fmt.Errorf("ResourceNotReady: target %s is %s", *target.Id, state)
+		}
+	}
+
+	return nil
+}
+
+func (f *fakeELBV2) WaitUntilTargetDeregisteredWithContext(ctx aws.Context, input *elbv2.DescribeTargetHealthInput, opts ...request.WaiterOption) error {
+	if err := f.aws.fail("WaitUntilTargetDeregistered"); err != nil {
+		return err
+	}
+
+	for _, target := range input.Targets {
+		if f.aws.targetGroups[*input.TargetGroupArn][*target.Id] {
+			return fmt.Errorf("ResourceNotReady: target %s is registered", *target.Id)
+		}
+	}
+
+	return nil
+}
+
+func (f *fakeEC2) CopyImage(input *ec2.CopyImageInput) (*ec2.CopyImageOutput, error) {
+	if err := f.aws.fail("CopyImage"); err != nil {
+		return nil, err
+	}
+
+	idx := f.aws.count("CopyImage")
+	image := &ec2.Image{
+		ImageId:            aws.String(fmt.Sprintf("ami-copy-%d", idx)),
+		Name:               input.Name,
+		State:              aws.String(ec2.ImageStateAvailable),
+		Architecture:       aws.String(ec2.ArchitectureValuesX8664),
+		VirtualizationType: aws.String(ec2.VirtualizationTypeHvm),
+		RootDeviceType:     aws.String(ec2.RootDeviceTypeEbs),
+		BlockDeviceMappings: []*ec2.BlockDeviceMapping{{
+			DeviceName: aws.String("/dev/xvda"),
+			Ebs:        &ec2.EbsBlockDevice{SnapshotId: aws.String(fmt.Sprintf("snap-copy-%d", idx))},
+		}},
+	}
+
+	f.aws.images[*image.ImageId] = image
+	f.aws.snapshots[*image.BlockDeviceMappings[0].Ebs.SnapshotId] = true
+
+	return &ec2.CopyImageOutput{ImageId: image.ImageId}, nil
+}
+
+func (f *fakeEC2) DescribeImages(input *ec2.DescribeImagesInput) (*ec2.DescribeImagesOutput, error) {
+	if err := f.aws.fail("DescribeImages"); err != nil {
+		return nil, err
+	}
+
+	res := &ec2.DescribeImagesOutput{}
+	for _, id := range input.ImageIds {
+		if image, ok := f.aws.images[*id]; ok {
+			res.Images = append(res.Images, image)
+		}
+	}
+
+	return res, nil
+}
+
+func (f *fakeEC2) DeregisterImage(input *ec2.DeregisterImageInput) (*ec2.DeregisterImageOutput, error) {
+	if err := f.aws.fail("DeregisterImage"); err != nil {
+		return nil, err
+	}
+
+	if _, ok := f.aws.images[*input.ImageId]; !ok {
+		return nil, fmt.Errorf("InvalidAMIID.NotFound: %s", *input.ImageId)
+	}
+	delete(f.aws.images, *input.ImageId)
+
+	return &ec2.DeregisterImageOutput{}, nil
+}
+
+func (f *fakeEC2) DeleteSnapshot(input *ec2.DeleteSnapshotInput) (*ec2.DeleteSnapshotOutput, error) {
+	if err := f.aws.fail("DeleteSnapshot"); err != nil {
+		return nil, err
+	}
+
+	if _, ok := f.aws.snapshots[*input.SnapshotId]; !ok {
+		return nil, awserr.New("InvalidSnapshot.NotFound", "The snapshot does not exist", nil)
+	}
+
+	delete(f.aws.snapshots, *input.SnapshotId)
+
+	return &ec2.DeleteSnapshotOutput{}, nil
+}
+
+func (f *fakeEC2) WaitUntilImageAvailableWithContext(ctx aws.Context, input *ec2.DescribeImagesInput, opts ...request.WaiterOption) error {
+	if err := f.aws.fail("WaitUntilImageAvailable"); err != nil {
+		return err
+	}
+
+	for _, id := range input.ImageIds {
+		if image, ok := f.aws.images[*id]; !ok || *image.State != ec2.ImageStateAvailable {
+			return fmt.Errorf("ResourceNotReady: image %s is not available", *id)
+		}
+	}
+
+	return nil
+}
+
+// modifyPermissions adds and removes accounts permitted to use the AMI or the snapshot
+func (f *fakeAWS) modifyPermissions(id string, add []string, remove []string) {
+	if f.permissions[id] == nil {
+		f.permissions[id] = map[string]bool{}
+	}
+
+	for _, account := range add {
+		f.permissions[id][account] = true
+	}
+
+	for _, account := range remove {
+		delete(f.permissions[id], account)
+	}
+}
+
+func (f *fakeEC2) DescribeImageAttribute(input *ec2.DescribeImageAttributeInput) (*ec2.DescribeImageAttributeOutput, error) {
+	if err := f.aws.fail("DescribeImageAttribute"); err != nil {
+		return nil, err
+	}
+
+	res := &ec2.DescribeImageAttributeOutput{ImageId: input.ImageId}
+	for account := range f.aws.permissions[*input.ImageId] {
+		res.LaunchPermissions = append(res.LaunchPermissions, &ec2.LaunchPermission{UserId: aws.String(account)})
+	}
+
+	return res, nil
+}
+
+func (f *fakeEC2) ModifyImageAttribute(input *ec2.ModifyImageAttributeInput) (*ec2.ModifyImageAttributeOutput, error) {
+	if err := f.aws.fail("ModifyImageAttribute"); err != nil {
+		return nil, err
+	}
+
+	add, remove := []string{}, []string{}
+	for _, permission := range input.LaunchPermission.Add {
+		add = append(add, *permission.UserId)
+	}
+	for _, permission := range input.LaunchPermission.Remove {
+		remove = append(remove, *permission.UserId)
+	}
+	f.aws.modifyPermissions(*input.ImageId, add, remove)
+
+	return &ec2.ModifyImageAttributeOutput{}, nil
+}
+
+func (f *fakeEC2) DescribeSnapshotAttribute(input *ec2.DescribeSnapshotAttributeInput) (*ec2.DescribeSnapshotAttributeOutput, error) {
+	if err := f.aws.fail("DescribeSnapshotAttribute"); err != nil {
+		return nil, err
+	}
+
+	res := &ec2.DescribeSnapshotAttributeOutput{SnapshotId: input.SnapshotId}
+	for account := range f.aws.permissions[*input.SnapshotId] {
+		res.CreateVolumePermissions = append(res.CreateVolumePermissions, &ec2.CreateVolumePermission{UserId: aws.String(account)})
+	}
+
+	return res, nil
+}
+
+func (f *fakeEC2) ModifySnapshotAttribute(input *ec2.ModifySnapshotAttributeInput) (*ec2.ModifySnapshotAttributeOutput, error) {
+	if err := f.aws.fail("ModifySnapshotAttribute"); err != nil {
+		return nil, err
+	}
+
+	add, remove := []string{}, []string{}
+	for _, permission := range input.CreateVolumePermission.Add {
+		add = append(add, *permission.UserId)
+	}
+	for _, permission := range input.CreateVolumePermission.Remove {
+		remove = append(remove, *permission.UserId)
+	}
+	f.aws.modifyPermissions(*input.SnapshotId, add, remove)
+
+	return &ec2.ModifySnapshotAttributeOutput{}, nil
+}
+
+func (f *fakeEC2) DescribeSnapshots(input *ec2.DescribeSnapshotsInput) (*ec2.DescribeSnapshotsOutput, error) {
+	if err := f.aws.fail("DescribeSnapshots"); err != nil {
+		return nil, err
+	}
+
+	res := &ec2.DescribeSnapshotsOutput{}
+	for _, id := range input.SnapshotIds {
+		if !f.aws.snapshots[*id] {
+			continue
+		}
+
+		snapshot := &ec2.Snapshot{SnapshotId: id, Encrypted: aws.Bool(false)}
+		if key, ok := f.aws.snapshotKeys[*id]; ok {
+			snapshot.Encrypted = aws.Bool(true)
+			snapshot.KmsKeyId = aws.String(key)
+		}
+		res.Snapshots = append(res.Snapshots, snapshot)
+	}
+
+	return res, nil
+}
+
+type fakeKMS struct {
+	kmsiface.KMSAPI
+	aws *fakeAWS
+}
+
+func (f *fakeKMS) CreateGrant(input *kms.CreateGrantInput) (*kms.CreateGrantOutput, error) {
+	if err := f.aws.fail("CreateGrant"); err != nil {
+		return nil, err
+	}
+
+	grantID := fmt.Sprintf("grant-%d", len(f.aws.grants)+1)
+	f.aws.grants[grantID] = *input.KeyId + " " + *input.GranteePrincipal
+
+	return &kms.CreateGrantOutput{GrantId: aws.String(grantID)}, nil
+}
+
+func (f *fakeKMS) RevokeGrant(input *kms.RevokeGrantInput) (*kms.RevokeGrantOutput, error) {
+	if err := f.aws.fail("RevokeGrant"); err != nil {
+		return nil, err
+	}
+
+	delete(f.aws.grants, *input.GrantId)
+
+	return &kms.RevokeGrantOutput{}, nil
+}
+
+type fakeSTS struct {
+	stsiface.STSAPI
+	aws *fakeAWS
+}
+
+func (f *fakeSTS) GetCallerIdentityWithContext(ctx aws.Context, input *sts.GetCallerIdentityInput, opts ...request.Option) (*sts.GetCallerIdentityOutput, error) {
+	if err := f.aws.fail("GetCallerIdentity"); err != nil {
+		return nil, err
+	}
+
+	return &sts.GetCallerIdentityOutput{Account: aws.String(f.aws.account)}, nil
+}
+
+// fakeInstanceTypes are instance types known to the fake AWS
+var fakeInstanceTypes = map[string]string{
+	"t2.micro":     ec2.ArchitectureTypeX8664,
+	"t4g.micro":    ec2.ArchitectureTypeArm64,
+	"trn1.2xlarge": ec2.ArchitectureTypeX8664,
+}
+
+// fakeBurstableTypes are instance types with CPU credits
+var fakeBurstableTypes = map[string]bool{"t2.micro": true, "t4g.micro": true}
+
+func (f *fakeEC2) DescribeInstanceTypes(input *ec2.DescribeInstanceTypesInput) (*ec2.DescribeInstanceTypesOutput, error) {
+	if err := f.aws.fail("DescribeInstanceTypes"); err != nil {
+		return nil, err
+	}
+
+	res := &ec2.DescribeInstanceTypesOutput{}
+	for _, instanceType := range input.InstanceTypes {
+		res.InstanceTypes = append(res.InstanceTypes, &ec2.InstanceTypeInfo{
+			InstanceType:                  instanceType,
+			ProcessorInfo:                 &ec2.ProcessorInfo{SupportedArchitectures: []*string{aws.String(fakeInstanceTypes[*instanceType])}},
+			SupportedVirtualizationTypes:  []*string{aws.String(ec2.VirtualizationTypeHvm)},
+			SupportedRootDeviceTypes:      []*string{aws.String(ec2.RootDeviceTypeEbs)},
+			BurstablePerformanceSupported: aws.Bool(fakeBurstableTypes[*instanceType]),
+		})
+	}
+
+	return res, nil
+}
+
+func (f *fakeEC2) CreateTags(input *ec2.CreateTagsInput) (*ec2.CreateTagsOutput, error) {
+	if err := f.aws.fail("CreateTags"); err != nil {
+		return nil, err
+	}
+
+	for _, id := range input.Resources {
+		if image, ok := f.aws.images[*id]; ok {
+			image.Tags = append(image.Tags, input.Tags...)
+		}
+	}
+
+	return &ec2.CreateTagsOutput{}, nil
+}
+
+func (f *fakeEC2) DescribeVolumesPages(input *ec2.DescribeVolumesInput, fn func(*ec2.DescribeVolumesOutput, bool) bool) error {
+	if err := f.aws.fail("DescribeVolumes"); err != nil {
+		return err
+	}
+
+	res := &ec2.DescribeVolumesOutput{}
+	for _, instance := range f.aws.instances {
+		for _, volume := range instance.Volumes {
+			if stringInSlice(volume.ID, aws.StringValueSlice(input.VolumeIds)) {
+				res.Volumes = append(res.Volumes, &ec2.Volume{
+					VolumeId:   aws.String(volume.ID),
+					Size:       aws.Int64(volume.Size),
+					VolumeType: aws.String(volume.Type),
+					Iops:       aws.Int64(3000),
+					Throughput: aws.Int64(125),
+					Encrypted:  aws.Bool(false),
+				})
+			}
+		}
+	}
+
+	fn(res, true)
+	return nil
+}
+
+func (f *fakeEC2) DescribeInstanceCreditSpecifications(input *ec2.DescribeInstanceCreditSpecificationsInput) (*ec2.DescribeInstanceCreditSpecificationsOutput, error) {
+	if err := f.aws.fail("DescribeInstanceCreditSpecifications"); err != nil {
+		return nil, err
+	}
+
+	res := &ec2.DescribeInstanceCreditSpecificationsOutput{}
+	for _, id := range input.InstanceIds {
+		if instance, ok := f.aws.instances[*id]; ok {
+			res.InstanceCreditSpecifications = append(res.InstanceCreditSpecifications, &ec2.InstanceCreditSpecification{
+				InstanceId: id,
+				CpuCredits: aws.String(instance.CPUCredits),
+			})
+		}
+	}
+
+	return res, nil
+}
+
+func (f *fakeEC2) DescribeInstanceAttribute(input *ec2.DescribeInstanceAttributeInput) (*ec2.DescribeInstanceAttributeOutput, error) {
+	if err := f.aws.fail("DescribeInstanceAttribute"); err != nil {
+		return nil, err
+	}
+
+	instance, ok := f.aws.instances[*input.InstanceId]
+	if !ok {
+		return nil, fmt.Errorf("InvalidInstanceID.NotFound: %s", *input.InstanceId)
+	}
+
+	return &ec2.DescribeInstanceAttributeOutput{
+		InstanceId: input.InstanceId,
+		UserData:   &ec2.AttributeValue{Value: aws.String(instance.UserData)},
+	}, nil
+}
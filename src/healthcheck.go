@@ -0,0 +1,172 @@
+package main
+
+import (
+    "github.com/aws/aws-sdk-go/aws"
+    "github.com/aws/aws-sdk-go/aws/awserr"
+    "github.com/aws/aws-sdk-go/service/elbv2"
+    "github.com/aws/aws-sdk-go/service/elbv2/elbv2iface"
+    "github.com/aws/aws-sdk-go/service/ssm"
+    "github.com/aws/aws-sdk-go/service/ssm/ssmiface"
+
+    "context"
+    "fmt"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// ssmPollInterval is the delay between checks of the SSM command result
+const ssmPollInterval = 2 * time.Second
+
+// WaitForTargetsHealthyAction is a pipeline step struct. It waits until new instances
+// pass the health check of the load balancer.
+type WaitForTargetsHealthyAction struct {
+    Svc elbv2iface.ELBV2API
+    Timeout time.Duration
+}
+
+// SSMHealthCheckAction is a pipeline step struct. It checks the application with curl
+// executed on new instances by the SSM Run Command, so instances do not have to be reachable from this machine.
+type SSMHealthCheckAction struct {
+    Svc ssmiface.SSMAPI
+    HealthCheck HealthCheckConfig
+}
+
+// Commit is an action to apply changes in the WaitForTargetsHealthyAction step
+func (act WaitForTargetsHealthyAction) Commit(ctx context.Context, pipelineInfo *PipelineInfo) error {
+    for _, tgArn := range pipelineInfo.TargetGroupsArns {
+        input := &elbv2.DescribeTargetHealthInput{
+            TargetGroupArn: tgArn,
+            Targets: newTargetDescriptions(pipelineInfo.NewInstancesIds),
+        }
+
+        err := act.Svc.WaitUntilTargetInServiceWithContext(ctx, input, waiterTimeout(act.Timeout))
+        if err != nil {
+            return fmt.Errorf("New instances are not healthy in target group %s: %s", *tgArn, err.Error())
+        }
+    }
+
+    return nil
+}
+
+// Rollback is an action to apply changes in the WaitForTargetsHealthyAction step
+func (act WaitForTargetsHealthyAction) Rollback(ctx context.Context, pipelineInfo *PipelineInfo) error {
+    return nil
+}
+
+// command returns the shell command printing the status code of the health check on the instance
+func (act SSMHealthCheckAction) command() string {
+    // Certificate of the application is not issued for the loopback address
+    insecure := ""
+    if act.HealthCheck.Scheme == "https" {
+        insecure = "-k "
+    }
+
+    return fmt.Sprintf("curl -s %s-o /dev/null -w '%%{http_code}' --max-time 10 '%s'", insecure, act.HealthCheck.healthCheckURL("127.0.0.1"))
+}
+
+// invocationCode waits for the command on the instance and returns the status code printed by curl
+func (act SSMHealthCheckAction) invocationCode(ctx context.Context, commandID *string, instanceID *string) (int, error) {
+    for {
+        res, err := act.Svc.GetCommandInvocation(&ssm.GetCommandInvocationInput{
+            CommandId: commandID,
+            InstanceId: instanceID,
+        })
+
+        // Invocation is visible shortly after the command is sent
+        if aerr, ok := err.(awserr.Error); ok && aerr.Code() == ssm.ErrCodeInvocationDoesNotExist {
+            if err := sleep(ctx, ssmPollInterval); err != nil {
+                return -1, err
+            }
+            continue
+        }
+
+        if err != nil {
+            return -1, err
+        }
+
+        switch *res.Status {
+        case ssm.CommandInvocationStatusPending, ssm.CommandInvocationStatusInProgress, ssm.CommandInvocationStatusDelayed:
+            if err := sleep(ctx, ssmPollInterval); err != nil {
+                return -1, err
+            }
+            continue
+        }
+
+        code, err := strconv.Atoi(strings.TrimSpace(aws.StringValue(res.StandardOutputContent)))
+        if err != nil {
+            return -1, fmt.Errorf("Health check command is %s on %s: %s", *res.Status, *instanceID, aws.StringValue(res.StandardErrorContent))
+        }
+
+        return code, nil
+    }
+}
+
+// Commit is an action to apply changes in the SSMHealthCheckAction step
+func (act SSMHealthCheckAction) Commit(ctx context.Context, pipelineInfo *PipelineInfo) error {
+    pending := pipelineInfo.NewInstancesIds
+    lastCodes := map[string]int{}
+    var unregistered error
+
+    for retries := act.HealthCheck.Retries; retries > 0 && len(pending) > 0; retries-- {
+        res, err := act.Svc.SendCommand(&ssm.SendCommandInput{
+            DocumentName: aws.String("AWS-RunShellScript"),
+            InstanceIds: pending,
+            Comment: aws.String("deploy-hat health check " + pipelineInfo.Version),
+            Parameters: map[string][]*string{
+                "commands": {aws.String(act.command())},
+            },
+        })
+
+        // Instances just launched are registered in SSM after their agent starts
+        if aerr, ok := err.(awserr.Error); ok && aerr.Code() == ssm.ErrCodeInvalidInstanceId {
+            unregistered = err
+            if retries > 1 {
+                if err := sleep(ctx, time.Duration(act.HealthCheck.Interval)); err != nil {
+                    return err
+                }
+            }
+            continue
+        }
+
+        if err != nil {
+            return err
+        }
+        unregistered = nil
+
+        unhealthy := []*string{}
+        for _, instanceID := range pending {
+            code, err := act.invocationCode(ctx, res.Command.CommandId, instanceID)
+            if err != nil {
+                return err
+            }
+
+            lastCodes[*instanceID] = code
+            if !act.HealthCheck.isExpectedCode(code) {
+                unhealthy = append(unhealthy, instanceID)
+            }
+        }
+
+        pending = unhealthy
+        if len(pending) > 0 && retries > 1 {
+            if err := sleep(ctx, time.Duration(act.HealthCheck.Interval)); err != nil {
+                return err
+            }
+        }
+    }
+
+    if unregistered != nil {
+        return fmt.Errorf("New instances are not registered in SSM: %s", unregistered.Error())
+    }
+
+    if len(pending) > 0 {
+        return fmt.Errorf("Application is down on %s. Response code %d", *pending[0], lastCodes[*pending[0]])
+    }
+
+    return nil
+}
+
+// Rollback is an action to apply changes in the SSMHealthCheckAction step
+func (act SSMHealthCheckAction) Rollback(ctx context.Context, pipelineInfo *PipelineInfo) error {
+    return nil
+}
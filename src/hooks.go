@@ -0,0 +1,224 @@
+package main
+
+import (
+    "github.com/aws/aws-sdk-go/aws"
+
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "strconv"
+    "strings"
+    "time"
+)
+
+const defaultHookTimeout = 10 * time.Minute
+
+// hookSteps are the steps which hooks can be run before or after
+var hookSteps = []string{
+    "InitializePipelineAction",
+    "ShareImageAction",
+    "CopyImageAction",
+    "ListInstancesAction",
+    "VerifyImageAction",
+    "FindLoadBalancerAction",
+    "RunInstancesAction",
+    "WaitUntilStatusOkAction",
+    "AuthorizeSecurityGroupsAction",
+    "CollectPublicIpsAction",
+    "TestInstancesAction",
+    "SSMHealthCheckAction",
+    "RegisterNewInstancesAction",
+    "WaitForTargetsHealthyAction",
+    "CanaryBakeAction",
+    "DeregisterOldInstancesAction",
+    "WaitForDeregisterAction",
+    "TerminateOldInstancesAction",
+    "RollingDeploymentAction",
+    "CreateGreenTargetGroupsAction",
+    "RegisterGreenInstancesAction",
+    "ShiftTrafficAction",
+    "FinalizeBlueGreenAction",
+    "FindAutoScalingGroupsAction",
+    "CreateLaunchTemplateVersionsAction",
+    "UpdateAutoScalingGroupsAction",
+    "InstanceRefreshAction",
+}
+
+// HookConfig describes the custom command run before or after the step of the pipeline
+type HookConfig struct {
+    Name string `yaml:"name" json:"name"`
+    // Before and After name the step the hook is run next to, e.g. RegisterNewInstancesAction. Only one of them is set.
+    Before string `yaml:"before" json:"before"`
+    After string `yaml:"after" json:"after"`
+    // Command is run with sh -c. The deployment is passed in DEPLOY_* env variables and as JSON on stdin.
+    Command string `yaml:"command" json:"command"`
+    // Rollback is the command undoing the hook. It is run when the hook or any later step fails.
+    Rollback string `yaml:"rollback" json:"rollback"`
+    Timeout Duration `yaml:"timeout" json:"timeout"`
+}
+
+func (c HookConfig) validate() error {
+    if c.Name == "" {
+        return errors.New("Hook name is required")
+    }
+
+    if (c.Before == "") == (c.After == "") {
+        return fmt.Errorf("Hook %s requires either before or after step", c.Name)
+    }
+
+    step := c.Before + c.After
+    if !stringInSlice(step, hookSteps) {
+        return fmt.Errorf("Hook %s refers to unknown step %s", c.Name, step)
+    }
+
+    if strings.TrimSpace(c.Command) == "" {
+        return fmt.Errorf("Hook %s has empty command", c.Name)
+    }
+
+    if c.Timeout < 0 {
+        return fmt.Errorf("Hook %s timeout must not be negative", c.Name)
+    }
+
+    return nil
+}
+
+// stepName returns the name hooks use to refer to the step
+func stepName(action InfrastructureAction) string {
+    return strings.TrimPrefix(strings.TrimPrefix(fmt.Sprintf("%T", action), "*"), "main.")
+}
+
+// insertHooks places the hooks before and after their steps, including the steps of every batch
+func insertHooks(actions []InfrastructureAction, hooks []HookConfig) []InfrastructureAction {
+    if len(hooks) == 0 {
+        return actions
+    }
+
+    result := []InfrastructureAction{}
+
+    for _, action := range actions {
+        if rolling, ok := action.(*RollingDeploymentAction); ok {
+            rolling.Actions = insertHooks(rolling.Actions, hooks)
+            rolling.CanaryActions = insertHooks(rolling.CanaryActions, hooks)
+        }
+
+        name := stepName(action)
+
+        for _, hook := range hooks {
+            if hook.Before == name {
+                result = append(result, HookAction{hook})
+            }
+        }
+
+        result = append(result, action)
+
+        for _, hook := range hooks {
+            if hook.After == name {
+                result = append(result, HookAction{hook})
+            }
+        }
+    }
+
+    return result
+}
+
+// validateHookSteps checks every hook was placed next to a step of the pipeline.
+// Hooks of steps which the strategy or the health check mode does not run would be skipped silently.
+func validateHookSteps(actions []InfrastructureAction, hooks []HookConfig) error {
+    inserted := map[HookConfig]bool{}
+    forEachStep(actions, func(action InfrastructureAction) {
+        if hook, ok := action.(HookAction); ok {
+            inserted[hook.Hook] = true
+        }
+    })
+
+    for _, hook := range hooks {
+        if !inserted[hook] {
+            return fmt.Errorf("Hook %s refers to step %s, which is not part of the deployment", hook.Name, hook.Before+hook.After)
+        }
+    }
+
+    return nil
+}
+
+// forEachStep calls fn for the steps of the pipeline, including the steps of batches and regions
+func forEachStep(actions []InfrastructureAction, fn func(action InfrastructureAction)) {
+    for _, action := range actions {
+        fn(action)
+
+        switch composite := action.(type) {
+        case *RollingDeploymentAction:
+            forEachStep(composite.Actions, fn)
+            forEachStep(composite.CanaryActions, fn)
+        case *MultiRegionAction:
+            for _, region := range composite.Regions {
+                forEachStep(region.Actions, fn)
+            }
+        }
+    }
+}
+
+// runHookCommand runs the command of the hook. It is replaced in the plan mode.
+var runHookCommand = shellCommand
+
+// HookAction is a pipeline step struct. It runs the user-defined command of the hook.
+type HookAction struct {
+    Hook HookConfig
+}
+
+// env returns the deployment as DEPLOY_* environment variables
+func (act HookAction) env(pipelineInfo *PipelineInfo, phase string) []string {
+    return []string{
+        "DEPLOY_HOOK=" + act.Hook.Name,
+        "DEPLOY_PHASE=" + phase,
+        "DEPLOY_VERSION=" + pipelineInfo.Version,
+        "DEPLOY_REGION=" + pipelineInfo.Config.Region,
+        "DEPLOY_OLD_AMI=" + pipelineInfo.Input.OldAMI,
+        "DEPLOY_NEW_AMI=" + pipelineInfo.Input.NewAMI,
+        "DEPLOY_BATCH=" + strconv.Itoa(pipelineInfo.Batch),
+        "DEPLOY_OLD_INSTANCE_IDS=" + strings.Join(aws.StringValueSlice(pipelineInfo.OldInstancesIds), ","),
+        "DEPLOY_NEW_INSTANCE_IDS=" + strings.Join(aws.StringValueSlice(pipelineInfo.NewInstancesIds), ","),
+        "DEPLOY_NEW_INSTANCE_IPS=" + strings.Join(pipelineInfo.NewInstancesIps, ","),
+        "DEPLOY_TARGET_GROUPS=" + strings.Join(aws.StringValueSlice(pipelineInfo.TargetGroupsArns), ","),
+    }
+}
+
+func (act HookAction) run(ctx context.Context, pipelineInfo *PipelineInfo, command string, phase string) error {
+    input, err := json.Marshal(pipelineInfo)
+    if err != nil {
+        return err
+    }
+
+    timeout := time.Duration(act.Hook.Timeout)
+    if timeout == 0 {
+        timeout = defaultHookTimeout
+    }
+
+    ctx, cancel := context.WithTimeout(ctx, timeout)
+    defer cancel()
+
+    output, err := runHookCommand(ctx, command, act.env(pipelineInfo, phase), input)
+    if err != nil {
+        return fmt.Errorf("Hook %s failed. %s", act.Hook.Name, err.Error())
+    }
+
+    if output != "" {
+        logger.Info("Hook output", Fields{"action": actionName(act), "output": output})
+    }
+
+    return nil
+}
+
+// Commit is an action to apply changes in the HookAction step
+func (act HookAction) Commit(ctx context.Context, pipelineInfo *PipelineInfo) error {
+    return act.run(ctx, pipelineInfo, act.Hook.Command, PhaseCommit)
+}
+
+// Rollback is an action to apply changes in the HookAction step
+func (act HookAction) Rollback(ctx context.Context, pipelineInfo *PipelineInfo) error {
+    if act.Hook.Rollback == "" {
+        return nil
+    }
+
+    return act.run(ctx, pipelineInfo, act.Hook.Rollback, PhaseRollback)
+}
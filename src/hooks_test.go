@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/stretchr/testify/assert"
+)
+
+func actionNames(actions []InfrastructureAction) []string {
+	names := []string{}
+	for _, action := range actions {
+		names = append(names, actionName(action))
+	}
+
+	return names
+}
+
+func TestInsertHooks(t *testing.T) {
+	rolling := &RollingDeploymentAction{
+		BatchSize: 1,
+		Actions: []InfrastructureAction{RunInstancesAction{}, RegisterNewInstancesAction{}, TerminateOldInstancesAction{}},
+	}
+	hooks := []HookConfig{
+		{Name: "migrate", Before: "RegisterNewInstancesAction", Command: "./migrate.sh"},
+		{Name: "warm", After: "RunInstancesAction", Command: "./warm.sh"},
+		{Name: "flush", After: "RollingDeploymentAction", Command: "./flush.sh"},
+	}
+
+	actions := insertHooks([]InfrastructureAction{InitializePipelineAction{}, rolling}, hooks)
+
+	assert.Equal(t, []string{"main.InitializePipelineAction", "*main.RollingDeploymentAction", "hook:flush"}, actionNames(actions))
+	assert.Equal(t, []string{
+		"main.RunInstancesAction",
+		"hook:warm",
+		"hook:migrate",
+		"main.RegisterNewInstancesAction",
+		"main.TerminateOldInstancesAction",
+	}, actionNames(rolling.Actions))
+	assert.Empty(t, rolling.CanaryActions)
+	assert.NoError(t, validateHookSteps(actions, hooks))
+
+	// The pipeline has no canary to bake
+	bake := HookConfig{Name: "bake", After: "CanaryBakeAction", Command: "./bake.sh"}
+	actions = insertHooks([]InfrastructureAction{InitializePipelineAction{}}, []HookConfig{bake})
+	assert.Error(t, validateHookSteps(actions, []HookConfig{bake}))
+}
+
+func TestHookActionRunsCommands(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deploy-hooks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	output := filepath.Join(dir, "hook.txt")
+	hook := HookAction{HookConfig{
+		Name: "migrate",
+		Before: "RegisterNewInstancesAction",
+		Command: `echo "$DEPLOY_HOOK $DEPLOY_PHASE $DEPLOY_NEW_INSTANCE_IDS" > ` + output + ` && cat >> ` + output,
+		Rollback: `echo "$DEPLOY_PHASE $DEPLOY_BATCH" > ` + output,
+	}}
+	info := &PipelineInfo{Version: "1", NewInstancesIds: aws.StringSlice([]string{"i-new1", "i-new2"}), Batch: 2}
+
+	if err := hook.Commit(context.Background(), info); err != nil {
+		t.Fatalf("Unexpected error from HookAction.Commit(): %s", err.Error())
+	}
+
+	content, _ := ioutil.ReadFile(output)
+	lines := strings.SplitN(string(content), "\n", 2)
+	assert.Equal(t, "migrate commit i-new1,i-new2", lines[0])
+
+	stdin := PipelineInfo{}
+	if assert.NoError(t, json.Unmarshal([]byte(lines[1]), &stdin)) {
+		assert.Equal(t, info.NewInstancesIds, stdin.NewInstancesIds)
+	}
+
+	if err := hook.Rollback(context.Background(), info); err != nil {
+		t.Fatalf("Unexpected error from HookAction.Rollback(): %s", err.Error())
+	}
+
+	content, _ = ioutil.ReadFile(output)
+	assert.Equal(t, "rollback 2\n", string(content))
+
+	hook.Hook.Rollback = ""
+	assert.NoError(t, hook.Rollback(context.Background(), info))
+
+	hook.Hook.Command = "echo database is locked >&2; exit 1"
+	err = hook.Commit(context.Background(), info)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "Hook migrate failed")
+		assert.Contains(t, err.Error(), "database is locked")
+	}
+}
+
+func TestHookConfigValidate(t *testing.T) {
+	assert.NoError(t, HookConfig{Name: "flush", After: "TerminateOldInstancesAction", Command: "./flush.sh"}.validate())
+
+	invalid := []HookConfig{
+		{Before: "RunInstancesAction", Command: "./warm.sh"},
+		{Name: "warm", Command: "./warm.sh"},
+		{Name: "warm", Before: "RunInstancesAction", After: "WaitUntilStatusOkAction", Command: "./warm.sh"},
+		{Name: "warm", After: "WarmCacheAction", Command: "./warm.sh"},
+		{Name: "warm", After: "RunInstancesAction"},
+		{Name: "warm", After: "RunInstancesAction", Command: "./warm.sh", Timeout: -1},
+	}
+	for idx, hook := range invalid {
+		assert.Error(t, hook.validate(), "hook %d", idx)
+	}
+}
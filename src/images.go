@@ -0,0 +1,417 @@
+package main
+
+import (
+    "github.com/aws/aws-sdk-go/aws"
+    "github.com/aws/aws-sdk-go/aws/awserr"
+    "github.com/aws/aws-sdk-go/service/ec2"
+    "github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+    "github.com/aws/aws-sdk-go/service/kms"
+    "github.com/aws/aws-sdk-go/service/kms/kmsiface"
+    "github.com/aws/aws-sdk-go/service/sts"
+    "github.com/aws/aws-sdk-go/service/sts/stsiface"
+
+    "context"
+    "fmt"
+    "sort"
+    "strings"
+    "sync"
+)
+
+// kmsGrantOperations are the operations EC2 of the target account needs to launch instances from encrypted snapshots
+var kmsGrantOperations = []*string{
+    aws.String(kms.GrantOperationDecrypt),
+    aws.String(kms.GrantOperationDescribeKey),
+    aws.String(kms.GrantOperationCreateGrant),
+    aws.String(kms.GrantOperationGenerateDataKeyWithoutPlaintext),
+    aws.String(kms.GrantOperationReEncryptFrom),
+    aws.String(kms.GrantOperationReEncryptTo),
+}
+
+// imageSharing serializes the shares of the new AMI, so targets of the same account running in parallel
+// do not both record the same permission and one of them does not revoke it from the other.
+var imageSharing sync.Mutex
+
+// ImageSharingConfig describes sharing the new AMI from the account it was built in with the accounts of the targets
+type ImageSharingConfig struct {
+    Enabled bool `yaml:"enabled" json:"enabled"`
+    // Credentials of the account owning the new AMI in the region of the config. The default credential chain is used when empty.
+    Credentials CredentialsConfig `yaml:"credentials" json:"credentials"`
+}
+
+// ImageValidationConfig describes checks of the new AMI besides its compatibility with old instances
+type ImageValidationConfig struct {
+    // RequiredTags the new AMI must have, e.g. BuildStatus: passed. Tags with an empty value only have to be present.
+    RequiredTags map[string]string `yaml:"required_tags" json:"required_tags"`
+}
+
+// KMSGrant is the grant on the KMS key of the encrypted snapshot created by the deployment
+type KMSGrant struct {
+    KeyID string
+    GrantID string
+}
+
+// SharedImageState records permissions on the new AMI granted by the deployment in the account owning it
+type SharedImageState struct {
+    ImageID string
+    Account string
+    LaunchPermission bool
+    SnapshotIds []*string
+    KMSGrants []KMSGrant
+}
+
+// ShareImageAction is a pipeline step struct. It shares the new AMI, its snapshots and the KMS keys of encrypted
+// snapshots from the account owning the AMI with the account of the deployment. Permissions which already exist are left alone.
+type ShareImageAction struct {
+    // Svc and KMS are clients of the account owning the AMI
+    Svc ec2iface.EC2API
+    KMS kmsiface.KMSAPI
+    // STS is the client of the deployment account
+    STS stsiface.STSAPI
+    AMI string
+    RequiredTags map[string]string
+}
+
+// VerifyImageAction is a pipeline step struct. It checks both AMIs exist and the new one can replace old instances
+// in the region and account of the deployment, before any instance is launched.
+type VerifyImageAction struct {
+    Svc ec2iface.EC2API
+    RequiredTags map[string]string
+}
+
+// Commit is an action to apply changes in the ShareImageAction step
+func (act ShareImageAction) Commit(ctx context.Context, pipelineInfo *PipelineInfo) error {
+    identity, err := act.STS.GetCallerIdentityWithContext(ctx, &sts.GetCallerIdentityInput{})
+    if err != nil {
+        return err
+    }
+    account := *identity.Account
+
+    output, err := act.Svc.DescribeImages(&ec2.DescribeImagesInput{ImageIds: []*string{aws.String(act.AMI)}})
+    if err != nil {
+        return err
+    }
+
+    if len(output.Images) == 0 {
+        return fmt.Errorf("AMI %s not found in the account owning it", act.AMI)
+    }
+    image := output.Images[0]
+
+    if missing := missingTags(image, act.RequiredTags); len(missing) > 0 {
+        return fmt.Errorf("AMI %s is missing required tags %s", act.AMI, strings.Join(missing, ", "))
+    }
+
+    if aws.StringValue(image.OwnerId) == account {
+        logger.Info("AMI belongs to the deployment account", Fields{"action": actionName(act), "image_id": act.AMI, "account": account})
+        return nil
+    }
+
+    imageSharing.Lock()
+    defer imageSharing.Unlock()
+
+    if pipelineInfo.SharedImage == nil {
+        pipelineInfo.SharedImage = &SharedImageState{ImageID: act.AMI, Account: account}
+    }
+    shared := pipelineInfo.SharedImage
+
+    if err := act.shareImage(shared); err != nil {
+        return err
+    }
+
+    for _, mapping := range image.BlockDeviceMappings {
+        if mapping.Ebs == nil || mapping.Ebs.SnapshotId == nil {
+            continue
+        }
+
+        if err := act.shareSnapshot(shared, *mapping.Ebs.SnapshotId, pipelineInfo.Version); err != nil {
+            return err
+        }
+    }
+
+    logger.Info("AMI shared", Fields{"action": actionName(act), "image_id": act.AMI, "account": account})
+    return nil
+}
+
+func (act ShareImageAction) shareImage(shared *SharedImageState) error {
+    attribute, err := act.Svc.DescribeImageAttribute(&ec2.DescribeImageAttributeInput{
+        ImageId: aws.String(shared.ImageID),
+        Attribute: aws.String(ec2.ImageAttributeNameLaunchPermission),
+    })
+    if err != nil {
+        return err
+    }
+
+    for _, permission := range attribute.LaunchPermissions {
+        if aws.StringValue(permission.UserId) == shared.Account || aws.StringValue(permission.Group) == "all" {
+            return nil
+        }
+    }
+
+    _, err = act.Svc.ModifyImageAttribute(&ec2.ModifyImageAttributeInput{
+        ImageId: aws.String(shared.ImageID),
+        LaunchPermission: &ec2.LaunchPermissionModifications{
+            Add: []*ec2.LaunchPermission{{UserId: aws.String(shared.Account)}},
+        },
+    })
+    if err != nil {
+        return err
+    }
+
+    shared.LaunchPermission = true
+    return nil
+}
+
+func (act ShareImageAction) shareSnapshot(shared *SharedImageState, snapshotID string, version string) error {
+    attribute, err := act.Svc.DescribeSnapshotAttribute(&ec2.DescribeSnapshotAttributeInput{
+        SnapshotId: aws.String(snapshotID),
+        Attribute: aws.String(ec2.SnapshotAttributeNameCreateVolumePermission),
+    })
+    if err != nil {
+        return err
+    }
+
+    permitted := false
+    for _, permission := range attribute.CreateVolumePermissions {
+        if aws.StringValue(permission.UserId) == shared.Account || aws.StringValue(permission.Group) == "all" {
+            permitted = true
+        }
+    }
+
+    if !permitted {
+        _, err = act.Svc.ModifySnapshotAttribute(&ec2.ModifySnapshotAttributeInput{
+            SnapshotId: aws.String(snapshotID),
+            CreateVolumePermission: &ec2.CreateVolumePermissionModifications{
+                Add: []*ec2.CreateVolumePermission{{UserId: aws.String(shared.Account)}},
+            },
+        })
+        if err != nil {
+            return err
+        }
+
+        shared.SnapshotIds = append(shared.SnapshotIds, aws.String(snapshotID))
+    }
+
+    output, err := act.Svc.DescribeSnapshots(&ec2.DescribeSnapshotsInput{SnapshotIds: []*string{aws.String(snapshotID)}})
+    if err != nil {
+        return err
+    }
+
+    for _, snapshot := range output.Snapshots {
+        if !aws.BoolValue(snapshot.Encrypted) || snapshot.KmsKeyId == nil {
+            continue
+        }
+
+        // Snapshots of the AMI usually share the key, which needs a single grant
+        granted := false
+        for _, grant := range shared.KMSGrants {
+            granted = granted || grant.KeyID == *snapshot.KmsKeyId
+        }
+
+        if granted {
+            continue
+        }
+
+        // The grant name makes the call idempotent, when the step is executed again by resume
+        grant, err := act.KMS.CreateGrant(&kms.CreateGrantInput{
+            KeyId: snapshot.KmsKeyId,
+            GranteePrincipal: aws.String(fmt.Sprintf("arn:aws:iam::%s:root", shared.Account)),
+            Operations: kmsGrantOperations,
+            Name: aws.String("deploy-" + version),
+        })
+        if err != nil {
+            return fmt.Errorf("Cannot grant KMS key %s to the account %s. AMIs encrypted with AWS managed keys cannot be shared. %s", *snapshot.KmsKeyId, shared.Account, err.Error())
+        }
+
+        shared.KMSGrants = append(shared.KMSGrants, KMSGrant{*snapshot.KmsKeyId, aws.StringValue(grant.GrantId)})
+    }
+
+    return nil
+}
+
+// Rollback is an action to apply changes in the ShareImageAction step
+func (act ShareImageAction) Rollback(ctx context.Context, pipelineInfo *PipelineInfo) error {
+    shared := pipelineInfo.SharedImage
+    if shared == nil {
+        return nil
+    }
+
+    for len(shared.KMSGrants) > 0 {
+        grant := shared.KMSGrants[0]
+
+        if _, err := act.KMS.RevokeGrant(&kms.RevokeGrantInput{KeyId: aws.String(grant.KeyID), GrantId: aws.String(grant.GrantID)}); err != nil {
+            return err
+        }
+
+        shared.KMSGrants = shared.KMSGrants[1:]
+    }
+
+    for len(shared.SnapshotIds) > 0 {
+        _, err := act.Svc.ModifySnapshotAttribute(&ec2.ModifySnapshotAttributeInput{
+            SnapshotId: shared.SnapshotIds[0],
+            CreateVolumePermission: &ec2.CreateVolumePermissionModifications{
+                Remove: []*ec2.CreateVolumePermission{{UserId: aws.String(shared.Account)}},
+            },
+        })
+        if err != nil {
+            return err
+        }
+
+        shared.SnapshotIds = shared.SnapshotIds[1:]
+    }
+
+    if shared.LaunchPermission {
+        _, err := act.Svc.ModifyImageAttribute(&ec2.ModifyImageAttributeInput{
+            ImageId: aws.String(shared.ImageID),
+            LaunchPermission: &ec2.LaunchPermissionModifications{
+                Remove: []*ec2.LaunchPermission{{UserId: aws.String(shared.Account)}},
+            },
+        })
+        if err != nil {
+            return err
+        }
+    }
+
+    pipelineInfo.SharedImage = nil
+    return nil
+}
+
+// Leftovers describes permissions on the new AMI, which the failed rollback did not revoke
+func (act ShareImageAction) Leftovers(pipelineInfo *PipelineInfo) []string {
+    leftovers := []string{}
+
+    shared := pipelineInfo.SharedImage
+    if shared == nil {
+        return leftovers
+    }
+
+    if shared.LaunchPermission {
+        leftovers = append(leftovers, fmt.Sprintf("launch permission of the account %s on AMI %s", shared.Account, shared.ImageID))
+    }
+
+    for _, snapshotID := range shared.SnapshotIds {
+        leftovers = append(leftovers, fmt.Sprintf("create volume permission of the account %s on EBS snapshot %s", shared.Account, *snapshotID))
+    }
+
+    for _, grant := range shared.KMSGrants {
+        leftovers = append(leftovers, fmt.Sprintf("KMS grant %s of the account %s on key %s", grant.GrantID, shared.Account, grant.KeyID))
+    }
+
+    return leftovers
+}
+
+// describeImage returns the AMI or nil, when it does not exist or is not shared with the account
+func describeImage(svc ec2iface.EC2API, imageID string) (*ec2.Image, error) {
+    output, err := svc.DescribeImages(&ec2.DescribeImagesInput{ImageIds: []*string{aws.String(imageID)}})
+
+    if aerr, ok := err.(awserr.Error); ok && strings.HasPrefix(aerr.Code(), "InvalidAMIID") {
+        return nil, nil
+    }
+
+    if err != nil || len(output.Images) == 0 {
+        return nil, err
+    }
+
+    return output.Images[0], nil
+}
+
+// missingTags returns the required tags the AMI does not have. Tags with an empty value only have to be present.
+func missingTags(image *ec2.Image, required map[string]string) []string {
+    tags := map[string]string{}
+    for _, tag := range image.Tags {
+        tags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+    }
+
+    missing := []string{}
+    for key, value := range required {
+        if actual, ok := tags[key]; !ok || (value != "" && actual != value) {
+            missing = append(missing, key+"="+value)
+        }
+    }
+    sort.Strings(missing)
+
+    return missing
+}
+
+// Commit is an action to apply changes in the VerifyImageAction step
+func (act VerifyImageAction) Commit(ctx context.Context, pipelineInfo *PipelineInfo) error {
+    ami := pipelineInfo.Input.NewAMI
+
+    image, err := describeImage(act.Svc, ami)
+    if err != nil {
+        return err
+    }
+
+    if image == nil {
+        return fmt.Errorf("AMI %s is not visible in the region %s of the deployment account. Share or copy it first", ami, pipelineInfo.Config.Region)
+    }
+
+    if state := aws.StringValue(image.State); state != ec2.ImageStateAvailable {
+        return fmt.Errorf("AMI %s is %s. Expected available", ami, state)
+    }
+
+    // Tags of the shared AMI are visible only to the account owning it, which checks them before sharing
+    if pipelineInfo.SharedImage == nil {
+        if missing := missingTags(image, act.RequiredTags); len(missing) > 0 {
+            return fmt.Errorf("AMI %s is missing required tags %s", ami, strings.Join(missing, ", "))
+        }
+    }
+
+    if oldAMI := pipelineInfo.Input.OldAMI; oldAMI != "" {
+        oldImage, err := describeImage(act.Svc, oldAMI)
+        if err != nil {
+            return err
+        }
+
+        if oldImage == nil {
+            return fmt.Errorf("Old AMI %s not found", oldAMI)
+        }
+
+        if image.RootDeviceType != nil && aws.StringValue(oldImage.RootDeviceType) != *image.RootDeviceType {
+            return fmt.Errorf("AMI %s has %s root device, but old AMI %s has %s", ami, *image.RootDeviceType, oldAMI, aws.StringValue(oldImage.RootDeviceType))
+        }
+    }
+
+    return act.verifyInstanceTypes(image, pipelineInfo.OldInstances)
+}
+
+// verifyInstanceTypes checks the AMI can run on instance types of old instances. Attributes missing in the description
+// are not checked, e.g. of the AMI copy planned in the plan mode.
+func (act VerifyImageAction) verifyInstanceTypes(image *ec2.Image, instances []ShortInstanceDesc) error {
+    instanceTypes := []*string{}
+    for _, instance := range instances {
+        if !stringInSlice(instance.InstanceType, aws.StringValueSlice(instanceTypes)) {
+            instanceTypes = append(instanceTypes, aws.String(instance.InstanceType))
+        }
+    }
+
+    if len(instanceTypes) == 0 {
+        return nil
+    }
+
+    output, err := act.Svc.DescribeInstanceTypes(&ec2.DescribeInstanceTypesInput{InstanceTypes: instanceTypes})
+    if err != nil {
+        return err
+    }
+
+    for _, info := range output.InstanceTypes {
+        instanceType := aws.StringValue(info.InstanceType)
+
+        if image.Architecture != nil && info.ProcessorInfo != nil && !stringInSlice(*image.Architecture, aws.StringValueSlice(info.ProcessorInfo.SupportedArchitectures)) {
+            return fmt.Errorf("AMI %s with %s architecture cannot run on instance type %s", *image.ImageId, *image.Architecture, instanceType)
+        }
+
+        if image.VirtualizationType != nil && !stringInSlice(*image.VirtualizationType, aws.StringValueSlice(info.SupportedVirtualizationTypes)) {
+            return fmt.Errorf("AMI %s with %s virtualization cannot run on instance type %s", *image.ImageId, *image.VirtualizationType, instanceType)
+        }
+
+        if image.RootDeviceType != nil && !stringInSlice(*image.RootDeviceType, aws.StringValueSlice(info.SupportedRootDeviceTypes)) {
+            return fmt.Errorf("AMI %s with %s root device cannot run on instance type %s", *image.ImageId, *image.RootDeviceType, instanceType)
+        }
+    }
+
+    return nil
+}
+
+// Rollback is an action to apply changes in the VerifyImageAction step
+func (act VerifyImageAction) Rollback(ctx context.Context, pipelineInfo *PipelineInfo) error {
+    return nil
+}
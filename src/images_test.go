@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/stretchr/testify/assert"
+)
+
+const ownerAccount = "111111111111"
+
+func TestShareImageAction(t *testing.T) {
+	owner := newFakeAWS()
+	owner.account = ownerAccount
+	owner.addImage("ami-new", ownerAccount, "snap-new", "arn:aws:kms:us-east-1:111111111111:key/build")
+	target := newFakeAWS()
+
+	act := ShareImageAction{Svc: owner.clients().EC2, KMS: owner.clients().KMS, STS: target.clients().STS, AMI: "ami-new"}
+	info := &PipelineInfo{Version: "1"}
+
+	assert.NoError(t, act.Commit(context.Background(), info))
+	assert.True(t, owner.permissions["ami-new"][fakeAccount])
+	assert.True(t, owner.permissions["snap-new"][fakeAccount])
+	assert.Equal(t, map[string]string{"grant-1": "arn:aws:kms:us-east-1:111111111111:key/build arn:aws:iam::123456789012:root"}, owner.grants)
+
+	// Resumed step keeps the recorded permissions and creates no other grant
+	assert.NoError(t, act.Commit(context.Background(), info))
+	assert.Equal(t, 1, owner.count("ModifyImageAttribute"))
+	assert.Equal(t, 1, owner.count("CreateGrant"))
+
+	owner.failures["ModifyImageAttribute"] = errors.New("InternalError: try again")
+	assert.Error(t, act.Rollback(context.Background(), info))
+	assert.Empty(t, owner.grants)
+	assert.False(t, owner.permissions["snap-new"][fakeAccount])
+	assert.Equal(t, []string{"launch permission of the account 123456789012 on AMI ami-new"}, act.Leftovers(info))
+
+	assert.NoError(t, act.Rollback(context.Background(), info))
+	assert.False(t, owner.permissions["ami-new"][fakeAccount])
+	assert.Nil(t, info.SharedImage)
+	assert.Empty(t, act.Leftovers(info))
+}
+
+func TestShareImageActionKeepsExistingPermissions(t *testing.T) {
+	owner := newFakeAWS()
+	owner.addImage("ami-new", ownerAccount, "snap-new", "")
+	owner.images["ami-new"].Tags = []*ec2.Tag{{Key: aws.String("BuildStatus"), Value: aws.String("passed")}}
+	owner.modifyPermissions("ami-new", []string{fakeAccount}, nil)
+	owner.modifyPermissions("snap-new", []string{fakeAccount}, nil)
+
+	act := ShareImageAction{Svc: owner.clients().EC2, KMS: owner.clients().KMS, STS: newFakeAWS().clients().STS, AMI: "ami-new"}
+	info := &PipelineInfo{Version: "1"}
+
+	act.RequiredTags = map[string]string{"BuildStatus": "failed"}
+	assert.Error(t, act.Commit(context.Background(), info))
+	act.RequiredTags = map[string]string{"BuildStatus": "passed"}
+
+	assert.NoError(t, act.Commit(context.Background(), info))
+	assert.NoError(t, act.Rollback(context.Background(), info))
+
+	// Permissions granted before the deployment are not revoked
+	assert.True(t, owner.permissions["ami-new"][fakeAccount])
+	assert.True(t, owner.permissions["snap-new"][fakeAccount])
+	assert.Equal(t, 0, owner.count("ModifyImageAttribute"))
+
+	// AMI of the deployment account needs no share
+	owner.addImage("ami-own", fakeAccount, "snap-own", "")
+	act.AMI = "ami-own"
+	act.RequiredTags = nil
+	info = &PipelineInfo{Version: "1"}
+
+	assert.NoError(t, act.Commit(context.Background(), info))
+	assert.Nil(t, info.SharedImage)
+	assert.Equal(t, 1, owner.count("DescribeImageAttribute"))
+}
+
+func TestVerifyImageAction(t *testing.T) {
+	fake := newFakeAWS()
+	act := VerifyImageAction{fake.clients().EC2, map[string]string{"BuildStatus": "passed", "Commit": ""}}
+	info := &PipelineInfo{
+		Input:        InputArgs{"ami-old", "ami-new"},
+		Config:       DefaultConfig(),
+		OldInstances: []ShortInstanceDesc{{ID: "i-1", InstanceType: "t2.micro"}},
+	}
+
+	err := act.Commit(context.Background(), info)
+	if assert.Error(t, err) {
+		assert.Equal(t, "AMI ami-new is not visible in the region us-east-1 of the deployment account. Share or copy it first", err.Error())
+	}
+
+	fake.failures["DescribeImages"] = awserr.New("InvalidAMIID.NotFound", "The image id '[ami-new]' does not exist", nil)
+	assert.Error(t, act.Commit(context.Background(), info))
+
+	fake.addImage("ami-new", fakeAccount, "snap-new", "")
+	image := fake.images["ami-new"]
+	image.State = aws.String(ec2.ImageStatePending)
+	err = act.Commit(context.Background(), info)
+	if assert.Error(t, err) {
+		assert.Equal(t, "AMI ami-new is pending. Expected available", err.Error())
+	}
+
+	image.State = aws.String(ec2.ImageStateAvailable)
+	image.Tags = []*ec2.Tag{{Key: aws.String("BuildStatus"), Value: aws.String("failed")}}
+	err = act.Commit(context.Background(), info)
+	if assert.Error(t, err) {
+		assert.Equal(t, "AMI ami-new is missing required tags BuildStatus=passed, Commit=", err.Error())
+	}
+
+	image.Tags = []*ec2.Tag{
+		{Key: aws.String("BuildStatus"), Value: aws.String("passed")},
+		{Key: aws.String("Commit"), Value: aws.String("4f2a9c1")},
+	}
+	err = act.Commit(context.Background(), info)
+	if assert.Error(t, err) {
+		assert.Equal(t, "Old AMI ami-old not found", err.Error())
+	}
+
+	fake.addImage("ami-old", fakeAccount, "snap-old", "")
+	assert.NoError(t, act.Commit(context.Background(), info))
+
+	// Tags of shared AMIs are checked by the account owning them
+	image.Tags = nil
+	info.SharedImage = &SharedImageState{ImageID: "ami-new", Account: fakeAccount}
+	assert.NoError(t, act.Commit(context.Background(), info))
+}
+
+func TestVerifyImageActionChecksOldInstances(t *testing.T) {
+	fake := newFakeAWS()
+	fake.addImage("ami-old", fakeAccount, "snap-old", "")
+	fake.addImage("ami-new", fakeAccount, "snap-new", "")
+	act := VerifyImageAction{Svc: fake.clients().EC2}
+	info := &PipelineInfo{
+		Input:        InputArgs{"ami-old", "ami-new"},
+		OldInstances: []ShortInstanceDesc{{ID: "i-1", InstanceType: "t2.micro"}, {ID: "i-2", InstanceType: "t4g.micro"}},
+	}
+
+	err := act.Commit(context.Background(), info)
+	if assert.Error(t, err) {
+		assert.Equal(t, "AMI ami-new with x86_64 architecture cannot run on instance type t4g.micro", err.Error())
+	}
+
+	info.OldInstances = info.OldInstances[:1]
+	fake.images["ami-new"].VirtualizationType = aws.String(ec2.VirtualizationTypeParavirtual)
+	err = act.Commit(context.Background(), info)
+	if assert.Error(t, err) {
+		assert.Equal(t, "AMI ami-new with paravirtual virtualization cannot run on instance type t2.micro", err.Error())
+	}
+
+	fake.images["ami-new"].VirtualizationType = aws.String(ec2.VirtualizationTypeHvm)
+	fake.images["ami-new"].RootDeviceType = aws.String(ec2.RootDeviceTypeInstanceStore)
+	err = act.Commit(context.Background(), info)
+	if assert.Error(t, err) {
+		assert.Equal(t, "AMI ami-new has instance-store root device, but old AMI ami-old has ebs", err.Error())
+	}
+
+	// Instances selected by tags have no old AMI
+	info.Input.OldAMI = ""
+	err = act.Commit(context.Background(), info)
+	if assert.Error(t, err) {
+		assert.Equal(t, "AMI ami-new with instance-store root device cannot run on instance type t2.micro", err.Error())
+	}
+}
+
+func TestNewPipelineSharesImage(t *testing.T) {
+	owner := newFakeAWS()
+	target := newFakeAWS()
+
+	config := DefaultConfig()
+	config.Selector.AMI = "ami-old"
+	config.NewAMI = "ami-new"
+	config.Credentials = CredentialsConfig{RoleARN: "arn:aws:iam::123456789012:role/deploy"}
+	config.ImageSharing.Enabled = true
+	assert.NoError(t, config.Validate())
+
+	actions := newPipeline(config, func(config Config) awsClients {
+		if config.Credentials.isEmpty() {
+			return owner.clients()
+		}
+
+		return target.clients()
+	})
+
+	// The AMI is shared by the account owning it and verified in the account of the deployment
+	assert.Equal(t, ShareImageAction{owner.clients().EC2, owner.clients().KMS, target.clients().STS, "ami-new", nil}, actions[1])
+	assert.Equal(t, VerifyImageAction{target.clients().EC2, nil}, actions[3])
+
+	config.ImageSharing.Credentials.ExternalID = "deploy-hat"
+	assert.Error(t, config.Validate())
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+    "github.com/aws/aws-sdk-go/aws"
+    "github.com/aws/aws-sdk-go/service/ec2"
+    "github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+
+    "fmt"
+)
+
+// BlockDeviceDesc keeps the EBS volume attached to the old instance. The new instance gets a volume of the same
+// size and type, filled from the snapshot of the new AMI for devices the AMI maps.
+type BlockDeviceDesc struct {
+    DeviceName string
+    VolumeID string
+    VolumeSize int64
+    VolumeType string
+    Iops int64 `json:",omitempty"`
+    Throughput int64 `json:",omitempty"`
+    Encrypted bool `json:",omitempty"`
+    KmsKeyID string `json:",omitempty"`
+    DeleteOnTermination bool
+}
+
+// InstanceMetadataDesc keeps the instance metadata service options, e.g. IMDSv2 required by http tokens
+type InstanceMetadataDesc struct {
+    HTTPEndpoint string
+    HTTPTokens string
+    HTTPPutResponseHopLimit int64
+    InstanceMetadataTags string `json:",omitempty"`
+}
+
+// burstableTypes returns the instance types of the instances which support CPU credits
+func burstableTypes(svc ec2iface.EC2API, instances []ShortInstanceDesc) (map[string]bool, error) {
+    instanceTypes := []*string{}
+    seen := map[string]bool{}
+
+    for _, instance := range instances {
+        if !seen[instance.InstanceType] {
+            seen[instance.InstanceType] = true
+            instanceTypes = append(instanceTypes, aws.String(instance.InstanceType))
+        }
+    }
+
+    burstable := map[string]bool{}
+    if len(instanceTypes) == 0 {
+        return burstable, nil
+    }
+
+    output, err := svc.DescribeInstanceTypes(&ec2.DescribeInstanceTypesInput{InstanceTypes: instanceTypes})
+    if err != nil {
+        return nil, err
+    }
+
+    for _, info := range output.InstanceTypes {
+        burstable[aws.StringValue(info.InstanceType)] = aws.BoolValue(info.BurstablePerformanceSupported)
+    }
+
+    return burstable, nil
+}
+
+// describeLaunchConfig completes the old instances with the settings which DescribeInstances does not return:
+// sizes and types of volumes, user data and CPU credits of burstable instances
+func describeLaunchConfig(svc ec2iface.EC2API, instances []ShortInstanceDesc) error {
+    volumes := map[string]*ec2.Volume{}
+    volumeIDs := []*string{}
+    burstableIDs := []*string{}
+
+    burstable, err := burstableTypes(svc, instances)
+    if err != nil {
+        return err
+    }
+
+    for _, instance := range instances {
+        for _, device := range instance.BlockDevices {
+            volumeIDs = append(volumeIDs, aws.String(device.VolumeID))
+        }
+
+        if burstable[instance.InstanceType] {
+            burstableIDs = append(burstableIDs, aws.String(instance.ID))
+        }
+    }
+
+    if len(volumeIDs) > 0 {
+        err := svc.DescribeVolumesPages(&ec2.DescribeVolumesInput{VolumeIds: volumeIDs}, func(page *ec2.DescribeVolumesOutput, lastPage bool) bool {
+            for _, volume := range page.Volumes {
+                volumes[*volume.VolumeId] = volume
+            }
+
+            return true
+        })
+        if err != nil {
+            return err
+        }
+    }
+
+    credits := map[string]string{}
+    if len(burstableIDs) > 0 {
+        output, err := svc.DescribeInstanceCreditSpecifications(&ec2.DescribeInstanceCreditSpecificationsInput{InstanceIds: burstableIDs})
+        if err != nil {
+            return err
+        }
+
+        for _, credit := range output.InstanceCreditSpecifications {
+            credits[*credit.InstanceId] = aws.StringValue(credit.CpuCredits)
+        }
+    }
+
+    for idx := range instances {
+        instance := &instances[idx]
+        instance.CreditSpecification = credits[instance.ID]
+
+        for deviceIdx := range instance.BlockDevices {
+            device := &instance.BlockDevices[deviceIdx]
+
+            volume, ok := volumes[device.VolumeID]
+            if !ok {
+                return fmt.Errorf("Not found volume %s of instance %s", device.VolumeID, instance.ID)
+            }
+
+            device.VolumeSize = aws.Int64Value(volume.Size)
+            device.VolumeType = aws.StringValue(volume.VolumeType)
+            device.Iops = aws.Int64Value(volume.Iops)
+            device.Throughput = aws.Int64Value(volume.Throughput)
+            device.Encrypted = aws.BoolValue(volume.Encrypted)
+            device.KmsKeyID = aws.StringValue(volume.KmsKeyId)
+        }
+
+        attribute, err := svc.DescribeInstanceAttribute(&ec2.DescribeInstanceAttributeInput{
+            InstanceId: aws.String(instance.ID),
+            Attribute: aws.String(ec2.InstanceAttributeNameUserData),
+        })
+        if err != nil {
+            return err
+        }
+
+        if attribute.UserData != nil {
+            instance.UserData = aws.StringValue(attribute.UserData.Value)
+        }
+    }
+
+    return nil
+}
+
+// launchConfig returns the launch settings of the instance described by DescribeInstances
+func launchConfig(instance *ec2.Instance) ShortInstanceDesc {
+    desc := ShortInstanceDesc{EbsOptimized: aws.BoolValue(instance.EbsOptimized)}
+
+    if instance.IamInstanceProfile != nil {
+        desc.IamInstanceProfile = aws.StringValue(instance.IamInstanceProfile.Arn)
+    }
+
+    if instance.Placement != nil {
+        desc.PlacementGroup = aws.StringValue(instance.Placement.GroupName)
+        desc.Tenancy = aws.StringValue(instance.Placement.Tenancy)
+    }
+
+    if instance.Monitoring != nil {
+        state := aws.StringValue(instance.Monitoring.State)
+        desc.Monitoring = state == ec2.MonitoringStateEnabled || state == ec2.MonitoringStatePending
+    }
+
+    if options := instance.MetadataOptions; options != nil {
+        desc.MetadataOptions = &InstanceMetadataDesc{
+            HTTPEndpoint: aws.StringValue(options.HttpEndpoint),
+            HTTPTokens: aws.StringValue(options.HttpTokens),
+            HTTPPutResponseHopLimit: aws.Int64Value(options.HttpPutResponseHopLimit),
+            InstanceMetadataTags: aws.StringValue(options.InstanceMetadataTags),
+        }
+    }
+
+    for _, mapping := range instance.BlockDeviceMappings {
+        // Instance store volumes come with the instance type
+        if mapping.Ebs == nil || mapping.Ebs.VolumeId == nil {
+            continue
+        }
+
+        desc.BlockDevices = append(desc.BlockDevices, BlockDeviceDesc{
+            DeviceName: aws.StringValue(mapping.DeviceName),
+            VolumeID: *mapping.Ebs.VolumeId,
+            DeleteOnTermination: aws.BoolValue(mapping.Ebs.DeleteOnTermination),
+        })
+    }
+
+    return desc
+}
+
+// applyLaunchConfig sets the launch settings of the old instance in the input launching its replacement
+func applyLaunchConfig(input *ec2.RunInstancesInput, item ShortInstanceDesc) {
+    if item.KeyName != "" {
+        input.KeyName = aws.String(item.KeyName)
+    }
+
+    if item.IamInstanceProfile != "" {
+        input.IamInstanceProfile = &ec2.IamInstanceProfileSpecification{Arn: aws.String(item.IamInstanceProfile)}
+    }
+
+    if item.UserData != "" {
+        input.UserData = aws.String(item.UserData)
+    }
+
+    if item.PlacementGroup != "" || item.Tenancy != "" {
+        input.Placement = &ec2.Placement{}
+
+        if item.PlacementGroup != "" {
+            input.Placement.GroupName = aws.String(item.PlacementGroup)
+        }
+
+        if item.Tenancy != "" {
+            input.Placement.Tenancy = aws.String(item.Tenancy)
+        }
+    }
+
+    if item.Monitoring {
+        input.Monitoring = &ec2.RunInstancesMonitoringEnabled{Enabled: aws.Bool(true)}
+    }
+
+    if item.EbsOptimized {
+        input.EbsOptimized = aws.Bool(true)
+    }
+
+    if item.CreditSpecification != "" {
+        input.CreditSpecification = &ec2.CreditSpecificationRequest{CpuCredits: aws.String(item.CreditSpecification)}
+    }
+
+    if options := item.MetadataOptions; options != nil {
+        input.MetadataOptions = &ec2.InstanceMetadataOptionsRequest{
+            HttpEndpoint: aws.String(options.HTTPEndpoint),
+            HttpTokens: aws.String(options.HTTPTokens),
+            HttpPutResponseHopLimit: aws.Int64(options.HTTPPutResponseHopLimit),
+        }
+
+        if options.InstanceMetadataTags != "" {
+            input.MetadataOptions.InstanceMetadataTags = aws.String(options.InstanceMetadataTags)
+        }
+    }
+
+    for _, device := range item.BlockDevices {
+        ebs := &ec2.EbsBlockDevice{
+            VolumeSize: aws.Int64(device.VolumeSize),
+            VolumeType: aws.String(device.VolumeType),
+            DeleteOnTermination: aws.Bool(device.DeleteOnTermination),
+        }
+
+        // IOPS and throughput can be set only for volume types which provision them
+        switch device.VolumeType {
+        case ec2.VolumeTypeIo1, ec2.VolumeTypeIo2, ec2.VolumeTypeGp3:
+            if device.Iops > 0 {
+                ebs.Iops = aws.Int64(device.Iops)
+            }
+        }
+
+        if device.VolumeType == ec2.VolumeTypeGp3 && device.Throughput > 0 {
+            ebs.Throughput = aws.Int64(device.Throughput)
+        }
+
+        // Volumes from encrypted snapshots cannot be unencrypted, so the flag is set only to encrypt
+        if device.Encrypted {
+            ebs.Encrypted = aws.Bool(true)
+
+            if device.KmsKeyID != "" {
+                ebs.KmsKeyId = aws.String(device.KmsKeyID)
+            }
+        }
+
+        input.BlockDeviceMappings = append(input.BlockDeviceMappings, &ec2.BlockDeviceMapping{
+            DeviceName: aws.String(device.DeviceName),
+            Ebs: ebs,
+        })
+    }
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApplyLaunchConfigVolumes(t *testing.T) {
+	input := &ec2.RunInstancesInput{}
+	applyLaunchConfig(input, ShortInstanceDesc{
+		BlockDevices: []BlockDeviceDesc{
+			{DeviceName: "/dev/xvda", VolumeSize: 20, VolumeType: ec2.VolumeTypeGp3, Iops: 3000, Throughput: 125, DeleteOnTermination: true},
+			{DeviceName: "/dev/xvdb", VolumeSize: 100, VolumeType: ec2.VolumeTypeGp2, Iops: 300, Encrypted: true, KmsKeyID: "arn:key"},
+			{DeviceName: "/dev/xvdc", VolumeSize: 50, VolumeType: ec2.VolumeTypeIo2, Iops: 5000, Throughput: 500},
+		},
+	})
+
+	assert.Nil(t, input.KeyName)
+	assert.Equal(t, []*ec2.BlockDeviceMapping{
+		{DeviceName: aws.String("/dev/xvda"), Ebs: &ec2.EbsBlockDevice{
+			VolumeSize: aws.Int64(20), VolumeType: aws.String("gp3"), DeleteOnTermination: aws.Bool(true), Iops: aws.Int64(3000), Throughput: aws.Int64(125),
+		}},
+		// IOPS of gp2 come with the size and cannot be set
+		{DeviceName: aws.String("/dev/xvdb"), Ebs: &ec2.EbsBlockDevice{
+			VolumeSize: aws.Int64(100), VolumeType: aws.String("gp2"), DeleteOnTermination: aws.Bool(false), Encrypted: aws.Bool(true), KmsKeyId: aws.String("arn:key"),
+		}},
+		{DeviceName: aws.String("/dev/xvdc"), Ebs: &ec2.EbsBlockDevice{
+			VolumeSize: aws.Int64(50), VolumeType: aws.String("io2"), DeleteOnTermination: aws.Bool(false), Iops: aws.Int64(5000),
+		}},
+	}, input.BlockDeviceMappings)
+}
+
+func TestApplyLaunchConfigInstanceSettings(t *testing.T) {
+	input := &ec2.RunInstancesInput{}
+	applyLaunchConfig(input, ShortInstanceDesc{
+		KeyName:             "prod",
+		IamInstanceProfile:  "arn:aws:iam::123456789012:instance-profile/web",
+		PlacementGroup:      "web-spread",
+		Monitoring:          true,
+		CreditSpecification: "standard",
+		MetadataOptions:     &InstanceMetadataDesc{HTTPEndpoint: "enabled", HTTPTokens: "required", HTTPPutResponseHopLimit: 2},
+	})
+
+	assert.Equal(t, "prod", aws.StringValue(input.KeyName))
+	assert.Equal(t, "arn:aws:iam::123456789012:instance-profile/web", aws.StringValue(input.IamInstanceProfile.Arn))
+	assert.Equal(t, &ec2.Placement{GroupName: aws.String("web-spread")}, input.Placement)
+	assert.True(t, aws.BoolValue(input.Monitoring.Enabled))
+	assert.Nil(t, input.EbsOptimized)
+	assert.Equal(t, "standard", aws.StringValue(input.CreditSpecification.CpuCredits))
+	assert.Equal(t, &ec2.InstanceMetadataOptionsRequest{
+		HttpEndpoint:            aws.String("enabled"),
+		HttpTokens:              aws.String("required"),
+		HttpPutResponseHopLimit: aws.Int64(2),
+	}, input.MetadataOptions)
+}
+
+func TestDescribeLaunchConfig(t *testing.T) {
+	fake := newFakeAWS()
+	fake.addInstance("i-1", "ami-old", "sg-1", "arn:tg-web")
+	fake.addInstance("i-2", "ami-old", "sg-1", "arn:tg-web")
+	fake.instances["i-2"].InstanceType = "trn1.2xlarge"
+
+	instances := []ShortInstanceDesc{
+		{ID: "i-1", InstanceType: "t2.micro", BlockDevices: []BlockDeviceDesc{{DeviceName: "/dev/xvda", VolumeID: "vol-i-1"}}},
+		{ID: "i-2", InstanceType: "trn1.2xlarge", BlockDevices: []BlockDeviceDesc{{DeviceName: "/dev/xvda", VolumeID: "vol-i-2"}}},
+	}
+
+	assert.NoError(t, describeLaunchConfig(fake.clients().EC2, instances))
+	assert.Equal(t, "unlimited", instances[0].CreditSpecification)
+	assert.Equal(t, BlockDeviceDesc{"/dev/xvda", "vol-i-1", 20, "gp3", 3000, 125, false, "", false}, instances[0].BlockDevices[0])
+
+	// Only burstable instance types have CPU credits, whatever their name is
+	assert.Equal(t, "", instances[1].CreditSpecification)
+
+	// Volume which cannot be described would launch the instance with an invalid mapping
+	instances[1].BlockDevices[0].VolumeID = "vol-detached"
+	err := describeLaunchConfig(fake.clients().EC2, instances)
+	if assert.Error(t, err) {
+		assert.Equal(t, "Not found volume vol-detached of instance i-2", err.Error())
+	}
+}
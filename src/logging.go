@@ -0,0 +1,195 @@
+package main
+
+import (
+    "github.com/aws/aws-sdk-go/aws"
+
+    "encoding/json"
+    "fmt"
+    "io"
+    "os"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+)
+
+// Log formats
+const (
+    LogFormatText = "text"
+    LogFormatJSON = "json"
+)
+
+// Log levels in the increasing order of severity
+const (
+    LevelDebug = "debug"
+    LevelInfo = "info"
+    LevelWarning = "warning"
+    LevelError = "error"
+)
+
+var logLevels = map[string]int{LevelDebug: 0, LevelInfo: 1, LevelWarning: 2, LevelError: 3}
+
+// Fields are structured values of the log entry, e.g. the step or instance IDs
+type Fields map[string]interface{}
+
+// Logger writes log entries of the given level and above as text lines or JSON objects.
+// Text lines keep the "[action][LEVEL] message" layout followed by key=value fields.
+type Logger struct {
+    Out io.Writer
+    Format string
+    Level string
+    // context fields are added to every entry. Text lines omit them to stay readable.
+    context Fields
+    mu *sync.Mutex
+}
+
+// logger is the logger of the deployment. It is configured by the logging section of the config.
+var logger = NewLogger(os.Stdout, LogFormatText, LevelInfo)
+
+// NewLogger returns the logger writing to the given output
+func NewLogger(out io.Writer, format string, level string) *Logger {
+    return &Logger{Out: out, Format: format, Level: level, context: Fields{}, mu: &sync.Mutex{}}
+}
+
+// configureLogger sets up the logger of the deployment. JSON entries carry the version of the deployment.
+func configureLogger(config LoggingConfig, version string) {
+    logger = NewLogger(os.Stdout, config.Format, config.Level).With(Fields{"version": version})
+}
+
+// With returns the logger adding the fields to every entry
+func (l *Logger) With(fields Fields) *Logger {
+    context := Fields{}
+    for key, value := range l.context {
+        context[key] = value
+    }
+    for key, value := range fields {
+        context[key] = value
+    }
+
+    return &Logger{Out: l.Out, Format: l.Format, Level: l.Level, context: context, mu: l.mu}
+}
+
+// Debug logs details useful when the deployment is investigated
+func (l *Logger) Debug(msg string, fields ...Fields) {
+    l.log(LevelDebug, msg, fields)
+}
+
+// Info logs the progress of the deployment
+func (l *Logger) Info(msg string, fields ...Fields) {
+    l.log(LevelInfo, msg, fields)
+}
+
+// Warning logs failures which the deployment recovers from
+func (l *Logger) Warning(msg string, fields ...Fields) {
+    l.log(LevelWarning, msg, fields)
+}
+
+// Error logs failures of the deployment
+func (l *Logger) Error(msg string, fields ...Fields) {
+    l.log(LevelError, msg, fields)
+}
+
+func (l *Logger) log(level string, msg string, fields []Fields) {
+    if logLevels[level] < logLevels[l.Level] {
+        return
+    }
+
+    entry := Fields{}
+    for _, f := range fields {
+        for key, value := range f {
+            entry[key] = value
+        }
+    }
+
+    var line string
+    if l.Format == LogFormatJSON {
+        line = l.jsonLine(level, msg, entry)
+    } else {
+        line = textLine(level, msg, entry)
+    }
+
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    fmt.Fprintln(l.Out, line)
+}
+
+func (l *Logger) jsonLine(level string, msg string, entry Fields) string {
+    object := Fields{}
+    for key, value := range l.context {
+        object[key] = value
+    }
+    for key, value := range entry {
+        object[key] = value
+    }
+
+    object["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+    object["level"] = level
+    object["msg"] = msg
+
+    data, err := json.Marshal(object)
+    if err != nil {
+        return fmt.Sprintf(`{"level":"error","msg":"Cannot encode log entry: %s"}`, err.Error())
+    }
+
+    return string(data)
+}
+
+func textLine(level string, msg string, entry Fields) string {
+    line := ""
+    if action, ok := entry["action"]; ok {
+        line += fmt.Sprintf("[%v]", action)
+    }
+
+    if level != LevelInfo {
+        line += "[" + strings.ToUpper(level) + "]"
+    }
+
+    if line != "" {
+        line += " "
+    }
+    line += msg
+
+    keys := []string{}
+    for key := range entry {
+        if key != "action" {
+            keys = append(keys, key)
+        }
+    }
+    sort.Strings(keys)
+
+    for _, key := range keys {
+        line += " " + key + "=" + textValue(entry[key])
+    }
+
+    return line
+}
+
+// textValue formats the field value, quoting values with spaces
+func textValue(value interface{}) string {
+    var text string
+
+    switch v := value.(type) {
+    case []string:
+        text = strings.Join(v, ",")
+    case []*string:
+        text = strings.Join(aws.StringValueSlice(v), ",")
+    default:
+        text = fmt.Sprint(v)
+    }
+
+    if strings.ContainsAny(text, " \"") {
+        return fmt.Sprintf("%q", text)
+    }
+
+    return text
+}
+
+// actionName returns the name of the step used in the action field
+func actionName(action interface{}) string {
+    // Hooks are told apart by their names
+    if hook, ok := action.(HookAction); ok {
+        return "hook:" + hook.Hook.Name
+    }
+
+    return fmt.Sprintf("%T", action)
+}
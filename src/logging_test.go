@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoggerText(t *testing.T) {
+	out := &bytes.Buffer{}
+	log := NewLogger(out, LogFormatText, LevelInfo).With(Fields{"version": "1"})
+
+	log.Debug("Hidden")
+	log.Info("Executing.", Fields{"action": "main.RunInstancesAction", "step": 3})
+	log.Error("Application is down", Fields{"action": "main.TestInstancesAction", "instance_ids": aws.StringSlice([]string{"i-1", "i-2"})})
+	log.Warning("Rollback failed. Throttling", Fields{"retry_in": "5s", "reason": "rate exceeded"})
+
+	assert.Equal(t, []string{
+		"[main.RunInstancesAction] Executing. step=3",
+		"[main.TestInstancesAction][ERROR] Application is down instance_ids=i-1,i-2",
+		`[WARNING] Rollback failed. Throttling reason="rate exceeded" retry_in=5s`,
+	}, strings.Split(strings.TrimSpace(out.String()), "\n"))
+}
+
+func TestLoggerJSON(t *testing.T) {
+	out := &bytes.Buffer{}
+	log := NewLogger(out, LogFormatJSON, LevelWarning).With(Fields{"version": "1"})
+
+	log.Info("Hidden")
+	log.Error("Application is down", Fields{"action": "main.TestInstancesAction", "step": 5})
+
+	entry := map[string]interface{}{}
+	if err := json.Unmarshal(out.Bytes(), &entry); err != nil {
+		t.Fatalf("Invalid JSON log entry %s: %s", out.String(), err.Error())
+	}
+
+	assert.Equal(t, "error", entry["level"])
+	assert.Equal(t, "Application is down", entry["msg"])
+	assert.Equal(t, "main.TestInstancesAction", entry["action"])
+	assert.Equal(t, float64(5), entry["step"])
+	assert.Equal(t, "1", entry["version"])
+	assert.NotEmpty(t, entry["time"])
+}
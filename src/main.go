@@ -2,63 +2,503 @@ package main
 
 import (
     "github.com/aws/aws-sdk-go/aws"
-    "github.com/aws/aws-sdk-go/aws/session"
-    "github.com/aws/aws-sdk-go/service/ec2"
-    "github.com/aws/aws-sdk-go/service/elbv2"
+    "context"
+    "flag"
     "fmt"
+    "io/ioutil"
     "os"
+    "os/signal"
+    "sync"
+    "syscall"
     "time"
 )
 
-func rollback(step int, pipelineInfo *PipelineInfo, actions *[]InfrastructureAction) {
-    for step >= 0 {
-        (*actions)[step].Rollback(pipelineInfo)
-        fmt.Printf("[%T] Rolling changes back\n", (*actions)[step])
-        step--
+// newActions returns the steps of the deployment target. The image steps are placed right after the input is validated.
+func newActions(config Config, clients awsClients, imageActions ...InfrastructureAction) []InfrastructureAction {
+    return insertHooks(withImageActions(strategyActions(config, clients), imageActions), config.Hooks)
+}
+
+func strategyActions(config Config, clients awsClients) []InfrastructureAction {
+    svc := clients.EC2
+    elbSvc := clients.ELBV2
+    strategy := config.Strategy
+
+    if strategy.Type == StrategyAutoScaling {
+        return []InfrastructureAction{
+            InitializePipelineAction{config.Selector.AMI, config.NewAMI},
+            ListInstancesAction{svc, config.Selector},
+            VerifyImageAction{svc, config.ImageValidation.RequiredTags},
+            FindAutoScalingGroupsAction{clients.AutoScaling},
+            CreateLaunchTemplateVersionsAction{svc},
+            UpdateAutoScalingGroupsAction{clients.AutoScaling},
+            &InstanceRefreshAction{Svc: clients.AutoScaling, MinHealthyPercentage: strategy.MinHealthyPercentage, Interval: 30 * time.Second},
+        }
+    }
+
+    actions := []InfrastructureAction{
+        InitializePipelineAction{config.Selector.AMI, config.NewAMI},
+        ListInstancesAction{svc, config.Selector},
+        VerifyImageAction{svc, config.ImageValidation.RequiredTags},
+        FindLoadBalancerAction{elbSvc},
+    }
+
+    healthCheck := config.HealthCheck
+    launchActions := []InfrastructureAction{
+        RunInstancesAction{svc, healthCheck.Mode != HealthCheckPublicIP},
+        WaitUntilStatusOkAction{svc, time.Duration(config.Timeouts.InstanceRunning)},
+    }
+
+    // Security groups are changed only when instances are checked from outside of the VPC
+    switch healthCheck.Mode {
+    case HealthCheckPublicIP:
+        if config.SecurityGroups.Authorize {
+            for _, port := range healthCheck.ports() {
+                launchActions = append(launchActions, AuthorizeSecurityGroupsAction{svc, port})
+            }
+        }
+
+        launchActions = append(launchActions, CollectPublicIpsAction{svc, false}, TestInstancesAction{svc, healthCheck, config.SmokeTests})
+    case HealthCheckPrivateIP:
+        launchActions = append(launchActions, CollectPublicIpsAction{svc, true}, TestInstancesAction{svc, healthCheck, config.SmokeTests})
+    case HealthCheckSSM:
+        launchActions = append(launchActions, SSMHealthCheckAction{clients.SSM, healthCheck})
+    }
+
+    if strategy.Type == StrategyBlueGreen {
+        actions = append(actions, launchActions...)
+
+        return append(actions,
+            CreateGreenTargetGroupsAction{elbSvc},
+            RegisterGreenInstancesAction{elbSvc, time.Duration(config.Timeouts.TargetHealthy)},
+            ShiftTrafficAction{elbSvc, strategy.TrafficSteps, time.Duration(strategy.TrafficStepInterval)},
+            DeregisterOldInstancesAction{elbSvc},
+            WaitForDeregisterAction{elbSvc, time.Duration(config.Timeouts.TargetDeregistration)},
+            FinalizeBlueGreenAction{elbSvc, time.Duration(config.Timeouts.TargetHealthy), time.Duration(config.Timeouts.TargetDeregistration)},
+            TerminateOldInstancesAction{svc},
+        )
+    }
+
+    replaceActions := append(launchActions, RegisterNewInstancesAction{elbSvc})
+
+    // Load balancer checks new instances while they serve the traffic together with the old ones
+    if healthCheck.Mode == HealthCheckTargetHealth {
+        replaceActions = append(replaceActions, WaitForTargetsHealthyAction{elbSvc, time.Duration(config.Timeouts.TargetHealthy)})
     }
+
+    replaceActions = append(replaceActions,
+        DeregisterOldInstancesAction{elbSvc},
+        WaitForDeregisterAction{elbSvc, time.Duration(config.Timeouts.TargetDeregistration)},
+        TerminateOldInstancesAction{svc},
+    )
+
+    switch strategy.Type {
+    case StrategyCanary:
+        canaryActions := []InfrastructureAction{}
+
+        for _, action := range replaceActions {
+            canaryActions = append(canaryActions, action)
+
+            // Canary is observed while it serves the traffic together with the old instances
+            if _, ok := action.(RegisterNewInstancesAction); ok {
+                canaryActions = append(canaryActions, CanaryBakeAction{
+                    Svc: elbSvc,
+                    Metrics: CloudWatchMetrics{clients.CloudWatch, elbSvc},
+                    BakeTime: time.Duration(strategy.CanaryBakeTime),
+                    Interval: 30 * time.Second,
+                    MaxErrors: strategy.CanaryMaxErrors,
+                    Timeout: time.Duration(config.Timeouts.TargetHealthy),
+                })
+            }
+        }
+
+        return append(actions, &RollingDeploymentAction{
+            BatchSize: strategy.BatchSize,
+            BatchPercent: strategy.BatchPercent,
+            Actions: replaceActions,
+            CanaryActions: canaryActions,
+        })
+
+    case StrategyRolling:
+        return append(actions, &RollingDeploymentAction{
+            BatchSize: strategy.BatchSize,
+            BatchPercent: strategy.BatchPercent,
+            Actions: replaceActions,
+        })
+    }
+
+    return append(actions, replaceActions...)
 }
 
-func main() {
-    if len(os.Args) != 3 {
-        fmt.Printf("[ERROR] Invalid usage. usage: %s OLD_AMI NEW_AMI\n", os.Args[0])
+// stateMu guards the state against regions deployed in parallel
+var stateMu sync.Mutex
+
+func checkpoint(statePath string, state *PipelineState) {
+    stateMu.Lock()
+    defer stateMu.Unlock()
+
+    if err := saveState(statePath, state); err != nil {
+        logger.Error("Cannot save state file", Fields{"path": statePath, "error": err.Error()})
+    }
+}
+
+// recordSteps keeps outcomes of the steps in the state for the report and notifies about committed and failed steps
+func recordSteps(state *PipelineState) {
+    recordStep = func(record StepRecord) {
+        stateMu.Lock()
+        state.Steps = append(state.Steps, record)
+        event := newEvent(EventStepCommitted, state)
+        stateMu.Unlock()
+
+        if record.Phase != PhaseCommit {
+            return
+        }
+
+        if record.Error != "" {
+            event.Type = EventStepFailed
+            event.Error = record.Error
+        }
+        event.Step = record.Step
+        event.Action = record.Action
+        event.Batch = record.Batch
+        event.Region = record.Region
+
+        notifier.Notify(event)
+    }
+}
+
+// enableCheckpoints lets the composite and long running actions save the state in the middle of their step
+func enableCheckpoints(actions []InfrastructureAction, statePath string, state *PipelineState) {
+    for _, action := range actions {
+        switch composite := action.(type) {
+        case *RollingDeploymentAction:
+            composite.Checkpoint = func() { checkpoint(statePath, state) }
+        case *MultiRegionAction:
+            composite.Checkpoint = func() { checkpoint(statePath, state) }
+        case *InstanceRefreshAction:
+            composite.Checkpoint = func() { checkpoint(statePath, state) }
+        }
+    }
+}
+
+// exitRollbackIncomplete is the exit code of the deployment, which left resources behind after the failed rollback
+const exitRollbackIncomplete = 3
+
+// printLeftovers lists resources which have to be cleaned up manually
+func printLeftovers(leftovers []string) {
+    if len(leftovers) == 0 {
+        return
+    }
+
+    logger.Warning("Resources left behind by the rollback. Clean them up manually")
+    for _, leftover := range leftovers {
+        logger.Warning("Left behind", Fields{"resource": leftover})
+    }
+}
+
+// interruptContext returns the context cancelled by SIGINT or SIGTERM
+func interruptContext() (context.Context, context.CancelFunc) {
+    return signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+}
+
+// rollback unwinds the deployment. The next signal stops it, leaving the state file for `rollback STATE_FILE`.
+func rollback(step int, state *PipelineState, actions []InfrastructureAction, statePath string) {
+    ctx, stop := interruptContext()
+    defer stop()
+
+    // Resume is refused from now on, even when the rollback is interrupted
+    state.Status = StatusRollingBack
+    checkpoint(statePath, state)
+    notifier.Notify(newEvent(EventRollbackStarted, state))
+
+    err := rollbackActions(ctx, step, &state.Info, actions, func(step int) {
+        state.Step = step
+        checkpoint(statePath, state)
+    })
+
+    if failures, ok := err.(*RollbackError); ok {
+        state.Status = StatusRollbackIncomplete
+        state.Leftovers = failures.Leftovers
+        checkpoint(statePath, state)
+
+        logger.Error(failures.Error())
+        printLeftovers(failures.Leftovers)
+        writeReport(state)
+        notifier.Notify(newEvent(EventRollbackFinished, state))
+        os.Exit(exitRollbackIncomplete)
+    }
+
+    if err != nil {
+        logger.Error(err.Error()+". Continue with: rollback "+statePath, Fields{"state_file": statePath})
+        writeReport(state)
+
+        // The status stays rolling back, so the event tells that the rollback has to be continued
+        event := newEvent(EventRollbackFinished, state)
+        event.Error = err.Error()
+        notifier.Notify(event)
         os.Exit(1)
     }
 
-    sess, _ := session.NewSession(&aws.Config{
-        Region: aws.String("us-east-1")},
-    )
-    
-    svc := ec2.New(sess)
-    elbv2 := elbv2.New(sess)
-    pipelineInfo := &PipelineInfo{
+    state.Status = StatusRolledBack
+    checkpoint(statePath, state)
+    writeReport(state)
+    notifier.Notify(newEvent(EventRollbackFinished, state))
+}
+
+// run executes the deployment. SIGINT or SIGTERM cancels the running step and rolls back the executed ones.
+func run(from int, state *PipelineState, actions []InfrastructureAction, statePath string) {
+    ctx, stop := interruptContext()
+
+    // The step may have applied part of its changes, so it is recorded also when it fails
+    idx, err := runActions(ctx, from, &state.Info, actions, func(step int) {
+        state.Step = step
+        checkpoint(statePath, state)
+    })
+
+    interrupted := ctx.Err() != nil
+    stop()
+
+    if err != nil {
+        if interrupted {
+            logger.Warning("Deployment interrupted. Rolling changes back. Signal again to stop the rollback")
+        }
+
+        state.Error = err.Error()
+        rollback(idx, state, actions, statePath)
+        os.Exit(2)
+    }
+
+    state.Status = StatusCompleted
+    checkpoint(statePath, state)
+    writeReport(state)
+    notifier.Notify(newEvent(EventDeploySucceeded, state))
+}
+
+func loadStateOrExit(statePath string) *PipelineState {
+    state, err := loadState(statePath)
+
+    if err != nil {
+        logger.Error("Cannot load state file: "+err.Error(), Fields{"path": statePath})
+        os.Exit(1)
+    }
+
+    return state
+}
+
+func planDeployment(config Config, clientsFor func(config Config) awsClients) {
+    plan := NewPlan()
+    httpTransport = plan.Transport(httpTransport)
+    runHealthCheck = plan.HealthCheck(runHealthCheck)
+    runHookCommand = plan.Command
+    sleep = func(ctx context.Context, d time.Duration) error { return ctx.Err() }
+
+    info := &PipelineInfo{
         Version: time.Now().Format("20060102_150405"),
+        Input: InputArgs{config.Selector.AMI, config.NewAMI},
+        Config: config,
     }
+    configureLogger(config.Logging, info.Version)
 
-    actions := []InfrastructureAction{
-        InitializePipelineAction{os.Args[1], os.Args[2]},
-        ListInstancesAction{svc},
-        FindLoadBalancerAction{elbv2},
-        RunInstancesAction{svc},
-        WaitUntilStatusOkAction{svc},
-        AuthorizeSecurityGroupsAction{svc},
-        CollectPublicIpsAction{svc},
-        TestInstancesAction{svc},
-        RegisterNewInstancesAction{elbv2},
-        DeregisterOldInstancesAction{elbv2},
-        WaitForDeregisterAction{elbv2},
-        TerminateOldInstancesAction{svc},
+    ctx, stop := interruptContext()
+    defer stop()
+
+    // Only service clients are intercepted. Roles are assumed for real, so reads see the target accounts.
+    actions := newPipeline(config, func(config Config) awsClients {
+        clients := clientsFor(config)
+        for _, handlers := range clients.handlers() {
+            plan.Intercept(handlers)
+        }
+
+        return clients
+    })
+
+    err := runPlan(ctx, info, actions)
+    fmt.Print(plan.Render(info))
+
+    planJSON, jsonErr := plan.JSON(info)
+    if jsonErr == nil {
+        jsonErr = ioutil.WriteFile(planFilePath(info.Version), planJSON, 0600)
+    }
+
+    if jsonErr != nil {
+        logger.Error("Cannot save plan file: "+jsonErr.Error())
+    } else {
+        logger.Info("Plan file saved", Fields{"path": planFilePath(info.Version)})
+    }
+
+    if err != nil {
+        logger.Error("Plan is incomplete. " + err.Error())
+        os.Exit(2)
+    }
+}
+
+func usage() {
+    fmt.Printf("[ERROR] Invalid usage. usage: %s [--config FILE] [--plan] [flags] [[OLD_AMI] NEW_AMI] | resume STATE_FILE | rollback STATE_FILE\n", os.Args[0])
+    flag.PrintDefaults()
+    os.Exit(1)
+}
+
+// resolveConfig builds the deployment config from the spec file, flags and positional AMIs
+func resolveConfig(configPath string, flags *configFlags, args []string) (Config, error) {
+    config := DefaultConfig()
+
+    if configPath != "" {
+        loaded, err := loadConfig(configPath)
+        if err != nil {
+            return config, err
+        }
+
+        config = loaded
+    }
+
+    if err := flags.apply(flag.CommandLine, &config); err != nil {
+        return config, err
+    }
+
+    switch len(args) {
+    case 1:
+        config.NewAMI = args[0]
+    case 2:
+        config.Selector.AMI = args[0]
+        config.NewAMI = args[1]
+    }
+
+    if err := config.Validate(); err != nil {
+        return config, err
+    }
+
+    // The suite is loaded again before the tests, but broken files are reported before any change is made
+    if config.SmokeTests.File != "" {
+        suite, err := loadSmokeSuite(config.SmokeTests.File)
+        if err != nil {
+            return config, err
+        }
+
+        if config.HealthCheck.Mode == HealthCheckPublicIP && config.SecurityGroups.Authorize {
+            if err := suite.checkPorts(config.HealthCheck); err != nil {
+                return config, err
+            }
+        }
     }
-    
-    for idx, action := range actions {
-        fmt.Printf("[%T] Executing.\n", action)
-        err := action.Commit(pipelineInfo)
+
+    return config, nil
+}
+
+// targetClients returns the function creating clients of the region with the credentials of the config.
+// Configured identities are checked right away, so roles are assumed and MFA tokens asked one after another
+// before the deployment starts.
+func targetClients(sessions *sessionFactory) func(config Config) awsClients {
+    return func(config Config) awsClients {
+        fields := Fields{"region": config.Region, "credentials": config.Credentials.String()}
+        sess, err := sessions.session(config.Region, config.Credentials)
+
+        if err == nil && !config.Credentials.isEmpty() {
+            identity, identityErr := callerIdentity(sess)
+            if identityErr == nil {
+                fields["account"] = aws.StringValue(identity.Account)
+                fields["arn"] = aws.StringValue(identity.Arn)
+                logger.Info("Using AWS identity", fields)
+            }
+            err = identityErr
+        }
 
         if err != nil {
-            fmt.Printf("[%T][ERROR] %s\n", action, err.Error())
-            rollback(idx, pipelineInfo, &actions)
+            logger.Error("Cannot create AWS session: "+err.Error(), fields)
+            os.Exit(1)
+        }
+
+        return newClients(sess)
+    }
+}
+
+func main() {
+    configPath := flag.String("config", "", "YAML or JSON deployment spec. Flags override values from the file")
+    planMode := flag.Bool("plan", false, "Print AWS changes made by the deployment without applying them")
+    mfaToken := flag.String("mfa-token", "", "Token of the MFA device for the first assumed role. Other tokens are asked on stdin")
+    flags := newConfigFlags(flag.CommandLine)
+    flag.Usage = usage
+    flag.Parse()
+
+    args := flag.Args()
+    if len(args) > 2 || (len(args) == 0 && *configPath == "") {
+        usage()
+    }
+
+    if len(args) == 2 && (args[0] == "resume" || args[0] == "rollback") {
+        if *planMode {
+            usage()
+        }
+
+        statePath := args[1]
+        state := loadStateOrExit(statePath)
+
+        if !canContinue(args[0], state.Status) {
+            logger.Error(fmt.Sprintf("Cannot %s deployment with status %s", args[0], state.Status))
+            os.Exit(1)
+        }
+
+        // Deployment continues with the config it was started with
+        configureLogger(state.Info.Config.Logging, state.Info.Version)
+        notifier = NewNotifier(state.Info.Config.Notifications)
+        actions := newPipeline(state.Info.Config, targetClients(newSessionFactory(state.Info.Version, *mfaToken)))
+        enableCheckpoints(actions, statePath, state)
+        recordSteps(state)
+
+        // The failed step was not rolled back before the process stopped. Its failure still requires the rollback,
+        // which starts with the changes the step applied partway.
+        if args[0] == "resume" && state.Info.PartialStep {
+            logger.Warning("Deployment failed before the rollback. Rolling changes back instead of resuming", Fields{"step": state.Step})
+            rollback(state.Step, state, actions, statePath)
             os.Exit(2)
         }
 
-        fmt.Printf("[%T] Finished. No errors\n", action)
+        if args[0] == "resume" {
+            logger.Info("Resuming deployment "+state.Info.Version, Fields{"step": state.Step + 1})
+            run(state.Step+1, state, actions, statePath)
+        } else {
+            logger.Info("Rolling back deployment "+state.Info.Version, Fields{"step": state.Step})
+            rollback(state.Step, state, actions, statePath)
+        }
+
+        return
+    }
+
+    config, err := resolveConfig(*configPath, flags, args)
+    if err != nil {
+        logger.Error(err.Error())
+        os.Exit(1)
+    }
+
+    started := time.Now()
+    sessions := newSessionFactory(started.Format("20060102_150405"), *mfaToken)
+
+    if *planMode {
+        planDeployment(config, targetClients(sessions))
+        return
+    }
+
+    state := &PipelineState{
+        Status: StatusInProgress,
+        Step: -1,
+        StartedAt: started.UTC(),
+        Info: PipelineInfo{
+            Version: started.Format("20060102_150405"),
+            Input: InputArgs{config.Selector.AMI, config.NewAMI},
+            Config: config,
+        },
     }
+
+    configureLogger(config.Logging, state.Info.Version)
+    notifier = NewNotifier(config.Notifications)
+    statePath := stateFilePath(state.Info.Version)
+    if err := saveState(statePath, state); err != nil {
+        logger.Error("Cannot create state file: "+err.Error(), Fields{"path": statePath})
+        os.Exit(1)
+    }
+
+    actions := newPipeline(config, targetClients(sessions))
+    enableCheckpoints(actions, statePath, state)
+    recordSteps(state)
+    logger.Info("State file created", Fields{"path": statePath})
+    notifier.Notify(newEvent(EventDeployStarted, state))
+    run(0, state, actions, statePath)
 }
@@ -0,0 +1,289 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/http"
+    "net/url"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// Deployment events sent to notifications
+const (
+    EventDeployStarted = "deploy_started"
+    EventStepCommitted = "step_committed"
+    EventStepFailed = "step_failed"
+    EventRollbackStarted = "rollback_started"
+    EventRollbackFinished = "rollback_finished"
+    EventDeploySucceeded = "deploy_succeeded"
+)
+
+var eventTypes = []string{
+    EventDeployStarted,
+    EventStepCommitted,
+    EventStepFailed,
+    EventRollbackStarted,
+    EventRollbackFinished,
+    EventDeploySucceeded,
+}
+
+// Notification types
+const (
+    NotificationWebhook = "webhook"
+    NotificationCommand = "command"
+)
+
+// Webhook payload formats
+const (
+    WebhookJSON = "json"
+    WebhookSlack = "slack"
+)
+
+const defaultNotificationTimeout = 10 * time.Second
+
+// NotificationConfig describes the webhook or the shell command receiving deployment events
+type NotificationConfig struct {
+    Type string `yaml:"type" json:"type"`
+    // URL of the webhook
+    URL string `yaml:"url" json:"url"`
+    // Format of the webhook payload: json with the whole event or slack with the message text
+    Format string `yaml:"format" json:"format"`
+    // Command is run with sh -c. The event is passed in DEPLOY_* env variables and as JSON on stdin.
+    Command string `yaml:"command" json:"command"`
+    // Events sent to the notification. All events by default.
+    Events []string `yaml:"events" json:"events"`
+    Timeout Duration `yaml:"timeout" json:"timeout"`
+}
+
+func (c NotificationConfig) validate() error {
+    switch c.Type {
+    case NotificationWebhook:
+        if u, err := url.Parse(c.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+            return fmt.Errorf("Invalid webhook URL %s", c.URL)
+        }
+
+        if c.Format != "" && c.Format != WebhookJSON && c.Format != WebhookSlack {
+            return fmt.Errorf("Invalid webhook format %s. Expected json or slack", c.Format)
+        }
+    case NotificationCommand:
+        if strings.TrimSpace(c.Command) == "" {
+            return errors.New("Notification command is empty")
+        }
+    default:
+        return fmt.Errorf("Unknown notification type %s. Expected webhook or command", c.Type)
+    }
+
+    for _, event := range c.Events {
+        if !stringInSlice(event, eventTypes) {
+            return fmt.Errorf("Unknown event %s. Expected one of %s", event, strings.Join(eventTypes, ", "))
+        }
+    }
+
+    if c.Timeout < 0 {
+        return errors.New("Notification timeout must not be negative")
+    }
+
+    return nil
+}
+
+// Event is a change of the deployment progress
+type Event struct {
+    Type string `json:"type"`
+    Version string `json:"version"`
+    Time time.Time `json:"time"`
+    OldAMI string `json:"old_ami"`
+    NewAMI string `json:"new_ami"`
+    Step int `json:"step"`
+    Action string `json:"action,omitempty"`
+    Batch int `json:"batch,omitempty"`
+    Region string `json:"region,omitempty"`
+    Status string `json:"status,omitempty"`
+    Error string `json:"error,omitempty"`
+    Leftovers []string `json:"leftovers,omitempty"`
+}
+
+// newEvent returns the event of the deployment at its current step
+func newEvent(eventType string, state *PipelineState) Event {
+    return Event{
+        Type: eventType,
+        Version: state.Info.Version,
+        Time: time.Now().UTC(),
+        OldAMI: state.Info.Input.OldAMI,
+        NewAMI: state.Info.Input.NewAMI,
+        Step: state.Step,
+        Status: state.Status,
+        Error: state.Error,
+        Leftovers: state.Leftovers,
+    }
+}
+
+// Message describes the event for people
+func (e Event) Message() string {
+    prefix := fmt.Sprintf("Deployment %s of %s", e.Version, e.NewAMI)
+    step := fmt.Sprintf("Step %d %s", e.Step, e.Action)
+    if e.Batch > 0 {
+        step += fmt.Sprintf(" of batch %d", e.Batch)
+    }
+    if e.Region != "" {
+        step += " in " + e.Region
+    }
+
+    switch e.Type {
+    case EventDeployStarted:
+        return prefix + " started"
+    case EventStepCommitted:
+        return fmt.Sprintf("%s: %s committed", prefix, step)
+    case EventStepFailed:
+        return fmt.Sprintf("%s: %s failed: %s", prefix, step, e.Error)
+    case EventRollbackStarted:
+        return fmt.Sprintf("%s is rolling back: %s", prefix, e.Error)
+    case EventRollbackFinished:
+        message := fmt.Sprintf("%s rollback finished with status %s", prefix, e.Status)
+        if len(e.Leftovers) > 0 {
+            message += ". Clean up manually: " + strings.Join(e.Leftovers, "; ")
+        }
+        return message
+    case EventDeploySucceeded:
+        return prefix + " succeeded"
+    }
+
+    return prefix + ": " + e.Type
+}
+
+// env returns the event as DEPLOY_* environment variables
+func (e Event) env() []string {
+    return []string{
+        "DEPLOY_EVENT=" + e.Type,
+        "DEPLOY_VERSION=" + e.Version,
+        "DEPLOY_OLD_AMI=" + e.OldAMI,
+        "DEPLOY_NEW_AMI=" + e.NewAMI,
+        "DEPLOY_STEP=" + strconv.Itoa(e.Step),
+        "DEPLOY_ACTION=" + e.Action,
+        "DEPLOY_BATCH=" + strconv.Itoa(e.Batch),
+        "DEPLOY_REGION=" + e.Region,
+        "DEPLOY_STATUS=" + e.Status,
+        "DEPLOY_ERROR=" + e.Error,
+        "DEPLOY_MESSAGE=" + e.Message(),
+    }
+}
+
+// EventSender delivers events to a single destination
+type EventSender interface {
+    Send(ctx context.Context, event Event) error
+}
+
+// WebhookSender posts events to the HTTP endpoint
+type WebhookSender struct {
+    URL string
+    Format string
+}
+
+// Send is a method to deliver the event in the WebhookSender
+func (s WebhookSender) Send(ctx context.Context, event Event) error {
+    var payload interface{} = event
+    if s.Format == WebhookSlack {
+        payload = map[string]string{"text": event.Message()}
+    }
+
+    body, err := json.Marshal(payload)
+    if err != nil {
+        return err
+    }
+
+    req, err := http.NewRequest(http.MethodPost, s.URL, bytes.NewReader(body))
+    if err != nil {
+        return err
+    }
+    req.Header.Set("Content-Type", "application/json")
+
+    resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+
+    if resp.StatusCode < 200 || resp.StatusCode > 299 {
+        return fmt.Errorf("Webhook responded with status code %d", resp.StatusCode)
+    }
+
+    return nil
+}
+
+// CommandSender runs the shell command for every event
+type CommandSender struct {
+    Command string
+}
+
+// Send is a method to deliver the event in the CommandSender
+func (s CommandSender) Send(ctx context.Context, event Event) error {
+    body, err := json.Marshal(event)
+    if err != nil {
+        return err
+    }
+
+    _, err = shellCommand(ctx, s.Command, event.env(), body)
+    return err
+}
+
+// notificationSink sends the subscribed events to the sender
+type notificationSink struct {
+    name string
+    sender EventSender
+    events []string
+    timeout time.Duration
+}
+
+// Notifier sends deployment events to the configured webhooks and commands.
+// Failed notifications are logged and never stop the deployment.
+type Notifier struct {
+    sinks []notificationSink
+}
+
+// notifier is the notifier of the deployment. It has no sinks until the config is loaded.
+var notifier = &Notifier{}
+
+// NewNotifier returns the notifier for the notifications of the config
+func NewNotifier(configs []NotificationConfig) *Notifier {
+    n := &Notifier{}
+
+    for _, config := range configs {
+        sink := notificationSink{events: config.Events, timeout: time.Duration(config.Timeout)}
+        if sink.timeout == 0 {
+            sink.timeout = defaultNotificationTimeout
+        }
+
+        if config.Type == NotificationCommand {
+            sink.name = "command " + config.Command
+            sink.sender = CommandSender{config.Command}
+        } else {
+            sink.name = "webhook " + config.URL
+            sink.sender = WebhookSender{config.URL, config.Format}
+        }
+
+        n.sinks = append(n.sinks, sink)
+    }
+
+    return n
+}
+
+// Notify sends the event to every sink subscribed to it, one after another
+func (n *Notifier) Notify(event Event) {
+    for _, sink := range n.sinks {
+        if len(sink.events) > 0 && !stringInSlice(event.Type, sink.events) {
+            continue
+        }
+
+        ctx, cancel := context.WithTimeout(context.Background(), sink.timeout)
+        err := sink.sender.Send(ctx, event)
+        cancel()
+
+        if err != nil {
+            logger.Warning("Notification failed. "+err.Error(), Fields{"notification": sink.name, "event": event.Type})
+        }
+    }
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// stubSender keeps the events instead of sending them
+type stubSender struct {
+	events *[]Event
+}
+
+func (s stubSender) Send(ctx context.Context, event Event) error {
+	*s.events = append(*s.events, event)
+	return nil
+}
+
+func TestWebhookSender(t *testing.T) {
+	bodies := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		if r.URL.Path == "/broken" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	event := Event{Type: EventStepFailed, Version: "1", NewAMI: "ami-new", Step: 7, Action: "main.TestInstancesAction", Error: "Application is down"}
+
+	assert.NoError(t, WebhookSender{server.URL, WebhookJSON}.Send(context.Background(), event))
+	assert.NoError(t, WebhookSender{server.URL, WebhookSlack}.Send(context.Background(), event))
+	assert.Error(t, WebhookSender{server.URL + "/broken", WebhookSlack}.Send(context.Background(), event))
+
+	sent := Event{}
+	if assert.NoError(t, json.Unmarshal([]byte(bodies[0]), &sent)) {
+		assert.Equal(t, event.Action, sent.Action)
+		assert.Equal(t, 7, sent.Step)
+	}
+
+	slack := map[string]string{}
+	if assert.NoError(t, json.Unmarshal([]byte(bodies[1]), &slack)) {
+		assert.Equal(t, "Deployment 1 of ami-new: Step 7 main.TestInstancesAction failed: Application is down", slack["text"])
+	}
+}
+
+func TestCommandSender(t *testing.T) {
+	output := filepath.Join(filepath.Dir(writeConfig(t, "deploy.yaml", "")), "event.txt")
+	sender := CommandSender{`echo "$DEPLOY_EVENT $DEPLOY_VERSION $DEPLOY_STEP" > ` + output + ` && cat >> ` + output}
+
+	event := Event{Type: EventDeploySucceeded, Version: "1", Step: 11}
+	if err := sender.Send(context.Background(), event); err != nil {
+		t.Fatalf("Unexpected error from CommandSender.Send(): %s", err.Error())
+	}
+
+	content, _ := ioutil.ReadFile(output)
+	lines := strings.SplitN(string(content), "\n", 2)
+	assert.Equal(t, "deploy_succeeded 1 11", lines[0])
+	assert.Contains(t, lines[1], `"type":"deploy_succeeded"`)
+
+	err := CommandSender{"echo failed >&2; exit 3"}.Send(context.Background(), event)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "failed")
+	}
+}
+
+func TestNotifierSendsSubscribedEvents(t *testing.T) {
+	all := []Event{}
+	failures := []Event{}
+	n := &Notifier{sinks: []notificationSink{
+		{name: "all", sender: stubSender{&all}, timeout: time.Second},
+		{name: "failures", sender: stubSender{&failures}, events: []string{EventStepFailed}, timeout: time.Second},
+		{name: "broken", sender: CommandSender{"exit 1"}, timeout: time.Second},
+	}}
+
+	n.Notify(Event{Type: EventStepCommitted})
+	n.Notify(Event{Type: EventStepFailed})
+
+	assert.Len(t, all, 2)
+	if assert.Len(t, failures, 1) {
+		assert.Equal(t, EventStepFailed, failures[0].Type)
+	}
+}
+
+func TestNotificationConfigValidate(t *testing.T) {
+	valid := []NotificationConfig{
+		{Type: NotificationWebhook, URL: "https://hooks.slack.com/services/T0/B0/X", Format: WebhookSlack},
+		{Type: NotificationCommand, Command: "./notify.sh", Events: []string{EventDeploySucceeded}},
+	}
+	for _, config := range valid {
+		assert.NoError(t, config.validate())
+	}
+
+	invalid := []NotificationConfig{
+		{Type: "email"},
+		{Type: NotificationWebhook, URL: "hooks.slack.com"},
+		{Type: NotificationWebhook, URL: "https://example.com", Format: "xml"},
+		{Type: NotificationCommand},
+		{Type: NotificationCommand, Command: "./notify.sh", Events: []string{"deploy_finished"}},
+	}
+	for _, config := range invalid {
+		assert.Error(t, config.validate(), config.Type)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "time"
+)
+
+// runActions commits actions starting from the given step.
+// The checkpoint is called after each step, also the failed one. It returns index of the last executed step.
+// When the context is done, the remaining steps are not started.
+func runActions(ctx context.Context, from int, info *PipelineInfo, actions []InfrastructureAction, checkpoint func(step int)) (int, error) {
+    for idx := from; idx < len(actions); idx++ {
+        if err := ctx.Err(); err != nil {
+            return idx - 1, fmt.Errorf("Deployment interrupted: %s", err.Error())
+        }
+
+        action := actions[idx]
+        fields := stepFields(idx, action, info)
+        logger.Info("Executing.", fields)
+
+        started := time.Now()
+        err := action.Commit(ctx, info)
+        record := newStepRecord(idx, action, info, PhaseCommit, started, err)
+        fields["duration_ms"] = record.DurationMs
+
+        // The failed step may have applied part of its changes. They are recorded in the info for the rollback.
+        info.PartialStep = err != nil
+        recordStep(record)
+        checkpoint(idx)
+
+        if err != nil {
+            logger.Error(err.Error(), fields)
+            return idx, err
+        }
+
+        logger.Info("Finished. No errors", fields)
+    }
+
+    return len(actions) - 1, nil
+}
+
+// rollbackActions rolls back actions from the given step down to the first one. Failed steps do not stop
+// the rollback of the remaining ones. They are reported together in RollbackError.
+// It stops when the context is done, so the rollback can be continued from the state file.
+func rollbackActions(ctx context.Context, step int, info *PipelineInfo, actions []InfrastructureAction, checkpoint func(step int)) error {
+    failures := &RollbackError{}
+
+    for step >= 0 {
+        if err := ctx.Err(); err != nil {
+            return fmt.Errorf("Rollback interrupted: %s", err.Error())
+        }
+
+        fields := stepFields(step, actions[step], info)
+        if info.PartialStep {
+            logger.Info("Rolling back changes applied before the failure", fields)
+        } else {
+            logger.Info("Rolling changes back", fields)
+        }
+
+        started := time.Now()
+        err := rollbackStep(ctx, actions[step], info)
+        record := newStepRecord(step, actions[step], info, PhaseRollback, started, err)
+        fields["duration_ms"] = record.DurationMs
+
+        // The interrupted step is rolled back again when the rollback is continued
+        if ctxErr := ctx.Err(); ctxErr != nil {
+            return fmt.Errorf("Rollback interrupted in %T: %s", actions[step], ctxErr.Error())
+        }
+
+        recordStep(record)
+
+        if err != nil {
+            logger.Error("Rollback failed: "+err.Error(), fields)
+            failures.add(step, actions[step], info, err)
+        }
+
+        step--
+        info.PartialStep = false
+
+        checkpoint(step)
+    }
+
+    if len(failures.Steps) > 0 {
+        return failures
+    }
+
+    return nil
+}
+
+// stepFields are log fields identifying the step
+func stepFields(step int, action InfrastructureAction, info *PipelineInfo) Fields {
+    fields := Fields{"action": actionName(action), "step": step}
+
+    if info.Batch > 0 {
+        fields["batch"] = info.Batch
+    }
+
+    if info.Region != "" {
+        fields["region"] = info.Region
+    }
+
+    return fields
+}
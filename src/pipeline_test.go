@@ -0,0 +1,354 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/stretchr/testify/assert"
+)
+
+func newFakeDeployment() (*fakeAWS, Config) {
+	fake := newFakeAWS()
+	fake.addInstance("i-old-1", "ami-old", "sg-1", "arn:tg-web")
+	fake.addInstance("i-old-2", "ami-old", "sg-1", "arn:tg-web")
+	fake.addInstance("i-other", "ami-other", "sg-2", "arn:tg-other")
+	fake.addImage("ami-old", fakeAccount, "snap-old", "")
+	fake.addImage("ami-new", fakeAccount, "snap-new", "")
+
+	config := DefaultConfig()
+	config.Selector.AMI = "ami-old"
+	config.NewAMI = "ami-new"
+
+	return fake, config
+}
+
+// useFakeNetwork sends health checks to the fake and skips waiting. It returns the function restoring both.
+func useFakeNetwork(fake *fakeAWS) func() {
+	transport := httpTransport
+	httpTransport = fake
+	sleep = func(ctx context.Context, d time.Duration) error { return ctx.Err() }
+
+	return func() {
+		httpTransport = transport
+		sleep = sleepContext
+	}
+}
+
+// runFakeDeployment runs the whole pipeline against the fake AWS and rolls it back on failure like main does
+func runFakeDeployment(fake *fakeAWS, config Config) (*PipelineInfo, error) {
+	defer useFakeNetwork(fake)()
+
+	info := &PipelineInfo{
+		Version: "20190101_120000",
+		Input:   InputArgs{config.Selector.AMI, config.NewAMI},
+		Config:  config,
+	}
+	actions := newActions(config, fake.clients())
+
+	step, err := runActions(context.Background(), 0, info, actions, func(int) {})
+	if err != nil {
+		rollbackActions(context.Background(), step, info, actions, func(int) {})
+	}
+
+	return info, err
+}
+
+func TestPipelineReplacesInstances(t *testing.T) {
+	for _, strategy := range []StrategyConfig{
+		{Type: StrategyAllAtOnce},
+		{Type: StrategyRolling, BatchSize: 1},
+	} {
+		fake, config := newFakeDeployment()
+		config.Strategy = strategy
+
+		info, err := runFakeDeployment(fake, config)
+		if err != nil {
+			t.Fatalf("Unexpected error from %s deployment: %s", strategy.Type, err.Error())
+		}
+
+		newIds := fake.instancesByState("ami-new", ec2.InstanceStateNameRunning)
+		assert.Equal(t, []string{"i-new-1", "i-new-2"}, newIds)
+		assert.Equal(t, []string{"i-old-1", "i-old-2"}, fake.instancesByState("ami-old", ec2.InstanceStateNameTerminated))
+		assert.Equal(t, newIds, fake.targets("arn:tg-web"))
+		assert.Equal(t, "web", fake.instances["i-new-1"].Tags["App"])
+		assert.Equal(t, info.Version, fake.instances["i-new-1"].Tags["Version"])
+
+		// New instances keep the launch configuration of the old ones
+		replacement := fake.instances["i-new-1"]
+		assert.Equal(t, fake.instances["i-old-1"].Profile, replacement.Profile)
+		assert.Equal(t, fake.instances["i-old-1"].UserData, replacement.UserData)
+		assert.Equal(t, "unlimited", replacement.CPUCredits)
+		assert.Equal(t, "required", replacement.HTTPTokens)
+		assert.Equal(t, []fakeVolume{{"vol-i-new-1-0", "/dev/xvda", 20, ec2.VolumeTypeGp3}}, replacement.Volumes)
+
+		// Instances of other applications are not touched
+		assert.Equal(t, []string{"i-other"}, fake.targets("arn:tg-other"))
+		assert.Equal(t, []string{"i-other"}, fake.instancesByState("ami-other", ec2.InstanceStateNameRunning))
+	}
+}
+
+// changes returns calls of the fake AWS modifying resources, starting from the given call
+func (f *fakeAWS) changes(from int) []string {
+	changes := []string{}
+
+	for _, call := range f.calls[from:] {
+		if !strings.HasPrefix(call, "Describe") && !strings.HasPrefix(call, "Wait") {
+			changes = append(changes, call)
+		}
+	}
+
+	return changes
+}
+
+func TestPipelineRollsBackFailures(t *testing.T) {
+	revoke := "RevokeSecurityGroupIngress"
+	terminate := "TerminateInstances"
+	deregister := "DeregisterTargets"
+	register := "RegisterTargets"
+
+	failures := []struct {
+		name      string
+		operation string
+		call      int
+		unhealthy bool
+		rollback  []string
+	}{
+		{name: "verify image", operation: "DescribeImages", rollback: []string{}},
+		{name: "list instances", operation: "DescribeInstances", rollback: []string{}},
+		{name: "find load balancer", operation: "DescribeTargetGroups", rollback: []string{}},
+		{name: "launch", operation: "RunInstances", rollback: []string{}},
+		{name: "launch second instance", operation: "RunInstances", call: 2, rollback: []string{terminate}},
+		{name: "wait for running", operation: "WaitUntilInstanceRunning", rollback: []string{terminate}},
+		{name: "describe security group", operation: "DescribeSecurityGroups", rollback: []string{terminate}},
+		{name: "authorize security group", operation: "AuthorizeSecurityGroupIngress", rollback: []string{terminate}},
+		{name: "collect public IPs", operation: "DescribeInstances", call: 2, rollback: []string{revoke, terminate}},
+		{name: "health check", unhealthy: true, rollback: []string{revoke, terminate}},
+		{name: "register", operation: register, rollback: []string{revoke, terminate}},
+		{name: "register in second target group", operation: register, call: 2,
+			rollback: []string{deregister, revoke, terminate}},
+		{name: "deregister", operation: deregister,
+			rollback: []string{deregister, deregister, revoke, terminate}},
+		{name: "deregister from second target group", operation: deregister, call: 2,
+			rollback: []string{register, deregister, deregister, revoke, terminate}},
+		{name: "wait for deregister", operation: "WaitUntilTargetDeregistered",
+			rollback: []string{register, register, deregister, deregister, revoke, terminate}},
+		{name: "terminate", operation: terminate,
+			rollback: []string{register, register, deregister, deregister, revoke, terminate}},
+	}
+
+	for _, failure := range failures {
+		fake, config := newFakeDeployment()
+		fake.targetGroups["arn:tg-api"] = map[string]bool{"i-old-1": true, "i-old-2": true}
+		if failure.operation != "" {
+			fake.failures[failure.operation] = errors.New("Injected " + failure.operation + " error")
+		}
+		if failure.call > 0 {
+			fake.failOnCall[failure.operation] = failure.call
+		}
+		fake.unhealthyAMIs["ami-new"] = failure.unhealthy
+
+		restore := useFakeNetwork(fake)
+		actions := newActions(config, fake.clients())
+		info := &PipelineInfo{Input: InputArgs{"ami-old", "ami-new"}, Config: config}
+
+		step, err := runActions(context.Background(), 0, info, actions, func(int) {})
+		if err == nil {
+			t.Errorf("Expected error from deployment failing at %s", failure.name)
+			restore()
+			continue
+		}
+		assert.True(t, info.PartialStep, failure.name)
+
+		// Rollback undoes only the changes recorded by the steps
+		calls := len(fake.calls)
+		assert.NoError(t, rollbackActions(context.Background(), step, info, actions, func(int) {}), failure.name)
+		assert.Equal(t, failure.rollback, fake.changes(calls), failure.name)
+		assert.False(t, info.PartialStep, failure.name)
+		restore()
+
+		// Old instances keep serving the traffic and nothing launched by the deployment is left behind
+		assert.Equal(t, []string{"i-old-1", "i-old-2"}, fake.instancesByState("ami-old", ec2.InstanceStateNameRunning), failure.name)
+		assert.Equal(t, []string{"i-old-1", "i-old-2"}, fake.targets("arn:tg-web"), failure.name)
+		assert.Equal(t, []string{"i-old-1", "i-old-2"}, fake.targets("arn:tg-api"), failure.name)
+		assert.Empty(t, fake.instancesByState("ami-new", ec2.InstanceStateNameRunning), failure.name)
+		assert.Empty(t, fake.rules("sg-1"), failure.name)
+	}
+}
+
+func TestPipelineRollsBackFailedBatchOnly(t *testing.T) {
+	fake, config := newFakeDeployment()
+	config.Strategy = StrategyConfig{Type: StrategyRolling, BatchSize: 1}
+
+	actions := newActions(config, fake.clients())
+	defer useFakeNetwork(fake)()
+
+	info := &PipelineInfo{Input: InputArgs{"ami-old", "ami-new"}, Config: config}
+	rolling := actions[len(actions)-1].(*RollingDeploymentAction)
+	rolling.Checkpoint = func() {
+		// Break health checks after the first batch is replaced
+		if info.CompletedBatches == 1 {
+			fake.unhealthyAMIs["ami-new"] = true
+		}
+	}
+
+	step, err := runActions(context.Background(), 0, info, actions, func(int) {})
+	if err == nil {
+		t.Fatal("Expected error from rolling deployment with unhealthy second batch")
+	}
+	rollbackActions(context.Background(), step, info, actions, func(int) {})
+
+	// The first batch stays replaced
+	assert.Equal(t, []string{"i-new-1"}, fake.instancesByState("ami-new", ec2.InstanceStateNameRunning))
+	assert.Equal(t, []string{"i-old-1"}, fake.instancesByState("ami-old", ec2.InstanceStateNameTerminated))
+	assert.Equal(t, []string{"i-new-1", "i-old-2"}, fake.targets("arn:tg-web"))
+}
+
+func TestPipelinePrivateNetworkHealthChecks(t *testing.T) {
+	for _, mode := range []string{HealthCheckPrivateIP, HealthCheckTargetHealth} {
+		fake, config := newFakeDeployment()
+		config.HealthCheck.Mode = mode
+
+		if _, err := runFakeDeployment(fake, config); err != nil {
+			t.Fatalf("Unexpected error from deployment with %s health check: %s", mode, err.Error())
+		}
+
+		// New instances have no public IPs and security groups are not changed
+		assert.Equal(t, "", fake.instances["i-new-1"].PublicIP, mode)
+		assert.Equal(t, []string{"i-new-1", "i-new-2"}, fake.targets("arn:tg-web"), mode)
+		assert.Empty(t, fake.rules("sg-1"), mode)
+
+		fake, config = newFakeDeployment()
+		config.HealthCheck.Mode = mode
+		fake.unhealthyAMIs["ami-new"] = true
+
+		if _, err := runFakeDeployment(fake, config); err == nil {
+			t.Errorf("Expected error from deployment of unhealthy instances with %s health check", mode)
+		}
+
+		assert.Equal(t, []string{"i-old-1", "i-old-2"}, fake.targets("arn:tg-web"), mode)
+		assert.Empty(t, fake.instancesByState("ami-new", ec2.InstanceStateNameRunning), mode)
+	}
+}
+
+// interruptingAction cancels the context like SIGINT received during the step
+type interruptingAction struct {
+	cancel context.CancelFunc
+}
+
+func (act interruptingAction) Commit(ctx context.Context, info *PipelineInfo) error {
+	act.cancel()
+	return nil
+}
+
+func (act interruptingAction) Rollback(ctx context.Context, info *PipelineInfo) error {
+	act.cancel()
+	return nil
+}
+
+func TestPipelineRollsBackInterruptedDeployment(t *testing.T) {
+	fake, config := newFakeDeployment()
+	actions := newActions(config, fake.clients())
+
+	// Interrupt right after new instances are launched
+	launched := 5
+	assert.IsType(t, RunInstancesAction{}, actions[launched-1])
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	actions = append(actions[:launched:launched], append([]InfrastructureAction{interruptingAction{cancel}}, actions[launched:]...)...)
+
+	info := &PipelineInfo{Input: InputArgs{"ami-old", "ami-new"}, Config: config}
+	step, err := runActions(ctx, 0, info, actions, func(int) {})
+	if assert.Error(t, err) {
+		assert.Equal(t, "Deployment interrupted: context canceled", err.Error())
+	}
+
+	// Steps after the interruption are not started
+	assert.Equal(t, launched, step)
+	assert.Equal(t, []string{"i-new-1", "i-new-2"}, fake.instancesByState("ami-new", ec2.InstanceStateNameRunning))
+
+	assert.NoError(t, rollbackActions(context.Background(), step, info, actions, func(int) {}))
+	assert.Empty(t, fake.instancesByState("ami-new", ec2.InstanceStateNameRunning))
+	assert.Equal(t, []string{"i-old-1", "i-old-2"}, fake.targets("arn:tg-web"))
+}
+
+func TestRollbackStopsWhenInterrupted(t *testing.T) {
+	log := []string{}
+	info := &PipelineInfo{OldInstances: instancesDesc("i-1")}
+	ctx, cancel := context.WithCancel(context.Background())
+	actions := []InfrastructureAction{launchingAction{&log}, interruptingAction{cancel}, failingAction{}}
+	steps := []int{}
+
+	launchingAction{&log}.Commit(context.Background(), info)
+	err := rollbackActions(ctx, 2, info, actions, func(step int) { steps = append(steps, step) })
+	if assert.Error(t, err) {
+		assert.Equal(t, "Rollback interrupted in main.interruptingAction: context canceled", err.Error())
+	}
+
+	// The interrupted step and the launched instance are left for `rollback STATE_FILE`
+	assert.Equal(t, []int{1}, steps)
+	assert.Equal(t, []string{"launch i-1"}, log)
+}
+
+func TestRollbackContinuesAfterFailedStep(t *testing.T) {
+	fake, config := newFakeDeployment()
+	fake.unhealthyAMIs["ami-new"] = true
+
+	actions := newActions(config, fake.clients())
+	defer useFakeNetwork(fake)()
+
+	info := &PipelineInfo{Input: InputArgs{"ami-old", "ami-new"}, Config: config}
+	step, err := runActions(context.Background(), 0, info, actions, func(int) {})
+	if err == nil {
+		t.Fatal("Expected error from deployment of unhealthy instances")
+	}
+
+	fake.failures["TerminateInstances"] = errors.New("Injected TerminateInstances error")
+	err = rollbackActions(context.Background(), step, info, actions, func(int) {})
+
+	failures, ok := err.(*RollbackError)
+	if !ok {
+		t.Fatalf("Expected RollbackError from failed rollback, got %v", err)
+	}
+
+	assert.Len(t, failures.Steps, 1)
+	assert.Equal(t, "main.RunInstancesAction", failures.Steps[0].Action)
+	assert.Equal(t, []string{
+		"EC2 instance i-new-1 launched by the deployment",
+		"EC2 instance i-new-2 launched by the deployment",
+	}, failures.Leftovers)
+
+	// Steps before the failed one are rolled back anyway
+	assert.Empty(t, fake.rules("sg-1"))
+	assert.Equal(t, []string{"i-new-1", "i-new-2"}, fake.instancesByState("ami-new", ec2.InstanceStateNameRunning))
+}
+
+func TestRollbackRetriesTransientErrors(t *testing.T) {
+	fake, config := newFakeDeployment()
+	fake.unhealthyAMIs["ami-new"] = true
+	actions := newActions(config, fake.clients())
+	defer useFakeNetwork(fake)()
+
+	info := &PipelineInfo{Input: InputArgs{"ami-old", "ami-new"}, Config: config}
+	step, _ := runActions(context.Background(), 0, info, actions, func(int) {})
+
+	// The fake fails only once, so the second attempt succeeds
+	fake.failures["TerminateInstances"] = awserr.NewRequestFailure(awserr.New("InternalError", "Injected error", nil), 500, "req-1")
+	assert.NoError(t, rollbackActions(context.Background(), step, info, actions, func(int) {}))
+	assert.Empty(t, fake.instancesByState("ami-new", ec2.InstanceStateNameRunning))
+}
+
+func TestIsTransientError(t *testing.T) {
+	assert.True(t, isTransientError(awserr.NewRequestFailure(awserr.New("InternalError", "", nil), 500, "")))
+	assert.True(t, isTransientError(awserr.NewRequestFailure(awserr.New("Throttling", "", nil), 400, "")))
+	assert.True(t, isTransientError(awserr.New("RequestLimitExceeded", "", nil)))
+	assert.True(t, isTransientError(awserr.New(request.ErrCodeRequestError, "", errors.New("connection reset by peer"))))
+	assert.False(t, isTransientError(awserr.NewRequestFailure(awserr.New("InvalidInstanceID.NotFound", "", nil), 400, "")))
+	assert.False(t, isTransientError(errors.New("Application is down")))
+}
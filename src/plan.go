@@ -0,0 +1,399 @@
+package main
+
+import (
+    "github.com/aws/aws-sdk-go/aws"
+    "github.com/aws/aws-sdk-go/aws/request"
+    "github.com/aws/aws-sdk-go/service/autoscaling"
+    "github.com/aws/aws-sdk-go/service/ec2"
+    "github.com/aws/aws-sdk-go/service/elbv2"
+    "github.com/aws/aws-sdk-go/service/kms"
+    "github.com/aws/aws-sdk-go/service/ssm"
+
+    "context"
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "io/ioutil"
+    "net/http"
+    "strings"
+    "sync"
+)
+
+// PlannedChange is a single mutation intercepted in the plan mode
+type PlannedChange struct {
+    Service string
+    Operation string
+    Input interface{}
+}
+
+// Plan intercepts mutating AWS calls and keeps them instead of sending to AWS.
+// Read-only calls are sent for real, except the ones asking about planned resources.
+type Plan struct {
+    Changes []PlannedChange
+
+    mu sync.Mutex
+    instances map[string]*ec2.Instance
+    instancesByIP map[string]*ec2.Instance
+    deregistered map[string]map[string]bool
+    refreshes map[string]bool
+    commands map[string]bool
+    // images are the AMIs copied or shared by the plan
+    images map[string]*ec2.Image
+}
+
+// NewPlan creates an empty plan
+func NewPlan() *Plan {
+    return &Plan{
+        instances: map[string]*ec2.Instance{},
+        instancesByIP: map[string]*ec2.Instance{},
+        deregistered: map[string]map[string]bool{},
+        refreshes: map[string]bool{},
+        commands: map[string]bool{},
+        images: map[string]*ec2.Image{},
+    }
+}
+
+// Intercept installs the plan on the AWS client handlers
+func (p *Plan) Intercept(handlers *request.Handlers) {
+    handlers.Build.PushBackNamed(request.NamedHandler{Name: "deployhat.Plan", Fn: p.handle})
+}
+
+// Transport wraps the HTTP transport, so health checks of planned instances are recorded instead of sent
+func (p *Plan) Transport(next http.RoundTripper) http.RoundTripper {
+    return planTransport{p, next}
+}
+
+// HealthCheck wraps the health check runner, so checks of planned instances are recorded instead of run
+func (p *Plan) HealthCheck(next func(context.Context, HealthCheck, string) error) func(context.Context, HealthCheck, string) error {
+    return func(ctx context.Context, check HealthCheck, host string) error {
+        p.mu.Lock()
+        _, planned := p.instancesByIP[host]
+        if planned {
+            p.record("healthcheck", check.Name(), host)
+        }
+        p.mu.Unlock()
+
+        if !planned {
+            return next(ctx, check, host)
+        }
+
+        return nil
+    }
+}
+
+// Command records the hook command instead of running it
+func (p *Plan) Command(ctx context.Context, command string, env []string, input []byte) (string, error) {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+
+    p.record("hook", "Run", command)
+    return "", nil
+}
+
+func isReadOnlyOperation(name string) bool {
+    for _, prefix := range []string{"Describe", "Get", "List"} {
+        if strings.HasPrefix(name, prefix) {
+            return true
+        }
+    }
+
+    return false
+}
+
+func skipSend(r *request.Request) {
+    r.Handlers.Sign.Clear()
+    r.Handlers.Send.Clear()
+    r.Handlers.UnmarshalMeta.Clear()
+    r.Handlers.ValidateResponse.Clear()
+    r.Handlers.Unmarshal.Clear()
+}
+
+func (p *Plan) record(service string, operation string, input interface{}) {
+    p.Changes = append(p.Changes, PlannedChange{service, operation, input})
+}
+
+func (p *Plan) handle(r *request.Request) {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+
+    if isReadOnlyOperation(r.Operation.Name) {
+        if p.answerReadOnly(r) {
+            skipSend(r)
+        }
+
+        return
+    }
+
+    p.record(r.ClientInfo.ServiceName, r.Operation.Name, r.Params)
+    skipSend(r)
+
+    switch input := r.Params.(type) {
+    case *ec2.RunInstancesInput:
+        p.planInstances(input, r.Data.(*ec2.Reservation))
+    case *elbv2.CreateTargetGroupInput:
+        r.Data.(*elbv2.CreateTargetGroupOutput).TargetGroups = []*elbv2.TargetGroup{{
+            TargetGroupArn: aws.String("arn:planned:targetgroup/" + *input.Name),
+            TargetGroupName: input.Name,
+        }}
+    case *ec2.CreateLaunchTemplateVersionInput:
+        r.Data.(*ec2.CreateLaunchTemplateVersionOutput).LaunchTemplateVersion = &ec2.LaunchTemplateVersion{
+            LaunchTemplateId: input.LaunchTemplateId,
+            VersionNumber: aws.Int64(0),
+        }
+    case *autoscaling.StartInstanceRefreshInput:
+        refreshID := fmt.Sprintf("planned-refresh-%d", len(p.refreshes)+1)
+        p.refreshes[refreshID] = true
+        r.Data.(*autoscaling.StartInstanceRefreshOutput).InstanceRefreshId = aws.String(refreshID)
+    case *ec2.CopyImageInput:
+        imageID := fmt.Sprintf("ami-planned-copy-%d", len(p.images)+1)
+        p.images[imageID] = &ec2.Image{ImageId: aws.String(imageID), Name: input.Name, State: aws.String(ec2.ImageStateAvailable)}
+        r.Data.(*ec2.CopyImageOutput).ImageId = aws.String(imageID)
+    case *ec2.ModifyImageAttributeInput:
+        // The shared AMI becomes visible to the account of the deployment
+        if input.LaunchPermission != nil && len(input.LaunchPermission.Add) > 0 {
+            p.images[*input.ImageId] = &ec2.Image{ImageId: input.ImageId, State: aws.String(ec2.ImageStateAvailable)}
+        }
+    case *ec2.CreateTagsInput:
+        for _, resourceID := range input.Resources {
+            if image, ok := p.images[*resourceID]; ok {
+                image.Tags = append(image.Tags, input.Tags...)
+            }
+        }
+    case *kms.CreateGrantInput:
+        r.Data.(*kms.CreateGrantOutput).GrantId = aws.String("planned-grant-" + *input.Name)
+    case *ssm.SendCommandInput:
+        commandID := fmt.Sprintf("planned-command-%d", len(p.commands)+1)
+        p.commands[commandID] = true
+        r.Data.(*ssm.SendCommandOutput).Command = &ssm.Command{CommandId: aws.String(commandID)}
+    case *elbv2.DeregisterTargetsInput:
+        if p.deregistered[*input.TargetGroupArn] == nil {
+            p.deregistered[*input.TargetGroupArn] = map[string]bool{}
+        }
+
+        for _, target := range input.Targets {
+            p.deregistered[*input.TargetGroupArn][*target.Id] = true
+        }
+    }
+}
+
+func (p *Plan) planInstances(input *ec2.RunInstancesInput, output *ec2.Reservation) {
+    for i := int64(0); i < aws.Int64Value(input.MinCount); i++ {
+        idx := len(p.instances) + 1
+        instance := &ec2.Instance{
+            InstanceId: aws.String(fmt.Sprintf("i-planned-%d", idx)),
+            ImageId: input.ImageId,
+            InstanceType: input.InstanceType,
+            KeyName: input.KeyName,
+            // Addresses from the TEST-NET-1 block are never routed, so planned instances cannot be mistaken for real ones
+            PublicIpAddress: aws.String(fmt.Sprintf("192.0.2.%d", idx)),
+            PrivateIpAddress: aws.String(fmt.Sprintf("192.0.2.%d", idx)),
+            State: &ec2.InstanceState{Name: aws.String("running")},
+        }
+
+        p.instances[*instance.InstanceId] = instance
+        p.instancesByIP[*instance.PublicIpAddress] = instance
+        output.Instances = append(output.Instances, instance)
+    }
+}
+
+// answerReadOnly answers the read-only calls about planned resources, which do not exist in AWS
+func (p *Plan) answerReadOnly(r *request.Request) bool {
+    switch input := r.Params.(type) {
+    case *ec2.DescribeInstancesInput:
+        if len(input.InstanceIds) < 1 {
+            return false
+        }
+
+        reservations := []*ec2.Reservation{}
+        for _, instanceID := range input.InstanceIds {
+            instance, ok := p.instances[*instanceID]
+            if !ok {
+                return false
+            }
+
+            reservations = append(reservations, &ec2.Reservation{Instances: []*ec2.Instance{instance}})
+        }
+
+        r.Data.(*ec2.DescribeInstancesOutput).Reservations = reservations
+        return true
+
+    case *autoscaling.DescribeInstanceRefreshesInput:
+        if len(input.InstanceRefreshIds) != 1 || !p.refreshes[*input.InstanceRefreshIds[0]] {
+            return false
+        }
+
+        r.Data.(*autoscaling.DescribeInstanceRefreshesOutput).InstanceRefreshes = []*autoscaling.InstanceRefresh{{
+            AutoScalingGroupName: input.AutoScalingGroupName,
+            InstanceRefreshId: input.InstanceRefreshIds[0],
+            Status: aws.String(autoscaling.InstanceRefreshStatusSuccessful),
+        }}
+        return true
+
+    case *ec2.DescribeImagesInput:
+        if len(input.ImageIds) < 1 {
+            return false
+        }
+
+        images := []*ec2.Image{}
+        for _, imageID := range input.ImageIds {
+            image, ok := p.images[*imageID]
+            if !ok {
+                return false
+            }
+
+            images = append(images, image)
+        }
+
+        r.Data.(*ec2.DescribeImagesOutput).Images = images
+        return true
+
+    case *ssm.GetCommandInvocationInput:
+        if !p.commands[*input.CommandId] {
+            return false
+        }
+
+        // Planned instances answer like the healthy application
+        r.Data.(*ssm.GetCommandInvocationOutput).Status = aws.String(ssm.CommandInvocationStatusSuccess)
+        r.Data.(*ssm.GetCommandInvocationOutput).StandardOutputContent = aws.String("200")
+        return true
+
+    case *elbv2.DescribeTargetHealthInput:
+        if len(input.Targets) < 1 {
+            return false
+        }
+
+        descriptions := []*elbv2.TargetHealthDescription{}
+        for _, target := range input.Targets {
+            state := elbv2.TargetHealthStateEnumHealthy
+
+            if p.deregistered[*input.TargetGroupArn][*target.Id] {
+                state = elbv2.TargetHealthStateEnumUnused
+            } else if _, ok := p.instances[*target.Id]; !ok {
+                return false
+            }
+
+            descriptions = append(descriptions, &elbv2.TargetHealthDescription{
+                Target: target,
+                TargetHealth: &elbv2.TargetHealth{State: aws.String(state)},
+            })
+        }
+
+        r.Data.(*elbv2.DescribeTargetHealthOutput).TargetHealthDescriptions = descriptions
+        return true
+    }
+
+    return false
+}
+
+type planTransport struct {
+    plan *Plan
+    next http.RoundTripper
+}
+
+// RoundTrip is an action to record requests sent to planned instances
+func (t planTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+    t.plan.mu.Lock()
+    _, planned := t.plan.instancesByIP[req.URL.Hostname()]
+    if planned {
+        t.plan.record("http", req.Method, req.URL.String())
+    }
+    t.plan.mu.Unlock()
+
+    if !planned {
+        return t.next.RoundTrip(req)
+    }
+
+    return &http.Response{
+        Status: "200 OK",
+        StatusCode: http.StatusOK,
+        Proto: "HTTP/1.1",
+        ProtoMajor: 1,
+        ProtoMinor: 1,
+        Header: http.Header{},
+        Body: ioutil.NopCloser(&bytes.Buffer{}),
+        Request: req,
+    }, nil
+}
+
+// Render returns the human-readable description of the plan
+func (p *Plan) Render(info *PipelineInfo) string {
+    var out strings.Builder
+
+    fmt.Fprintf(&out, "Deployment plan %s (%s -> %s)\n\n", info.Version, info.Config.Selector, info.Input.NewAMI)
+
+    fmt.Fprintf(&out, "Matched instances:\n")
+    for _, instance := range info.OldInstances {
+        fmt.Fprintf(&out, "  %s (%s, %s)\n", instance.ID, instance.InstanceType, instance.SubnetID)
+    }
+    for _, region := range info.Regions {
+        for _, instance := range region.Info.OldInstances {
+            fmt.Fprintf(&out, "  %s (%s, %s, %s)\n", instance.ID, instance.InstanceType, instance.SubnetID, region.Region)
+        }
+    }
+
+    fmt.Fprintf(&out, "Target groups:\n")
+    for _, tgArn := range info.TargetGroupsArns {
+        fmt.Fprintf(&out, "  %s\n", *tgArn)
+    }
+    for _, region := range info.Regions {
+        for _, tgArn := range region.Info.TargetGroupsArns {
+            fmt.Fprintf(&out, "  %s\n", *tgArn)
+        }
+    }
+
+    fmt.Fprintf(&out, "\nChanges:\n")
+    for idx, change := range p.Changes {
+        fmt.Fprintf(&out, "%d. %s %s\n", idx+1, change.Service, change.Operation)
+
+        if url, ok := change.Input.(string); ok {
+            fmt.Fprintf(&out, "  %s\n", url)
+            continue
+        }
+
+        for _, line := range strings.Split(fmt.Sprint(change.Input), "\n") {
+            fmt.Fprintf(&out, "  %s\n", line)
+        }
+    }
+
+    return out.String()
+}
+
+// planReport is the JSON representation of the plan
+type planReport struct {
+    Version string
+    Input InputArgs
+    Config Config
+    OldInstances []ShortInstanceDesc
+    TargetGroupsArns []*string
+    Regions []RegionDeployment `json:",omitempty"`
+    Changes []PlannedChange
+}
+
+// JSON returns the machine-readable description of the plan
+func (p *Plan) JSON(info *PipelineInfo) ([]byte, error) {
+    return json.MarshalIndent(planReport{
+        Version: info.Version,
+        Input: info.Input,
+        Config: info.Config,
+        OldInstances: info.OldInstances,
+        TargetGroupsArns: info.TargetGroupsArns,
+        Regions: info.Regions,
+        Changes: p.Changes,
+    }, "", "  ")
+}
+
+func planFilePath(version string) string {
+    return fmt.Sprintf("deploy_%s.plan.json", version)
+}
+
+func runPlan(ctx context.Context, info *PipelineInfo, actions []InfrastructureAction) error {
+    for _, action := range actions {
+        logger.Info("Planning.", Fields{"action": actionName(action)})
+
+        if err := action.Commit(ctx, info); err != nil {
+            return fmt.Errorf("[%T] %s", action, err.Error())
+        }
+    }
+
+    return nil
+}
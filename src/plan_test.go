@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	"github.com/stretchr/testify/assert"
+)
+
+// offlineSession points to the closed port, so every call which is not intercepted fails
+func offlineSession() *session.Session {
+	return session.Must(session.NewSession(&aws.Config{
+		Region:      aws.String("us-east-1"),
+		Endpoint:    aws.String("http://127.0.0.1:1"),
+		Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+		MaxRetries:  aws.Int(0),
+	}))
+}
+
+func TestPlanInterceptsMutations(t *testing.T) {
+	plan := NewPlan()
+	svc := ec2.New(offlineSession())
+	plan.Intercept(&svc.Handlers)
+
+	res, err := svc.RunInstances(&ec2.RunInstancesInput{
+		ImageId:  aws.String("ami-456"),
+		MinCount: aws.Int64(1),
+		MaxCount: aws.Int64(1),
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error from planned RunInstances(): %s", err.Error())
+	}
+
+	assert.Equal(t, 1, len(res.Instances))
+	assert.Equal(t, "i-planned-1", *res.Instances[0].InstanceId)
+
+	_, err = svc.TerminateInstances(&ec2.TerminateInstancesInput{InstanceIds: []*string{aws.String("i-1")}})
+	if err != nil {
+		t.Fatalf("Unexpected error from planned TerminateInstances(): %s", err.Error())
+	}
+
+	assert.Equal(t, 2, len(plan.Changes))
+	assert.Equal(t, "RunInstances", plan.Changes[0].Operation)
+	assert.Equal(t, "TerminateInstances", plan.Changes[1].Operation)
+}
+
+func TestPlanAnswersReadsAboutPlannedResources(t *testing.T) {
+	plan := NewPlan()
+	sess := offlineSession()
+	svc := ec2.New(sess)
+	elbSvc := elbv2.New(sess)
+	plan.Intercept(&svc.Handlers)
+	plan.Intercept(&elbSvc.Handlers)
+
+	res, _ := svc.RunInstances(&ec2.RunInstancesInput{MinCount: aws.Int64(1), MaxCount: aws.Int64(1)})
+
+	err := svc.WaitUntilInstanceRunning(&ec2.DescribeInstancesInput{InstanceIds: []*string{res.Instances[0].InstanceId}})
+	assert.Nil(t, err)
+
+	targets := []*elbv2.TargetDescription{{Id: aws.String("i-1")}}
+	elbSvc.DeregisterTargets(&elbv2.DeregisterTargetsInput{TargetGroupArn: aws.String("arn:tg"), Targets: targets})
+
+	err = elbSvc.WaitUntilTargetDeregistered(&elbv2.DescribeTargetHealthInput{TargetGroupArn: aws.String("arn:tg"), Targets: targets})
+	assert.Nil(t, err)
+
+	// Instances which are not planned are described by AWS
+	_, err = svc.DescribeInstances(&ec2.DescribeInstancesInput{InstanceIds: []*string{aws.String("i-1")}})
+	assert.NotNil(t, err)
+}
+
+func TestPlanAnswersReadsAboutPlannedImages(t *testing.T) {
+	plan := NewPlan()
+	svc := ec2.New(offlineSession())
+	plan.Intercept(&svc.Handlers)
+
+	res, err := svc.CopyImage(&ec2.CopyImageInput{SourceImageId: aws.String("ami-456"), SourceRegion: aws.String("us-east-1"), Name: aws.String("web")})
+	if err != nil {
+		t.Fatalf("Unexpected error from planned CopyImage(): %s", err.Error())
+	}
+
+	err = svc.WaitUntilImageAvailable(&ec2.DescribeImagesInput{ImageIds: []*string{res.ImageId}})
+	assert.Nil(t, err)
+
+	// The shared AMI is visible to the deployment account
+	svc.ModifyImageAttribute(&ec2.ModifyImageAttributeInput{
+		ImageId:          aws.String("ami-456"),
+		LaunchPermission: &ec2.LaunchPermissionModifications{Add: []*ec2.LaunchPermission{{UserId: aws.String(fakeAccount)}}},
+	})
+
+	images, err := svc.DescribeImages(&ec2.DescribeImagesInput{ImageIds: []*string{aws.String("ami-456")}})
+	if assert.NoError(t, err) {
+		assert.Equal(t, ec2.ImageStateAvailable, *images.Images[0].State)
+	}
+
+	assert.Equal(t, []string{"CopyImage", "ModifyImageAttribute"}, []string{plan.Changes[0].Operation, plan.Changes[1].Operation})
+}
+
+func TestPlanTransport(t *testing.T) {
+	plan := NewPlan()
+	svc := ec2.New(offlineSession())
+	plan.Intercept(&svc.Handlers)
+	res, _ := svc.RunInstances(&ec2.RunInstancesInput{MinCount: aws.Int64(1), MaxCount: aws.Int64(1)})
+
+	client := &http.Client{Transport: plan.Transport(http.DefaultTransport)}
+	resp, err := client.Get("http://" + *res.Instances[0].PublicIpAddress)
+	if err != nil {
+		t.Fatalf("Unexpected error for planned instance: %s", err.Error())
+	}
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "http", plan.Changes[len(plan.Changes)-1].Service)
+
+	info := &PipelineInfo{Version: "1", TargetGroupsArns: []*string{aws.String("arn:tg")}}
+	rendered := plan.Render(info)
+	assert.True(t, strings.Contains(rendered, "ec2 RunInstances"))
+	assert.True(t, strings.Contains(rendered, "arn:tg"))
+
+	if _, err := plan.JSON(info); err != nil {
+		t.Errorf("Unexpected error from Plan.JSON(): %s", err.Error())
+	}
+}
+
+func TestPlanHealthCheck(t *testing.T) {
+	plan := NewPlan()
+	svc := ec2.New(offlineSession())
+	plan.Intercept(&svc.Handlers)
+	res, _ := svc.RunInstances(&ec2.RunInstancesInput{MinCount: aws.Int64(1), MaxCount: aws.Int64(1)})
+
+	ran := []string{}
+	run := plan.HealthCheck(func(ctx context.Context, check HealthCheck, host string) error {
+		ran = append(ran, host)
+		return nil
+	})
+	check := TCPCheck{CheckConfig{Name: "tcp:9000", Type: CheckTCP, Port: 9000}}
+
+	assert.NoError(t, run(context.Background(), check, *res.Instances[0].PrivateIpAddress))
+	assert.Equal(t, PlannedChange{"healthcheck", "tcp:9000", *res.Instances[0].PrivateIpAddress}, plan.Changes[len(plan.Changes)-1])
+
+	assert.NoError(t, run(context.Background(), check, "10.1.1.1"))
+	assert.Equal(t, []string{"10.1.1.1"}, ran)
+}
+
+func TestPlanRecordsHooks(t *testing.T) {
+	plan := NewPlan()
+
+	output, err := plan.Command(context.Background(), "./migrate.sh", nil, nil)
+
+	assert.NoError(t, err)
+	assert.Empty(t, output)
+	assert.Equal(t, []PlannedChange{{"hook", "Run", "./migrate.sh"}}, plan.Changes)
+}
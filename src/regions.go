@@ -0,0 +1,483 @@
+package main
+
+import (
+    "github.com/aws/aws-sdk-go/aws"
+    "github.com/aws/aws-sdk-go/aws/awserr"
+    "github.com/aws/aws-sdk-go/service/ec2"
+    "github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+
+    "context"
+    "encoding/json"
+    "fmt"
+    "strings"
+    "sync"
+    "time"
+)
+
+// RegionDeployment keeps progress of the deployment in a single region
+type RegionDeployment struct {
+    Region string
+    Step int
+    Info PipelineInfo
+    // Completed regions keep the new AMI when another region fails
+    Completed bool `json:",omitempty"`
+}
+
+// RegionPipeline is the list of steps deploying a single region
+type RegionPipeline struct {
+    // Name tells apart targets in the same region. It is the region by default.
+    Name string
+    Config Config
+    Actions []InfrastructureAction
+}
+
+// MultiRegionAction is a pipeline step struct. It executes the pipeline of every region, one after another
+// or all at once. When a region fails, the regions which have not started are skipped, the running ones are
+// stopped and all unfinished regions are rolled back. Completed regions stay in place.
+type MultiRegionAction struct {
+    Regions []RegionPipeline
+    Parallel bool
+    Checkpoint func()
+
+    mu sync.Mutex
+}
+
+// newPipeline returns the steps of the deployment. Every region of the multi-region deployment
+// gets its own steps with clients of the region.
+func newPipeline(config Config, clientsFor func(config Config) awsClients) []InfrastructureAction {
+    owner := awsClients{}
+    if config.ImageSharing.Enabled {
+        owner = clientsFor(config.ownerConfig())
+    }
+
+    if len(config.MultiRegion.Regions) == 0 {
+        clients := clientsFor(config)
+        return newActions(config, clients, config.imageActions(RegionConfig{Region: config.Region}, clients, owner, clientsFor)...)
+    }
+
+    multiRegion := &MultiRegionAction{Parallel: config.MultiRegion.Mode == RegionModeParallel}
+
+    for _, region := range config.MultiRegion.Regions {
+        regionConfig := config.regionConfig(region)
+        clients := clientsFor(regionConfig)
+
+        multiRegion.Regions = append(multiRegion.Regions, RegionPipeline{
+            Name: region.name(),
+            Config: regionConfig,
+            Actions: newActions(regionConfig, clients, config.imageActions(region, clients, owner, clientsFor)...),
+        })
+    }
+
+    return []InfrastructureAction{multiRegion}
+}
+
+// imageActions returns the steps making the new AMI of the config available in the region. The AMI is shared
+// by the account owning it first, so the account of the region can copy it.
+func (c Config) imageActions(region RegionConfig, clients awsClients, owner awsClients, clientsFor func(config Config) awsClients) []InfrastructureAction {
+    actions := []InfrastructureAction{}
+
+    if c.sharesImage(region) {
+        actions = append(actions, ShareImageAction{
+            Svc: owner.EC2,
+            KMS: owner.KMS,
+            STS: clients.STS,
+            AMI: c.NewAMI,
+            RequiredTags: c.ImageValidation.RequiredTags,
+        })
+    }
+
+    if c.copiesImage(region) {
+        // The account of the region describes the source AMI in the region of the config
+        source := c.regionConfig(region)
+        source.Region = c.Region
+
+        actions = append(actions, CopyImageAction{
+            Svc: clients.EC2,
+            Source: clientsFor(source).EC2,
+            SourceRegion: c.Region,
+            SourceAMI: c.NewAMI,
+            Timeout: time.Duration(c.Timeouts.ImageAvailable),
+        })
+    }
+
+    return actions
+}
+
+// withImageActions places the image steps right after the input is validated, so the next steps verify and launch the AMI
+func withImageActions(actions []InfrastructureAction, imageActions []InfrastructureAction) []InfrastructureAction {
+    if len(imageActions) == 0 {
+        return actions
+    }
+
+    for idx, action := range actions {
+        if _, ok := action.(InitializePipelineAction); ok {
+            result := append([]InfrastructureAction{}, actions[:idx+1]...)
+            result = append(result, imageActions...)
+            return append(result, actions[idx+1:]...)
+        }
+    }
+
+    return actions
+}
+
+// copyInfo returns the deep copy of the info, which regions running in parallel do not share.
+// The info is encoded the same way as in the state file, which never fails for its types.
+func copyInfo(info PipelineInfo) PipelineInfo {
+    data, _ := json.Marshal(info)
+
+    copied := PipelineInfo{}
+    json.Unmarshal(data, &copied)
+
+    return copied
+}
+
+func (act *MultiRegionAction) initRegions(pipelineInfo *PipelineInfo) {
+    if len(pipelineInfo.Regions) > 0 {
+        return
+    }
+
+    for _, region := range act.Regions {
+        pipelineInfo.Regions = append(pipelineInfo.Regions, RegionDeployment{
+            Region: region.Name,
+            Step: -1,
+            Info: PipelineInfo{
+                Version: pipelineInfo.Version,
+                Input: InputArgs{region.Config.Selector.AMI, region.Config.NewAMI},
+                Config: region.Config,
+                Region: region.Name,
+            },
+        })
+    }
+}
+
+// save copies the progress of the region into the info of the deployment and saves the state
+func (act *MultiRegionAction) save(pipelineInfo *PipelineInfo, idx int, regionInfo *PipelineInfo, update func(*RegionDeployment)) {
+    act.mu.Lock()
+    defer act.mu.Unlock()
+
+    deployment := &pipelineInfo.Regions[idx]
+    deployment.Info = copyInfo(*regionInfo)
+    update(deployment)
+
+    if act.Checkpoint != nil {
+        act.Checkpoint()
+    }
+}
+
+// checkpoint returns the checkpoint of the region steps. Composite steps of the region save it in the middle.
+func (act *MultiRegionAction) checkpoint(pipelineInfo *PipelineInfo, idx int, regionInfo *PipelineInfo) func(step int) {
+    for _, action := range act.Regions[idx].Actions {
+        save := func() {
+            act.save(pipelineInfo, idx, regionInfo, func(*RegionDeployment) {})
+        }
+
+        switch step := action.(type) {
+        case *RollingDeploymentAction:
+            step.Checkpoint = save
+        case *InstanceRefreshAction:
+            step.Checkpoint = save
+        }
+    }
+
+    return func(step int) {
+        act.save(pipelineInfo, idx, regionInfo, func(deployment *RegionDeployment) {
+            deployment.Step = step
+        })
+    }
+}
+
+// forEachRegion calls fn for the regions in the given order, all at once in the parallel mode.
+// Every region works on its own copy of the info.
+func (act *MultiRegionAction) forEachRegion(pipelineInfo *PipelineInfo, order []int, fn func(idx int, regionInfo *PipelineInfo)) {
+    regionInfos := map[int]*PipelineInfo{}
+    for _, idx := range order {
+        regionInfo := copyInfo(pipelineInfo.Regions[idx].Info)
+        regionInfos[idx] = &regionInfo
+    }
+
+    if !act.Parallel {
+        for _, idx := range order {
+            fn(idx, regionInfos[idx])
+        }
+
+        return
+    }
+
+    var wg sync.WaitGroup
+    for _, idx := range order {
+        wg.Add(1)
+
+        go func(idx int) {
+            defer wg.Done()
+            fn(idx, regionInfos[idx])
+        }(idx)
+    }
+    wg.Wait()
+}
+
+// Commit is an action to apply changes in the MultiRegionAction step
+func (act *MultiRegionAction) Commit(ctx context.Context, pipelineInfo *PipelineInfo) error {
+    act.initRegions(pipelineInfo)
+
+    // The first failure stops the remaining regions
+    ctx, cancel := context.WithCancel(ctx)
+    defer cancel()
+
+    var failure error
+    var once sync.Once
+
+    pending := []int{}
+    for idx, deployment := range pipelineInfo.Regions {
+        if !deployment.Completed {
+            pending = append(pending, idx)
+        }
+    }
+
+    act.forEachRegion(pipelineInfo, pending, func(idx int, regionInfo *PipelineInfo) {
+        if ctx.Err() != nil {
+            return
+        }
+
+        region := act.Regions[idx]
+        logger.Info("Deploying region", Fields{"action": actionName(act), "region": region.Name})
+
+        _, err := runActions(ctx, pipelineInfo.Regions[idx].Step+1, regionInfo, region.Actions, act.checkpoint(pipelineInfo, idx, regionInfo))
+        if err != nil {
+            once.Do(func() {
+                failure = fmt.Errorf("Region %s failed: %s", region.Name, err.Error())
+            })
+            cancel()
+            return
+        }
+
+        act.save(pipelineInfo, idx, regionInfo, func(deployment *RegionDeployment) {
+            deployment.Completed = true
+        })
+    })
+
+    if failure != nil {
+        return failure
+    }
+
+    // The deployment was interrupted before the next region started
+    if err := ctx.Err(); err != nil {
+        return fmt.Errorf("Deployment interrupted: %s", err.Error())
+    }
+
+    return nil
+}
+
+// Rollback is an action to apply changes in the MultiRegionAction step.
+// Unfinished regions are rolled back, completed regions stay in place.
+func (act *MultiRegionAction) Rollback(ctx context.Context, pipelineInfo *PipelineInfo) error {
+    act.keepSharedImages(pipelineInfo)
+
+    unfinished := []int{}
+    for idx := len(pipelineInfo.Regions) - 1; idx >= 0; idx-- {
+        deployment := pipelineInfo.Regions[idx]
+        if !deployment.Completed && deployment.Step >= 0 {
+            unfinished = append(unfinished, idx)
+        }
+    }
+
+    failures := &RollbackError{}
+    var interrupted error
+    var mu sync.Mutex
+
+    act.forEachRegion(pipelineInfo, unfinished, func(idx int, regionInfo *PipelineInfo) {
+        region := act.Regions[idx]
+        logger.Info("Rolling back region", Fields{"action": actionName(act), "region": region.Name})
+
+        err := rollbackActions(ctx, pipelineInfo.Regions[idx].Step, regionInfo, region.Actions, act.checkpoint(pipelineInfo, idx, regionInfo))
+
+        mu.Lock()
+        defer mu.Unlock()
+
+        nested, failed := err.(*RollbackError)
+        if err != nil && !failed {
+            interrupted = fmt.Errorf("Region %s: %s", region.Name, err.Error())
+            return
+        }
+
+        if failed {
+            for _, step := range nested.Steps {
+                failures.Steps = append(failures.Steps, StepError{step.Step, step.Action + " in " + region.Name, step.Err})
+            }
+
+            for _, leftover := range nested.Leftovers {
+                failures.Leftovers = append(failures.Leftovers, region.Name+": "+leftover)
+            }
+        }
+    })
+
+    if interrupted != nil {
+        return interrupted
+    }
+
+    if len(failures.Steps) > 0 {
+        return failures
+    }
+
+    return nil
+}
+
+// keepSharedImages hands permissions on the new AMI granted by unfinished regions over to completed regions
+// of the same account, which launched instances from the AMI itself instead of its copy. The rollback of
+// the unfinished region would revoke permissions the instances of the completed region still depend on.
+func (act *MultiRegionAction) keepSharedImages(pipelineInfo *PipelineInfo) {
+    for idx := range pipelineInfo.Regions {
+        deployment := &pipelineInfo.Regions[idx]
+        shared := deployment.Info.SharedImage
+        if deployment.Completed || shared == nil {
+            continue
+        }
+
+        for _, completed := range pipelineInfo.Regions {
+            owner := completed.Info.SharedImage
+            if !completed.Completed || owner == nil || owner.Account != shared.Account || completed.Info.Input.NewAMI != shared.ImageID {
+                continue
+            }
+
+            owner.LaunchPermission = owner.LaunchPermission || shared.LaunchPermission
+            owner.SnapshotIds = append(owner.SnapshotIds, shared.SnapshotIds...)
+            owner.KMSGrants = append(owner.KMSGrants, shared.KMSGrants...)
+            deployment.Info.SharedImage = nil
+
+            logger.Info("AMI stays shared with the account of the completed region", Fields{
+                "action": actionName(act),
+                "region": deployment.Region,
+                "completed_region": completed.Region,
+                "image_id": shared.ImageID,
+                "account": shared.Account,
+            })
+
+            if act.Checkpoint != nil {
+                act.Checkpoint()
+            }
+            break
+        }
+    }
+}
+
+// CopyImageAction is a pipeline step struct. It copies the new AMI from the source region to the region of the deployment.
+// Tags of the source AMI are copied as well, so the copy passes the same checks.
+type CopyImageAction struct {
+    Svc ec2iface.EC2API
+    // Source is the client of the source region
+    Source ec2iface.EC2API
+    SourceRegion string
+    SourceAMI string
+    Timeout time.Duration
+}
+
+// Commit is an action to apply changes in the CopyImageAction step
+func (act CopyImageAction) Commit(ctx context.Context, pipelineInfo *PipelineInfo) error {
+    if pipelineInfo.CopiedImageID == "" {
+        // The client token makes the copy idempotent, when the step is executed again by resume
+        output, err := act.Svc.CopyImage(&ec2.CopyImageInput{
+            SourceImageId: aws.String(act.SourceAMI),
+            SourceRegion: aws.String(act.SourceRegion),
+            Name: aws.String(fmt.Sprintf("%s-%s", act.SourceAMI, pipelineInfo.Version)),
+            Description: aws.String(fmt.Sprintf("Copy of %s from %s made by the deployment %s", act.SourceAMI, act.SourceRegion, pipelineInfo.Version)),
+            ClientToken: aws.String(fmt.Sprintf("%s-%s", pipelineInfo.Version, act.SourceAMI)),
+        })
+
+        if err != nil {
+            return err
+        }
+
+        pipelineInfo.CopiedImageID = *output.ImageId
+    }
+
+    pipelineInfo.Input.NewAMI = pipelineInfo.CopiedImageID
+
+    if err := act.copyTags(pipelineInfo.CopiedImageID); err != nil {
+        return err
+    }
+
+    logger.Info("Waiting for AMI copy", Fields{"action": actionName(act), "image_id": pipelineInfo.CopiedImageID})
+
+    input := &ec2.DescribeImagesInput{ImageIds: []*string{aws.String(pipelineInfo.CopiedImageID)}}
+    return act.Svc.WaitUntilImageAvailableWithContext(ctx, input, waiterTimeout(act.Timeout))
+}
+
+func (act CopyImageAction) copyTags(imageID string) error {
+    source, err := describeImage(act.Source, act.SourceAMI)
+    if err != nil || source == nil {
+        return err
+    }
+
+    // Tags with the aws: prefix are reserved
+    tags := []*ec2.Tag{}
+    for _, tag := range source.Tags {
+        if !strings.HasPrefix(aws.StringValue(tag.Key), "aws:") {
+            tags = append(tags, tag)
+        }
+    }
+
+    if len(tags) == 0 {
+        return nil
+    }
+
+    _, err = act.Svc.CreateTags(&ec2.CreateTagsInput{Resources: []*string{aws.String(imageID)}, Tags: tags})
+    return err
+}
+
+// Rollback is an action to apply changes in the CopyImageAction step
+func (act CopyImageAction) Rollback(ctx context.Context, pipelineInfo *PipelineInfo) error {
+    // Snapshots stay after the AMI is deregistered, so they are recorded first.
+    // The retried rollback keeps the snapshots recorded by the previous attempt.
+    if pipelineInfo.CopiedImageID != "" && len(pipelineInfo.CopiedSnapshotIds) == 0 {
+        output, err := act.Svc.DescribeImages(&ec2.DescribeImagesInput{ImageIds: []*string{aws.String(pipelineInfo.CopiedImageID)}})
+        if err != nil {
+            return err
+        }
+
+        for _, image := range output.Images {
+            for _, mapping := range image.BlockDeviceMappings {
+                if mapping.Ebs != nil && mapping.Ebs.SnapshotId != nil {
+                    pipelineInfo.CopiedSnapshotIds = append(pipelineInfo.CopiedSnapshotIds, mapping.Ebs.SnapshotId)
+                }
+            }
+        }
+    }
+
+    if pipelineInfo.CopiedImageID != "" {
+        if _, err := act.Svc.DeregisterImage(&ec2.DeregisterImageInput{ImageId: aws.String(pipelineInfo.CopiedImageID)}); err != nil {
+            return err
+        }
+
+        pipelineInfo.CopiedImageID = ""
+        pipelineInfo.Input.NewAMI = act.SourceAMI
+    }
+
+    for len(pipelineInfo.CopiedSnapshotIds) > 0 {
+        snapshotID := pipelineInfo.CopiedSnapshotIds[0]
+
+        _, err := act.Svc.DeleteSnapshot(&ec2.DeleteSnapshotInput{SnapshotId: snapshotID})
+
+        // Snapshot deleted by the interrupted rollback is not found anymore
+        if aerr, ok := err.(awserr.Error); err != nil && !(ok && aerr.Code() == "InvalidSnapshot.NotFound") {
+            return err
+        }
+
+        pipelineInfo.CopiedSnapshotIds = pipelineInfo.CopiedSnapshotIds[1:]
+    }
+
+    return nil
+}
+
+// Leftovers describes the AMI copy, which the failed rollback did not remove
+func (act CopyImageAction) Leftovers(pipelineInfo *PipelineInfo) []string {
+    leftovers := []string{}
+
+    if pipelineInfo.CopiedImageID != "" {
+        leftovers = append(leftovers, "AMI "+pipelineInfo.CopiedImageID+" copied by the deployment")
+    }
+
+    for _, snapshotID := range pipelineInfo.CopiedSnapshotIds {
+        leftovers = append(leftovers, "EBS snapshot "+*snapshotID+" of the AMI copied by the deployment")
+    }
+
+    return leftovers
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/stretchr/testify/assert"
+)
+
+// regionLog collects changes made by steps of regions running in parallel
+type regionLog struct {
+	mu      sync.Mutex
+	changes []string
+}
+
+func (l *regionLog) add(change string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.changes = append(l.changes, change)
+}
+
+func (l *regionLog) sorted() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	changes := append([]string{}, l.changes...)
+	sort.Strings(changes)
+
+	return changes
+}
+
+// regionLaunchAction launches a single instance in the region of the info
+type regionLaunchAction struct {
+	log      *regionLog
+	launched chan struct{}
+}
+
+func (act regionLaunchAction) Commit(ctx context.Context, info *PipelineInfo) error {
+	info.NewInstancesIds = append(info.NewInstancesIds, aws.String("i-"+info.Region))
+	act.log.add("launch i-" + info.Region)
+
+	if act.launched != nil {
+		close(act.launched)
+	}
+
+	return nil
+}
+
+func (act regionLaunchAction) Rollback(ctx context.Context, info *PipelineInfo) error {
+	for _, instanceID := range info.NewInstancesIds {
+		act.log.add("terminate " + *instanceID)
+	}
+
+	return nil
+}
+
+// regionFailAction fails once the other region launched its instance
+type regionFailAction struct {
+	launched chan struct{}
+}
+
+func (act regionFailAction) Commit(ctx context.Context, info *PipelineInfo) error {
+	if act.launched != nil {
+		<-act.launched
+	}
+
+	return errors.New("Application is down")
+}
+
+func (act regionFailAction) Rollback(ctx context.Context, info *PipelineInfo) error {
+	return nil
+}
+
+// regionBlockAction runs until the deployment is stopped
+type regionBlockAction struct{}
+
+func (act regionBlockAction) Commit(ctx context.Context, info *PipelineInfo) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func (act regionBlockAction) Rollback(ctx context.Context, info *PipelineInfo) error {
+	return nil
+}
+
+func regionPipeline(region string, actions ...InfrastructureAction) RegionPipeline {
+	config := DefaultConfig()
+	config.Region = region
+
+	return RegionPipeline{Name: region, Config: config, Actions: actions}
+}
+
+func TestMultiRegionActionStopsAtFailedRegion(t *testing.T) {
+	log := &regionLog{}
+	checkpoints := 0
+	act := &MultiRegionAction{
+		Regions: []RegionPipeline{
+			regionPipeline("us-east-1", regionLaunchAction{log: log}),
+			regionPipeline("eu-west-1", regionLaunchAction{log: log}, regionFailAction{}),
+			regionPipeline("ap-south-1", regionLaunchAction{log: log}),
+		},
+		Checkpoint: func() { checkpoints++ },
+	}
+	info := &PipelineInfo{Version: "1"}
+
+	err := act.Commit(context.Background(), info)
+	if assert.Error(t, err) {
+		assert.Equal(t, "Region eu-west-1 failed: Application is down", err.Error())
+	}
+
+	// Regions after the failed one are not started
+	assert.Equal(t, []string{"launch i-eu-west-1", "launch i-us-east-1"}, log.sorted())
+	assert.True(t, info.Regions[0].Completed)
+	assert.Equal(t, 1, info.Regions[1].Step)
+	assert.Equal(t, -1, info.Regions[2].Step)
+	assert.Equal(t, 4, checkpoints)
+
+	assert.NoError(t, act.Rollback(context.Background(), info))
+
+	// Completed region keeps the new instances
+	assert.Equal(t, []string{"launch i-eu-west-1", "launch i-us-east-1", "terminate i-eu-west-1"}, log.sorted())
+	assert.Equal(t, -1, info.Regions[1].Step)
+}
+
+func TestMultiRegionActionStopsParallelRegions(t *testing.T) {
+	log := &regionLog{}
+	launched := make(chan struct{})
+	act := &MultiRegionAction{
+		Regions: []RegionPipeline{
+			regionPipeline("us-east-1", regionLaunchAction{log, launched}, regionBlockAction{}),
+			regionPipeline("eu-west-1", regionFailAction{launched}),
+		},
+		Parallel: true,
+	}
+	info := &PipelineInfo{Version: "1"}
+
+	err := act.Commit(context.Background(), info)
+	if assert.Error(t, err) {
+		assert.Equal(t, "Region eu-west-1 failed: Application is down", err.Error())
+	}
+
+	// The running region is stopped in the middle and rolled back with the failed one
+	assert.False(t, info.Regions[0].Completed)
+	assert.Equal(t, 1, info.Regions[0].Step)
+
+	assert.NoError(t, act.Rollback(context.Background(), info))
+	assert.Equal(t, []string{"launch i-us-east-1", "terminate i-us-east-1"}, log.sorted())
+}
+
+func TestMultiRegionActionResumesUnfinishedRegions(t *testing.T) {
+	log := &regionLog{}
+	act := &MultiRegionAction{
+		Regions: []RegionPipeline{
+			regionPipeline("us-east-1", regionLaunchAction{log: log}),
+			regionPipeline("eu-west-1", regionLaunchAction{log: log}, regionLaunchAction{log: log}),
+		},
+	}
+	info := &PipelineInfo{Version: "1"}
+	act.initRegions(info)
+	info.Regions[0].Completed = true
+	info.Regions[1].Step = 0
+
+	assert.NoError(t, act.Commit(context.Background(), info))
+	assert.Equal(t, []string{"launch i-eu-west-1"}, log.sorted())
+	assert.True(t, info.Regions[1].Completed)
+}
+
+func TestMultiRegionActionReportsRegionLeftovers(t *testing.T) {
+	fake := newFakeAWS()
+	fake.failures["DeregisterImage"] = errors.New("UnauthorizedOperation: not allowed")
+
+	act := &MultiRegionAction{
+		Regions: []RegionPipeline{
+			regionPipeline("eu-west-1", CopyImageAction{Svc: fake.clients().EC2, Source: newFakeAWS().clients().EC2, SourceRegion: "us-east-1", SourceAMI: "ami-new"}, regionFailAction{}),
+		},
+	}
+	info := &PipelineInfo{Version: "1"}
+
+	assert.Error(t, act.Commit(context.Background(), info))
+
+	err := act.Rollback(context.Background(), info)
+	failures, ok := err.(*RollbackError)
+	if assert.True(t, ok) {
+		assert.Equal(t, "main.CopyImageAction in eu-west-1", failures.Steps[0].Action)
+		assert.Equal(t, []string{
+			"eu-west-1: AMI ami-copy-1 copied by the deployment",
+			"eu-west-1: EBS snapshot snap-copy-1 of the AMI copied by the deployment",
+		}, failures.Leftovers)
+	}
+}
+
+func TestMultiRegionActionKeepsImageSharedWithCompletedRegion(t *testing.T) {
+	owner := newFakeAWS()
+	owner.account = ownerAccount
+	owner.addImage("ami-new", ownerAccount, "snap-new", "")
+	target := newFakeAWS()
+
+	share := ShareImageAction{Svc: owner.clients().EC2, KMS: owner.clients().KMS, STS: target.clients().STS, AMI: "ami-new"}
+	act := &MultiRegionAction{
+		Regions: []RegionPipeline{
+			regionPipeline("web", share),
+			regionPipeline("api", share, regionFailAction{}),
+		},
+	}
+	info := &PipelineInfo{Version: "1"}
+	act.initRegions(info)
+
+	// The failed region granted the permissions, the completed one launched from the shared AMI
+	assert.NoError(t, share.Commit(context.Background(), &info.Regions[1].Info))
+	info.Regions[1].Step = 1
+	info.Regions[0].Completed = true
+	info.Regions[0].Step = 0
+	info.Regions[0].Info.Input.NewAMI = "ami-new"
+	info.Regions[0].Info.SharedImage = &SharedImageState{ImageID: "ami-new", Account: fakeAccount}
+
+	assert.NoError(t, act.Rollback(context.Background(), info))
+	assert.True(t, owner.permissions["ami-new"][fakeAccount])
+	assert.True(t, owner.permissions["snap-new"][fakeAccount])
+	assert.True(t, info.Regions[0].Info.SharedImage.LaunchPermission)
+	assert.Nil(t, info.Regions[1].Info.SharedImage)
+
+	// Completed region using its own copy does not need the permissions
+	info.Regions[0].Info.Input.NewAMI = "ami-copy-1"
+	owner.modifyPermissions("ami-new", nil, []string{fakeAccount})
+	owner.modifyPermissions("snap-new", nil, []string{fakeAccount})
+	assert.NoError(t, share.Commit(context.Background(), &info.Regions[1].Info))
+	info.Regions[1].Step = 1
+
+	assert.NoError(t, act.Rollback(context.Background(), info))
+	assert.False(t, owner.permissions["ami-new"][fakeAccount])
+}
+
+func TestCopyImageAction(t *testing.T) {
+	fake := newFakeAWS()
+	source := newFakeAWS()
+	source.addImage("ami-new", fakeAccount, "snap-new", "")
+	source.images["ami-new"].Tags = []*ec2.Tag{
+		{Key: aws.String("BuildStatus"), Value: aws.String("passed")},
+		{Key: aws.String("aws:cloudformation:stack-name"), Value: aws.String("build")},
+	}
+
+	act := CopyImageAction{Svc: fake.clients().EC2, Source: source.clients().EC2, SourceRegion: "us-east-1", SourceAMI: "ami-new"}
+	info := &PipelineInfo{Version: "1", Input: InputArgs{"ami-old", "ami-new"}}
+
+	assert.NoError(t, act.Commit(context.Background(), info))
+	assert.Equal(t, "ami-copy-1", info.Input.NewAMI)
+	assert.Equal(t, "ami-copy-1", info.CopiedImageID)
+
+	// Reserved tags are not copied
+	assert.Equal(t, []*ec2.Tag{{Key: aws.String("BuildStatus"), Value: aws.String("passed")}}, fake.images["ami-copy-1"].Tags)
+
+	// Resumed step waits for the same copy
+	assert.NoError(t, act.Commit(context.Background(), info))
+	assert.Equal(t, 1, fake.count("CopyImage"))
+
+	// Retried rollback records the snapshots of the copy only once
+	for attempt := 0; attempt < 2; attempt++ {
+		fake.failures["DeregisterImage"] = errors.New("InternalError: try again")
+		assert.Error(t, act.Rollback(context.Background(), info))
+	}
+	assert.Equal(t, []string{"snap-copy-1"}, aws.StringValueSlice(info.CopiedSnapshotIds))
+
+	fake.failures["DeleteSnapshot"] = errors.New("InternalError: try again")
+	assert.Error(t, act.Rollback(context.Background(), info))
+	assert.Empty(t, fake.images)
+	assert.Equal(t, "ami-new", info.Input.NewAMI)
+	assert.Equal(t, []string{"EBS snapshot snap-copy-1 of the AMI copied by the deployment"}, act.Leftovers(info))
+
+	assert.NoError(t, act.Rollback(context.Background(), info))
+	assert.Empty(t, fake.snapshots)
+	assert.Empty(t, act.Leftovers(info))
+
+	// Snapshot already deleted by an interrupted rollback
+	info.CopiedSnapshotIds = aws.StringSlice([]string{"snap-copy-1"})
+	assert.NoError(t, act.Rollback(context.Background(), info))
+	assert.Empty(t, info.CopiedSnapshotIds)
+}
+
+func TestNewPipelineDeploysEveryRegion(t *testing.T) {
+	config := DefaultConfig()
+	config.Selector.Tags = map[string]string{"App": "web"}
+	config.NewAMI = "ami-new"
+	config.MultiRegion = MultiRegionConfig{
+		Mode:    RegionModeParallel,
+		CopyAMI: true,
+		Regions: []RegionConfig{
+			{Region: "us-east-1"},
+			{Region: "eu-west-1"},
+			{Region: "ap-south-1", NewAMI: "ami-south"},
+		},
+	}
+	assert.NoError(t, config.Validate())
+
+	regions := []string{}
+	actions := newPipeline(config, func(config Config) awsClients {
+		regions = append(regions, config.Region)
+		return newFakeAWS().clients()
+	})
+
+	// The region with the copy describes the source AMI in us-east-1
+	assert.Equal(t, []string{"us-east-1", "eu-west-1", "us-east-1", "ap-south-1"}, regions)
+	if assert.Len(t, actions, 1) {
+		multiRegion := actions[0].(*MultiRegionAction)
+		assert.True(t, multiRegion.Parallel)
+
+		// Only the region without its own AMI gets the copy
+		assert.IsType(t, ListInstancesAction{}, multiRegion.Regions[0].Actions[1])
+		copyAction := multiRegion.Regions[1].Actions[1].(CopyImageAction)
+		assert.Equal(t, CopyImageAction{copyAction.Svc, copyAction.Source, "us-east-1", "ami-new", 30 * time.Minute}, copyAction)
+		assert.IsType(t, ListInstancesAction{}, multiRegion.Regions[2].Actions[1])
+
+		assert.Equal(t, "ami-new", multiRegion.Regions[1].Config.NewAMI)
+		assert.Equal(t, "ami-south", multiRegion.Regions[2].Config.NewAMI)
+		assert.Equal(t, "ap-south-1", multiRegion.Regions[2].Config.Region)
+	}
+}
+
+func TestNewPipelineDeploysAccountsInTheSameRegion(t *testing.T) {
+	staging := CredentialsConfig{RoleARN: "arn:aws:iam::111111111111:role/deploy"}
+	production := CredentialsConfig{RoleARN: "arn:aws:iam::222222222222:role/deploy", ExternalID: "deploy-hat"}
+
+	config := DefaultConfig()
+	config.Selector.AMI = "ami-old"
+	config.NewAMI = "ami-new"
+	config.Credentials = staging
+	config.MultiRegion.Regions = []RegionConfig{
+		{Name: "staging", Region: "us-east-1"},
+		{Name: "production", Region: "us-east-1", Credentials: production},
+	}
+	assert.NoError(t, config.Validate())
+
+	credentials := []CredentialsConfig{}
+	actions := newPipeline(config, func(config Config) awsClients {
+		credentials = append(credentials, config.Credentials)
+		return newFakeAWS().clients()
+	})
+
+	assert.Equal(t, []CredentialsConfig{staging, production}, credentials)
+
+	info := &PipelineInfo{Version: "1"}
+	actions[0].(*MultiRegionAction).initRegions(info)
+	assert.Equal(t, "production", info.Regions[1].Region)
+	assert.Equal(t, "production", info.Regions[1].Info.Region)
+	assert.Equal(t, "us-east-1", info.Regions[1].Info.Config.Region)
+
+	config.MultiRegion.Regions[0].Name = ""
+	config.MultiRegion.Regions[1].Name = ""
+	assert.Error(t, config.Validate())
+}
+
+func TestParseRegions(t *testing.T) {
+	regions, err := parseRegions("us-east-1, eu-west-1=ami-123")
+
+	assert.NoError(t, err)
+	assert.Equal(t, []RegionConfig{{Region: "us-east-1"}, {Region: "eu-west-1", NewAMI: "ami-123"}}, regions)
+
+	_, err = parseRegions("eu-west-1=")
+	assert.Error(t, err)
+}
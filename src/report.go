@@ -0,0 +1,144 @@
+package main
+
+import (
+    "github.com/aws/aws-sdk-go/aws"
+
+    "encoding/json"
+    "fmt"
+    "io/ioutil"
+    "time"
+)
+
+// Phases of the step in the report
+const (
+    PhaseCommit = "commit"
+    PhaseRollback = "rollback"
+)
+
+// StepRecord is the outcome of a single executed or rolled back step
+type StepRecord struct {
+    Step int `json:"step"`
+    Action string `json:"action"`
+    // Batch is the number of the rolling deployment batch. It is omitted for steps of the whole deployment.
+    Batch int `json:"batch,omitempty"`
+    // Region is the region of the multi-region deployment. It is omitted for single-region deployments.
+    Region string `json:"region,omitempty"`
+    Phase string `json:"phase"`
+    Status string `json:"status"`
+    StartedAt time.Time `json:"started_at"`
+    DurationMs int64 `json:"duration_ms"`
+    Error string `json:"error,omitempty"`
+}
+
+// recordStep receives the outcome of every step. The deployment keeps them in the state file for the report.
+var recordStep = func(record StepRecord) {}
+
+// newStepRecord measures the step started at the given time
+func newStepRecord(step int, action InfrastructureAction, info *PipelineInfo, phase string, started time.Time, err error) StepRecord {
+    record := StepRecord{
+        Step: step,
+        Action: actionName(action),
+        Batch: info.Batch,
+        Region: info.Region,
+        Phase: phase,
+        Status: "succeeded",
+        StartedAt: started.UTC(),
+        DurationMs: time.Since(started).Nanoseconds() / int64(time.Millisecond),
+    }
+
+    if err != nil {
+        record.Status = "failed"
+        record.Error = err.Error()
+    }
+
+    return record
+}
+
+// DeploymentReport summarizes the deployment for CI and audit tools
+type DeploymentReport struct {
+    Version string `json:"version"`
+    Status string `json:"status"`
+    Error string `json:"error,omitempty"`
+    Strategy string `json:"strategy"`
+    OldAMI string `json:"old_ami"`
+    NewAMI string `json:"new_ami"`
+    StartedAt time.Time `json:"started_at"`
+    FinishedAt time.Time `json:"finished_at"`
+    DurationMs int64 `json:"duration_ms"`
+    OldInstances []string `json:"old_instances"`
+    NewInstances []string `json:"new_instances"`
+    TargetGroups []string `json:"target_groups"`
+    Steps []StepRecord `json:"steps"`
+    Leftovers []string `json:"leftovers,omitempty"`
+}
+
+func reportFilePath(version string) string {
+    return fmt.Sprintf("deploy_%s.report.json", version)
+}
+
+// newReport builds the report from the state of the deployment
+func newReport(state *PipelineState, finished time.Time) DeploymentReport {
+    info := state.Info
+    report := DeploymentReport{
+        Version: info.Version,
+        Status: state.Status,
+        Error: state.Error,
+        Strategy: info.Config.Strategy.Type,
+        OldAMI: info.Input.OldAMI,
+        NewAMI: info.Input.NewAMI,
+        StartedAt: state.StartedAt,
+        FinishedAt: finished.UTC(),
+        OldInstances: stringValues(info.OldInstancesIds),
+        NewInstances: stringValues(info.NewInstancesIds),
+        TargetGroups: stringValues(info.TargetGroupsArns),
+        Steps: state.Steps,
+        Leftovers: state.Leftovers,
+    }
+
+    if !state.StartedAt.IsZero() {
+        report.DurationMs = finished.Sub(state.StartedAt).Nanoseconds() / int64(time.Millisecond)
+    }
+
+    for _, group := range info.GreenTargetGroups {
+        report.TargetGroups = append(report.TargetGroups, group.GreenArn)
+    }
+
+    // Resources of the multi-region deployment are listed together, step records tell the regions apart
+    for _, region := range info.Regions {
+        regional := newReport(&PipelineState{Info: region.Info}, finished)
+        report.OldInstances = append(report.OldInstances, regional.OldInstances...)
+        report.NewInstances = append(report.NewInstances, regional.NewInstances...)
+        report.TargetGroups = append(report.TargetGroups, regional.TargetGroups...)
+    }
+
+    if report.Steps == nil {
+        report.Steps = []StepRecord{}
+    }
+
+    return report
+}
+
+// writeReport saves the report of the deployment to the path from the config or next to the state file
+func writeReport(state *PipelineState) {
+    path := state.Info.Config.Logging.Report
+    if path == "" {
+        path = reportFilePath(state.Info.Version)
+    }
+
+    data, err := json.MarshalIndent(newReport(state, time.Now()), "", "  ")
+    if err == nil {
+        err = ioutil.WriteFile(path, data, 0644)
+    }
+
+    if err != nil {
+        logger.Error("Cannot save report file", Fields{"path": path, "error": err.Error()})
+        return
+    }
+
+    logger.Info("Report file saved", Fields{"path": path})
+}
+
+// stringValues returns the values as the list, which is empty rather than null in JSON
+func stringValues(values []*string) []string {
+    return append([]string{}, aws.StringValueSlice(values)...)
+}
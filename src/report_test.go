@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPipelineRecordsSteps(t *testing.T) {
+	records := []StepRecord{}
+	recordStep = func(record StepRecord) { records = append(records, record) }
+	defer func() { recordStep = func(StepRecord) {} }()
+
+	log := []string{}
+	info := &PipelineInfo{OldInstances: instancesDesc("i-1", "i-2")}
+	actions := []InfrastructureAction{
+		&RollingDeploymentAction{BatchSize: 1, Actions: []InfrastructureAction{launchingAction{&log}, failingAction{"i-2"}}},
+	}
+
+	step, err := runActions(context.Background(), 0, info, actions, func(int) {})
+	assert.Error(t, err)
+	assert.NoError(t, rollbackActions(context.Background(), step, info, actions, func(int) {}))
+
+	summary := []string{}
+	for _, record := range records {
+		summary = append(summary, record.Action+" "+record.Phase+" "+record.Status)
+	}
+
+	assert.Equal(t, []string{
+		"main.launchingAction commit succeeded",
+		"main.failingAction commit succeeded",
+		"main.launchingAction commit succeeded",
+		"main.failingAction commit failed",
+		"main.failingAction rollback succeeded",
+		"main.launchingAction rollback succeeded",
+		"*main.RollingDeploymentAction commit failed",
+		"*main.RollingDeploymentAction rollback succeeded",
+	}, summary)
+	assert.Equal(t, 2, records[3].Batch)
+	assert.Equal(t, "Application is down", records[3].Error)
+	assert.Equal(t, 0, records[6].Batch)
+}
+
+func TestWriteReport(t *testing.T) {
+	started := time.Date(2019, 1, 1, 12, 0, 0, 0, time.UTC)
+	config := DefaultConfig()
+	config.Logging.Report = filepath.Join(filepath.Dir(writeConfig(t, "deploy.yaml", "")), "report.json")
+
+	state := &PipelineState{
+		Status:    StatusRolledBack,
+		StartedAt: started,
+		Error:     "Application is down",
+		Info: PipelineInfo{
+			Version:          "20190101_120000",
+			Input:            InputArgs{"ami-old", "ami-new"},
+			Config:           config,
+			OldInstancesIds:  aws.StringSlice([]string{"i-old-1"}),
+			NewInstancesIds:  aws.StringSlice([]string{"i-new-1"}),
+			TargetGroupsArns: aws.StringSlice([]string{"arn:tg-web"}),
+		},
+		Steps: []StepRecord{{Step: 0, Action: "main.InitializePipelineAction", Phase: PhaseCommit, Status: "succeeded", StartedAt: started}},
+	}
+
+	writeReport(state)
+
+	content, err := ioutil.ReadFile(config.Logging.Report)
+	if err != nil {
+		t.Fatalf("Report file was not written: %s", err.Error())
+	}
+
+	report := DeploymentReport{}
+	if err := json.Unmarshal(content, &report); err != nil {
+		t.Fatalf("Invalid report: %s", err.Error())
+	}
+
+	assert.Equal(t, "20190101_120000", report.Version)
+	assert.Equal(t, StatusRolledBack, report.Status)
+	assert.Equal(t, "Application is down", report.Error)
+	assert.Equal(t, []string{"i-old-1"}, report.OldInstances)
+	assert.Equal(t, []string{"i-new-1"}, report.NewInstances)
+	assert.Equal(t, []string{"arn:tg-web"}, report.TargetGroups)
+	assert.Len(t, report.Steps, 1)
+	assert.True(t, report.DurationMs > 0)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+    "github.com/aws/aws-sdk-go/aws/awserr"
+    "github.com/aws/aws-sdk-go/aws/request"
+
+    "context"
+    "fmt"
+    "strings"
+    "time"
+)
+
+// rollbackAttempts is the number of attempts to roll back the step failing with transient AWS errors
+const rollbackAttempts = 3
+
+// rollbackRetryDelay is the delay after the first failed attempt. It grows with every next attempt.
+const rollbackRetryDelay = 5 * time.Second
+
+// LeftoverReporter is implemented by steps which create or modify AWS resources.
+// It describes resources which still need the manual cleanup, when the rollback of the step fails.
+type LeftoverReporter interface {
+    Leftovers(info *PipelineInfo) []string
+}
+
+// StepError is the failed rollback of a single step
+type StepError struct {
+    Step int
+    Action string
+    Err error
+}
+
+// RollbackError collects failed rollbacks of all steps and resources they left behind
+type RollbackError struct {
+    Steps []StepError
+    Leftovers []string
+}
+
+func (e *RollbackError) Error() string {
+    failures := []string{}
+    for _, step := range e.Steps {
+        failures = append(failures, fmt.Sprintf("%s: %s", step.Action, step.Err.Error()))
+    }
+
+    return fmt.Sprintf("Rollback incomplete. %d steps failed. %s", len(e.Steps), strings.Join(failures, "; "))
+}
+
+// add records the failed rollback of the step with resources it left behind
+func (e *RollbackError) add(step int, action InfrastructureAction, info *PipelineInfo, err error) {
+    e.Steps = append(e.Steps, StepError{step, fmt.Sprintf("%T", action), err})
+
+    // Nested steps, e.g. batches of the rolling deployment, report their own leftovers
+    if nested, ok := err.(*RollbackError); ok {
+        e.Leftovers = append(e.Leftovers, nested.Leftovers...)
+        return
+    }
+
+    if reporter, ok := action.(LeftoverReporter); ok {
+        e.Leftovers = append(e.Leftovers, reporter.Leftovers(info)...)
+    }
+}
+
+// isTransientError checks whether the AWS call may succeed when it is repeated.
+// Throttling, server errors and failed connections are transient.
+func isTransientError(err error) bool {
+    if request.IsErrorThrottle(err) {
+        return true
+    }
+
+    if reqErr, ok := err.(awserr.RequestFailure); ok {
+        return reqErr.StatusCode() >= 500
+    }
+
+    if awsErr, ok := err.(awserr.Error); ok {
+        return awsErr.Code() == request.ErrCodeRequestError || awsErr.Code() == request.ErrCodeResponseTimeout
+    }
+
+    return false
+}
+
+// rollbackStep rolls back the single step. Transient AWS errors are retried.
+func rollbackStep(ctx context.Context, action InfrastructureAction, info *PipelineInfo) error {
+    var err error
+
+    for attempt := 1; attempt <= rollbackAttempts; attempt++ {
+        err = action.Rollback(ctx, info)
+        if err == nil || !isTransientError(err) || attempt == rollbackAttempts {
+            return err
+        }
+
+        delay := rollbackRetryDelay * time.Duration(attempt)
+        logger.Warning("Rollback failed. "+err.Error(), Fields{"action": actionName(action), "attempt": attempt, "retry_in": delay.String()})
+
+        if sleepErr := sleep(ctx, delay); sleepErr != nil {
+            return err
+        }
+    }
+
+    return err
+}
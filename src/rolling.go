@@ -0,0 +1,190 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "fmt"
+)
+
+// BatchInfo keeps progress of the batch which is currently replaced
+type BatchInfo struct {
+    Index int
+    Step int
+    Info PipelineInfo
+    // Leftovers are resources left behind by the failed rollback of the batch
+    Leftovers []string
+}
+
+// RollingDeploymentAction is a pipeline step struct. It replaces old instances in batches,
+// executing all the Actions for each batch. Failed batch is rolled back, completed batches stay in place.
+// When CanaryActions are set, the first batch contains a single instance replaced with the CanaryActions.
+type RollingDeploymentAction struct {
+    BatchSize int
+    BatchPercent int
+    Actions []InfrastructureAction
+    CanaryActions []InfrastructureAction
+    Checkpoint func()
+}
+
+func batchSize(instancesCount int, size int, percent int) int {
+    if percent > 0 {
+        size = (instancesCount*percent + 99) / 100
+    }
+
+    if size == 0 && percent == 0 {
+        size = instancesCount
+    }
+
+    if size < 1 {
+        size = 1
+    }
+
+    return size
+}
+
+func splitBatches(instances []ShortInstanceDesc, size int) [][]ShortInstanceDesc {
+    batches := [][]ShortInstanceDesc{}
+
+    for len(instances) > size {
+        batches = append(batches, instances[:size])
+        instances = instances[size:]
+    }
+
+    return append(batches, instances)
+}
+
+func newBatchInfo(pipelineInfo *PipelineInfo, index int, instances []ShortInstanceDesc) *BatchInfo {
+    batch := &BatchInfo{
+        Index: index,
+        Step: -1,
+        Info: PipelineInfo{
+            Version: pipelineInfo.Version,
+            Input: pipelineInfo.Input,
+            Config: pipelineInfo.Config,
+            ClientIP: pipelineInfo.ClientIP,
+            OldInstances: instances,
+            TargetGroupsArns: pipelineInfo.TargetGroupsArns,
+            Batch: index + 1,
+        },
+    }
+
+    for _, instance := range instances {
+        instanceID := instance.ID
+        batch.Info.OldInstancesIds = append(batch.Info.OldInstancesIds, &instanceID)
+    }
+
+    return batch
+}
+
+func (act *RollingDeploymentAction) batches(instances []ShortInstanceDesc) [][]ShortInstanceDesc {
+    if len(act.CanaryActions) > 0 && len(instances) > 1 {
+        size := batchSize(len(instances)-1, act.BatchSize, act.BatchPercent)
+        return append([][]ShortInstanceDesc{instances[:1]}, splitBatches(instances[1:], size)...)
+    }
+
+    return splitBatches(instances, batchSize(len(instances), act.BatchSize, act.BatchPercent))
+}
+
+func (act *RollingDeploymentAction) batchActions(index int) []InfrastructureAction {
+    if index == 0 && len(act.CanaryActions) > 0 {
+        return act.CanaryActions
+    }
+
+    return act.Actions
+}
+
+func (act *RollingDeploymentAction) checkpoint(pipelineInfo *PipelineInfo) func(step int) {
+    return func(step int) {
+        pipelineInfo.CurrentBatch.Step = step
+
+        if act.Checkpoint != nil {
+            act.Checkpoint()
+        }
+    }
+}
+
+// Commit is an action to apply changes in the RollingDeploymentAction step
+func (act *RollingDeploymentAction) Commit(ctx context.Context, pipelineInfo *PipelineInfo) error {
+    batches := act.batches(pipelineInfo.OldInstances)
+
+    for idx := pipelineInfo.CompletedBatches; idx < len(batches); idx++ {
+        // The batch interrupted in the previous run is continued from its last step
+        if pipelineInfo.CurrentBatch == nil || pipelineInfo.CurrentBatch.Index != idx {
+            pipelineInfo.CurrentBatch = newBatchInfo(pipelineInfo, idx, batches[idx])
+        }
+
+        batch := pipelineInfo.CurrentBatch
+        actions := act.batchActions(idx)
+        logger.Info("Replacing batch", Fields{
+            "action": actionName(act),
+            "batch": idx + 1,
+            "batches": len(batches),
+            "instance_ids": batch.Info.OldInstancesIds,
+        })
+
+        step, err := runActions(ctx, batch.Step+1, &batch.Info, actions, act.checkpoint(pipelineInfo))
+
+        // The interrupted batch is left for the rollback of this step, which runs with its own context
+        if err != nil && ctx.Err() != nil {
+            return fmt.Errorf("Batch %d of %d interrupted: %s", idx+1, len(batches), err.Error())
+        }
+
+        if err != nil {
+            rollbackErr := rollbackActions(ctx, step, &batch.Info, actions, act.checkpoint(pipelineInfo))
+
+            // Leftovers of the batch are reported by the rollback of this step. The batch whose rollback
+            // was interrupted is kept too, so the rollback of this step continues from its checkpointed step.
+            if failures, ok := rollbackErr.(*RollbackError); ok {
+                batch.Leftovers = failures.Leftovers
+            } else if rollbackErr == nil {
+                pipelineInfo.CurrentBatch = nil
+            }
+
+            return fmt.Errorf("Batch %d of %d failed: %s", idx+1, len(batches), err.Error())
+        }
+
+        pipelineInfo.NewInstancesIds = append(pipelineInfo.NewInstancesIds, batch.Info.NewInstancesIds...)
+        pipelineInfo.NewInstancesIps = append(pipelineInfo.NewInstancesIps, batch.Info.NewInstancesIps...)
+        pipelineInfo.ModifiedSecurityGroups = append(pipelineInfo.ModifiedSecurityGroups, batch.Info.ModifiedSecurityGroups...)
+        pipelineInfo.CompletedBatches = idx + 1
+        pipelineInfo.CurrentBatch = nil
+
+        if act.Checkpoint != nil {
+            act.Checkpoint()
+        }
+    }
+
+    return nil
+}
+
+// Rollback is an action to apply changes in the RollingDeploymentAction step.
+// Only the batch interrupted in the middle is rolled back.
+func (act *RollingDeploymentAction) Rollback(ctx context.Context, pipelineInfo *PipelineInfo) error {
+    batch := pipelineInfo.CurrentBatch
+
+    if batch == nil {
+        return nil
+    }
+
+    err := rollbackActions(ctx, batch.Step, &batch.Info, act.batchActions(batch.Index), act.checkpoint(pipelineInfo))
+    failures, failed := err.(*RollbackError)
+    if err != nil && !failed {
+        return err
+    }
+
+    pipelineInfo.CurrentBatch = nil
+
+    if failed {
+        failures.Leftovers = append(batch.Leftovers, failures.Leftovers...)
+        return failures
+    }
+
+    if len(batch.Leftovers) > 0 {
+        return &RollbackError{
+            Steps: []StepError{{batch.Index, fmt.Sprintf("batch %d", batch.Index+1), errors.New("Batch was rolled back incompletely")}},
+            Leftovers: batch.Leftovers,
+        }
+    }
+
+    return nil
+}
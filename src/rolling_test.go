@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/stretchr/testify/assert"
+)
+
+// launchingAction pretends to launch a replacement for every old instance
+type launchingAction struct {
+	log *[]string
+}
+
+func (act launchingAction) Commit(ctx context.Context, info *PipelineInfo) error {
+	for _, instance := range info.OldInstances {
+		info.NewInstancesIds = append(info.NewInstancesIds, aws.String("new-"+instance.ID))
+		*act.log = append(*act.log, "launch "+instance.ID)
+	}
+
+	return nil
+}
+
+func (act launchingAction) Rollback(ctx context.Context, info *PipelineInfo) error {
+	for _, instanceID := range info.NewInstancesIds {
+		*act.log = append(*act.log, "terminate "+*instanceID)
+	}
+
+	return nil
+}
+
+// failingAction fails for the batch containing the given instance
+type failingAction struct {
+	failOn string
+}
+
+func (act failingAction) Commit(ctx context.Context, info *PipelineInfo) error {
+	for _, instance := range info.OldInstances {
+		if instance.ID == act.failOn {
+			return errors.New("Application is down")
+		}
+	}
+
+	return nil
+}
+
+func (act failingAction) Rollback(ctx context.Context, info *PipelineInfo) error {
+	return nil
+}
+
+func instancesDesc(ids ...string) []ShortInstanceDesc {
+	instances := []ShortInstanceDesc{}
+
+	for _, id := range ids {
+		instances = append(instances, ShortInstanceDesc{ID: id})
+	}
+
+	return instances
+}
+
+func TestBatchSize(t *testing.T) {
+	assert.Equal(t, 2, batchSize(5, 2, 0))
+	assert.Equal(t, 2, batchSize(5, 0, 25))
+	assert.Equal(t, 1, batchSize(3, 0, 10))
+	assert.Equal(t, 5, batchSize(5, 0, 100))
+}
+
+func TestSplitBatches(t *testing.T) {
+	batches := splitBatches(instancesDesc("i-1", "i-2", "i-3", "i-4", "i-5"), 2)
+
+	assert.Equal(t, 3, len(batches))
+	assert.Equal(t, instancesDesc("i-1", "i-2"), batches[0])
+	assert.Equal(t, instancesDesc("i-5"), batches[2])
+}
+
+func TestRollingDeploymentAction(t *testing.T) {
+	log := []string{}
+	info := &PipelineInfo{OldInstances: instancesDesc("i-1", "i-2", "i-3")}
+	checkpoints := 0
+
+	action := &RollingDeploymentAction{
+		BatchSize:  2,
+		Actions:    []InfrastructureAction{launchingAction{&log}, failingAction{}},
+		Checkpoint: func() { checkpoints++ },
+	}
+
+	if err := action.Commit(context.Background(), info); err != nil {
+		t.Fatalf("Unexpected error from RollingDeploymentAction.Commit(): %s", err.Error())
+	}
+
+	assert.Equal(t, []string{"launch i-1", "launch i-2", "launch i-3"}, log)
+	assert.Equal(t, []*string{aws.String("new-i-1"), aws.String("new-i-2"), aws.String("new-i-3")}, info.NewInstancesIds)
+	assert.Equal(t, 2, info.CompletedBatches)
+	assert.Nil(t, info.CurrentBatch)
+	assert.True(t, checkpoints > 0)
+}
+
+func TestRollingDeploymentActionRollsBackFailedBatchOnly(t *testing.T) {
+	log := []string{}
+	info := &PipelineInfo{OldInstances: instancesDesc("i-1", "i-2", "i-3")}
+
+	action := &RollingDeploymentAction{
+		BatchSize: 1,
+		Actions:   []InfrastructureAction{launchingAction{&log}, failingAction{"i-2"}},
+	}
+
+	if err := action.Commit(context.Background(), info); err == nil {
+		t.Fatal("Expected error from RollingDeploymentAction.Commit()")
+	}
+
+	assert.Equal(t, []string{"launch i-1", "launch i-2", "terminate new-i-2"}, log)
+	assert.Equal(t, []*string{aws.String("new-i-1")}, info.NewInstancesIds)
+	assert.Equal(t, 1, info.CompletedBatches)
+	assert.Nil(t, action.Rollback(context.Background(), info))
+	assert.Equal(t, 3, len(log))
+}
+
+func TestRollingDeploymentActionResumesInterruptedBatch(t *testing.T) {
+	log := []string{}
+	info := &PipelineInfo{OldInstances: instancesDesc("i-1", "i-2")}
+	info.CompletedBatches = 1
+	info.CurrentBatch = newBatchInfo(info, 1, instancesDesc("i-2"))
+	info.CurrentBatch.Step = 0
+	info.CurrentBatch.Info.NewInstancesIds = []*string{aws.String("new-i-2")}
+
+	action := &RollingDeploymentAction{
+		BatchSize: 1,
+		Actions:   []InfrastructureAction{launchingAction{&log}, failingAction{}},
+	}
+
+	if err := action.Commit(context.Background(), info); err != nil {
+		t.Fatalf("Unexpected error from RollingDeploymentAction.Commit(): %s", err.Error())
+	}
+
+	assert.Equal(t, 0, len(log))
+	assert.Equal(t, []*string{aws.String("new-i-2")}, info.NewInstancesIds)
+	assert.Equal(t, 2, info.CompletedBatches)
+}
+
+func TestRollingDeploymentActionLeavesInterruptedBatchForRollback(t *testing.T) {
+	log := []string{}
+	info := &PipelineInfo{OldInstances: instancesDesc("i-1", "i-2")}
+	ctx, cancel := context.WithCancel(context.Background())
+
+	action := &RollingDeploymentAction{
+		BatchSize: 1,
+		Actions:   []InfrastructureAction{launchingAction{&log}, interruptingAction{cancel}, failingAction{}},
+	}
+
+	if err := action.Commit(ctx, info); err == nil {
+		t.Fatal("Expected error from RollingDeploymentAction.Commit() for interrupted deployment")
+	}
+
+	// The batch is not rolled back with the cancelled context
+	assert.Equal(t, []string{"launch i-1"}, log)
+	if assert.NotNil(t, info.CurrentBatch) {
+		assert.Equal(t, 1, info.CurrentBatch.Step)
+	}
+
+	assert.Nil(t, action.Rollback(context.Background(), info))
+	assert.Equal(t, []string{"launch i-1", "terminate new-i-1"}, log)
+	assert.Nil(t, info.CurrentBatch)
+}
+
+// rollbackInterruptingAction cancels the context when it is rolled back
+type rollbackInterruptingAction struct {
+	cancel context.CancelFunc
+}
+
+func (act rollbackInterruptingAction) Commit(ctx context.Context, info *PipelineInfo) error {
+	return nil
+}
+
+func (act rollbackInterruptingAction) Rollback(ctx context.Context, info *PipelineInfo) error {
+	act.cancel()
+	return nil
+}
+
+func TestRollingDeploymentActionContinuesInterruptedBatchRollback(t *testing.T) {
+	log := []string{}
+	info := &PipelineInfo{OldInstances: instancesDesc("i-1", "i-2")}
+	ctx, cancel := context.WithCancel(context.Background())
+
+	action := &RollingDeploymentAction{
+		BatchSize: 1,
+		Actions:   []InfrastructureAction{launchingAction{&log}, rollbackInterruptingAction{cancel}, failingAction{"i-1"}},
+	}
+
+	if err := action.Commit(ctx, info); err == nil {
+		t.Fatal("Expected error from RollingDeploymentAction.Commit()")
+	}
+
+	// The batch rollback stopped by the signal is kept with its progress
+	assert.Equal(t, []string{"launch i-1"}, log)
+	if assert.NotNil(t, info.CurrentBatch) {
+		assert.Equal(t, 1, info.CurrentBatch.Step)
+	}
+
+	assert.Nil(t, action.Rollback(context.Background(), info))
+	assert.Equal(t, []string{"launch i-1", "terminate new-i-1"}, log)
+	assert.Nil(t, info.CurrentBatch)
+}
+
+// brokenRollbackAction fails to roll back the batch containing the given instance
+type brokenRollbackAction struct {
+	failOn string
+}
+
+func (act brokenRollbackAction) Commit(ctx context.Context, info *PipelineInfo) error {
+	return nil
+}
+
+func (act brokenRollbackAction) Rollback(ctx context.Context, info *PipelineInfo) error {
+	for _, instance := range info.OldInstances {
+		if instance.ID == act.failOn {
+			return errors.New("Cannot terminate instances")
+		}
+	}
+
+	return nil
+}
+
+func (act brokenRollbackAction) Leftovers(info *PipelineInfo) []string {
+	return []string{"instances of batch " + info.OldInstances[0].ID}
+}
+
+func TestRollingDeploymentActionReportsBatchLeftovers(t *testing.T) {
+	log := []string{}
+	info := &PipelineInfo{OldInstances: instancesDesc("i-1", "i-2")}
+
+	action := &RollingDeploymentAction{
+		BatchSize: 1,
+		Actions:   []InfrastructureAction{brokenRollbackAction{"i-2"}, launchingAction{&log}, failingAction{"i-2"}},
+	}
+
+	if err := action.Commit(context.Background(), info); err == nil {
+		t.Fatal("Expected error from RollingDeploymentAction.Commit()")
+	}
+
+	// The batch rolled back incompletely is kept for the rollback of the step
+	if assert.NotNil(t, info.CurrentBatch) {
+		assert.Equal(t, []string{"instances of batch i-2"}, info.CurrentBatch.Leftovers)
+	}
+
+	err := action.Rollback(context.Background(), info)
+	if failures, ok := err.(*RollbackError); assert.True(t, ok) {
+		assert.Equal(t, []string{"instances of batch i-2"}, failures.Leftovers)
+	}
+	assert.Nil(t, info.CurrentBatch)
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+    "gopkg.in/yaml.v2"
+
+    "context"
+    "encoding/xml"
+    "errors"
+    "fmt"
+    "io/ioutil"
+    "strings"
+    "sync"
+    "time"
+)
+
+// SmokeSuite is the list of requests which every new instance has to answer as expected
+type SmokeSuite struct {
+    Tests []CheckConfig `yaml:"tests" json:"tests"`
+}
+
+// SmokeResult is the result of a single smoke test on a single instance
+type SmokeResult struct {
+    Test string
+    Host string
+    Duration time.Duration
+    Err error
+}
+
+type junitTestSuites struct {
+    XMLName xml.Name `xml:"testsuites"`
+    Name string `xml:"name,attr"`
+    Suites []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+    Name string `xml:"name,attr"`
+    Tests int `xml:"tests,attr"`
+    Failures int `xml:"failures,attr"`
+    Time string `xml:"time,attr"`
+    Cases []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+    Name string `xml:"name,attr"`
+    ClassName string `xml:"classname,attr"`
+    Time string `xml:"time,attr"`
+    Failure *junitFailure `xml:"failure,omitempty"`
+}
+
+type junitFailure struct {
+    Message string `xml:"message,attr"`
+    Text string `xml:",chardata"`
+}
+
+// loadSmokeSuite reads the YAML or JSON suite. Tests are HTTP requests unless their type says otherwise.
+func loadSmokeSuite(path string) (SmokeSuite, error) {
+    suite := SmokeSuite{}
+
+    content, err := ioutil.ReadFile(path)
+    if err != nil {
+        return suite, err
+    }
+
+    if err := yaml.UnmarshalStrict(content, &suite); err != nil {
+        return suite, fmt.Errorf("Invalid smoke test suite %s: %s", path, err.Error())
+    }
+
+    if len(suite.Tests) == 0 {
+        return suite, fmt.Errorf("Smoke test suite %s has no tests", path)
+    }
+
+    for i, test := range suite.Tests {
+        if test.Type == "" {
+            test.Type = CheckHTTP
+        }
+
+        if test.Name == "" {
+            test.Name = strings.TrimSpace(test.Method + " " + test.Path)
+        }
+
+        if test.Name == "" {
+            test.Name = fmt.Sprintf("test %d", i+1)
+        }
+
+        if err := test.validate(); err != nil {
+            return suite, err
+        }
+
+        suite.Tests[i] = test
+    }
+
+    return suite, nil
+}
+
+// run executes every test once on every host
+func (s SmokeSuite) run(ctx context.Context, hosts []string, hc HealthCheckConfig) []SmokeResult {
+    checks := HealthCheckConfig{Port: hc.Port, Scheme: hc.Scheme, Path: hc.Path, ExpectedCodes: hc.ExpectedCodes, Checks: s.Tests}.healthChecks()
+    results := []SmokeResult{}
+
+    for _, host := range hosts {
+        for _, check := range checks {
+            started := time.Now()
+            err := runHealthCheck(ctx, check, host)
+            results = append(results, SmokeResult{check.Name(), host, time.Since(started), err})
+        }
+    }
+
+    return results
+}
+
+// checkPorts checks the tests use only the ports of the health check. In public-ip mode security groups are
+// opened for these ports only, and tests of other ports would fail on every instance.
+func (s SmokeSuite) checkPorts(hc HealthCheckConfig) error {
+    opened := map[int64]bool{}
+    for _, port := range hc.ports() {
+        opened[port] = true
+    }
+
+    for _, test := range s.Tests {
+        if port := test.withDefaults(hc).Port; !opened[port] {
+            return fmt.Errorf("Smoke test %s uses port %d, which is not opened for the health check. Add a check of the port to health_check.checks or open it and use --authorize-sg=false", test.Name, port)
+        }
+    }
+
+    return nil
+}
+
+// smokeFailure returns the error describing failed tests or nil when all of them passed
+func smokeFailure(results []SmokeResult) error {
+    failed := []SmokeResult{}
+    for _, result := range results {
+        if result.Err != nil {
+            failed = append(failed, result)
+        }
+    }
+
+    if len(failed) == 0 {
+        return nil
+    }
+
+    first := failed[0]
+    return fmt.Errorf("%d of %d smoke tests failed. Smoke test %s failed on %s: %s", len(failed), len(results), first.Test, first.Host, first.Err.Error())
+}
+
+// junitReports serializes updates of the report, which regions running in parallel share
+var junitReports sync.Mutex
+
+// writeJUnitReport saves results as JUnit XML with a test suite per instance. Suites of other instances
+// from the report of the same deployment are kept, so every batch of the rolling deployment is reported.
+func writeJUnitReport(path string, version string, results []SmokeResult) error {
+    junitReports.Lock()
+    defer junitReports.Unlock()
+
+    report := junitTestSuites{Name: "deploy-hat " + version}
+
+    if content, err := ioutil.ReadFile(path); err == nil {
+        previous := junitTestSuites{}
+        if xml.Unmarshal(content, &previous) == nil && previous.Name == report.Name {
+            report.Suites = previous.Suites
+        }
+    }
+
+    suites := map[string]*junitTestSuite{}
+    totals := map[string]time.Duration{}
+    hosts := []string{}
+    for _, result := range results {
+        suite, ok := suites[result.Host]
+        if !ok {
+            suite = &junitTestSuite{Name: result.Host}
+            suites[result.Host] = suite
+            hosts = append(hosts, result.Host)
+        }
+
+        testCase := junitTestCase{Name: result.Test, ClassName: result.Host, Time: junitSeconds(result.Duration)}
+        if result.Err != nil {
+            testCase.Failure = &junitFailure{Message: result.Err.Error(), Text: result.Err.Error()}
+            suite.Failures++
+        }
+
+        totals[result.Host] += result.Duration
+        suite.Tests++
+        suite.Cases = append(suite.Cases, testCase)
+    }
+
+    kept := []junitTestSuite{}
+    for _, suite := range report.Suites {
+        if _, ok := suites[suite.Name]; !ok {
+            kept = append(kept, suite)
+        }
+    }
+
+    for _, host := range hosts {
+        suite := suites[host]
+        suite.Time = junitSeconds(totals[host])
+        kept = append(kept, *suite)
+    }
+
+    report.Suites = kept
+
+    content, err := xml.MarshalIndent(report, "", "  ")
+    if err != nil {
+        return err
+    }
+
+    if err := ioutil.WriteFile(path, append([]byte(xml.Header), content...), 0644); err != nil {
+        return errors.New("Cannot write JUnit report: " + err.Error())
+    }
+
+    return nil
+}
+
+func junitSeconds(duration time.Duration) string {
+    return fmt.Sprintf("%.3f", duration.Seconds())
+}
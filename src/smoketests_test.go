@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadSmokeSuite(t *testing.T) {
+	path := writeConfig(t, "smoke.yaml", `
+tests:
+  - path: /health
+  - name: create order
+    method: POST
+    path: /orders
+    request_headers:
+      Content-Type: application/json
+    body: '{"sku": "smoke"}'
+    expected_codes: [201]
+    json_path: id
+  - type: tcp
+    port: 6379
+`)
+
+	suite, err := loadSmokeSuite(path)
+	if err != nil {
+		t.Fatalf("Unexpected error from loadSmokeSuite(): %s", err.Error())
+	}
+
+	if assert.Len(t, suite.Tests, 3) {
+		assert.Equal(t, "/health", suite.Tests[0].Name)
+		assert.Equal(t, CheckHTTP, suite.Tests[0].Type)
+		assert.Equal(t, "create order", suite.Tests[1].Name)
+		assert.Equal(t, "test 3", suite.Tests[2].Name)
+	}
+
+	for _, content := range []string{
+		"tests: []",
+		"tests:\n  - path: /\n    unknown: true",
+		"tests:\n  - path: health",
+	} {
+		_, err := loadSmokeSuite(writeConfig(t, "smoke.yaml", content))
+		assert.Error(t, err, content)
+	}
+}
+
+func TestSmokeSuiteCheckPorts(t *testing.T) {
+	hc := DefaultConfig().HealthCheck
+	suite := SmokeSuite{Tests: []CheckConfig{{Name: "/", Type: CheckHTTP, Path: "/"}}}
+	assert.NoError(t, suite.checkPorts(hc))
+
+	// Port of the test has to be opened by one of the checks
+	suite.Tests = append(suite.Tests, CheckConfig{Name: "redis", Type: CheckTCP, Port: 6379})
+	assert.Error(t, suite.checkPorts(hc))
+
+	hc.Checks = []CheckConfig{{Type: CheckHTTP}, {Type: CheckTCP, Port: 6379}}
+	assert.NoError(t, suite.checkPorts(hc))
+}
+
+func TestSmokeSuiteRun(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.Method == http.MethodPost && r.Header.Get("Content-Type") == "application/json" && string(body) == `{"sku": "smoke"}` {
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{"id": 1}`))
+		}
+	}))
+	defer server.Close()
+
+	host, port := splitTestAddr(t, server.Listener.Addr().String())
+	hc := DefaultConfig().HealthCheck
+	hc.Port = port
+
+	suite := SmokeSuite{Tests: []CheckConfig{
+		{Name: "home", Type: CheckHTTP},
+		{Name: "create order", Type: CheckHTTP, Method: http.MethodPost, Path: "/orders", Body: `{"sku": "smoke"}`,
+			RequestHeaders: map[string]string{"Content-Type": "application/json"}, ExpectedCodes: []int{201}, JSONPath: "id"},
+		{Name: "list orders", Type: CheckHTTP, Path: "/orders", JSONPath: "orders"},
+	}}
+
+	results := suite.run(context.Background(), []string{host}, hc)
+	if assert.Len(t, results, 3) {
+		assert.NoError(t, results[0].Err)
+		assert.NoError(t, results[1].Err)
+		assert.Error(t, results[2].Err)
+	}
+
+	err := smokeFailure(results)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "1 of 3 smoke tests failed. Smoke test list orders failed on "+host)
+	}
+
+	assert.NoError(t, smokeFailure(results[:2]))
+}
+
+func TestWriteJUnitReport(t *testing.T) {
+	path := filepath.Join(filepath.Dir(writeConfig(t, "smoke.yaml", "")), "report.xml")
+
+	assert.NoError(t, writeJUnitReport(path, "1", []SmokeResult{{Test: "home", Host: "10.0.0.1"}}))
+	assert.NoError(t, writeJUnitReport(path, "1", []SmokeResult{
+		{Test: "home", Host: "10.0.0.2"},
+		{Test: "orders", Host: "10.0.0.2", Err: assert.AnError},
+	}))
+
+	report := junitTestSuites{}
+	content, _ := ioutil.ReadFile(path)
+	if err := xml.Unmarshal(content, &report); err != nil {
+		t.Fatalf("Invalid JUnit report: %s", err.Error())
+	}
+
+	// Suites of the previous batch are kept
+	if assert.Len(t, report.Suites, 2) {
+		assert.Equal(t, "10.0.0.1", report.Suites[0].Name)
+		assert.Equal(t, 2, report.Suites[1].Tests)
+		assert.Equal(t, 1, report.Suites[1].Failures)
+		assert.Equal(t, assert.AnError.Error(), report.Suites[1].Cases[1].Failure.Message)
+	}
+
+	// Report of the previous deployment is replaced
+	assert.NoError(t, writeJUnitReport(path, "2", []SmokeResult{{Test: "home", Host: "10.0.0.3"}}))
+	content, _ = ioutil.ReadFile(path)
+	report = junitTestSuites{}
+	xml.Unmarshal(content, &report)
+	assert.Len(t, report.Suites, 1)
+}
+
+func TestWriteJUnitReportOfParallelRegions(t *testing.T) {
+	path := filepath.Join(filepath.Dir(writeConfig(t, "smoke.yaml", "")), "report.xml")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			assert.NoError(t, writeJUnitReport(path, "1", []SmokeResult{{Test: "home", Host: fmt.Sprintf("10.0.%d.1", i)}}))
+		}(i)
+	}
+	wg.Wait()
+
+	report := junitTestSuites{}
+	content, _ := ioutil.ReadFile(path)
+	assert.NoError(t, xml.Unmarshal(content, &report))
+	assert.Len(t, report.Suites, 10)
+}
+
+func TestPipelineRollsBackFailedSmokeTests(t *testing.T) {
+	fake, config := newFakeDeployment()
+	dir := filepath.Dir(writeConfig(t, "smoke.yaml", ""))
+	config.SmokeTests = SmokeTestsConfig{
+		File:   writeConfig(t, "smoke.yaml", "tests:\n  - path: /\n  - name: version\n    path: /version\n    body_regex: '2\\.0'\n"),
+		Report: filepath.Join(dir, "report.xml"),
+	}
+
+	if _, err := runFakeDeployment(fake, config); err == nil {
+		t.Fatal("Expected error from deployment with failed smoke tests")
+	}
+
+	assert.Equal(t, []string{"i-old-1", "i-old-2"}, fake.targets("arn:tg-web"))
+	assert.Empty(t, fake.instancesByState("ami-new", ec2.InstanceStateNameRunning))
+
+	report := junitTestSuites{}
+	content, _ := ioutil.ReadFile(config.SmokeTests.Report)
+	if err := xml.Unmarshal(content, &report); err != nil {
+		t.Fatalf("Invalid JUnit report: %s", err.Error())
+	}
+
+	if assert.Len(t, report.Suites, 2) {
+		assert.Equal(t, 1, report.Suites[0].Failures)
+		assert.Equal(t, "version", report.Suites[0].Cases[1].Name)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "io/ioutil"
+    "os"
+    "time"
+)
+
+// StateFileVersion is a version of the state file format written by this binary
+const StateFileVersion = 3
+
+// Deployment statuses kept in the state file
+const (
+    StatusInProgress         = "in-progress"
+    // StatusRollingBack is set before the rollback starts. The deployment can only be rolled back further.
+    StatusRollingBack        = "rolling-back"
+    StatusCompleted          = "completed"
+    StatusRolledBack         = "rolled-back"
+    StatusRollbackIncomplete = "rollback-incomplete"
+)
+
+// PipelineState is a checkpoint of the deployment written after each step
+type PipelineState struct {
+    StateVersion int
+    Status string
+    Step int
+    Info PipelineInfo
+    // Leftovers are resources left behind by the failed rollback
+    Leftovers []string `json:",omitempty"`
+    StartedAt time.Time
+    // Error is the failure which made the deployment roll back
+    Error string `json:",omitempty"`
+    // Steps are outcomes of executed and rolled back steps kept for the report
+    Steps []StepRecord `json:",omitempty"`
+}
+
+// canContinue tells whether resume or rollback can continue the deployment with the status.
+// Deployment which started to roll back can only be rolled back further.
+func canContinue(command string, status string) bool {
+    return status == StatusInProgress || (command == "rollback" && status == StatusRollingBack)
+}
+
+func stateFilePath(version string) string {
+    return fmt.Sprintf("deploy_%s.state.json", version)
+}
+
+func saveState(path string, state *PipelineState) error {
+    state.StateVersion = StateFileVersion
+
+    data, err := json.MarshalIndent(state, "", "  ")
+    if err != nil {
+        return err
+    }
+
+    // Write to the temporary file first, so an interrupted write never leaves broken state behind
+    tmpPath := path + ".tmp"
+    if err := ioutil.WriteFile(tmpPath, data, 0600); err != nil {
+        return err
+    }
+
+    return os.Rename(tmpPath, path)
+}
+
+func loadState(path string) (*PipelineState, error) {
+    data, err := ioutil.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+
+    state := &PipelineState{}
+    if err := json.Unmarshal(data, state); err != nil {
+        return nil, fmt.Errorf("Invalid state file %s: %s", path, err.Error())
+    }
+
+    if state.StateVersion != StateFileVersion {
+        return nil, fmt.Errorf("Unsupported state file version %d. Expected %d", state.StateVersion, StateFileVersion)
+    }
+
+    return state, nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSaveAndLoadState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deploy-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, stateFilePath("20190101_120000"))
+	state := &PipelineState{
+		Status: StatusInProgress,
+		Step:   3,
+		Info: PipelineInfo{
+			Version:                "20190101_120000",
+			Input:                  InputArgs{OldAMI: "ami-123", NewAMI: "ami-456"},
+			OldInstancesIds:        []*string{aws.String("i-1")},
+			NewInstancesIds:        []*string{aws.String("i-2")},
+			ModifiedSecurityGroups: []SecurityGroupRule{{"sg-1", 80}},
+			TargetGroupsArns:       []*string{aws.String("arn:tg")},
+		},
+	}
+
+	if err := saveState(path, state); err != nil {
+		t.Fatalf("Unexpected error from saveState(): %s", err.Error())
+	}
+
+	loaded, err := loadState(path)
+	if err != nil {
+		t.Fatalf("Unexpected error from loadState(): %s", err.Error())
+	}
+
+	assert.Equal(t, StateFileVersion, loaded.StateVersion)
+	assert.Equal(t, state, loaded)
+}
+
+func TestLoadStateUnsupportedVersion(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deploy-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "state.json")
+	if err := ioutil.WriteFile(path, []byte(`{"StateVersion": 999}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := loadState(path); err == nil {
+		t.Error("Expected error from loadState() for unsupported version")
+	}
+}
+
+func TestCanContinue(t *testing.T) {
+	assert.True(t, canContinue("resume", StatusInProgress))
+	assert.True(t, canContinue("rollback", StatusInProgress))
+	assert.True(t, canContinue("rollback", StatusRollingBack))
+	assert.False(t, canContinue("resume", StatusRollingBack))
+	assert.False(t, canContinue("resume", StatusRolledBack))
+	assert.False(t, canContinue("rollback", StatusCompleted))
+}
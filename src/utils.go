@@ -1,17 +1,43 @@
 package main
 
 import (
+    "bytes"
+    "context"
     "io/ioutil"
     "net/http"
     "math/rand"
+    "os"
+    "os/exec"
     "time"
     "regexp"
     "errors"
     "strings"
+    "strconv"
     "fmt"
 )
 
+// httpTransport is used by the application health checks. It is replaced in the plan mode.
+var httpTransport http.RoundTripper = http.DefaultTransport
 
+// sleep is used between the checks. It is replaced in the plan mode and tests.
+var sleep = sleepContext
+
+// sleepContext sleeps for the duration, but returns the error of the context as soon as it is done
+func sleepContext(ctx context.Context, d time.Duration) error {
+    if err := ctx.Err(); err != nil {
+        return err
+    }
+
+    timer := time.NewTimer(d)
+    defer timer.Stop()
+
+    select {
+    case <-timer.C:
+        return nil
+    case <-ctx.Done():
+        return ctx.Err()
+    }
+}
 
 func getClientIP() (string, error) {
     var kindOfValidIP = regexp.MustCompile(`^([1-9][0-9]{0,2})(\.[0-9]{0,3}){3}$`)
@@ -27,8 +53,10 @@ func getClientIP() (string, error) {
     rand.Seed(time.Now().UnixNano())
     rand.Shuffle(len(apiUrls), func(i, j int) { apiUrls[i], apiUrls[j] = apiUrls[j], apiUrls[i] })
 
+    client := &http.Client{Transport: httpTransport}
+
     for _, url := range apiUrls {
-        resp, err := http.Get(url)
+        resp, err := client.Get(url)
         if err != nil {
             continue
         }
@@ -53,6 +81,7 @@ func getClientIP() (string, error) {
 
 func getHTTPResponseCode(url string) (int, error) {
     client := &http.Client{
+        Transport: httpTransport,
         CheckRedirect: func(req *http.Request, via []*http.Request) error {
             return http.ErrUseLastResponse
         },
@@ -88,9 +117,53 @@ func isValidRequest(url string, retries uint) (bool, error) {
         }
 
         if retries > 0 {
-            time.Sleep(15 * time.Second)
+            sleep(context.Background(), 15*time.Second)
         }
     }
 
     return false, fmt.Errorf("Response code %d. Expected in <200; 399>", statusCodeProp)
 }
+
+func parseTrafficSteps(steps string) ([]int64, error) {
+    weights := []int64{}
+
+    for _, step := range strings.Split(steps, ",") {
+        weight, err := strconv.ParseInt(strings.TrimSpace(step), 10, 64)
+        if err != nil {
+            return nil, fmt.Errorf("Invalid traffic steps %s. Expected increasing percents ending with 100", steps)
+        }
+
+        weights = append(weights, weight)
+    }
+
+    if err := validateTrafficSteps(weights); err != nil {
+        return nil, fmt.Errorf("Invalid traffic steps %s. Expected increasing percents ending with 100", steps)
+    }
+
+    return weights, nil
+}
+
+func stringInSlice(value string, list []string) bool {
+    for _, item := range list {
+        if item == value {
+            return true
+        }
+    }
+
+    return false
+}
+
+// shellCommand runs the command with sh -c, adding the env variables and passing the input on stdin.
+// The error contains the output of the failed command.
+func shellCommand(ctx context.Context, command string, env []string, input []byte) (string, error) {
+    cmd := exec.CommandContext(ctx, "sh", "-c", command)
+    cmd.Env = append(os.Environ(), env...)
+    cmd.Stdin = bytes.NewReader(input)
+
+    output, err := cmd.CombinedOutput()
+    if err != nil {
+        return "", fmt.Errorf("%s: %s", err.Error(), strings.TrimSpace(string(output)))
+    }
+
+    return strings.TrimSpace(string(output)), nil
+}
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"context"
 	"testing"
 	"regexp"
+	"time"
 )
 
 func TestGetClientIP(t *testing.T) {
@@ -59,3 +61,40 @@ func TestIsValidRequest(t *testing.T) {
 		}
 	}
 }
+
+func TestParseTrafficSteps(t *testing.T) {
+	stepsTable := []struct{
+		steps         string
+		expectedError bool
+	}{
+		{"10,50,100", false},
+		{"100", false},
+		{"10, 100", false},
+		{"50,10,100", true},
+		{"10,50", true},
+		{"10,150", true},
+		{"abc", true},
+	}
+
+	for _, item := range stepsTable {
+		_, err := parseTrafficSteps(item.steps)
+
+		if item.expectedError != (err != nil) {
+			t.Errorf("Invalid result of parseTrafficSteps(%s). Expected error: %t. Got %v.", item.steps, item.expectedError, err)
+		}
+	}
+}
+
+func TestSleepContextStopsWhenCancelled(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	started := time.Now()
+	if err := sleepContext(ctx, time.Hour); err != context.DeadlineExceeded {
+		t.Errorf("Expected deadline error from sleepContext(). Got %v.", err)
+	}
+
+	if time.Since(started) > time.Second {
+		t.Error("sleepContext() did not return when the context was done")
+	}
+}